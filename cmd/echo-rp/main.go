@@ -1,55 +1,408 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/skonto/test-reverse-proxy/pkg/echo"
+	rep "github.com/skonto/test-reverse-proxy/pkg/rp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	addr     = flag.String("addr", "127.0.0.1:0", "Address the proxy listens on.")
+	upstream = flag.String("upstream", "", "Upstream URL. An in-process echo server is used when empty.")
+	protocol = flag.String("upstream-protocol", "auto", "Protocol towards plaintext upstreams: auto (mirror the client), http1 or h2c.")
+
+	tlsCert = flag.String("tls-cert", "", "Certificate file for the proxy listener. Enables TLS when set.")
+	tlsKey  = flag.String("tls-key", "", "Key file for the proxy listener.")
+	http3   = flag.Bool("http3", false, "Also serve HTTP/3 over QUIC on the same port number and advertise it with Alt-Svc. Requires -tls-cert.")
+
+	upstreamCA         = flag.String("upstream-ca", "", "CA bundle used to verify an https upstream.")
+	upstreamSNI        = flag.String("upstream-sni", "", "SNI sent to an https upstream.")
+	upstreamCert       = flag.String("upstream-cert", "", "Client certificate presented to an https upstream.")
+	upstreamKey        = flag.String("upstream-key", "", "Client key presented to an https upstream.")
+	flushInterval      = flag.Duration("flush-interval", 0, "Flush responses at most this long after a write. Negative flushes every write; text/event-stream and gRPC always stream.")
+	upgradeIdle        = flag.Duration("upgrade-idle-timeout", 5*time.Minute, "Idle timeout of WebSocket and other upgraded connections.")
+	certPollInterval   = flag.Duration("cert-poll-interval", 10*time.Second, "How often certificate files are checked for changes.")
+	configFile         = flag.String("config", "", "YAML config file with timeouts, header rules, routes and rate limits. Reloaded when it changes or on SIGHUP.")
+	configPollInterval = flag.Duration("config-poll-interval", 5*time.Second, "How often the -config file is checked for changes.")
+	kubeconfig         = flag.String("kubeconfig", "", "Kubeconfig of the cluster whose EndpointSlices upstreams with kubernetes discovery watch. The in-cluster config is used when empty.")
+	kubeSyncTimeout    = flag.Duration("kube-sync-timeout", 10*time.Second, "Longest wait for the EndpointSlices of an upstream when the config is loaded.")
+	dnsServer          = flag.String("dns-server", "", "DNS server, host:port, resolving upstreams with dns discovery. The first nameserver of /etc/resolv.conf when empty.")
+	envoyConfig        = flag.String("envoy-config", "", "Envoy bootstrap config whose static_resources listener, routes and clusters replace -addr, -upstream and the ones of -config.")
+	accessLog          = flag.Bool("access-log", false, "Log one line per request.")
+
+	maxInFlight  = flag.Int("max-in-flight", 0, "Requests proxied at once to -upstream, like container concurrency. Unlimited when 0.")
+	queueDepth   = flag.Int("queue-depth", 0, "Requests waiting for a free slot once -max-in-flight is reached.")
+	queueTimeout = flag.Duration("queue-timeout", 0, "Longest wait for a free slot. Unlimited when 0.")
+	metricsAddr  = flag.String("metrics-addr", "", "Address serving Prometheus metrics on /metrics. Disabled when empty.")
+
+	maxIdleConnsPerHost  = flag.Int("upstream-max-idle-conns-per-host", 0, "Idle HTTP/1 connections kept per -upstream endpoint. 2 when 0.")
+	maxConnsPerHost      = flag.Int("upstream-max-conns-per-host", 0, "HTTP/1 connections per -upstream endpoint, requests wait for one beyond. Unlimited when 0.")
+	upstreamIdleTimeout  = flag.Duration("upstream-idle-timeout", 0, "Idle -upstream connections are closed after this long. 90s when 0.")
+	maxConcurrentStreams = flag.Int("upstream-max-concurrent-streams", 0, "Requests sent at once on an h2c -upstream connection before another is opened. The upstream's limit when 0.")
+	readIdleTimeout      = flag.Duration("upstream-read-idle-timeout", 0, "HTTP/2 -upstream connections nothing was read on for this long are pinged. 30s when 0.")
+	pingTimeout          = flag.Duration("upstream-ping-timeout", 0, "HTTP/2 -upstream connections are closed when a ping isn't answered within this long. 15s when 0.")
+
+	readinessPath = flag.String("readiness-path", "/ready", "Path answering readiness probes, failing once draining or when an upstream can't be dialed. Disabled when empty.")
+	livenessPath  = flag.String("liveness-path", "/healthz", "Path answering liveness probes, even while draining. Disabled when empty.")
+	probeTimeout  = flag.Duration("probe-timeout", rep.DefaultProbeTimeout, "Longest time a readiness probe spends dialing upstreams.")
+	drainDelay    = flag.Duration("drain-delay", 0, "Time requests are still served after SIGTERM, with readiness failing, before listeners close.")
+	drainTimeout  = flag.Duration("drain-timeout", 30*time.Second, "Time in-flight requests have to finish once listeners close.")
+
+	adminAddr        = flag.String("admin-addr", "", "Loopback address serving the admin API, e.g. 127.0.0.1:9901. Disabled when empty.")
+	adminAllowRemote = flag.Bool("admin-allow-remote", false, "Allow -admin-addr to be a non-loopback address. The admin API has no authentication.")
+	logLevel         = flag.String("log-level", "info", "Level of logged messages: debug, info or error. Changed at runtime with the admin API.")
+
+	xdsServer    = flag.String("xds-server", "", "Address of an xDS management server, e.g. 127.0.0.1:18000. Its clusters and routes replace the ones of -config.")
+	xdsNodeID    = flag.String("xds-node-id", "echo-rp", "Node ID sent to the xDS management server.")
+	xdsCluster   = flag.String("xds-cluster", "echo-rp", "Node cluster sent to the xDS management server.")
+	xdsListeners = flag.String("xds-listeners", "", "Comma separated listeners to subscribe to. All of them when empty.")
 )
 
 func main() {
-	// The server responding with the sent body.
-	echoServer := httptest.NewServer(http.HandlerFunc(
-		func(w http.ResponseWriter, req *http.Request) {
-			body, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("error reading body: %v", err)
-				http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusInternalServerError)
-				return
-			}
+	flag.Parse()
+	ctx := context.Background()
 
-			if _, err := w.Write(body); err != nil {
-				log.Printf("error writing body: %v", err)
-			}
-		},
-	))
-	defer echoServer.Close()
+	level, err := rep.ParseLogLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+	rep.SetLogLevel(level)
+	if *adminAddr != "" {
+		if err := rep.CheckAdminAddress(*adminAddr, *adminAllowRemote); err != nil {
+			log.Fatalf("Invalid -admin-addr: %v", err)
+		}
+	}
+
+	// With -xds-server or -envoy-config, requests only go to the upstreams
+	// of their routes, and get a 404 without any like with Envoy, rather
+	// than to -upstream.
+	discovered := *xdsServer != "" || *envoyConfig != ""
+
+	if *upstream == "" && !discovered {
+		// The server responding with the sent body.
+		echoServer := httptest.NewServer(h2c.NewHandler(echo.Handler(), &http2.Server{}))
+		defer echoServer.Close()
+		*upstream = echoServer.URL
+	}
 
 	// The server proxying requests to the echo server.
-	echoURL, err := url.Parse(echoServer.URL)
+	echoURL, err := url.Parse(*upstream)
 	if err != nil {
 		log.Fatalf("Failed to parse echo URL: %v", err)
 	}
-	proxy := httputil.NewSingleHostReverseProxy(echoURL)
+	upstreamProtocol, err := rep.ParseUpstreamProtocol(*protocol)
+	if err != nil {
+		log.Fatalf("Invalid -upstream-protocol: %v", err)
+	}
+
+	flushPolicy := rep.DefaultFlushPolicy()
+	flushPolicy.Interval = *flushInterval
+	metrics := &rep.Metrics{}
+	breakers := &rep.BreakerSet{}
+	metrics.Register(breakers)
+	pools := &rep.PoolSet{}
+	metrics.Register(pools)
+
+	// Upstream TLS is configured by flags, shared by every https upstream.
+	var upstreamTLS *tls.Config
+	upstreamTLSConfig := func() (*tls.Config, error) {
+		if upstreamTLS != nil {
+			return upstreamTLS, nil
+		}
+		tlsConf, reloader, err := rep.NewUpstreamTLSConfig(rep.UpstreamTLSOptions{
+			CAFile:     *upstreamCA,
+			ServerName: *upstreamSNI,
+			CertFile:   *upstreamCert,
+			KeyFile:    *upstreamKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure upstream TLS: %w", err)
+		}
+		if reloader != nil {
+			go reloader.Watch(ctx, *certPollInterval)
+		}
+		upstreamTLS = tlsConf
+		return tlsConf, nil
+	}
+
+	// The Kubernetes client is only created for upstreams discovering
+	// their endpoints from EndpointSlices.
+	var kubeClient kubernetes.Interface
+	newKubeClient := func() (kubernetes.Interface, error) {
+		if kubeClient != nil {
+			return kubeClient, nil
+		}
+		restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure the Kubernetes client: %w", err)
+		}
+		if kubeClient, err = kubernetes.NewForConfig(restConfig); err != nil {
+			return nil, fmt.Errorf("failed to create the Kubernetes client: %w", err)
+		}
+		return kubeClient, nil
+	}
+
+	dnsResolver := &rep.DNSResolver{Server: *dnsServer}
+	if dnsResolver.Server == "" {
+		dnsResolver.Server = rep.DefaultDNSServer()
+	}
+
+	// Probes are answered in front of the proxy, with Knative's probe
+	// headers, and never proxied.
+	drainer := rep.NewDrainer()
+	prober := &rep.Prober{
+		Drainer:       drainer,
+		ReadinessPath: *readinessPath,
+		LivenessPath:  *livenessPath,
+		Timeout:       *probeTimeout,
+	}
+
+	builder := &rep.ProxyBuilder{
+		UpstreamTLS:        upstreamTLSConfig,
+		KubeClient:         newKubeClient,
+		KubeSyncTimeout:    *kubeSyncTimeout,
+		DNSResolver:        dnsResolver,
+		UpgradeIdleTimeout: *upgradeIdle,
+		Flush:              flushPolicy,
+		Limiter:            rep.NewTokenBucketLimiter(),
+		Breakers:           breakers,
+		Pools:              pools,
+		Prober:             prober,
+	}
+	if !discovered {
+		builder.Default = &rep.UpstreamConfig{
+			Name:     "default",
+			URL:      echoURL.String(),
+			Protocol: string(upstreamProtocol),
+			Concurrency: rep.ConcurrencyLimit{
+				MaxInFlight:  *maxInFlight,
+				QueueDepth:   *queueDepth,
+				QueueTimeout: rep.Duration{Duration: *queueTimeout},
+			},
+			Pool: rep.ConnectionPool{
+				MaxIdleConnsPerHost:  *maxIdleConnsPerHost,
+				MaxConnsPerHost:      *maxConnsPerHost,
+				IdleTimeout:          rep.Duration{Duration: *upstreamIdleTimeout},
+				MaxConcurrentStreams: *maxConcurrentStreams,
+				ReadIdleTimeout:      rep.Duration{Duration: *readIdleTimeout},
+				PingTimeout:          rep.Duration{Duration: *pingTimeout},
+			},
+		}
+	}
+
+	// With -xds-server or -envoy-config, the clusters and routes of the
+	// management server or Envoy config are applied on top of -config, read
+	// once. Otherwise, with -config, the config file is reloaded when it
+	// changes or on SIGHUP.
+	var routed http.Handler
+	currentConfig := func() *rep.Config { return &rep.Config{} }
+	base := &rep.Config{}
+	if discovered {
+		if *xdsServer != "" && *envoyConfig != "" {
+			log.Fatal("-xds-server and -envoy-config are exclusive")
+		}
+		if *configFile != "" {
+			if base, err = rep.LoadConfig(*configFile); err != nil {
+				log.Fatalf("Failed to load config: %v", err)
+			}
+		}
+	}
+	if *envoyConfig != "" {
+		bootstrap, err := rep.LoadEnvoyBootstrap(*envoyConfig)
+		if err != nil {
+			log.Fatalf("Failed to load Envoy config: %v", err)
+		}
+		// The listener of the Envoy config wins over the default -addr.
+		addrSet := false
+		flag.Visit(func(f *flag.Flag) { addrSet = addrSet || f.Name == "addr" })
+		if !addrSet {
+			*addr = bootstrap.Address
+		}
+		cfg := *base
+		cfg.Upstreams, cfg.Routes = bootstrap.Upstreams, bootstrap.Routes
+		reloader, err := rep.NewConfigReloaderFromConfig(&cfg, builder.Build)
+		if err != nil {
+			log.Fatalf("Failed to create proxy: %v", err)
+		}
+		routed, currentConfig = reloader, reloader.Config
+	} else if *xdsServer != "" {
+		reloader, err := rep.NewConfigReloaderFromConfig(base, builder.Build)
+		if err != nil {
+			log.Fatalf("Failed to create proxy: %v", err)
+		}
+		cc, err := grpc.NewClient(*xdsServer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatalf("Invalid -xds-server: %v", err)
+		}
+		defer cc.Close()
+		client := rep.NewXDSClient(cc, &corev3.Node{Id: *xdsNodeID, Cluster: *xdsCluster}, func(upstreams []rep.UpstreamConfig, routes []rep.Route) error {
+			cfg := *base
+			cfg.Upstreams, cfg.Routes = upstreams, routes
+			if err := reloader.Apply(&cfg); err != nil {
+				return err
+			}
+			log.Printf("Applied %d clusters and %d routes from xDS", len(upstreams), len(routes))
+			return nil
+		})
+		if *xdsListeners != "" {
+			client.Listeners = strings.Split(*xdsListeners, ",")
+		}
+		go client.Run(ctx)
+		metrics.Register(reloader)
+		routed, currentConfig = reloader, reloader.Config
+	} else if *configFile != "" {
+		reloader, err := rep.NewConfigReloader(*configFile, builder.Build)
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		go reloader.Watch(ctx, *configPollInterval)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				reloader.ReloadAndLog()
+			}
+		}()
+		metrics.Register(reloader)
+		routed, currentConfig = reloader, reloader.Config
+	} else if routed, err = builder.Build(&rep.Config{}); err != nil {
+		log.Fatalf("Failed to create proxy: %v", err)
+	}
 
 	proxyWithMiddleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rc := http.NewResponseController(w)
 		_ = rc.EnableFullDuplex()
-		proxy.ServeHTTP(w, r)
+		routed.ServeHTTP(w, r)
 	})
-	proxyServer := httptest.NewServer(proxyWithMiddleware)
+	handler := rep.NewRequestIDHandler(proxyWithMiddleware)
+	if *accessLog {
+		handler = rep.NewAccessLogHandler(handler, nil)
+	}
 
 	// Uncomment to make it fail
-	// proxyServer := httptest.NewServer(proxy)
+	// handler = routed
+
+	handler = prober.Handler(handler)
+
+	var serverTLS *tls.Config
+	scheme := "http"
+	if *tlsCert != "" {
+		reloader, err := rep.NewCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Failed to load listener certificate: %v", err)
+		}
+		go reloader.Watch(ctx, *certPollInterval)
+		serverTLS = rep.NewServerTLSConfig(reloader)
+		scheme = "https"
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Fatalf("Metrics server failed: %v", err)
+			}
+		}()
+	}
 
-	log.Printf("Proxy listening to :%s", proxyServer.URL)
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *addr, err)
+	}
+
+	var h3 *rep.HTTP3Server
+	if *http3 {
+		if serverTLS == nil {
+			log.Fatal("-http3 requires -tls-cert")
+		}
+		h3 = rep.NewHTTP3Server(ln.Addr().String(), handler, serverTLS)
+		go func() {
+			if err := h3.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP/3 server failed: %v", err)
+			}
+		}()
+		handler = h3.AltSvcHandler(handler)
+		log.Printf("Proxy listening to :https://%s (HTTP/3)", ln.Addr())
+	}
+
+	// HTTP/1.1, h2c and, with a certificate, TLS are all served on the same port.
+	proxyServer, err := rep.NewServer(*addr, handler, serverTLS)
+	if err != nil {
+		log.Fatalf("Failed to create proxy server: %v", err)
+	}
 
-	time.Sleep(15 * time.Minute)
+	conns := &rep.ConnTracker{}
+	proxyServer.ConnState = conns.ConnState
+	metrics.Register(conns)
 
-	defer proxyServer.Close()
+	log.Printf("Proxy listening to :%s://%s", scheme, ln.Addr())
 
+	go func() {
+		if err := proxyServer.Serve(conns.Listener(ln)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Proxy server failed: %v", err)
+		}
+	}()
+
+	// A drain is started by SIGTERM or through the admin API.
+	drainRequested := make(chan struct{})
+	var drainOnce sync.Once
+	if *adminAddr != "" {
+		admin := &rep.Admin{
+			Config:   currentConfig,
+			Prober:   prober,
+			Breakers: breakers,
+			Pools:    pools,
+			Drainer:  drainer,
+			Conns:    conns,
+			Metrics:  metrics,
+			Drain:    func() { drainOnce.Do(func() { close(drainRequested) }) },
+		}
+		go func() {
+			if err := http.ListenAndServe(*adminAddr, admin.Handler()); err != nil {
+				log.Fatalf("Admin server failed: %v", err)
+			}
+		}()
+		log.Printf("Admin API listening to http://%s", *adminAddr)
+	}
+
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	select {
+	case <-sigCtx.Done():
+	case <-drainRequested:
+	}
+	log.Printf("Draining %d in-flight requests", drainer.InFlight())
+	drainCtx, cancel := context.WithTimeout(ctx, *drainDelay+*drainTimeout)
+	defer cancel()
+	if err := drainer.Drain(drainCtx, *drainDelay, proxyServer.Server); err != nil {
+		log.Printf("Drain incomplete, %d requests cut: %v", drainer.InFlight(), err)
+	}
+	if h3 != nil {
+		h3.Close()
+	}
+	log.Print("Proxy stopped")
 }
@@ -1,25 +1,62 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/skonto/test-reverse-proxy/pkg/echo"
+	rep "github.com/skonto/test-reverse-proxy/pkg/rp"
+)
+
+var (
+	addr     = flag.String("addr", ":8080", "Address the echo server listens on.")
+	mode     = flag.String("mode", "echo", "Backend mode: echo (respond with the request body) or sse (emit Server-Sent Events).")
+	sseRate  = flag.Float64("sse-rate", 10, "Events per second in sse mode.")
+	sseCount = flag.Int("sse-count", 0, "Events per response in sse mode, unlimited when zero.")
+
+	readinessPath = flag.String("readiness-path", "/ready", "Path answering readiness probes, failing once draining. Disabled when empty.")
+	drainDelay    = flag.Duration("drain-delay", 0, "Time requests are still served after SIGTERM, with readiness failing, before the listener closes.")
+	drainTimeout  = flag.Duration("drain-timeout", 30*time.Second, "Time in-flight requests have to finish once the listener closes.")
 )
 
 func main() {
-	http.ListenAndServe(":8080", http.HandlerFunc(
-		func(w http.ResponseWriter, req *http.Request) {
-			body, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("error reading body: %v", err)
-				http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			if _, err := w.Write(body); err != nil {
-				log.Printf("error writing body: %v", err)
-			}
-		},
-	))
+	flag.Parse()
+
+	var h http.Handler
+	switch *mode {
+	case "echo":
+		h = echo.Handler()
+	case "sse":
+		if !(*sseRate > 0) {
+			log.Fatalf("-sse-rate must be positive, got %v", *sseRate)
+		}
+		h = echo.SSEHandler(*sseRate, *sseCount)
+	default:
+		log.Fatalf("Unknown mode %q", *mode)
+	}
+
+	drainer := rep.NewDrainer()
+	server := &http.Server{Addr: *addr, Handler: drainer.HandlerWithReadiness(*readinessPath, h)}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	log.Printf("Draining %d in-flight requests", drainer.InFlight())
+	drainCtx, cancel := context.WithTimeout(context.Background(), *drainDelay+*drainTimeout)
+	defer cancel()
+	if err := drainer.Drain(drainCtx, *drainDelay, server); err != nil {
+		log.Printf("Drain incomplete, %d requests cut: %v", drainer.InFlight(), err)
+	}
 }
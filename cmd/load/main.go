@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/skonto/test-reverse-proxy/pkg/load"
+)
+
+var (
+	target            = flag.String("url", "http://0.0.0.0:10000", "URL to send requests to.")
+	host              = flag.String("host", os.Getenv("REQUEST_HOST"), "Host header override.")
+	protocol          = flag.String("protocol", string(load.HTTP1), "Client protocol: h1, h2c, h2 or h3.")
+	parallelism       = flag.Int("parallelism", 32, "Number of concurrent workers.")
+	requests          = flag.Int("requests", 1000, "Requests sent by every worker.")
+	payload           = flag.String("payload", "fill", "Request bodies: fill (bytes of 42), random or empty.")
+	bodySize          = flag.String("body-size", "32KiB", "Request body sizes: SIZE, uniform:MIN-MAX or exp:MEAN, in bytes or with a KiB, MiB or GiB suffix.")
+	seed              = flag.Int64("seed", 1, "Seed of random bodies and sizes.")
+	chunkSize         = flag.Int("chunk-size", 1024, "Bytes sent per chunk by slow bodies.")
+	chunkInterval     = flag.Duration("chunk-interval", 0, "Stream bodies chunked, pausing this long between chunks.")
+	disableKeepAlives = flag.Bool("disable-keep-alives", false, "Disable connection reuse for h1 and h2.")
+	caFile            = flag.String("ca", "", "CA bundle used to verify the proxy certificate.")
+	insecure          = flag.Bool("insecure", false, "Skip verification of the proxy certificate.")
+)
+
+func main() {
+	flag.Parse()
+
+	tlsConf := &tls.Config{InsecureSkipVerify: *insecure}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			log.Fatalf("Failed to read CA bundle: %v", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %s", *caFile)
+		}
+	}
+
+	transport, err := load.NewTransport(load.Protocol(*protocol), tlsConf, *disableKeepAlives)
+	if err != nil {
+		log.Fatalf("Failed to create transport: %v", err)
+	}
+
+	sizes, err := load.ParseSizes(*bodySize)
+	if err != nil {
+		log.Fatalf("Failed to parse -body-size: %v", err)
+	}
+	var p load.Payload
+	switch *payload {
+	case "fill":
+		p = load.Fill{Byte: 42, Size: sizes}
+	case "random":
+		p = load.Random{Size: sizes}
+	case "empty":
+		p = load.Empty{}
+	default:
+		log.Fatalf("Unknown payload %q", *payload)
+	}
+	if *chunkInterval > 0 {
+		p = load.Slow{Payload: p, Chunk: *chunkSize, Interval: *chunkInterval}
+	}
+
+	res := load.Run(context.Background(), &http.Client{Transport: transport}, load.Config{
+		URL:         *target,
+		Host:        *host,
+		Parallelism: *parallelism,
+		Requests:    *requests,
+		Payload:     p,
+		Seed:        *seed,
+	})
+	fmt.Print(res)
+	if res.Errors > 0 {
+		os.Exit(1)
+	}
+}
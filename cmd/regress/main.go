@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/skonto/test-reverse-proxy/pkg/regress"
+)
+
+var (
+	goroots  = flag.String("goroots", os.Getenv("GOROOTS"), "GOROOTs to test besides the discovered ones, separated like PATH.")
+	run      = flag.String("run", "TestProxyEchoMatrix/golang-go-40747", "Tests of the reproduction suite, as for go test -run, by default the golang/go#40747 cell of the echo matrix.")
+	packages = flag.String("packages", "./repro", "Comma-separated packages of the reproduction suite, relative to -dir, by default repro, which older toolchains build.")
+	dir      = flag.String("dir", ".", "Module directory go test runs in.")
+	args     = flag.String("args", "-echo-repro=1000", "Space-separated flags of the test binaries, by default running the golang/go#40747 cell of the echo matrix.")
+	count    = flag.Int("count", 5, "Runs of each test with each toolchain, to tell flaky failures from regressions, which fail at least twice.")
+	timeout  = flag.Duration("timeout", 10*time.Minute, "Timeout of the suite under each toolchain.")
+	out      = flag.String("out", "", "File the JSON report is written to. The markdown summary is always printed.")
+)
+
+func main() {
+	flag.Parse()
+
+	toolchains := regress.Discover(filepath.SplitList(*goroots))
+	if len(toolchains) == 0 {
+		log.Fatal("No Go toolchain found, set -goroots")
+	}
+	suite := regress.Suite{
+		Dir:      *dir,
+		Packages: strings.Split(*packages, ","),
+		Run:      *run,
+		Timeout:  *timeout,
+		Args:     strings.Fields(*args),
+		Count:    *count,
+	}
+	report := &regress.Report{Date: time.Now().UTC(), Suite: suite}
+	for _, tc := range toolchains {
+		log.Printf("Running the suite with %s from %s", tc.Version, tc.GOROOT)
+		res := suite.Test(context.Background(), tc)
+		if res.Error != "" {
+			log.Printf("The suite didn't run with %s: %s", tc.Version, res.Error)
+		} else {
+			log.Printf("%s: %d tests run %d times, passed: %t", tc.Version, len(res.Tests), suite.Count, res.Passed())
+		}
+		report.Results = append(report.Results, res)
+	}
+
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Failed to create the report: %v", err)
+		}
+		if err := report.WriteJSON(f); err != nil {
+			log.Fatalf("Failed to write the report: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatalf("Failed to write the report: %v", err)
+		}
+	}
+	report.WriteMarkdown(os.Stdout)
+	if len(report.Regressions()) > 0 {
+		os.Exit(1)
+	}
+}
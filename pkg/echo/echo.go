@@ -0,0 +1,63 @@
+package echo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Handler responds with the sent body.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			log.Printf("error reading body: %v", err)
+			http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := w.Write(body); err != nil {
+			log.Printf("error writing body: %v", err)
+		}
+	})
+}
+
+// SSEHandler emits Server-Sent Events at rate events per second, flushing
+// each of them. It stops after count events, or when the client goes away if
+// count is zero. rate must be positive, SSEHandler panics otherwise.
+func SSEHandler(rate float64, count int) http.Handler {
+	if !(rate > 0) {
+		panic(fmt.Sprintf("echo: SSE rate must be positive, got %v", rate))
+	}
+	// Rates over one event per nanosecond pause the least a ticker can.
+	interval := max(time.Duration(float64(time.Second)/rate), 1)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for i := 0; count == 0 || i < count; i++ {
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: tick\ndata: %d\n\n", i, time.Now().UnixNano()); err != nil {
+				log.Printf("error writing event: %v", err)
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				log.Printf("error flushing event: %v", err)
+				return
+			}
+			if count != 0 && i == count-1 {
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package echo
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSSEHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		rate       float64
+		count      int
+		wantEvents int
+	}{{
+		name:       "count",
+		rate:       1000,
+		count:      3,
+		wantEvents: 3,
+	}, {
+		name:       "one",
+		rate:       0.001,
+		count:      1,
+		wantEvents: 1,
+	}, {
+		name:       "over a nanosecond",
+		rate:       1e12,
+		count:      2,
+		wantEvents: 2,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := httptest.NewServer(SSEHandler(test.rate, test.count))
+			defer s.Close()
+
+			resp, err := http.Get(s.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+				t.Errorf("Content-Type = %q, want text/event-stream", got)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(body), "event: tick\n"); got != test.wantEvents {
+				t.Errorf("Got %d events, want %d:\n%s", got, test.wantEvents, body)
+			}
+		})
+	}
+}
+
+func TestSSEHandlerRate(t *testing.T) {
+	for _, rate := range []float64{0, -1, math.NaN()} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("SSEHandler(%v, 2) didn't panic", rate)
+				}
+			}()
+			SSEHandler(rate, 2)
+		}()
+	}
+}
@@ -0,0 +1,202 @@
+package load
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// Protocol is the protocol the load generator speaks to the proxy.
+type Protocol string
+
+const (
+	HTTP1 Protocol = "h1"
+	H2C   Protocol = "h2c"
+	H2    Protocol = "h2"
+	H3    Protocol = "h3"
+)
+
+// NewTransport returns a round tripper speaking p. tlsConf is used for h1 and
+// h2 against https URLs and is required for h3.
+func NewTransport(p Protocol, tlsConf *tls.Config, disableKeepAlives bool) (http.RoundTripper, error) {
+	switch p {
+	case HTTP1, H2:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = 10000
+		transport.DisableKeepAlives = disableKeepAlives
+		transport.ForceAttemptHTTP2 = p == H2
+		if tlsConf != nil {
+			transport.TLSClientConfig = tlsConf.Clone()
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		if p == HTTP1 {
+			transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+			// A non-nil empty map disables HTTP/2.
+			transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		return transport, nil
+	case H2C:
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}, nil
+	case H3:
+		if tlsConf == nil {
+			tlsConf = &tls.Config{}
+		}
+		return &http3.RoundTripper{TLSClientConfig: tlsConf.Clone()}, nil
+	}
+	return nil, fmt.Errorf("unknown protocol %q", p)
+}
+
+// Config describes a load run.
+type Config struct {
+	URL string
+	// Host overrides the Host header, e.g. to reach a Knative service through its ingress.
+	Host        string
+	Parallelism int
+	// Requests is the number of requests sent by every worker.
+	Requests int
+	// Body is sent by every request when Payload is nil.
+	Body []byte
+	// Payload makes the bodies, e.g. Random bodies of sizes from a distribution.
+	Payload Payload
+	// Seed seeds the payload of each worker, Seed+i for worker i, so runs are
+	// reproducible.
+	Seed int64
+}
+
+// Result summarizes a load run.
+type Result struct {
+	Requests int
+	Errors   int
+	// Bytes is the length of the echoed bodies.
+	Bytes    int64
+	Duration time.Duration
+	// ErrorCounts groups errors by message.
+	ErrorCounts map[string]int
+}
+
+// String renders the result with the most frequent errors first.
+func (r Result) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "requests: %d, errors: %d, bytes: %d, duration: %s\n", r.Requests, r.Errors, r.Bytes, r.Duration.Round(time.Millisecond))
+	msgs := make([]string, 0, len(r.ErrorCounts))
+	for msg := range r.ErrorCounts {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return r.ErrorCounts[msgs[i]] > r.ErrorCounts[msgs[j]] })
+	for _, msg := range msgs {
+		fmt.Fprintf(&b, "%6d %s\n", r.ErrorCounts[msg], msg)
+	}
+	return b.String()
+}
+
+// Run sends cfg.Requests requests from each of cfg.Parallelism workers and
+// checks every response echoes the body.
+func Run(ctx context.Context, client *http.Client, cfg Config) Result {
+	payload := cfg.Payload
+	if payload == nil {
+		payload = fixed(cfg.Body)
+	}
+	var (
+		mu  sync.Mutex
+		res = Result{ErrorCounts: map[string]int{}}
+		wg  sync.WaitGroup
+	)
+	start := time.Now()
+	wg.Add(cfg.Parallelism)
+	for i := 0; i < cfg.Parallelism; i++ {
+		go func(r *rand.Rand) {
+			defer wg.Done()
+
+			for i := 0; i < cfg.Requests && ctx.Err() == nil; i++ {
+				body, length := payload.Body(r)
+				n, err := send(client, cfg.URL, body, length, cfg.Host)
+				mu.Lock()
+				res.Requests++
+				res.Bytes += n
+				if err != nil {
+					res.Errors++
+					res.ErrorCounts[err.Error()]++
+				}
+				mu.Unlock()
+			}
+		}(rand.New(rand.NewSource(cfg.Seed + int64(i))))
+	}
+	wg.Wait()
+	res.Duration = time.Since(start)
+	return res
+}
+
+// Send posts body to url and checks the response echoes it.
+func Send(client *http.Client, url string, body []byte, rHost string) error {
+	_, err := send(client, url, bytes.NewReader(body), int64(len(body)), rHost)
+	return err
+}
+
+// send posts length bytes of body, -1 for unknown, to url and checks the
+// response echoes them, comparing checksums so the bodies are never held in
+// memory. It returns the length of the echoed body.
+func send(client *http.Client, url string, body io.Reader, length int64, rHost string) (int64, error) {
+	sent := newChecksumReader(body)
+	var reqBody io.Reader = sent
+	if length == 0 {
+		reqBody = http.NoBody
+	}
+	req, err := http.NewRequest("POST", url, reqBody)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.ContentLength = length
+
+	if rHost != "" {
+		req.Host = rHost
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	rec := crc32.New(crcTable)
+	n, err := io.Copy(rec, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return n, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	// The whole body was sent once the echo ends.
+	want, sum := sent.sum()
+	if length >= 0 && want != length {
+		return n, fmt.Errorf("sent body length: %d, want %d", want, length)
+	}
+	if n != want {
+		return n, fmt.Errorf("unexpected body length: %d", n)
+	}
+	if rec.Sum32() != sum {
+		return n, fmt.Errorf("unexpected body content: crc32 %08x, want %08x", rec.Sum32(), sum)
+	}
+
+	return n, nil
+}
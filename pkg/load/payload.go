@@ -0,0 +1,244 @@
+package load
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Payload makes the request bodies of a worker. Bodies are streamed, never
+// held in memory, so they can be GiBs.
+type Payload interface {
+	// Body returns the body of the next request and its length, -1 to send
+	// it chunked. r is the worker's, seeded from the run's seed.
+	Body(r *rand.Rand) (io.Reader, int64)
+}
+
+// Fill sends bodies of Byte repeated, like the 42s of the proxy tests.
+type Fill struct {
+	Byte byte
+	Size Sizes
+}
+
+// Body implements Payload.
+func (p Fill) Body(r *rand.Rand) (io.Reader, int64) {
+	n := p.Size.Size(r)
+	return &fillReader{b: p.Byte, remaining: n}, n
+}
+
+// Random sends random bodies, the same ones for the same seed.
+type Random struct {
+	Size Sizes
+}
+
+// Body implements Payload.
+func (p Random) Body(r *rand.Rand) (io.Reader, int64) {
+	n := p.Size.Size(r)
+	return &randomReader{r: rand.New(rand.NewSource(r.Int63())), remaining: n}, n
+}
+
+// Empty sends requests without a body.
+type Empty struct{}
+
+// Body implements Payload.
+func (Empty) Body(*rand.Rand) (io.Reader, int64) {
+	return strings.NewReader(""), 0
+}
+
+// Slow streams the bodies of Payload chunked, Chunk bytes every Interval,
+// like a client uploading slowly.
+type Slow struct {
+	Payload
+	Chunk    int
+	Interval time.Duration
+}
+
+// Body implements Payload.
+func (p Slow) Body(r *rand.Rand) (io.Reader, int64) {
+	body, _ := p.Payload.Body(r)
+	return &slowReader{r: body, chunk: p.Chunk, interval: p.Interval}, -1
+}
+
+// fixed sends the same body with every request.
+type fixed []byte
+
+func (p fixed) Body(*rand.Rand) (io.Reader, int64) {
+	return strings.NewReader(string(p)), int64(len(p))
+}
+
+type fillReader struct {
+	b         byte
+	remaining int64
+}
+
+func (f *fillReader) Read(p []byte) (int, error) {
+	if f.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	for i := range p {
+		p[i] = f.b
+	}
+	f.remaining -= int64(len(p))
+	return len(p), nil
+}
+
+type randomReader struct {
+	r         *rand.Rand
+	remaining int64
+}
+
+func (rr *randomReader) Read(p []byte) (int, error) {
+	if rr.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > rr.remaining {
+		p = p[:rr.remaining]
+	}
+	rr.r.Read(p)
+	rr.remaining -= int64(len(p))
+	return len(p), nil
+}
+
+type slowReader struct {
+	r        io.Reader
+	chunk    int
+	interval time.Duration
+	started  bool
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if s.started {
+		time.Sleep(s.interval)
+	}
+	s.started = true
+	if s.chunk > 0 && len(p) > s.chunk {
+		p = p[:s.chunk]
+	}
+	return s.r.Read(p)
+}
+
+// Sizes draws the sizes of bodies.
+type Sizes interface {
+	Size(r *rand.Rand) int64
+}
+
+// ConstantSize is always the same size.
+type ConstantSize int64
+
+// Size implements Sizes.
+func (s ConstantSize) Size(*rand.Rand) int64 { return int64(s) }
+
+// UniformSizes are uniformly distributed between Min and Max, included.
+type UniformSizes struct {
+	Min, Max int64
+}
+
+// Size implements Sizes.
+func (s UniformSizes) Size(r *rand.Rand) int64 {
+	return s.Min + r.Int63n(s.Max-s.Min+1)
+}
+
+// ExponentialSizes are exponentially distributed around Mean, mostly small
+// bodies and a few large ones.
+type ExponentialSizes struct {
+	Mean int64
+}
+
+// Size implements Sizes.
+func (s ExponentialSizes) Size(r *rand.Rand) int64 {
+	return int64(math.Round(r.ExpFloat64() * float64(s.Mean)))
+}
+
+// ParseSizes parses SIZE, uniform:MIN-MAX or exp:MEAN, sizes in bytes with
+// an optional KiB, MiB or GiB suffix.
+func ParseSizes(s string) (Sizes, error) {
+	kind, arg, ok := strings.Cut(s, ":")
+	if !ok {
+		n, err := parseSize(s)
+		return ConstantSize(n), err
+	}
+	switch kind {
+	case "uniform":
+		lo, hi, ok := strings.Cut(arg, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid sizes %q, want uniform:MIN-MAX", s)
+		}
+		min, err := parseSize(lo)
+		if err != nil {
+			return nil, err
+		}
+		max, err := parseSize(hi)
+		if err != nil {
+			return nil, err
+		}
+		if min > max {
+			return nil, fmt.Errorf("invalid sizes %q, min is over max", s)
+		}
+		if max-min == math.MaxInt64 {
+			return nil, fmt.Errorf("invalid sizes %q, the range is too wide", s)
+		}
+		return UniformSizes{Min: min, Max: max}, nil
+	case "exp":
+		mean, err := parseSize(arg)
+		return ExponentialSizes{Mean: mean}, err
+	}
+	return nil, fmt.Errorf("unknown sizes %q, want SIZE, uniform:MIN-MAX or exp:MEAN", s)
+}
+
+func parseSize(s string) (int64, error) {
+	digits, mult := s, int64(1)
+	for suffix, m := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			digits, mult = strings.TrimSuffix(s, suffix), m
+			break
+		}
+	}
+	// Sizes over math.MaxInt64 bytes overflow.
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumReader checksums what's read of r, by the transport while the
+// response is read.
+type checksumReader struct {
+	r io.Reader
+
+	mu  sync.Mutex
+	crc hash.Hash32
+	n   int64
+}
+
+func newChecksumReader(r io.Reader) *checksumReader {
+	return &checksumReader{r: r, crc: crc32.New(crcTable)}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crc.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// sum returns the length and checksum of what was read.
+func (c *checksumReader) sum() (int64, uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n, c.crc.Sum32()
+}
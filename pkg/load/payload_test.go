@@ -0,0 +1,148 @@
+package load
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lying claims its bodies are longer than they are.
+type lying struct{}
+
+func (lying) Body(*rand.Rand) (io.Reader, int64) {
+	return strings.NewReader("short"), 10
+}
+
+func TestRunPayloads(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer echo.Close()
+	corrupt := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if len(b) > 0 {
+			b[len(b)/2]++
+		}
+		w.Write(b)
+	}))
+	defer corrupt.Close()
+
+	tests := []struct {
+		name      string
+		url       string
+		payload   Payload
+		body      []byte
+		wantBytes int64
+		wantErr   string
+	}{{
+		name:      "body",
+		url:       echo.URL,
+		body:      []byte("hello"),
+		wantBytes: 4 * 5,
+	}, {
+		name:      "fill",
+		url:       echo.URL,
+		payload:   Fill{Byte: 42, Size: ConstantSize(32 << 10)},
+		wantBytes: 4 * 32 << 10,
+	}, {
+		name:    "random",
+		url:     echo.URL,
+		payload: Random{Size: UniformSizes{Min: 0, Max: 1 << 20}},
+	}, {
+		name:    "empty",
+		url:     echo.URL,
+		payload: Empty{},
+	}, {
+		name:      "slow",
+		url:       echo.URL,
+		payload:   Slow{Payload: Random{Size: ConstantSize(4 << 10)}, Chunk: 1 << 10, Interval: time.Millisecond},
+		wantBytes: 4 * 4 << 10,
+	}, {
+		name:      "slow last chunk short",
+		url:       echo.URL,
+		payload:   Slow{Payload: Fill{Byte: 42, Size: ConstantSize(1500)}, Chunk: 1 << 10, Interval: time.Millisecond},
+		wantBytes: 4 * 1500,
+	}, {
+		name:    "slow sizes",
+		url:     echo.URL,
+		payload: Slow{Payload: Random{Size: UniformSizes{Min: 0, Max: 10 << 10}}, Chunk: 1 << 10, Interval: time.Millisecond},
+	}, {
+		name:    "body shorter than its length",
+		url:     echo.URL,
+		payload: lying{},
+		wantErr: "failed to execute request",
+	}, {
+		name:      "corrupted",
+		url:       corrupt.URL,
+		payload:   Fill{Byte: 42, Size: ConstantSize(1 << 10)},
+		wantBytes: 4 * 1 << 10,
+		wantErr:   "unexpected body content",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := Run(context.Background(), echo.Client(), Config{
+				URL:         test.url,
+				Parallelism: 2,
+				Requests:    2,
+				Body:        test.body,
+				Payload:     test.payload,
+			})
+			if res.Requests != 4 {
+				t.Errorf("Requests = %d, want 4", res.Requests)
+			}
+			wantErrors := 0
+			if test.wantErr != "" {
+				wantErrors = 4
+			}
+			if res.Errors != wantErrors {
+				t.Errorf("Run() = %s, want %d errors %q", res, wantErrors, test.wantErr)
+			}
+			for msg := range res.ErrorCounts {
+				if test.wantErr == "" || !strings.HasPrefix(msg, test.wantErr) {
+					t.Errorf("Run() = %s, want errors %q", res, test.wantErr)
+				}
+			}
+			if test.wantBytes > 0 && res.Bytes != test.wantBytes {
+				t.Errorf("Bytes = %d, want %d", res.Bytes, test.wantBytes)
+			}
+		})
+	}
+}
+
+func TestParseSizes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Sizes
+		wantErr bool
+	}{
+		{in: "32768", want: ConstantSize(32768)},
+		{in: "1GiB", want: ConstantSize(1 << 30)},
+		{in: "uniform:0-1MiB", want: UniformSizes{Min: 0, Max: 1 << 20}},
+		{in: "exp:32KiB", want: ExponentialSizes{Mean: 32 << 10}},
+		{in: "uniform:2-1", wantErr: true},
+		{in: "uniform:1", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "normal:1", wantErr: true},
+		{in: "8589934591GiB", want: ConstantSize(8589934591 << 30)},
+		{in: "8589934592GiB", wantErr: true},
+		{in: "9999999999GiB", wantErr: true},
+		{in: "uniform:0-9999999999GiB", wantErr: true},
+		{in: "uniform:0-9223372036854775807", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSizes(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseSizes(%q) = %v, want error: %t", test.in, err, test.wantErr)
+		} else if err == nil && got != test.want {
+			t.Errorf("ParseSizes(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+// Package regress runs the reproduction suite of golang/go#40747 under every
+// Go toolchain installed on the machine, and reports what passes and how the
+// rest fails, to catch regressions when upgrading Go.
+package regress
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Toolchain is a Go installation.
+type Toolchain struct {
+	GOROOT string `json:"goroot"`
+	// Version is the one of the VERSION file of GOROOT, e.g. go1.21.5.
+	Version string `json:"version"`
+}
+
+// Discover returns the toolchains under roots and the GOROOTs of the usual
+// installations: $GOROOT, /usr/local/go, /usr/lib/go-*, ~/sdk/go* of
+// golang.org/dl, and the toolchains GOTOOLCHAIN downloaded to the module
+// cache. They're sorted by version, one per version.
+func Discover(roots []string) []Toolchain {
+	candidates := append([]string{}, roots...)
+	if root := os.Getenv("GOROOT"); root != "" {
+		candidates = append(candidates, root)
+	}
+	candidates = append(candidates, "/usr/local/go")
+	patterns := []string{"/usr/lib/go-*"}
+	if home, err := os.UserHomeDir(); err == nil {
+		patterns = append(patterns, filepath.Join(home, "sdk", "go*"))
+	}
+	if cache := modCache(); cache != "" {
+		patterns = append(patterns, filepath.Join(cache, "golang.org", "toolchain@*"))
+	}
+	for _, p := range patterns {
+		matches, _ := filepath.Glob(p)
+		candidates = append(candidates, matches...)
+	}
+
+	seen := map[string]bool{}
+	var toolchains []Toolchain
+	for _, root := range candidates {
+		tc, err := Lookup(root)
+		if err != nil || seen[tc.Version] {
+			continue
+		}
+		seen[tc.Version] = true
+		toolchains = append(toolchains, tc)
+	}
+	sort.Slice(toolchains, func(i, j int) bool {
+		return compareVersions(toolchains[i].Version, toolchains[j].Version) < 0
+	})
+	return toolchains
+}
+
+// Lookup returns the toolchain at root, which needs bin/go and a VERSION
+// file.
+func Lookup(root string) (Toolchain, error) {
+	if _, err := os.Stat(filepath.Join(root, "bin", "go")); err != nil {
+		return Toolchain{}, err
+	}
+	b, err := os.ReadFile(filepath.Join(root, "VERSION"))
+	if err != nil {
+		return Toolchain{}, err
+	}
+	v, _, _ := strings.Cut(string(b), "\n")
+	v = strings.TrimSpace(v)
+	if _, ok := parseVersion(v); !ok {
+		return Toolchain{}, fmt.Errorf("%s: invalid version %q", root, v)
+	}
+	return Toolchain{GOROOT: root, Version: v}, nil
+}
+
+// goVersionPattern matches the versions of Go releases: go1.21, go1.21.5,
+// go1.22rc1 or go1.22beta1.
+var goVersionPattern = regexp.MustCompile(`^go(\d+)\.(\d+)(?:\.(\d+))?(?:(beta|rc)(\d+))?$`)
+
+// parseVersion returns the major, minor and patch numbers of v, then 0, 1 or
+// 2 for a beta, a release candidate or a release, and the beta or rc number.
+func parseVersion(v string) ([5]int, bool) {
+	var parts [5]int
+	m := goVersionPattern.FindStringSubmatch(v)
+	if m == nil {
+		return parts, false
+	}
+	for i, s := range []string{m[1], m[2], m[3], "", m[5]} {
+		parts[i], _ = strconv.Atoi(s)
+	}
+	parts[3] = map[string]int{"beta": 0, "rc": 1, "": 2}[m[4]]
+	return parts, true
+}
+
+// compareVersions orders Go versions, as go/version does from Go 1.22 on,
+// invalid ones first.
+func compareVersions(a, b string) int {
+	pa, oka := parseVersion(a)
+	pb, okb := parseVersion(b)
+	if !oka || !okb {
+		if oka == okb {
+			return strings.Compare(a, b)
+		}
+		if oka {
+			return 1
+		}
+		return -1
+	}
+	for i := range pa {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func modCache() string {
+	if cache := os.Getenv("GOMODCACHE"); cache != "" {
+		return cache
+	}
+	if gopath := os.Getenv("GOPATH"); gopath != "" {
+		return filepath.Join(filepath.SplitList(gopath)[0], "pkg", "mod")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, "go", "pkg", "mod")
+	}
+	return ""
+}
+
+// Suite is the reproduction suite, go test run in Dir.
+type Suite struct {
+	Dir      string   `json:"dir"`
+	Packages []string `json:"packages"`
+	// Run selects the tests, e.g. TestProxyEchoMatrix.
+	Run     string        `json:"run"`
+	Timeout time.Duration `json:"timeout"`
+	// Args are passed to the test binaries, e.g. -echo-repro=1000.
+	Args []string `json:"args,omitempty"`
+	// Count is the runs of each test, as for go test -count, 1 by default.
+	Count int `json:"count,omitempty"`
+}
+
+// TestResult is the outcome of a test, or subtest, over the runs of the
+// suite.
+type TestResult struct {
+	Name     string `json:"name"`
+	Runs     int    `json:"runs"`
+	Failures int    `json:"failures,omitempty"`
+	// Signature identifies the failure: the first error the test reported,
+	// without line numbers, addresses and other numbers varying between runs.
+	Signature string `json:"signature,omitempty"`
+}
+
+// Passed reports whether the test passed every run.
+func (t TestResult) Passed() bool {
+	return t.Failures == 0
+}
+
+// Flaky reports whether the test failed some runs only.
+func (t TestResult) Flaky() bool {
+	return t.Failures > 0 && t.Failures < t.Runs
+}
+
+// Result is the outcome of the suite under a toolchain.
+type Result struct {
+	Toolchain
+	// Error is set when the suite couldn't run, e.g. didn't build or the
+	// toolchain is older than go.mod requires.
+	Error    string        `json:"error,omitempty"`
+	Tests    []TestResult  `json:"tests"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Passed reports whether the suite ran and every test passed.
+func (r Result) Passed() bool {
+	if r.Error != "" {
+		return false
+	}
+	for _, t := range r.Tests {
+		if !t.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// Test runs the suite under tc. Only tc is used, GOTOOLCHAIN can't switch to
+// another.
+func (s *Suite) Test(ctx context.Context, tc Toolchain) Result {
+	count := s.Count
+	if count < 1 {
+		count = 1
+	}
+	args := []string{"test", "-json", fmt.Sprintf("-count=%d", count)}
+	if s.Run != "" {
+		args = append(args, "-run", s.Run)
+	}
+	if s.Timeout > 0 {
+		args = append(args, "-timeout", s.Timeout.String())
+	}
+	args = append(args, s.Packages...)
+	if len(s.Args) > 0 {
+		args = append(append(args, "-args"), s.Args...)
+	}
+	cmd := exec.CommandContext(ctx, filepath.Join(tc.GOROOT, "bin", "go"), args...)
+	cmd.Dir = s.Dir
+	cmd.Env = toolchainEnv(os.Environ(), tc)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return Result{Toolchain: tc, Error: err.Error()}
+	}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return Result{Toolchain: tc, Error: err.Error()}
+	}
+	tests, other := parseEvents(stdout)
+	err = cmd.Wait()
+	res := Result{Toolchain: tc, Tests: tests, Duration: time.Since(start)}
+	// go test fails with failing tests, only an error without any is the
+	// suite's.
+	var exit *exec.ExitError
+	if err != nil && (len(tests) == 0 || !errors.As(err, &exit)) {
+		res.Error = firstLines(other+stderr.String(), 5)
+		if res.Error == "" {
+			res.Error = err.Error()
+		}
+	}
+	return res
+}
+
+// toolchainEnv returns env running tc.
+func toolchainEnv(env []string, tc Toolchain) []string {
+	out := make([]string, 0, len(env)+2)
+	for _, kv := range env {
+		switch k, v, _ := strings.Cut(kv, "="); k {
+		case "GOROOT", "GOTOOLCHAIN":
+		case "PATH":
+			out = append(out, "PATH="+filepath.Join(tc.GOROOT, "bin")+string(os.PathListSeparator)+v)
+		default:
+			out = append(out, kv)
+		}
+	}
+	return append(out, "GOROOT="+tc.GOROOT, "GOTOOLCHAIN=local")
+}
+
+// event is a line of go test -json, see cmd/test2json.
+type event struct {
+	Action string
+	Test   string
+	Output string
+}
+
+// parseEvents returns the results of the tests in the go test -json output
+// of r, in the order they first completed, and the output of no test, e.g.
+// build errors. The runs of a test with -count add up in its result.
+func parseEvents(r io.Reader) ([]TestResult, string) {
+	var (
+		tests  []TestResult
+		index  = map[string]int{}
+		other  strings.Builder
+		output = map[string][]string{}
+		// failed are the tests failing in the current run of their parent.
+		failed = map[string]bool{}
+	)
+	result := func(name string) *TestResult {
+		i, ok := index[name]
+		if !ok {
+			i = len(tests)
+			index[name] = i
+			tests = append(tests, TestResult{Name: name})
+		}
+		return &tests[i]
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		var e event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// Older toolchains print build errors as text.
+			other.WriteString(sc.Text() + "\n")
+			continue
+		}
+		if e.Test == "" {
+			if e.Action == "output" || e.Action == "build-output" {
+				other.WriteString(e.Output)
+			}
+			continue
+		}
+		switch e.Action {
+		case "output":
+			output[e.Test] = append(output[e.Test], e.Output)
+		case "pass":
+			result(e.Test).Runs++
+			delete(output, e.Test)
+		case "fail":
+			res := result(e.Test)
+			res.Runs++
+			res.Failures++
+			// A test failing with its subtests has theirs.
+			sub := false
+			for name := range failed {
+				if strings.HasPrefix(name, e.Test+"/") {
+					sub = true
+					delete(failed, name)
+				}
+			}
+			if res.Signature == "" && !sub {
+				res.Signature = Signature(output[e.Test])
+			}
+			failed[e.Test] = true
+			delete(output, e.Test)
+		}
+	}
+	return tests, other.String()
+}
+
+var (
+	// fileLine is the position t.Error prefixes its message with.
+	fileLine = regexp.MustCompile(`^\s*[\w.-]+\.go:\d+: `)
+	hex      = regexp.MustCompile(`0x[0-9a-fA-F]+`)
+	number   = regexp.MustCompile(`\d+`)
+)
+
+// Signature returns the first error of the output of a failed test,
+// normalized to compare it across runs and versions: the first message of
+// t.Error, or else the first line that isn't of go test, like a panic.
+func Signature(output []string) string {
+	first := ""
+	for _, line := range output {
+		line = strings.TrimRight(line, "\n")
+		if fileLine.MatchString(line) {
+			return normalize(fileLine.ReplaceAllString(line, ""))
+		}
+		trimmed := strings.TrimSpace(line)
+		if first == "" && trimmed != "" && !strings.HasPrefix(trimmed, "=== ") && !strings.HasPrefix(trimmed, "--- ") {
+			first = trimmed
+		}
+	}
+	return normalize(first)
+}
+
+func normalize(s string) string {
+	s = hex.ReplaceAllString(s, "0x?")
+	return number.ReplaceAllString(s, "N")
+}
+
+func firstLines(s string, n int) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
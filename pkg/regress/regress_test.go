@@ -0,0 +1,258 @@
+package regress
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeGOROOT returns a GOROOT whose go prints events and exits with status,
+// if it runs with GOROOT set to it.
+func fakeGOROOT(t *testing.T, version, events string, status int) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake go is a shell script")
+	}
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"VERSION": version + "\ntime 2024-01-01T00:00:00Z\n",
+		"events":  events,
+		"bin/go": `#!/bin/sh
+[ "$GOTOOLCHAIN" = local ] || { echo "GOTOOLCHAIN=$GOTOOLCHAIN" >&2; exit 2; }
+cat "$GOROOT/events"
+exit ` + strconv.Itoa(status) + "\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+const (
+	passEvents = `{"Action":"run","Test":"TestEcho"}
+{"Action":"output","Test":"TestEcho","Output":"=== RUN   TestEcho\n"}
+{"Action":"pass","Test":"TestEcho"}
+{"Action":"pass"}
+`
+	failEvents = `{"Action":"run","Test":"TestEcho"}
+{"Action":"run","Test":"TestEcho/h1"}
+{"Action":"output","Test":"TestEcho/h1","Output":"    rev_test.go:123: error during request: failed to read body: unexpected EOF\n"}
+{"Action":"fail","Test":"TestEcho/h1"}
+{"Action":"run","Test":"TestEcho/h2c"}
+{"Action":"pass","Test":"TestEcho/h2c"}
+{"Action":"output","Test":"TestEcho","Output":"    rev_test.go:244: Echo matrix:\n"}
+{"Action":"fail","Test":"TestEcho"}
+{"Action":"fail"}
+`
+	// flakyEvents are two runs of failEvents' tests, with -count=2, the
+	// second passing.
+	flakyEvents = `{"Action":"run","Test":"TestEcho"}
+{"Action":"run","Test":"TestEcho/h1"}
+{"Action":"output","Test":"TestEcho/h1","Output":"    rev_test.go:123: error during request: failed to read body: unexpected EOF\n"}
+{"Action":"fail","Test":"TestEcho/h1"}
+{"Action":"run","Test":"TestEcho/h2c"}
+{"Action":"pass","Test":"TestEcho/h2c"}
+{"Action":"fail","Test":"TestEcho"}
+{"Action":"run","Test":"TestEcho"}
+{"Action":"run","Test":"TestEcho/h1"}
+{"Action":"pass","Test":"TestEcho/h1"}
+{"Action":"run","Test":"TestEcho/h2c"}
+{"Action":"pass","Test":"TestEcho/h2c"}
+{"Action":"pass","Test":"TestEcho"}
+{"Action":"fail"}
+`
+	buildEvents = `go: go.mod requires go >= 1.22 (running go 1.21.0; GOTOOLCHAIN=local)
+`
+)
+
+func TestSuiteTest(t *testing.T) {
+	tests := []struct {
+		name      string
+		events    string
+		status    int
+		wantTests []TestResult
+		wantError string
+	}{{
+		name:      "pass",
+		events:    passEvents,
+		wantTests: []TestResult{{Name: "TestEcho", Runs: 1}},
+	}, {
+		name:   "fail",
+		events: failEvents,
+		status: 1,
+		wantTests: []TestResult{
+			{Name: "TestEcho/h1", Runs: 1, Failures: 1, Signature: "error during request: failed to read body: unexpected EOF"},
+			{Name: "TestEcho/h2c", Runs: 1},
+			{Name: "TestEcho", Runs: 1, Failures: 1},
+		},
+	}, {
+		name:   "flaky",
+		events: flakyEvents,
+		status: 1,
+		wantTests: []TestResult{
+			{Name: "TestEcho/h1", Runs: 2, Failures: 1, Signature: "error during request: failed to read body: unexpected EOF"},
+			{Name: "TestEcho/h2c", Runs: 2},
+			{Name: "TestEcho", Runs: 2, Failures: 1},
+		},
+	}, {
+		name:      "build error",
+		events:    buildEvents,
+		status:    1,
+		wantError: "go: go.mod requires go >= 1.22 (running go 1.21.0; GOTOOLCHAIN=local)",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := fakeGOROOT(t, "go1.21.0", test.events, test.status)
+			t.Setenv("GOTOOLCHAIN", "auto")
+			tc, err := Lookup(root)
+			if err != nil {
+				t.Fatalf("Lookup() = %v", err)
+			}
+			suite := &Suite{Dir: t.TempDir(), Packages: []string{"./..."}, Count: 2}
+			res := suite.Test(context.Background(), tc)
+			if res.Error != test.wantError {
+				t.Errorf("Error = %q, want %q", res.Error, test.wantError)
+			}
+			if !reflect.DeepEqual(res.Tests, test.wantTests) {
+				t.Errorf("Tests = %+v, want %+v", res.Tests, test.wantTests)
+			}
+			if got, want := res.Passed(), test.name == "pass"; got != want {
+				t.Errorf("Passed() = %t, want %t", got, want)
+			}
+		})
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	roots := []string{
+		fakeGOROOT(t, "go1.22.0", passEvents, 0),
+		fakeGOROOT(t, "go1.21.5", passEvents, 0),
+		fakeGOROOT(t, "go1.22.0", passEvents, 0),
+		t.TempDir(),
+	}
+	var got []string
+	for _, tc := range Discover(roots) {
+		// Ignore the toolchains of the machine.
+		if strings.HasPrefix(tc.GOROOT, os.TempDir()) {
+			got = append(got, tc.Version)
+		}
+	}
+	if want := []string{"go1.21.5", "go1.22.0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Discover() = %v, want %v", got, want)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	ordered := []string{"devel", "go1.9", "go1.20", "go1.21rc1", "go1.21.0", "go1.21.5", "go1.22beta1", "go1.22rc2", "go1.22.0"}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			want := 0
+			switch {
+			case i < j:
+				want = -1
+			case i > j:
+				want = 1
+			}
+			if got := compareVersions(a, b); got != want {
+				t.Errorf("compareVersions(%s, %s) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		output []string
+		want   string
+	}{{
+		name: "t.Error",
+		output: []string{
+			"=== RUN   TestEcho\n",
+			"    rev_test.go:123: unexpected body of length 3224, want 32768\n",
+			"    rev_test.go:123: error during request: failed to read body: unexpected EOF\n",
+		},
+		want: "unexpected body of length N, want N",
+	}, {
+		name: "panic",
+		output: []string{
+			"=== RUN   TestEcho\n",
+			"panic: runtime error: invalid memory address or nil pointer dereference [recovered]\n",
+			"[signal SIGSEGV: segmentation violation code=0x1 addr=0x18 pc=0x6bd2f4]\n",
+		},
+		want: "panic: runtime error: invalid memory address or nil pointer dereference [recovered]",
+	}, {
+		name:   "address",
+		output: []string{"    rev_test.go:1: dial tcp 127.0.0.1:41235: connect: connection refused\n"},
+		want:   "dial tcp N.N.N.N:N: connect: connection refused",
+	}, {
+		name:   "none",
+		output: []string{"=== RUN   TestEcho\n", "--- FAIL: TestEcho (0.00s)\n"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Signature(test.output); got != test.want {
+				t.Errorf("Signature() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	report := &Report{
+		Suite: Suite{Dir: "repro", Packages: []string{"."}, Run: "TestEcho", Count: 5},
+		Results: []Result{{
+			Toolchain: Toolchain{Version: "go1.20.14"},
+			Error:     "go: go.mod requires go >= 1.22",
+		}, {
+			Toolchain: Toolchain{Version: "go1.21.5"},
+			Tests: []TestResult{
+				{Name: "TestEcho/h1", Runs: 5},
+				{Name: "TestEcho/h2c", Runs: 5},
+				{Name: "TestEcho/h2", Runs: 5},
+			},
+		}, {
+			Toolchain: Toolchain{Version: "go1.22.0"},
+			Tests: []TestResult{
+				{Name: "TestEcho/h1", Runs: 5, Failures: 3, Signature: "unexpected EOF"},
+				{Name: "TestEcho/h2c", Runs: 5, Failures: 1, Signature: "unexpected EOF"},
+				{Name: "TestEcho/h2", Runs: 5},
+			},
+		}},
+	}
+
+	// A single flaky failure of h2c isn't a regression.
+	want := []Regression{{Test: "TestEcho/h1", Passed: "go1.21.5", Failed: "go1.22.0", Failures: 3, Runs: 5, Signature: "unexpected EOF"}}
+	if got := report.Regressions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Regressions() = %+v, want %+v", got, want)
+	}
+
+	var b strings.Builder
+	report.WriteMarkdown(&b)
+	for _, line := range []string{
+		"`go test -run 'TestEcho' -count=5 .` in `repro`, 0001-01-01T00:00:00Z",
+		"",
+		"| go1.20.14 | error | | | | 0s | go: go.mod requires go >= 1.22 |",
+		"| go1.21.5 | pass | 3 | 0 | 0 | 0s |  |",
+		"| go1.22.0 | flaky | 1 | 0 | 2 | 0s | 4× unexpected EOF |",
+		"| TestEcho/h1 | error | pass | flaky 3/5: unexpected EOF |",
+		"| TestEcho/h2c | error | pass | flaky 1/5: unexpected EOF |",
+		"- TestEcho/h1 passes with go1.21.5, fails 3/5 runs with go1.22.0: unexpected EOF",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("WriteMarkdown() = %s, want a line %q", b.String(), line)
+		}
+	}
+}
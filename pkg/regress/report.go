@@ -0,0 +1,215 @@
+package regress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Report is the outcome of the suite under every toolchain, oldest first.
+type Report struct {
+	Date    time.Time `json:"date"`
+	Suite   Suite     `json:"suite"`
+	Results []Result  `json:"results"`
+}
+
+// Regression is a test failing with a toolchain after passing with the
+// previous one.
+type Regression struct {
+	Test string `json:"test"`
+	// Passed is the last version passing, Failed the next one, failing.
+	Passed string `json:"passed"`
+	Failed string `json:"failed"`
+	// Failures of the Runs with Failed.
+	Failures  int    `json:"failures"`
+	Runs      int    `json:"runs"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// minFailures is the failures making a regression, so that a single flaky
+// run doesn't.
+const minFailures = 2
+
+// Regressions compares the results of each toolchain with the previous one
+// that ran the suite: the tests passing every run with the previous one and
+// failing at least twice with the next one, which takes a -count of 2 or
+// more.
+func (r *Report) Regressions() []Regression {
+	var (
+		regressions []Regression
+		prev        *Result
+	)
+	for i := range r.Results {
+		res := &r.Results[i]
+		if res.Error != "" {
+			continue
+		}
+		if prev != nil {
+			passed := map[string]bool{}
+			for _, t := range prev.Tests {
+				passed[t.Name] = t.Passed()
+			}
+			for _, t := range res.Tests {
+				if t.Failures >= minFailures && passed[t.Name] {
+					regressions = append(regressions, Regression{
+						Test:      t.Name,
+						Passed:    prev.Version,
+						Failed:    res.Version,
+						Failures:  t.Failures,
+						Runs:      t.Runs,
+						Signature: t.Signature,
+					})
+				}
+			}
+		}
+		prev = res
+	}
+	return regressions
+}
+
+// WriteJSON writes r indented.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteMarkdown writes a summary of r: the outcome of each toolchain with
+// its error signatures, the tests failing with any and their failure rates,
+// and the regressions.
+func (r *Report) WriteMarkdown(w io.Writer) {
+	fmt.Fprintf(w, "# Go versions\n\n")
+	fmt.Fprintf(w, "`go test -run '%s'", r.Suite.Run)
+	if r.Suite.Count > 1 {
+		fmt.Fprintf(w, " -count=%d", r.Suite.Count)
+	}
+	fmt.Fprintf(w, " %s", strings.Join(r.Suite.Packages, " "))
+	if len(r.Suite.Args) > 0 {
+		fmt.Fprintf(w, " -args %s", strings.Join(r.Suite.Args, " "))
+	}
+	fmt.Fprint(w, "`")
+	if r.Suite.Dir != "" && r.Suite.Dir != "." {
+		fmt.Fprintf(w, " in `%s`", r.Suite.Dir)
+	}
+	fmt.Fprintf(w, ", %s\n\n", r.Date.Format(time.RFC3339))
+	fmt.Fprintf(w, "| Version | Result | Passed | Failed | Flaky | Duration | Errors |\n|---|---|---|---|---|---|---|\n")
+	for _, res := range r.Results {
+		if res.Error != "" {
+			fmt.Fprintf(w, "| %s | error | | | | %s | %s |\n", res.Version, res.Duration.Round(time.Second), cell(res.Error))
+			continue
+		}
+		passed, failed, flaky := 0, 0, 0
+		signatures := map[string]int{}
+		for _, t := range res.Tests {
+			switch {
+			case t.Passed():
+				passed++
+				continue
+			case t.Flaky():
+				flaky++
+			default:
+				failed++
+			}
+			if t.Signature != "" {
+				signatures[t.Signature] += t.Failures
+			}
+		}
+		result := "pass"
+		switch {
+		case failed > 0:
+			result = "FAIL"
+		case flaky > 0:
+			result = "flaky"
+		}
+		fmt.Fprintf(w, "| %s | %s | %d | %d | %d | %s | %s |\n", res.Version, result, passed, failed, flaky, res.Duration.Round(time.Second), cell(countList(signatures)))
+	}
+
+	failing := map[string]map[string]TestResult{}
+	for _, res := range r.Results {
+		for _, t := range res.Tests {
+			if t.Passed() {
+				continue
+			}
+			if failing[t.Name] == nil {
+				failing[t.Name] = map[string]TestResult{}
+			}
+			failing[t.Name][res.Version] = t
+		}
+	}
+	if len(failing) > 0 {
+		names := make([]string, 0, len(failing))
+		for name := range failing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "\n## Failing tests\n\n| Test |")
+		for _, res := range r.Results {
+			fmt.Fprintf(w, " %s |", res.Version)
+		}
+		fmt.Fprintf(w, "\n|---|%s\n", strings.Repeat("---|", len(r.Results)))
+		for _, name := range names {
+			fmt.Fprintf(w, "| %s |", name)
+			for _, res := range r.Results {
+				t, failed := failing[name][res.Version]
+				switch {
+				case res.Error != "":
+					fmt.Fprint(w, " error |")
+				case failed && t.Signature == "":
+					fmt.Fprintf(w, " %s |", failureRate(t))
+				case failed:
+					fmt.Fprintf(w, " %s: %s |", failureRate(t), cell(t.Signature))
+				default:
+					fmt.Fprint(w, " pass |")
+				}
+			}
+			fmt.Fprintln(w)
+		}
+	}
+
+	if regressions := r.Regressions(); len(regressions) > 0 {
+		fmt.Fprintf(w, "\n## Regressions\n\n")
+		for _, reg := range regressions {
+			fmt.Fprintf(w, "- %s passes with %s, fails %d/%d runs with %s: %s\n", reg.Test, reg.Passed, reg.Failures, reg.Runs, reg.Failed, reg.Signature)
+		}
+	}
+}
+
+// failureRate renders the failures of t, FAIL when it failed every run.
+func failureRate(t TestResult) string {
+	result := "FAIL"
+	if t.Flaky() {
+		result = "flaky"
+	}
+	if t.Runs > 1 {
+		result += fmt.Sprintf(" %d/%d", t.Failures, t.Runs)
+	}
+	return result
+}
+
+// countList renders counts, the most frequent first.
+func countList(counts map[string]int) string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%d× %s", counts[k], k)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// cell escapes s for a markdown table cell.
+func cell(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", "<br>")
+}
@@ -0,0 +1,115 @@
+package rep
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type accessLogKey struct{}
+
+type accessLogEntry struct {
+	mu     sync.Mutex
+	fields []string
+}
+
+// AnnotateAccessLog adds key=value to the access log line of the request
+// carrying ctx. It is a no-op outside of an AccessLogHandler.
+func AnnotateAccessLog(ctx context.Context, key, value string) {
+	e, ok := ctx.Value(accessLogKey{}).(*accessLogEntry)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.fields = append(e.fields, key+"="+value)
+}
+
+// NewAccessLogHandler logs one line per request served by h once it
+// completes, including annotations added with AnnotateAccessLog. The
+// standard logger is used when logger is nil.
+func NewAccessLogHandler(h http.Handler, logger *log.Logger) http.Handler {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{}
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			status, bytes := rec.result()
+			entry.mu.Lock()
+			extra := strings.Join(entry.fields, " ")
+			entry.mu.Unlock()
+			if extra != "" {
+				extra = " " + extra
+			}
+			logger.Printf("access method=%s host=%s path=%s proto=%s remote=%s status=%d bytes=%d duration=%s%s",
+				r.Method, r.Host, r.URL.Path, r.Proto, r.RemoteAddr, status, bytes, time.Since(start), extra)
+		}()
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+	})
+}
+
+// responseRecorder records what was written through it. It forwards Flush
+// and Hijack explicitly since the knative timeout handler type-asserts them.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	mu          sync.Mutex
+	status      int
+	bytes       int64
+	lateHeaders []int
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.mu.Lock()
+	if rr.status == 0 {
+		rr.status = code
+	} else {
+		rr.lateHeaders = append(rr.lateHeaders, code)
+	}
+	rr.mu.Unlock()
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(p)
+	rr.mu.Lock()
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.bytes += int64(n)
+	rr.mu.Unlock()
+	return n, err
+}
+
+// result returns the response status and the number of body bytes written.
+func (rr *responseRecorder) result() (int, int64) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.status, rr.bytes
+}
+
+// Flush implements http.Flusher.
+func (rr *responseRecorder) Flush() {
+	http.NewResponseController(rr.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker.
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rr.mu.Lock()
+	rr.status = http.StatusSwitchingProtocols
+	rr.mu.Unlock()
+	return http.NewResponseController(rr.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
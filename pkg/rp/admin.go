@@ -0,0 +1,353 @@
+package rep
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ConnTracker counts the connections of an http.Server by state. Accept
+// them through Listener and set ConnState as the server's ConnState hook.
+type ConnTracker struct {
+	mu sync.Mutex
+	// states holds connections served by http.Server, hijacked ones are
+	// only counted by open until they're closed.
+	states   map[net.Conn]http.ConnState
+	open     int
+	accepted uint64
+}
+
+// ConnStats is a snapshot of a ConnTracker.
+type ConnStats struct {
+	Open   int `json:"open"`
+	Active int `json:"active"`
+	Idle   int `json:"idle"`
+	New    int `json:"new"`
+	// Hijacked connections serve h2c and upgraded requests.
+	Hijacked int    `json:"hijacked"`
+	Accepted uint64 `json:"accepted"`
+}
+
+// Listener counts the connections accepted by ln until they're closed.
+func (t *ConnTracker) Listener(ln net.Listener) net.Listener {
+	return &trackedListener{Listener: ln, t: t}
+}
+
+type trackedListener struct {
+	net.Listener
+	t *ConnTracker
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.t.mu.Lock()
+	l.t.open++
+	l.t.accepted++
+	l.t.mu.Unlock()
+	return &trackedConn{Conn: c, t: l.t}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	t    *ConnTracker
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.t.mu.Lock()
+		c.t.open--
+		c.t.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// CloseWrite keeps half-closes of upgraded connections working.
+func (c *trackedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// ConnState tracks c through state, as an http.Server ConnState hook.
+func (t *ConnTracker) ConnState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.states == nil {
+		t.states = make(map[net.Conn]http.ConnState)
+	}
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(t.states, c)
+	default:
+		t.states[c] = state
+	}
+}
+
+// Stats returns the connections in each state.
+func (t *ConnTracker) Stats() ConnStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := ConnStats{Open: t.open, Accepted: t.accepted}
+	for _, state := range t.states {
+		switch state {
+		case http.StateNew:
+			s.New++
+		case http.StateActive:
+			s.Active++
+		case http.StateIdle:
+			s.Idle++
+		}
+	}
+	// Connections are closed by the server after reporting StateClosed.
+	s.Hijacked = max(0, s.Open-len(t.states))
+	return s
+}
+
+// WriteMetrics implements MetricsSource.
+func (t *ConnTracker) WriteMetrics(w io.Writer) {
+	s := t.Stats()
+	writeMetric(w, "rp_connections_open", nil, s.Open)
+	writeMetric(w, "rp_connections", map[string]string{"state": "active"}, s.Active)
+	writeMetric(w, "rp_connections", map[string]string{"state": "idle"}, s.Idle)
+	writeMetric(w, "rp_connections", map[string]string{"state": "new"}, s.New)
+	writeMetric(w, "rp_connections", map[string]string{"state": "hijacked"}, s.Hijacked)
+	writeMetric(w, "rp_connections_accepted_total", nil, s.Accepted)
+}
+
+// Admin serves a JSON API to inspect and control the proxy at runtime, like
+// Envoy's admin listener. Mutating endpoints require POST. It has no
+// authentication, so serve it on a loopback address, see CheckAdminAddress.
+type Admin struct {
+	// Config returns the config in use.
+	Config func() *Config
+	// Prober checks the upstreams reported on /upstreams.
+	Prober *Prober
+	// Breakers report the concurrency of each upstream.
+	Breakers *BreakerSet
+	// Pools report the connections to each upstream.
+	Pools   *PoolSet
+	Drainer *Drainer
+	Conns   *ConnTracker
+	// Metrics are served on /stats/prometheus.
+	Metrics *Metrics
+	// Drain starts a drain, as on SIGTERM, when POSTed to /drain.
+	Drain func()
+}
+
+// UpstreamStatus is an entry of /upstreams.
+type UpstreamStatus struct {
+	Name        string        `json:"name"`
+	Address     string        `json:"address,omitempty"`
+	Health      string        `json:"health,omitempty"`
+	Concurrency *BreakerStats `json:"concurrency,omitempty"`
+	Pool        *PoolStats    `json:"pool,omitempty"`
+}
+
+// Stats is the body of /stats.
+type Stats struct {
+	InFlight    int                     `json:"inFlight"`
+	Draining    bool                    `json:"draining"`
+	Connections ConnStats               `json:"connections"`
+	Upstreams   map[string]BreakerStats `json:"upstreams"`
+	Pools       map[string]PoolStats    `json:"pools"`
+}
+
+// Handler returns the admin API:
+//
+//	GET  /config_dump       the config in use
+//	GET  /upstreams         addresses, health, concurrency and pools of upstreams
+//	GET  /connections       connections by state
+//	GET  /stats             counters, /stats/prometheus in text format
+//	GET  /logging           the log level, POST /logging?level= changes it
+//	POST /drain             starts draining
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.index)
+	mux.HandleFunc("/config_dump", get(func(w http.ResponseWriter, r *http.Request) {
+		cfg := &Config{}
+		if a.Config != nil {
+			cfg = a.Config()
+		}
+		writeJSON(w, http.StatusOK, cfg)
+	}))
+	mux.HandleFunc("/upstreams", get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.upstreams(r))
+	}))
+	mux.HandleFunc("/connections", get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.connStats())
+	}))
+	mux.HandleFunc("/stats", get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.stats())
+	}))
+	mux.HandleFunc("/stats/prometheus", get(func(w http.ResponseWriter, r *http.Request) {
+		if a.Metrics == nil {
+			http.NotFound(w, r)
+			return
+		}
+		a.Metrics.ServeHTTP(w, r)
+	}))
+	mux.HandleFunc("/logging", a.logging)
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if a.Drain == nil {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "drain not supported"})
+			return
+		}
+		logf(LogInfo, "Drain requested from %s", r.RemoteAddr)
+		a.Drain()
+		writeJSON(w, http.StatusAccepted, map[string]bool{"draining": true})
+	})
+	return mux
+}
+
+func (a *Admin) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, []string{
+		"GET /config_dump", "GET /upstreams", "GET /connections", "GET /stats",
+		"GET /stats/prometheus", "GET /logging", "POST /logging?level=", "POST /drain",
+	})
+}
+
+func (a *Admin) logging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		l, err := ParseLogLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if old := CurrentLogLevel(); old != l {
+			SetLogLevel(l)
+			logf(LogError, "Log level changed from %s to %s", old, l)
+		}
+	default:
+		methodNotAllowed(w, http.MethodGet+", "+http.MethodPost)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": CurrentLogLevel().String()})
+}
+
+func (a *Admin) upstreams(r *http.Request) []UpstreamStatus {
+	byName := make(map[string]*UpstreamStatus)
+	status := func(name string) *UpstreamStatus {
+		if byName[name] == nil {
+			byName[name] = &UpstreamStatus{Name: name}
+		}
+		return byName[name]
+	}
+	if a.Prober != nil {
+		check := a.Prober.Check(r.Context())
+		for name, addr := range a.Prober.upstreams() {
+			s := status(name)
+			s.Address = addr
+			s.Health = check.Upstreams[name]
+			if check.Draining {
+				s.Health = "draining"
+			}
+		}
+	}
+	for _, b := range a.breakers() {
+		stats := b.Stats()
+		status(b.name).Concurrency = &stats
+	}
+	for name, stats := range a.pools() {
+		stats := stats
+		status(name).Pool = &stats
+	}
+
+	list := make([]UpstreamStatus, 0, len(byName))
+	for _, s := range byName {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (a *Admin) breakers() []*Breaker {
+	if a.Breakers == nil {
+		return nil
+	}
+	return a.Breakers.List()
+}
+
+func (a *Admin) pools() map[string]PoolStats {
+	if a.Pools == nil {
+		return map[string]PoolStats{}
+	}
+	return a.Pools.Stats()
+}
+
+func (a *Admin) connStats() ConnStats {
+	if a.Conns == nil {
+		return ConnStats{}
+	}
+	return a.Conns.Stats()
+}
+
+func (a *Admin) stats() Stats {
+	s := Stats{Connections: a.connStats(), Upstreams: make(map[string]BreakerStats), Pools: a.pools()}
+	if a.Drainer != nil {
+		s.InFlight = a.Drainer.InFlight()
+		s.Draining = a.Drainer.Draining()
+	}
+	for _, b := range a.breakers() {
+		s.Upstreams[b.name] = b.Stats()
+	}
+	return s
+}
+
+// CheckAdminAddress rejects addresses the admin API shouldn't listen on,
+// anything but loopback ones, unless allowRemote is set.
+func CheckAdminAddress(addr string, allowRemote bool) error {
+	if allowRemote {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("admin address %s isn't a loopback address", addr)
+	}
+	return nil
+}
+
+// get restricts h to GET and HEAD requests.
+func get(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
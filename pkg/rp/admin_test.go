@@ -0,0 +1,213 @@
+package rep
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+- name: echo
+  url: http://echo.default.svc
+  concurrency:
+    maxInFlight: 2
+routes:
+- match:
+    pathPrefix: /
+  upstream: echo
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() = %v", err)
+	}
+	breakers := &BreakerSet{}
+	breakers.Set(map[string]*Breaker{"echo": breakers.Get("echo", cfg.Upstreams[0].Concurrency)})
+	pools := &PoolSet{}
+	transport := NewProtocolTransport(UpstreamHTTP1)
+	transport.TrackEndpoints()
+	pools.Set(map[string]*ProtocolTransport{"echo": transport})
+	drainer := NewDrainer()
+	drained := false
+	admin := &Admin{
+		Config:   func() *Config { return cfg },
+		Breakers: breakers,
+		Pools:    pools,
+		Drainer:  drainer,
+		Conns:    &ConnTracker{},
+		Metrics:  &Metrics{},
+		Drain:    func() { drained = true },
+	}
+	admin.Metrics.Register(breakers)
+	admin.Metrics.Register(pools)
+	srv := httptest.NewServer(admin.Handler())
+	defer srv.Close()
+	defer SetLogLevel(LogInfo)
+
+	do := func(method, path string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	tests := []struct {
+		method, path string
+		want         int
+		wantBody     string
+	}{
+		{http.MethodGet, "/", http.StatusOK, "POST /drain"},
+		{http.MethodGet, "/config_dump", http.StatusOK, `"maxInFlight": 2`},
+		{http.MethodPost, "/config_dump", http.StatusMethodNotAllowed, "method not allowed"},
+		{http.MethodGet, "/upstreams", http.StatusOK, `"name": "echo"`},
+		{http.MethodGet, "/upstreams", http.StatusOK, `"dialsPerSecond": 0`},
+		{http.MethodGet, "/connections", http.StatusOK, `"hijacked": 0`},
+		{http.MethodGet, "/stats", http.StatusOK, `"maxInFlight": 2`},
+		{http.MethodGet, "/stats/prometheus", http.StatusOK, `rp_upstream_max_in_flight{upstream="echo"} 2`},
+		{http.MethodGet, "/stats/prometheus", http.StatusOK, `rp_upstream_connections{state="idle",upstream="echo"} 0`},
+		{http.MethodGet, "/stats/prometheus", http.StatusOK, `rp_upstream_retries_total{upstream="echo"} 0`},
+		{http.MethodGet, "/logging", http.StatusOK, `"level": "info"`},
+		{http.MethodPost, "/logging?level=loud", http.StatusBadRequest, "unknown log level"},
+		{http.MethodPost, "/logging?level=debug", http.StatusOK, `"level": "debug"`},
+		{http.MethodGet, "/drain", http.StatusMethodNotAllowed, "method not allowed"},
+		{http.MethodGet, "/nope", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		code, body := do(test.method, test.path)
+		if code != test.want || !strings.Contains(body, test.wantBody) {
+			t.Errorf("%s %s = %d %q, want %d with %q", test.method, test.path, code, body, test.want, test.wantBody)
+		}
+	}
+	if got := CurrentLogLevel(); got != LogDebug {
+		t.Errorf("log level = %s, want %s", got, LogDebug)
+	}
+	if drained {
+		t.Fatal("drain started by a GET")
+	}
+	if code, _ := do(http.MethodPost, "/drain"); code != http.StatusAccepted || !drained {
+		t.Errorf("POST /drain = %d, drained %v", code, drained)
+	}
+}
+
+func TestAdminUpstreamHealth(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	admin := &Admin{Prober: &Prober{Upstreams: map[string]string{"up": up.Listener.Addr().String(), "down": down}}}
+	rec := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/upstreams", nil))
+	var got []UpstreamStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode /upstreams: %v", err)
+	}
+	if len(got) != 2 || got[0].Name != "down" || got[1].Name != "up" {
+		t.Fatalf("/upstreams = %+v, want down and up", got)
+	}
+	if got[0].Health == "ok" || got[0].Address != down {
+		t.Errorf("unreachable upstream = %+v", got[0])
+	}
+	if got[1].Health != "ok" {
+		t.Errorf("reachable upstream = %+v", got[1])
+	}
+}
+
+func TestConnTracker(t *testing.T) {
+	conns := &ConnTracker{}
+	release := make(chan struct{})
+	srv, err := NewServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/block":
+			w.WriteHeader(http.StatusOK)
+			http.NewResponseController(w).Flush()
+			<-release
+		case "/hijack":
+			// Like an upgraded connection.
+			c, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+			brw.Flush()
+			<-release
+			c.Close()
+		}
+	}), nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	srv.ConnState = conns.ConnState
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(conns.Listener(ln))
+	defer srv.Close()
+	url := "http://" + ln.Addr().String()
+
+	// An idle connection, an active one and a hijacked one.
+	http1 := &http.Client{Transport: &http.Transport{}}
+	resp, err := http1.Get(url + "/")
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	blocked, err := (&http.Client{Transport: &http.Transport{}}).Get(url + "/block")
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer blocked.Body.Close()
+	req, _ := http.NewRequest(http.MethodGet, url+"/hijack", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	upgraded, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	if err != nil {
+		t.Fatalf("Failed to execute upgrade request: %v", err)
+	}
+	defer upgraded.Body.Close()
+
+	want := ConnStats{Open: 3, Active: 1, Idle: 1, Hijacked: 1, Accepted: 3}
+	waitFor(t, "connection states", func() bool { return conns.Stats() == want })
+
+	close(release)
+	http1.CloseIdleConnections()
+	srv.Close()
+	want = ConnStats{Accepted: 3}
+	waitFor(t, "connections to close", func() bool { return conns.Stats() == want })
+}
+
+func TestCheckAdminAddress(t *testing.T) {
+	for _, test := range []struct {
+		addr        string
+		allowRemote bool
+		wantErr     bool
+	}{
+		{"127.0.0.1:9901", false, false},
+		{"[::1]:9901", false, false},
+		{"localhost:9901", false, false},
+		{":9901", false, true},
+		{"0.0.0.0:9901", false, true},
+		{"10.0.0.1:9901", false, true},
+		{"0.0.0.0:9901", true, false},
+		{"9901", false, true},
+	} {
+		if err := CheckAdminAddress(test.addr, test.allowRemote); (err != nil) != test.wantErr {
+			t.Errorf("CheckAdminAddress(%q, %v) = %v, want error %v", test.addr, test.allowRemote, err, test.wantErr)
+		}
+	}
+}
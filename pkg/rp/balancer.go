@@ -0,0 +1,80 @@
+package rep
+
+import (
+	"net/http"
+	"slices"
+	"sync/atomic"
+)
+
+// EndpointBalancer spreads the requests to an upstream over its endpoints,
+// round robin, instead of the host of its URL. The endpoints may change
+// while requests are served, e.g. as discovery finds them.
+type EndpointBalancer struct {
+	endpoints atomic.Pointer[[]string]
+	next      atomic.Uint64
+	onRemoved atomic.Pointer[[]func([]string)]
+}
+
+// NewEndpointBalancer returns a balancer over host:port endpoints.
+func NewEndpointBalancer(endpoints []string) *EndpointBalancer {
+	b := &EndpointBalancer{}
+	b.SetEndpoints(endpoints)
+	return b
+}
+
+// SetEndpoints replaces the endpoints requests are sent to.
+func (b *EndpointBalancer) SetEndpoints(endpoints []string) {
+	old := b.endpoints.Swap(&endpoints)
+	fs := b.onRemoved.Load()
+	if old == nil || fs == nil {
+		return
+	}
+	var removed []string
+	for _, ep := range *old {
+		if !slices.Contains(endpoints, ep) {
+			removed = append(removed, ep)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	for _, f := range *fs {
+		f(removed)
+	}
+}
+
+// OnRemoved calls each of fs with the endpoints SetEndpoints removes, e.g.
+// to drain their connections in every transport sending requests to them.
+// It replaces the functions of a previous call.
+func (b *EndpointBalancer) OnRemoved(fs ...func(removed []string)) {
+	b.onRemoved.Store(&fs)
+}
+
+// Endpoints returns the endpoints requests are sent to.
+func (b *EndpointBalancer) Endpoints() []string {
+	return *b.endpoints.Load()
+}
+
+// Director wraps director, e.g. of an httputil.ReverseProxy, to send
+// requests to the next endpoint.
+func (b *EndpointBalancer) Director(director func(*http.Request)) func(*http.Request) {
+	return func(r *http.Request) {
+		director(r)
+		if endpoints := b.Endpoints(); len(endpoints) > 0 {
+			r.URL.Host = endpoints[(b.next.Add(1)-1)%uint64(len(endpoints))]
+		}
+	}
+}
+
+// Handler answers 503 while there are no endpoints, like Envoy for clusters
+// without healthy hosts, and passes requests to h otherwise.
+func (b *EndpointBalancer) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(b.Endpoints()) == 0 {
+			AnnotateAccessLog(r.Context(), "endpoints", "none")
+			http.Error(w, "no healthy upstream", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,271 @@
+package rep
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	httpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+	"sigs.k8s.io/yaml"
+)
+
+// EnvoyBootstrap is the proxy equivalent to the static_resources of an Envoy
+// bootstrap config.
+type EnvoyBootstrap struct {
+	// Address the listener binds, host:port.
+	Address   string
+	Upstreams []UpstreamConfig
+	Routes    []Route
+}
+
+// UnsupportedFieldsError lists the fields of an Envoy config the proxy
+// doesn't implement, so it can't behave like Envoy would.
+type UnsupportedFieldsError struct {
+	Fields []string
+}
+
+func (e *UnsupportedFieldsError) Error() string {
+	return "unsupported Envoy config fields:\n\t" + strings.Join(e.Fields, "\n\t")
+}
+
+// LoadEnvoyBootstrap reads the Envoy bootstrap config at path.
+func LoadEnvoyBootstrap(path string) (*EnvoyBootstrap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Envoy config: %w", err)
+	}
+	return ParseEnvoyBootstrap(b)
+}
+
+// ParseEnvoyBootstrap translates the listener, routes and clusters of the
+// static_resources of an Envoy bootstrap config, in YAML or JSON. Every field
+// set that the proxy doesn't implement is reported, as an
+// UnsupportedFieldsError, rather than ignored.
+func ParseEnvoyBootstrap(b []byte) (*EnvoyBootstrap, error) {
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Envoy config: %w", err)
+	}
+	var bootstrap map[string]json.RawMessage
+	if err := json.Unmarshal(j, &bootstrap); err != nil {
+		return nil, fmt.Errorf("failed to parse Envoy config: %w", err)
+	}
+	var unsupported []string
+	var static map[string]json.RawMessage
+	for _, key := range sortedNames(bootstrap) {
+		switch key {
+		case "static_resources", "staticResources":
+			if err := json.Unmarshal(bootstrap[key], &static); err != nil {
+				return nil, fmt.Errorf("failed to parse static_resources: %w", err)
+			}
+		case "node":
+			// Only identifies Envoy to management servers.
+		default:
+			unsupported = append(unsupported, key)
+		}
+	}
+
+	var listeners []*listenerv3.Listener
+	var clusters []*clusterv3.Cluster
+	for _, key := range sortedNames(static) {
+		var err error
+		switch key {
+		case "listeners":
+			listeners, err = parseEnvoyResources[*listenerv3.Listener](static[key], "static_resources.listeners", &unsupported)
+		case "clusters":
+			clusters, err = parseEnvoyResources[*clusterv3.Cluster](static[key], "static_resources.clusters", &unsupported)
+		default:
+			unsupported = append(unsupported, "static_resources."+key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, c := range clusters {
+		if c.GetType() == clusterv3.Cluster_EDS {
+			unsupported = append(unsupported, fmt.Sprintf("static_resources.clusters[%d].type: EDS, use -xds-server", i))
+		}
+	}
+	for i, l := range listeners {
+		hcms, _ := listenerHCMs(l)
+		for _, hcm := range hcms {
+			if hcm.GetRds() != nil {
+				unsupported = append(unsupported, fmt.Sprintf("static_resources.listeners[%d]: rds, use -xds-server", i))
+			}
+		}
+	}
+	if len(unsupported) > 0 {
+		return nil, &UnsupportedFieldsError{Fields: unsupported}
+	}
+
+	if len(listeners) != 1 {
+		return nil, fmt.Errorf("exactly one listener is supported, got %d", len(listeners))
+	}
+	sa := listeners[0].GetAddress().GetSocketAddress()
+	if sa == nil {
+		return nil, fmt.Errorf("listener %s: missing socket_address", listeners[0].GetName())
+	}
+
+	msgs := make([]proto.Message, 0, len(listeners)+len(clusters))
+	for _, l := range listeners {
+		msgs = append(msgs, l)
+	}
+	for _, c := range clusters {
+		msgs = append(msgs, c)
+	}
+	res, err := NewXDSResources(msgs...)
+	if err != nil {
+		return nil, err
+	}
+	upstreams, routes, err := res.Translate()
+	if err != nil {
+		return nil, err
+	}
+	return &EnvoyBootstrap{
+		Address:   net.JoinHostPort(sa.GetAddress(), strconv.Itoa(int(sa.GetPortValue()))),
+		Upstreams: upstreams,
+		Routes:    routes,
+	}, nil
+}
+
+// parseEnvoyResources decodes a list of resources, adding the unsupported
+// fields they set.
+func parseEnvoyResources[M proto.Message](b json.RawMessage, path string, unsupported *[]string) ([]M, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	resources := make([]M, 0, len(raw))
+	for i, r := range raw {
+		var m M
+		m = m.ProtoReflect().Type().New().Interface().(M)
+		if err := protojson.Unmarshal(r, m); err != nil {
+			return nil, fmt.Errorf("failed to parse %s[%d]: %w", path, i, err)
+		}
+		unsupportedFields(m.ProtoReflect(), fmt.Sprintf("%s[%d]", path, i), unsupported)
+		resources = append(resources, m)
+	}
+	return resources, nil
+}
+
+// envoySupportedFields are the fields the proxy implements, by message.
+// Messages not listed, like durations, are supported as a whole, except in
+// Any fields, whose type must be listed.
+var envoySupportedFields = map[protoreflect.FullName]map[protoreflect.Name]bool{}
+
+func supportFields(m proto.Message, names ...protoreflect.Name) {
+	fields := make(map[protoreflect.Name]bool, len(names))
+	for _, name := range names {
+		fields[name] = true
+	}
+	envoySupportedFields[m.ProtoReflect().Descriptor().FullName()] = fields
+}
+
+func init() {
+	supportFields(&listenerv3.Listener{}, "name", "address", "filter_chains", "stat_prefix")
+	supportFields(&listenerv3.FilterChain{}, "filters")
+	supportFields(&listenerv3.Filter{}, "name", "typed_config")
+	supportFields(&corev3.Address{}, "socket_address")
+	supportFields(&corev3.SocketAddress{}, "address", "port_value")
+	supportFields(&hcmv3.HttpConnectionManager{}, "stat_prefix", "codec_type", "route_config", "rds", "http_filters")
+	supportFields(&hcmv3.Rds{}, "config_source", "route_config_name")
+	// Resources discovered with xDS only come over the ADS stream.
+	supportFields(&corev3.ConfigSource{}, "ads", "resource_api_version")
+	supportFields(&corev3.AggregatedConfigSource{})
+	supportFields(&hcmv3.HttpFilter{}, "name", "typed_config")
+	supportFields(&routerv3.Router{})
+
+	supportFields(&routev3.RouteConfiguration{}, "name", "virtual_hosts")
+	supportFields(&routev3.VirtualHost{}, "name", "domains", "routes")
+	supportFields(&routev3.Route{}, "name", "match", "route")
+	supportFields(&routev3.RouteMatch{}, "prefix", "path", "safe_regex", "headers", "case_sensitive")
+	supportFields(&routev3.HeaderMatcher{}, "name", "exact_match", "string_match")
+	supportFields(&matcherv3.StringMatcher{}, "exact")
+	supportFields(&matcherv3.RegexMatcher{}, "regex")
+	supportFields(&matcherv3.RegexMatchAndSubstitute{}, "pattern", "substitution")
+	supportFields(&routev3.RouteAction{}, "cluster", "weighted_clusters", "prefix_rewrite", "regex_rewrite",
+		"timeout", "idle_timeout", "max_stream_duration", "request_mirror_policies")
+	supportFields(&routev3.RouteAction_MaxStreamDuration{}, "max_stream_duration")
+	supportFields(&routev3.RouteAction_RequestMirrorPolicy{}, "cluster", "runtime_fraction")
+	supportFields(&corev3.RuntimeFractionalPercent{}, "default_value")
+	supportFields(&routev3.WeightedCluster{}, "clusters")
+	supportFields(&routev3.WeightedCluster_ClusterWeight{}, "name", "weight")
+
+	supportFields(&clusterv3.Cluster{}, "name", "type", "connect_timeout", "load_assignment", "http2_protocol_options",
+		"typed_extension_protocol_options", "transport_socket", "circuit_breakers", "eds_cluster_config")
+	supportFields(&clusterv3.Cluster_EdsClusterConfig{}, "eds_config", "service_name")
+	supportFields(&clusterv3.CircuitBreakers{}, "thresholds")
+	supportFields(&clusterv3.CircuitBreakers_Thresholds{}, "priority", "max_requests", "max_pending_requests")
+	supportFields(&endpointv3.ClusterLoadAssignment{}, "cluster_name", "endpoints")
+	supportFields(&endpointv3.LocalityLbEndpoints{}, "lb_endpoints")
+	supportFields(&endpointv3.LbEndpoint{}, "endpoint", "health_status")
+	supportFields(&endpointv3.Endpoint{}, "address")
+	supportFields(&corev3.Http1ProtocolOptions{})
+	supportFields(&corev3.Http2ProtocolOptions{}, "max_concurrent_streams", "connection_keepalive")
+	supportFields(&corev3.KeepaliveSettings{}, "interval", "timeout")
+	supportFields(&corev3.HttpProtocolOptions{}, "idle_timeout")
+	supportFields(&httpv3.HttpProtocolOptions{}, "common_http_protocol_options", "explicit_http_config", "use_downstream_protocol_config")
+	supportFields(&httpv3.HttpProtocolOptions_ExplicitHttpConfig{}, "http_protocol_options", "http2_protocol_options")
+	supportFields(&httpv3.HttpProtocolOptions_UseDownstreamHttpConfig{}, "http_protocol_options", "http2_protocol_options")
+	// Upstream TLS is configured with flags, short of the SNI and trusted CA.
+	supportFields(&corev3.TransportSocket{}, "name", "typed_config")
+	supportFields(&tlsv3.UpstreamTlsContext{}, "sni", "common_tls_context")
+	supportFields(&tlsv3.CommonTlsContext{}, "validation_context")
+	supportFields(&tlsv3.CertificateValidationContext{}, "trusted_ca")
+	supportFields(&corev3.DataSource{}, "filename", "inline_bytes", "inline_string")
+}
+
+// unsupportedFields adds the path of every field set in m, recursively, that
+// isn't in envoySupportedFields.
+func unsupportedFields(m protoreflect.Message, path string, unsupported *[]string) {
+	if a, ok := m.Interface().(*anypb.Any); ok {
+		inner, err := a.UnmarshalNew()
+		if err != nil || envoySupportedFields[inner.ProtoReflect().Descriptor().FullName()] == nil {
+			*unsupported = append(*unsupported, path+": "+a.GetTypeUrl())
+			return
+		}
+		m = inner.ProtoReflect()
+	}
+	supported, listed := envoySupportedFields[m.Descriptor().FullName()]
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		p := path + "." + string(fd.Name())
+		switch {
+		case listed && !supported[fd.Name()]:
+			*unsupported = append(*unsupported, p)
+		case fd.IsList() && fd.Message() != nil:
+			for i := 0; i < v.List().Len(); i++ {
+				unsupportedFields(v.List().Get(i).Message(), fmt.Sprintf("%s[%d]", p, i), unsupported)
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			var keys []string
+			v.Map().Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+				keys = append(keys, k.String())
+				return true
+			})
+			sort.Strings(keys)
+			for _, k := range keys {
+				unsupportedFields(v.Map().Get(protoreflect.ValueOfString(k).MapKey()).Message(), p+"["+k+"]", unsupported)
+			}
+		case fd.Message() != nil && !fd.IsList() && !fd.IsMap():
+			unsupportedFields(v.Message(), p, unsupported)
+		}
+		return true
+	})
+}
@@ -0,0 +1,299 @@
+package rep
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadEnvoyBootstrap(t *testing.T) {
+	// The config Envoy runs with in the README scenario.
+	bootstrap, err := LoadEnvoyBootstrap("../../config.yaml")
+	if err != nil {
+		t.Fatalf("LoadEnvoyBootstrap() = %v", err)
+	}
+	want := &EnvoyBootstrap{
+		Address: "0.0.0.0:10000",
+		Upstreams: []UpstreamConfig{{
+			Name:           "test",
+			URL:            "http://test",
+			Protocol:       "http1",
+			Endpoints:      []string{"127.0.0.1:5050"},
+			ConnectTimeout: Duration{Duration: 5 * time.Second},
+		}},
+		Routes: []Route{{
+			Name:     "all_domains",
+			Match:    RequestMatch{PathPrefix: "/"},
+			Upstream: "test",
+			Timeouts: &TimeoutPolicy{MaxStreamDuration: Duration{Duration: 15 * time.Second}},
+		}},
+	}
+	if !reflect.DeepEqual(bootstrap, want) {
+		t.Errorf("LoadEnvoyBootstrap() = %+v, want %+v", bootstrap, want)
+	}
+	if err := (&Config{Upstreams: bootstrap.Upstreams, Routes: bootstrap.Routes}).Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+const envoyListener = `
+static_resources:
+  listeners:
+  - name: listener_0
+    address:
+      socket_address: {address: 127.0.0.1, port_value: 10000}
+    filter_chains:
+    - filters:
+      - name: envoy.filters.network.http_connection_manager
+        typed_config:
+          "@type": type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager
+          stat_prefix: edge
+          http_filters:
+          - name: envoy.filters.http.router
+            typed_config:
+              "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
+          route_config:
+            virtual_hosts:
+            - name: api
+              domains: ["api.example.com"]
+              routes:
+              - match: {prefix: "/v1/"}
+                route: {cluster: api, prefix_rewrite: "/", timeout: 2s}
+            - name: all
+              domains: ["*"]
+              routes:
+              - match: {prefix: "/"}
+                route: {cluster: web}
+`
+
+func TestParseEnvoyBootstrap(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        string
+		wantUpstreams []UpstreamConfig
+		wantRoutes    []Route
+		wantErr       string
+		wantFields    []string
+	}{{
+		name: "routes and clusters",
+		config: envoyListener + `
+  clusters:
+  - name: api
+    connect_timeout: 0.25s
+    type: STRICT_DNS
+    typed_extension_protocol_options:
+      envoy.extensions.upstreams.http.v3.HttpProtocolOptions:
+        "@type": type.googleapis.com/envoy.extensions.upstreams.http.v3.HttpProtocolOptions
+        common_http_protocol_options: {idle_timeout: 30s}
+        explicit_http_config:
+          http2_protocol_options:
+            max_concurrent_streams: 50
+            connection_keepalive: {interval: 10s, timeout: 2s}
+    circuit_breakers:
+      thresholds:
+      - max_requests: 100
+    load_assignment:
+      cluster_name: api
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address: {address: api.internal, port_value: 8080}
+  - name: web
+    load_assignment:
+      cluster_name: web
+      endpoints:
+      - lb_endpoints:
+        - endpoint:
+            address:
+              socket_address: {address: 10.0.0.1, port_value: 80}
+        - endpoint:
+            address:
+              socket_address: {address: 10.0.0.2, port_value: 80}
+`,
+		wantUpstreams: []UpstreamConfig{{
+			Name:           "api",
+			URL:            "http://api",
+			Protocol:       "h2c",
+			Endpoints:      []string{"api.internal:8080"},
+			Concurrency:    ConcurrencyLimit{MaxInFlight: 100},
+			ConnectTimeout: Duration{Duration: 250 * time.Millisecond},
+			Pool: ConnectionPool{
+				IdleTimeout:          Duration{Duration: 30 * time.Second},
+				MaxConcurrentStreams: 50,
+				ReadIdleTimeout:      Duration{Duration: 10 * time.Second},
+				PingTimeout:          Duration{Duration: 2 * time.Second},
+			},
+		}, {
+			Name:      "web",
+			URL:       "http://web",
+			Protocol:  "http1",
+			Endpoints: []string{"10.0.0.1:80", "10.0.0.2:80"},
+		}},
+		wantRoutes: []Route{{
+			Name:     "api",
+			Match:    RequestMatch{Hosts: []string{"api.example.com"}, PathPrefix: "/v1/"},
+			Rewrite:  &PathRewrite{Prefix: "/"},
+			Upstream: "api",
+			Timeouts: &TimeoutPolicy{MaxStreamDuration: Duration{Duration: 2 * time.Second}},
+		}, {
+			Name:     "all",
+			Match:    RequestMatch{PathPrefix: "/"},
+			Upstream: "web",
+			Timeouts: &TimeoutPolicy{MaxStreamDuration: Duration{Duration: 15 * time.Second}},
+		}},
+	}, {
+		name: "tls clusters",
+		config: envoyListener + `
+  clusters:
+  - name: api
+    transport_socket:
+      name: envoy.transport_sockets.tls
+      typed_config:
+        "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext
+        sni: api.internal
+        common_tls_context:
+          validation_context:
+            trusted_ca: {inline_string: "-----BEGIN CERTIFICATE-----"}
+  - name: web
+    transport_socket:
+      name: envoy.transport_sockets.tls
+      typed_config:
+        "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext
+`,
+		wantUpstreams: []UpstreamConfig{{
+			Name:      "api",
+			URL:       "https://api",
+			Protocol:  "http1",
+			Endpoints: []string{},
+			TLS:       &UpstreamTLS{ServerName: "api.internal", CA: "-----BEGIN CERTIFICATE-----"},
+		}, {
+			Name:      "web",
+			URL:       "https://web",
+			Protocol:  "http1",
+			Endpoints: []string{},
+		}},
+		wantRoutes: []Route{{
+			Name:     "api",
+			Match:    RequestMatch{Hosts: []string{"api.example.com"}, PathPrefix: "/v1/"},
+			Rewrite:  &PathRewrite{Prefix: "/"},
+			Upstream: "api",
+			Timeouts: &TimeoutPolicy{MaxStreamDuration: Duration{Duration: 2 * time.Second}},
+		}, {
+			Name:     "all",
+			Match:    RequestMatch{PathPrefix: "/"},
+			Upstream: "web",
+			Timeouts: &TimeoutPolicy{MaxStreamDuration: Duration{Duration: 15 * time.Second}},
+		}},
+	}, {
+		name: "unsupported fields",
+		config: `
+admin:
+  address:
+    socket_address: {address: 127.0.0.1, port_value: 9901}
+` + strings.NewReplacer("          stat_prefix: edge\n", `          stat_prefix: edge
+          stream_idle_timeout: 10s
+`, "          http_filters:\n", `          http_filters:
+          - name: envoy.filters.http.router
+            typed_config:
+              "@type": type.googleapis.com/envoy.extensions.filters.http.router.v3.Router
+              suppress_envoy_headers: true
+`).Replace(envoyListener) + `
+  clusters:
+  - name: api
+    lb_policy: LEAST_REQUEST
+    load_assignment:
+      cluster_name: api
+      endpoints:
+      - priority: 1
+        lb_endpoints:
+        - endpoint:
+            address:
+              socket_address: {address: 10.0.0.1, port_value: 80}
+    transport_socket:
+      name: envoy.transport_sockets.tls
+      typed_config:
+        "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext
+        common_tls_context:
+          tls_certificates: [{certificate_chain: {filename: cert.pem}}]
+  - name: web
+    type: EDS
+  secrets: []
+`,
+		wantFields: []string{
+			"admin",
+			"static_resources.clusters[0].lb_policy",
+			"static_resources.clusters[0].load_assignment.endpoints[0].priority",
+			"static_resources.clusters[0].transport_socket.typed_config.common_tls_context.tls_certificates",
+			"static_resources.listeners[0].filter_chains[0].filters[0].typed_config.http_filters[0].typed_config.suppress_envoy_headers",
+			"static_resources.listeners[0].filter_chains[0].filters[0].typed_config.stream_idle_timeout",
+			"static_resources.secrets",
+			"static_resources.clusters[1].type: EDS, use -xds-server",
+		},
+	}, {
+		name:    "unknown field",
+		config:  "static_resources:\n  clusters:\n  - name: api\n    conect_timeout: 1s\n",
+		wantErr: `failed to parse static_resources.clusters[0]`,
+	}, {
+		name:    "no listener",
+		config:  "static_resources:\n  clusters:\n  - name: api\n",
+		wantErr: "exactly one listener is supported, got 0",
+	}, {
+		name: "unsupported action",
+		config: strings.Replace(envoyListener, `route: {cluster: web}`, `redirect: {https_redirect: true}`, 1) + `
+  clusters:
+  - name: api
+  - name: web
+`,
+		wantFields: []string{"static_resources.listeners[0].filter_chains[0].filters[0].typed_config.route_config.virtual_hosts[1].routes[0].redirect"},
+	}, {
+		name: "rds",
+		config: envoyListener[:strings.Index(envoyListener, "          route_config:")] + `          rds:
+            route_config_name: local
+            config_source: {ads: {}}
+`,
+		wantFields: []string{"static_resources.listeners[0]: rds, use -xds-server"},
+	}, {
+		name: "untranslatable domain",
+		config: strings.Replace(envoyListener, `["*"]`, `["web.*"]`, 1) + `
+  clusters:
+  - name: api
+  - name: web
+`,
+		wantErr: "unsupported prefix wildcard domain web.*",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bootstrap, err := ParseEnvoyBootstrap([]byte(test.config))
+			var fieldsErr *UnsupportedFieldsError
+			switch {
+			case test.wantFields != nil:
+				if !errors.As(err, &fieldsErr) {
+					t.Fatalf("ParseEnvoyBootstrap() = %v, want unsupported fields", err)
+				}
+				if !reflect.DeepEqual(fieldsErr.Fields, test.wantFields) {
+					t.Errorf("unsupported fields =\n%s\nwant\n%s", strings.Join(fieldsErr.Fields, "\n"), strings.Join(test.wantFields, "\n"))
+				}
+			case test.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ParseEnvoyBootstrap() = %v, want error %q", err, test.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("ParseEnvoyBootstrap() = %v", err)
+			default:
+				if bootstrap.Address != "127.0.0.1:10000" {
+					t.Errorf("Address = %s, want 127.0.0.1:10000", bootstrap.Address)
+				}
+				if !reflect.DeepEqual(bootstrap.Upstreams, test.wantUpstreams) {
+					t.Errorf("Upstreams = %+v, want %+v", bootstrap.Upstreams, test.wantUpstreams)
+				}
+				if !reflect.DeepEqual(bootstrap.Routes, test.wantRoutes) {
+					t.Errorf("Routes = %+v, want %+v", bootstrap.Routes, test.wantRoutes)
+				}
+			}
+		})
+	}
+}
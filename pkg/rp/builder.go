@@ -0,0 +1,296 @@
+package rep
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// ProxyBuilder builds the handler serving a config, with its upstreams,
+// routes and rate limits. Its Build method is the ConfigBuilder of a
+// ConfigReloader, so it's called again on every config reload, one at a
+// time.
+//
+// Transports, with their connection pools, and endpoint watchers are kept
+// across builds and shared by the upstreams with the same settings. Once a
+// config is accepted, the ones it no longer uses are closed; when it's
+// rejected, the ones it started are.
+type ProxyBuilder struct {
+	// Default is the upstream of configs without routes. Without it, requests
+	// only go to the upstreams of their routes, and get a 404 without any
+	// like with Envoy.
+	Default *UpstreamConfig
+	// UpstreamTLS returns the TLS config of https upstreams, before the
+	// overrides of each.
+	UpstreamTLS func() (*tls.Config, error)
+	// KubeClient returns the client of upstreams discovering their endpoints
+	// from EndpointSlices. It's only called for those.
+	KubeClient func() (kubernetes.Interface, error)
+	// KubeSyncTimeout is the longest wait for the EndpointSlices of an
+	// upstream.
+	KubeSyncTimeout time.Duration
+	// DNSResolver resolves the upstreams with dns discovery.
+	DNSResolver *DNSResolver
+	// UpgradeIdleTimeout is the idle timeout of upgraded connections.
+	UpgradeIdleTimeout time.Duration
+	// Flush is the flush policy of upstreams without their own.
+	Flush FlushPolicy
+	// Limiter enforces the rate limits of configs without a rate limit
+	// service.
+	Limiter RateLimiter
+
+	// Breakers, Pools and Prober are updated once a config is accepted.
+	Breakers *BreakerSet
+	Pools    *PoolSet
+	Prober   *Prober
+
+	// current are the resources of the accepted config.
+	current *upstreamResources
+}
+
+// transportKey are the settings of upstreams that can share a transport.
+type transportKey struct {
+	scheme, host   string
+	proto          UpstreamProtocol
+	connectTimeout time.Duration
+	pool           ConnectionPool
+	tls            UpstreamTLS
+}
+
+// endpointWatcher is an EndpointSliceWatcher or a DNSWatcher, by
+// KubernetesDiscovery or DNSDiscovery.
+type endpointWatcher interface {
+	Balancer() *EndpointBalancer
+	Stop()
+}
+
+// upstreamResources are the resources used by a config.
+type upstreamResources struct {
+	transports map[transportKey]*ProtocolTransport
+	watchers   map[any]endpointWatcher
+	// pools are the transports by upstream name.
+	pools    map[string]*ProtocolTransport
+	breakers map[string]*Breaker
+	// drains are the transports of the upstreams using each watcher.
+	drains map[any]map[*ProtocolTransport]bool
+}
+
+func newUpstreamResources() *upstreamResources {
+	return &upstreamResources{
+		transports: map[transportKey]*ProtocolTransport{},
+		watchers:   map[any]endpointWatcher{},
+		pools:      map[string]*ProtocolTransport{},
+		breakers:   map[string]*Breaker{},
+		drains:     map[any]map[*ProtocolTransport]bool{},
+	}
+}
+
+// Build returns the handler serving cfg, which must be validated.
+func (b *ProxyBuilder) Build(cfg *Config) (http.Handler, error) {
+	if b.current == nil {
+		b.current = newUpstreamResources()
+	}
+	used := newUpstreamResources()
+	h, upstreams, err := b.build(cfg, used)
+	if err != nil {
+		b.discard(used)
+		return nil, err
+	}
+	b.accept(used)
+	b.Prober.SetUpstreams(UpstreamAddrs(upstreams))
+	return h, nil
+}
+
+func (b *ProxyBuilder) build(cfg *Config, used *upstreamResources) (http.Handler, []UpstreamConfig, error) {
+	// Routes from the config replace the default upstream.
+	upstreams := cfg.Upstreams
+	var routed http.Handler
+	if len(cfg.Routes) == 0 && b.Default != nil {
+		upstreams = []UpstreamConfig{*b.Default}
+		h, err := b.newUpstream(cfg, upstreams[0], used)
+		if err != nil {
+			return nil, nil, err
+		}
+		routed = h
+	} else {
+		handlers := make(map[string]http.Handler, len(upstreams))
+		for _, u := range upstreams {
+			h, err := b.newUpstream(cfg, u, used)
+			if err != nil {
+				return nil, nil, err
+			}
+			handlers[u.Name] = h
+		}
+		router, err := NewRouter(cfg.Routes, handlers)
+		if err != nil {
+			return nil, nil, err
+		}
+		routed = router
+	}
+
+	limiter := b.Limiter
+	if cfg.RateLimits.Service != "" {
+		limiter = NewRemoteRateLimiter(cfg.RateLimits.Service)
+	}
+	return NewRateLimitHandler(routed, cfg.RateLimits, limiter), upstreams, nil
+}
+
+func (b *ProxyBuilder) newUpstream(cfg *Config, u UpstreamConfig, used *upstreamResources) (http.Handler, error) {
+	// The config is validated, so are the URL and protocol.
+	target, _ := url.Parse(u.URL)
+	proto, _ := ParseUpstreamProtocol(u.Protocol)
+	var tlsConf *tls.Config
+	var tlsOverride UpstreamTLS
+	if target.Scheme == "https" {
+		if b.UpstreamTLS == nil {
+			return nil, fmt.Errorf("upstream %s: no upstream TLS config", u.Name)
+		}
+		var err error
+		if tlsConf, err = b.UpstreamTLS(); err != nil {
+			return nil, err
+		}
+		if u.TLS != nil {
+			tlsOverride = *u.TLS
+			if tlsConf, err = u.TLS.Config(tlsConf); err != nil {
+				return nil, fmt.Errorf("upstream %s: %w", u.Name, err)
+			}
+		}
+	}
+	key := transportKey{target.Scheme, target.Host, proto, u.ConnectTimeout.Duration, u.Pool, tlsOverride}
+	transport := used.transports[key]
+	if transport == nil {
+		transport = b.current.transports[key]
+	}
+	if transport == nil {
+		transport = NewProtocolTransport(proto)
+		if tlsConf != nil {
+			transport.HTTP1 = NewHTTPSTransport(tlsConf)
+		}
+		if u.ConnectTimeout.Duration > 0 {
+			transport.SetConnectTimeout(u.ConnectTimeout.Duration)
+		}
+		if err := transport.SetPool(u.Pool); err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+		transport.TrackEndpoints()
+	}
+	used.transports[key] = transport
+	used.pools[u.Name] = transport
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	var balancer *EndpointBalancer
+	var discovery any
+	switch {
+	case u.Kubernetes != nil:
+		discovery = *u.Kubernetes
+	case u.DNS != nil:
+		discovery = *u.DNS
+	case u.Endpoints != nil:
+		balancer = NewEndpointBalancer(u.Endpoints)
+	}
+	if discovery != nil {
+		watcher, err := b.watcher(discovery, used)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+		balancer = watcher.Balancer()
+		if used.drains[discovery] == nil {
+			used.drains[discovery] = map[*ProtocolTransport]bool{}
+		}
+		used.drains[discovery][transport] = true
+	}
+	if balancer != nil {
+		proxy.Director = balancer.Director(proxy.Director)
+	}
+	// ${upstream_host} is the endpoint the balancer picked.
+	cfg.Headers.Apply(proxy)
+	tunnel := NewUpgradeTunnel(proxy, b.UpgradeIdleTimeout)
+	tunnel.TLSConfig = tlsConf
+	// Like queue-proxy, requests queue before their timeouts start.
+	breaker := b.Breakers.Get(u.Name, u.Concurrency)
+	used.breakers[u.Name] = breaker
+	var h http.Handler = NewConcurrencyHandler(NewTimeoutPolicyHandler(b.Flush.With(u.Flush).Handler(tunnel), cfg.Timeouts), breaker)
+	if balancer != nil {
+		h = balancer.Handler(h)
+	}
+	return h, nil
+}
+
+// watcher returns the watcher of discovery, the one of the accepted config
+// or a started one.
+func (b *ProxyBuilder) watcher(discovery any, used *upstreamResources) (endpointWatcher, error) {
+	if w := used.watchers[discovery]; w != nil {
+		return w, nil
+	}
+	if w := b.current.watchers[discovery]; w != nil {
+		used.watchers[discovery] = w
+		return w, nil
+	}
+	var watcher endpointWatcher
+	var start func() error
+	switch d := discovery.(type) {
+	case KubernetesDiscovery:
+		if b.KubeClient == nil {
+			return nil, errors.New("no Kubernetes client")
+		}
+		client, err := b.KubeClient()
+		if err != nil {
+			return nil, err
+		}
+		w := NewEndpointSliceWatcher(client, d)
+		watcher, start = w, func() error { return w.Start(b.KubeSyncTimeout) }
+	case DNSDiscovery:
+		w := NewDNSWatcher(b.DNSResolver, d)
+		watcher, start = w, w.Start
+	}
+	// Recorded first, to be stopped if the config is rejected.
+	used.watchers[discovery] = watcher
+	if err := start(); err != nil {
+		return nil, err
+	}
+	return watcher, nil
+}
+
+// discard stops the watchers started for a rejected config. The accepted
+// config keeps its resources.
+func (b *ProxyBuilder) discard(used *upstreamResources) {
+	for d, watcher := range used.watchers {
+		if b.current.watchers[d] == nil {
+			watcher.Stop()
+		}
+	}
+}
+
+// accept makes used the resources of the accepted config, and closes the
+// ones of the previous config it dropped.
+func (b *ProxyBuilder) accept(used *upstreamResources) {
+	b.Breakers.Set(used.breakers)
+	for key, transport := range b.current.transports {
+		if used.transports[key] == nil {
+			transport.CloseIdleConnections()
+		}
+	}
+	for d, watcher := range b.current.watchers {
+		if used.watchers[d] == nil {
+			watcher.Stop()
+		}
+	}
+	// The connections to the endpoints a watcher removes are closed once
+	// done, in the transport of every upstream using it.
+	for d, watcher := range used.watchers {
+		drains := make([]func([]string), 0, len(used.drains[d]))
+		for transport := range used.drains[d] {
+			drains = append(drains, transport.DrainEndpoints)
+		}
+		watcher.Balancer().OnRemoved(drains...)
+	}
+	b.current = used
+	b.Pools.Set(used.pools)
+}
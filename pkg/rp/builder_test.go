@@ -0,0 +1,221 @@
+package rep
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestProxyBuilder() *ProxyBuilder {
+	return &ProxyBuilder{
+		Flush:    DefaultFlushPolicy(),
+		Limiter:  NewTokenBucketLimiter(),
+		Breakers: &BreakerSet{},
+		Pools:    &PoolSet{},
+		Prober:   &Prober{},
+	}
+}
+
+func TestProxyBuilder(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	b := newTestProxyBuilder()
+	b.Default = &UpstreamConfig{Name: "default", URL: backend.URL}
+	get := func(h http.Handler, host string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	upstreams := func() []string {
+		var names []string
+		for _, breaker := range b.Breakers.List() {
+			names = append(names, breaker.name)
+		}
+		return names
+	}
+
+	h, err := b.Build(&Config{})
+	if err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	if got := get(h, "a.example.com"); got != http.StatusOK {
+		t.Errorf("default upstream got %d, want %d", got, http.StatusOK)
+	}
+	if got, want := upstreams(), []string{"default"}; !slices.Equal(got, want) {
+		t.Errorf("upstreams = %v, want %v", got, want)
+	}
+	if got, want := b.Prober.upstreams(), map[string]string{"default": backend.Listener.Addr().String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("probed upstreams = %v, want %v", got, want)
+	}
+
+	// Routes replace the default upstream.
+	routed := &Config{
+		Upstreams: []UpstreamConfig{{Name: "a", URL: backend.URL}},
+		Routes:    []Route{{Match: RequestMatch{Hosts: []string{"a.example.com"}}, Upstream: "a"}},
+	}
+	if h, err = b.Build(routed); err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	for host, want := range map[string]int{"a.example.com": http.StatusOK, "b.example.com": http.StatusNotFound} {
+		if got := get(h, host); got != want {
+			t.Errorf("%s got %d, want %d", host, got, want)
+		}
+	}
+	if got, want := upstreams(), []string{"a"}; !slices.Equal(got, want) {
+		t.Errorf("upstreams = %v, want %v", got, want)
+	}
+
+	// A rejected config leaves the accepted one in place.
+	b.UpstreamTLS = func() (*tls.Config, error) { return nil, errors.New("no CA") }
+	rejected := &Config{
+		Upstreams: []UpstreamConfig{{Name: "b", URL: backend.URL}, {Name: "secure", URL: "https://secure.example.com"}},
+		Routes:    []Route{{Upstream: "b"}},
+	}
+	if _, err := b.Build(rejected); err == nil || !strings.Contains(err.Error(), "no CA") {
+		t.Errorf("Build() = %v, want the TLS error", err)
+	}
+	if got, want := upstreams(), []string{"a"}; !slices.Equal(got, want) {
+		t.Errorf("upstreams after a rejected config = %v, want %v", got, want)
+	}
+}
+
+func TestProxyBuilderTransports(t *testing.T) {
+	b := newTestProxyBuilder()
+	pool := ConnectionPool{MaxIdleConnsPerHost: 4}
+	cfg := &Config{Upstreams: []UpstreamConfig{
+		{Name: "a", URL: "http://echo.example.com", Pool: pool},
+		{Name: "b", URL: "http://echo.example.com/b", Pool: pool},
+		{Name: "other", URL: "http://other.example.com", Pool: pool},
+	}}
+	if _, err := b.Build(cfg); err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	first := b.Pools.transports
+	if first["a"] != first["b"] {
+		t.Error("upstreams with the same host and settings don't share a transport")
+	}
+	if first["a"] == first["other"] {
+		t.Error("upstreams with different hosts share a transport")
+	}
+
+	// Transports are kept across builds, unless their settings change.
+	cfg.Upstreams[1].Pool.MaxIdleConnsPerHost = 8
+	if _, err := b.Build(cfg); err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	second := b.Pools.transports
+	if second["a"] != first["a"] || second["other"] != first["other"] {
+		t.Error("transports weren't kept across builds")
+	}
+	if second["b"] == first["b"] {
+		t.Error("upstream b kept its transport after its pool changed")
+	}
+}
+
+func TestProxyBuilderWatchers(t *testing.T) {
+	b := newTestProxyBuilder()
+	b.KubeClient = func() (kubernetes.Interface, error) { return fake.NewSimpleClientset(), nil }
+	b.KubeSyncTimeout = 5 * time.Second
+	app := KubernetesDiscovery{Service: "app", Namespace: "serving"}
+	cfg := &Config{Upstreams: []UpstreamConfig{
+		{Name: "app", URL: "http://app.serving.svc", Kubernetes: &app},
+		{Name: "app-h2c", URL: "http://app.serving.svc", Protocol: "h2c", Kubernetes: &app},
+	}}
+	if _, err := b.Build(cfg); err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	w := b.current.watchers[app].(*EndpointSliceWatcher)
+	// The connections to removed endpoints are drained in both transports.
+	if got := len(*w.Balancer().onRemoved.Load()); got != 2 {
+		t.Errorf("endpoints drained in %d transports, want 2", got)
+	}
+
+	if _, err := b.Build(cfg); err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	if b.current.watchers[app] != w {
+		t.Error("watcher wasn't kept across builds")
+	}
+	if stopped(w) {
+		t.Error("watcher of the accepted config was stopped")
+	}
+
+	if _, err := b.Build(&Config{}); err != nil {
+		t.Fatalf("Build() = %v", err)
+	}
+	if !stopped(w) {
+		t.Error("watcher dropped by the accepted config wasn't stopped")
+	}
+}
+
+func stopped(w *EndpointSliceWatcher) bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+type fakeWatcher struct {
+	balancer *EndpointBalancer
+	stopped  bool
+}
+
+func (w *fakeWatcher) Balancer() *EndpointBalancer { return w.balancer }
+func (w *fakeWatcher) Stop()                       { w.stopped = true }
+
+func TestProxyBuilderLifecycle(t *testing.T) {
+	kept, dropped, started := &fakeWatcher{balancer: NewEndpointBalancer(nil)}, &fakeWatcher{balancer: NewEndpointBalancer(nil)}, &fakeWatcher{balancer: NewEndpointBalancer(nil)}
+	newBuilder := func() *ProxyBuilder {
+		b := newTestProxyBuilder()
+		b.current = newUpstreamResources()
+		b.current.watchers["kept"] = kept
+		b.current.watchers["dropped"] = dropped
+		return b
+	}
+	newUsed := func() *upstreamResources {
+		used := newUpstreamResources()
+		used.watchers["kept"] = kept
+		used.watchers["started"] = started
+		return used
+	}
+	stops := func() []bool {
+		got := []bool{kept.stopped, dropped.stopped, started.stopped}
+		kept.stopped, dropped.stopped, started.stopped = false, false, false
+		return got
+	}
+
+	// A rejected config only stops the watchers it started.
+	b := newBuilder()
+	b.discard(newUsed())
+	if got, want := stops(), []bool{false, false, true}; !slices.Equal(got, want) {
+		t.Errorf("discard stopped kept, dropped, started = %v, want %v", got, want)
+	}
+
+	// An accepted config stops the ones of the previous config it dropped.
+	b = newBuilder()
+	used := newUsed()
+	b.accept(used)
+	if got, want := stops(), []bool{false, true, false}; !slices.Equal(got, want) {
+		t.Errorf("accept stopped kept, dropped, started = %v, want %v", got, want)
+	}
+	if b.current != used {
+		t.Error("accepted resources aren't current")
+	}
+}
@@ -0,0 +1,237 @@
+package rep
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrRequestQueueFull is returned when a request can neither run nor queue,
+// as by knative's queue.Breaker.
+var ErrRequestQueueFull = errors.New("pending request queue full")
+
+// ConcurrencyLimit caps the requests in flight to an upstream, like the
+// container concurrency enforced by Knative's queue-proxy.
+type ConcurrencyLimit struct {
+	// MaxInFlight is the number of requests proxied at once. Unlimited when
+	// zero.
+	MaxInFlight int `json:"maxInFlight,omitempty"`
+	// QueueDepth is the number of requests waiting for a slot in FIFO order.
+	// Requests beyond it are rejected right away.
+	QueueDepth int `json:"queueDepth,omitempty"`
+	// QueueTimeout bounds the time spent waiting. Unlimited when zero.
+	QueueTimeout Duration `json:"queueTimeout,omitempty"`
+}
+
+// Validate rejects negative limits.
+func (c *ConcurrencyLimit) Validate() error {
+	if c.MaxInFlight < 0 || c.QueueDepth < 0 || c.QueueTimeout.Duration < 0 {
+		return errors.New("concurrency limits must not be negative")
+	}
+	return nil
+}
+
+// Breaker admits up to MaxInFlight concurrent calls and queues up to
+// QueueDepth more in FIFO order.
+type Breaker struct {
+	name  string
+	limit ConcurrencyLimit
+
+	mu       sync.Mutex
+	inFlight int
+	// waiters holds a channel per queued call, closed when it gets a slot.
+	waiters list.List
+
+	admitted, rejected, timedOut uint64
+}
+
+// NewBreaker returns a Breaker reporting its metrics for the named upstream.
+func NewBreaker(name string, limit ConcurrencyLimit) *Breaker {
+	return &Breaker{name: name, limit: limit}
+}
+
+// BreakerStats is a snapshot of a Breaker.
+type BreakerStats struct {
+	InFlight    int    `json:"inFlight"`
+	Queued      int    `json:"queued"`
+	MaxInFlight int    `json:"maxInFlight"`
+	QueueDepth  int    `json:"queueDepth"`
+	Admitted    uint64 `json:"admitted"`
+	Rejected    uint64 `json:"rejected"`
+	TimedOut    uint64 `json:"timedOut"`
+}
+
+// Stats returns the current state of b.
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{
+		InFlight:    b.inFlight,
+		Queued:      b.waiters.Len(),
+		MaxInFlight: b.limit.MaxInFlight,
+		QueueDepth:  b.limit.QueueDepth,
+		Admitted:    b.admitted,
+		Rejected:    b.rejected,
+		TimedOut:    b.timedOut,
+	}
+}
+
+// Maybe runs thunk once a slot is free. It returns ErrRequestQueueFull when
+// the queue is full and the context error when ctx ends while queued.
+func (b *Breaker) Maybe(ctx context.Context, thunk func()) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+	thunk()
+	return nil
+}
+
+func (b *Breaker) acquire(ctx context.Context) error {
+	b.mu.Lock()
+	if b.limit.MaxInFlight == 0 || (b.inFlight < b.limit.MaxInFlight && b.waiters.Len() == 0) {
+		b.inFlight++
+		b.admitted++
+		b.mu.Unlock()
+		return nil
+	}
+	if b.waiters.Len() >= b.limit.QueueDepth {
+		b.rejected++
+		b.mu.Unlock()
+		return ErrRequestQueueFull
+	}
+	ready := make(chan struct{})
+	elem := b.waiters.PushBack(ready)
+	b.mu.Unlock()
+
+	if b.limit.QueueTimeout.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.limit.QueueTimeout.Duration)
+		defer cancel()
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		b.timedOut++
+	}
+	select {
+	case <-ready:
+		// The slot was handed over while giving up, pass it on.
+		b.admitted--
+		b.mu.Unlock()
+		b.release()
+	default:
+		b.waiters.Remove(elem)
+		b.mu.Unlock()
+	}
+	return ctx.Err()
+}
+
+// release hands the slot to the oldest waiter, if any.
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if front := b.waiters.Front(); front != nil {
+		b.waiters.Remove(front)
+		b.admitted++
+		close(front.Value.(chan struct{}))
+		return
+	}
+	b.inFlight--
+}
+
+// WriteMetrics implements MetricsSource.
+func (b *Breaker) WriteMetrics(w io.Writer) {
+	s := b.Stats()
+	labels := map[string]string{"upstream": b.name}
+	writeMetric(w, "rp_upstream_requests_in_flight", labels, s.InFlight)
+	writeMetric(w, "rp_upstream_queue_depth", labels, s.Queued)
+	writeMetric(w, "rp_upstream_max_in_flight", labels, s.MaxInFlight)
+	writeMetric(w, "rp_upstream_queue_capacity", labels, s.QueueDepth)
+	writeMetric(w, "rp_upstream_requests_admitted_total", labels, s.Admitted)
+	writeMetric(w, "rp_upstream_requests_rejected_total", labels, s.Rejected)
+	writeMetric(w, "rp_upstream_queue_timeouts_total", labels, s.TimedOut)
+}
+
+// NewConcurrencyHandler serves h through b. Requests that can't be queued, or
+// waited too long, get a 503 like queue-proxy's overload response.
+func NewConcurrencyHandler(h http.Handler, b *Breaker) http.Handler {
+	if b.limit.MaxInFlight == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		err := b.Maybe(r.Context(), func() {
+			if wait := time.Since(start); wait > time.Millisecond {
+				AnnotateAccessLog(r.Context(), "queued", wait.Round(time.Millisecond).String())
+			}
+			h.ServeHTTP(w, r)
+		})
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrRequestQueueFull):
+			AnnotateAccessLog(r.Context(), "queue", "full")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil:
+			AnnotateAccessLog(r.Context(), "queue", "timeout")
+			http.Error(w, fmt.Sprintf("timed out after %s waiting for a free slot", b.limit.QueueTimeout), http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// BreakerSet holds the Breaker of each upstream across config reloads, so
+// requests in flight on the old config still count against the limit.
+type BreakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+// Get returns the Breaker of the named upstream, or a new one when there's
+// none or the limit changed: requests in flight on the old one aren't
+// counted by it. New Breakers are only kept once passed to Set, so a
+// rejected config leaves the set untouched.
+func (s *BreakerSet) Get(name string, limit ConcurrencyLimit) *Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b := s.breakers[name]; b != nil && b.limit == limit {
+		return b
+	}
+	return NewBreaker(name, limit)
+}
+
+// Set replaces the Breakers, by upstream name.
+func (s *BreakerSet) Set(breakers map[string]*Breaker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.breakers = breakers
+}
+
+// List returns the Breakers ordered by upstream name.
+func (s *BreakerSet) List() []*Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*Breaker, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// WriteMetrics implements MetricsSource.
+func (s *BreakerSet) WriteMetrics(w io.Writer) {
+	for _, b := range s.List() {
+		b.WriteMetrics(w)
+	}
+}
@@ -0,0 +1,161 @@
+package rep
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or a few seconds passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestBreakerFIFO(t *testing.T) {
+	b := NewBreaker("echo", ConcurrencyLimit{MaxInFlight: 1, QueueDepth: 5})
+	hold := make(chan struct{})
+	go b.Maybe(context.Background(), func() { <-hold })
+	waitFor(t, "the first call", func() bool { return b.Stats().InFlight == 1 })
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Maybe(context.Background(), func() {
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+			})
+		}()
+		waitFor(t, "the call to queue", func() bool { return b.Stats().Queued == i+1 })
+	}
+
+	if err := b.Maybe(context.Background(), func() {}); !errors.Is(err, ErrRequestQueueFull) {
+		t.Errorf("Maybe() = %v with a full queue, want %v", err, ErrRequestQueueFull)
+	}
+	close(hold)
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("calls ran in order %v, want FIFO", order)
+		}
+	}
+	if s := b.Stats(); s.InFlight != 0 || s.Queued != 0 || s.Admitted != 6 || s.Rejected != 1 {
+		t.Errorf("Stats() = %+v after draining", s)
+	}
+}
+
+func TestBreakerAbandonedWaiters(t *testing.T) {
+	b := NewBreaker("echo", ConcurrencyLimit{MaxInFlight: 1, QueueDepth: 2, QueueTimeout: Duration{50 * time.Millisecond}})
+	hold := make(chan struct{})
+	go b.Maybe(context.Background(), func() { <-hold })
+	waitFor(t, "the first call", func() bool { return b.Stats().InFlight == 1 })
+
+	if err := b.Maybe(context.Background(), func() {}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Maybe() = %v, want the queue timeout", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.Maybe(ctx, func() {}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Maybe() = %v, want %v", err, context.Canceled)
+	}
+	close(hold)
+	waitFor(t, "the first call to end", func() bool { return b.Stats().InFlight == 0 })
+
+	// Abandoned waiters must not hold slots.
+	ran := false
+	if err := b.Maybe(context.Background(), func() { ran = true }); err != nil || !ran {
+		t.Errorf("Maybe() = %v, ran %v on an idle breaker", err, ran)
+	}
+	if s := b.Stats(); s.TimedOut != 1 || s.Queued != 0 || s.Admitted != 2 {
+		t.Errorf("Stats() = %+v", s)
+	}
+}
+
+func TestConcurrencyHandler(t *testing.T) {
+	release := make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			<-release
+		}
+	})
+	b := NewBreaker("echo", ConcurrencyLimit{MaxInFlight: 1, QueueDepth: 1, QueueTimeout: Duration{100 * time.Millisecond}})
+	h := NewConcurrencyHandler(upstream, b)
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	held := make(chan int)
+	go func() { held <- serve("/hold") }()
+	waitFor(t, "the held request", func() bool { return b.Stats().InFlight == 1 })
+
+	queued := make(chan int)
+	go func() { queued <- serve("/") }()
+	waitFor(t, "the queued request", func() bool { return b.Stats().Queued == 1 })
+	if code := serve("/"); code != http.StatusServiceUnavailable {
+		t.Errorf("status with a full queue = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := <-queued; code != http.StatusServiceUnavailable {
+		t.Errorf("status after the queue timeout = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	var metrics strings.Builder
+	b.WriteMetrics(&metrics)
+	for _, want := range []string{
+		`rp_upstream_requests_in_flight{upstream="echo"} 1`,
+		`rp_upstream_queue_depth{upstream="echo"} 0`,
+		`rp_upstream_requests_rejected_total{upstream="echo"} 1`,
+		`rp_upstream_queue_timeouts_total{upstream="echo"} 1`,
+	} {
+		if !strings.Contains(metrics.String(), want+"\n") {
+			t.Errorf("metrics lack %q:\n%s", want, metrics.String())
+		}
+	}
+
+	close(release)
+	if code := <-held; code != http.StatusOK {
+		t.Errorf("held request status = %d, want %d", code, http.StatusOK)
+	}
+	if code := serve("/"); code != http.StatusOK {
+		t.Errorf("status once idle = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestBreakerSet(t *testing.T) {
+	s := &BreakerSet{}
+	limit := ConcurrencyLimit{MaxInFlight: 1}
+	a := s.Get("a", limit)
+	if list := s.List(); len(list) != 0 {
+		t.Errorf("List() before Set() = %v, want none", list)
+	}
+	s.Set(map[string]*Breaker{"a": a})
+	if got := s.Get("a", limit); got != a {
+		t.Error("Get() with the same limit returned a new Breaker")
+	}
+	if got := s.Get("a", ConcurrencyLimit{MaxInFlight: 2}); got == a {
+		t.Error("Get() with a new limit returned the old Breaker")
+	}
+	if list := s.List(); len(list) != 1 || list[0] != a {
+		t.Errorf("List() after Get() with a new limit = %v, want the old Breaker", list)
+	}
+	s.Set(map[string]*Breaker{"b": s.Get("b", limit)})
+	if list := s.List(); len(list) != 1 || list[0].name != "b" {
+		t.Errorf("List() after Set() = %v, want b only", list)
+	}
+}
@@ -0,0 +1,83 @@
+package rep
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the declarative proxy configuration, usually read from YAML.
+type Config struct {
+	Timeouts TimeoutConfig `json:"timeouts,omitempty"`
+	Headers  HeaderRules   `json:"headers,omitempty"`
+	// Upstreams and Routes replace the single upstream of the proxy.
+	Upstreams []UpstreamConfig `json:"upstreams,omitempty"`
+	Routes    []Route          `json:"routes,omitempty"`
+	// RateLimits apply before requests are routed.
+	RateLimits RateLimitConfig `json:"rateLimits,omitempty"`
+}
+
+// LoadConfig reads and validates the YAML config at path.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	return ParseConfig(b)
+}
+
+// ParseConfig parses and validates a YAML config. Unknown fields are errors.
+func ParseConfig(b []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Validate checks the config for values the proxy can't apply.
+func (c *Config) Validate() error {
+	if err := c.Timeouts.Validate(); err != nil {
+		return fmt.Errorf("timeouts: %w", err)
+	}
+	if err := c.Headers.Validate(); err != nil {
+		return fmt.Errorf("headers: %w", err)
+	}
+	if err := ValidateRoutes(c.Routes, c.Upstreams); err != nil {
+		return fmt.Errorf("routes: %w", err)
+	}
+	if err := c.RateLimits.Validate(); err != nil {
+		return fmt.Errorf("rateLimits: %w", err)
+	}
+	return nil
+}
+
+// Duration is a time.Duration written as a Go duration string, e.g. "1m30s".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
@@ -0,0 +1,419 @@
+package rep
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSTimeout    = 5 * time.Second
+	defaultDNSMinRefresh = time.Second
+	defaultDNSMaxRefresh = 5 * time.Minute
+)
+
+// DNSDiscovery names the DNS records the endpoints of an upstream are
+// resolved from, again as their TTLs expire.
+type DNSDiscovery struct {
+	// Name is resolved to its A and AAAA records, listening on Port, or to
+	// its SRV records, e.g. _http._tcp.app.example.com, with SRV set.
+	Name string `json:"name"`
+	Port int    `json:"port,omitempty"`
+	SRV  bool   `json:"srv,omitempty"`
+	// MinRefresh and MaxRefresh bound the time until the name is resolved
+	// again, the lowest TTL of its records. 1s and 5m when zero.
+	MinRefresh Duration `json:"minRefresh,omitempty"`
+	MaxRefresh Duration `json:"maxRefresh,omitempty"`
+}
+
+// Validate checks that a name and, unless SRV records give them, a port are
+// set.
+func (d *DNSDiscovery) Validate() error {
+	if d.Name == "" {
+		return errors.New("dns discovery without a name")
+	}
+	switch {
+	case d.SRV && d.Port != 0:
+		return errors.New("dns discovery: SRV records give the port, got port too")
+	case !d.SRV && (d.Port <= 0 || d.Port > 65535):
+		return fmt.Errorf("dns discovery: invalid port %d", d.Port)
+	}
+	if d.MinRefresh.Duration < 0 || d.MaxRefresh.Duration < 0 {
+		return errors.New("dns discovery: refresh bounds must not be negative")
+	}
+	if d.MaxRefresh.Duration > 0 && d.MinRefresh.Duration > d.MaxRefresh.Duration {
+		return fmt.Errorf("dns discovery: minRefresh %s is above maxRefresh %s", d.MinRefresh.Duration, d.MaxRefresh.Duration)
+	}
+	return nil
+}
+
+// refresh clamps ttl between the refresh bounds.
+func (d DNSDiscovery) refresh(ttl time.Duration) time.Duration {
+	minRefresh, maxRefresh := d.MinRefresh.Duration, d.MaxRefresh.Duration
+	if minRefresh == 0 {
+		minRefresh = defaultDNSMinRefresh
+		if maxRefresh > 0 {
+			minRefresh = min(minRefresh, maxRefresh)
+		}
+	}
+	if maxRefresh == 0 {
+		maxRefresh = max(defaultDNSMaxRefresh, minRefresh)
+	}
+	return min(max(ttl, minRefresh), maxRefresh)
+}
+
+// DefaultDNSServer returns the first nameserver of /etc/resolv.conf, or the
+// local one.
+func DefaultDNSServer() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			// Zones of link-local addresses aren't supported by dialing.
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// DNSResolver queries a DNS server directly, unlike net.Resolver, to know
+// for how long the records it returns are valid. Queries go over UDP, and
+// TCP when the response is truncated.
+type DNSResolver struct {
+	// Server is the host:port of the DNS server, usually a recursive one.
+	Server string
+	// Timeout bounds each query, 5s when zero.
+	Timeout time.Duration
+}
+
+// LookupHost returns the addresses of the A and AAAA records of name, and
+// the lowest TTL of the records. A name without records has no addresses,
+// for the negative caching TTL of its zone.
+func (r *DNSResolver) LookupHost(ctx context.Context, name string) ([]string, time.Duration, error) {
+	var addrs []string
+	ttl := time.Duration(-1)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, err := r.query(ctx, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Answers include the CNAMEs name is an alias through.
+		for _, rr := range msg.Answers {
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, net.IP(body.A[:]).String())
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, net.IP(body.AAAA[:]).String())
+			}
+			ttl = minTTL(ttl, rr.Header.TTL)
+		}
+		if len(msg.Answers) == 0 {
+			ttl = minTTL(ttl, negativeTTL(msg))
+		}
+	}
+	return uniqueSorted(addrs), max(ttl, 0), nil
+}
+
+// LookupSRV returns the SRV records of name, and their lowest TTL.
+func (r *DNSResolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	msg, err := r.query(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var srvs []*net.SRV
+	ttl := time.Duration(-1)
+	for _, rr := range msg.Answers {
+		if body, ok := rr.Body.(*dnsmessage.SRVResource); ok {
+			srvs = append(srvs, &net.SRV{
+				Target:   body.Target.String(),
+				Port:     body.Port,
+				Priority: body.Priority,
+				Weight:   body.Weight,
+			})
+		}
+		ttl = minTTL(ttl, rr.Header.TTL)
+	}
+	if len(msg.Answers) == 0 {
+		ttl = minTTL(ttl, negativeTTL(msg))
+	}
+	return srvs, max(ttl, 0), nil
+}
+
+func minTTL(ttl time.Duration, seconds uint32) time.Duration {
+	d := time.Duration(seconds) * time.Second
+	if ttl < 0 || d < ttl {
+		return d
+	}
+	return ttl
+}
+
+// negativeTTL returns how long the absence of records is cached, from the
+// SOA record of the zone, RFC 2308.
+func negativeTTL(msg *dnsmessage.Message) uint32 {
+	for _, rr := range msg.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return min(rr.Header.TTL, soa.MinTTL)
+		}
+	}
+	return 0
+}
+
+func (r *DNSResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS name %s: %w", name, err)
+	}
+	question := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	msg, err := r.exchange(ctx, "udp", b, req.Header.ID, question)
+	if err == nil && msg.Truncated {
+		msg, err = r.exchange(ctx, "tcp", b, req.Header.ID, question)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s %s: %w", qtype, name, err)
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		return msg, nil
+	}
+	return nil, fmt.Errorf("failed to resolve %s %s: %s", qtype, name, msg.RCode)
+}
+
+func (r *DNSResolver) exchange(ctx context.Context, network string, req []byte, id uint16, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, r.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
+	if network == "tcp" {
+		b := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(req)), uint16(len(req)))
+		if _, err := c.Write(append(b, req...)); err != nil {
+			return nil, err
+		}
+		var n [2]byte
+		if _, err := io.ReadFull(c, n[:]); err != nil {
+			return nil, err
+		}
+		b = make([]byte, binary.BigEndian.Uint16(n[:]))
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, err
+		}
+		return parseDNSResponse(b, id, question)
+	}
+
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 65535)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		// Responses to someone else, e.g. to an earlier query that timed
+		// out, are skipped.
+		if msg, err := parseDNSResponse(b[:n], id, question); err == nil {
+			return msg, nil
+		}
+	}
+}
+
+func parseDNSResponse(b []byte, id uint16, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(b); err != nil {
+		return nil, err
+	}
+	if !msg.Response || msg.ID != id || len(msg.Questions) != 1 ||
+		msg.Questions[0].Type != question.Type || !strings.EqualFold(msg.Questions[0].Name.String(), question.Name.String()) {
+		return nil, errors.New("mismatched DNS response")
+	}
+	return &msg, nil
+}
+
+// DNSWatcher keeps the endpoints of a balancer in sync with DNS records,
+// resolving them again when their TTL expires. Endpoints are kept while
+// resolving fails, but a name without records has none.
+type DNSWatcher struct {
+	balancer  *EndpointBalancer
+	resolver  *DNSResolver
+	discovery DNSDiscovery
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewDNSWatcher returns a watcher of the records of d, queried through
+// resolver. It does nothing until started.
+func NewDNSWatcher(resolver *DNSResolver, d DNSDiscovery) *DNSWatcher {
+	return &DNSWatcher{
+		balancer:  NewEndpointBalancer(nil),
+		resolver:  resolver,
+		discovery: d,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Balancer returns the balancer over the resolved endpoints.
+func (w *DNSWatcher) Balancer() *EndpointBalancer {
+	return w.balancer
+}
+
+// Start resolves the endpoints, and again until Stop is called.
+func (w *DNSWatcher) Start() error {
+	ttl, err := w.update()
+	if err != nil {
+		return err
+	}
+	go w.run(w.discovery.refresh(ttl))
+	return nil
+}
+
+// Stop stops resolving the endpoints.
+func (w *DNSWatcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+func (w *DNSWatcher) run(refresh time.Duration) {
+	timer := time.NewTimer(refresh)
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-timer.C:
+		}
+		ttl, err := w.update()
+		if err != nil {
+			// Retried sooner than records would be, the endpoints may be
+			// stale.
+			logf(LogError, "%v", err)
+			ttl = 0
+		}
+		timer.Reset(w.discovery.refresh(ttl))
+	}
+}
+
+// update resolves the endpoints and replaces the ones of the balancer if
+// they changed. It returns the lowest TTL of the records.
+func (w *DNSWatcher) update() (time.Duration, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	endpoints, ttl, err := w.resolve(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if old := w.balancer.Endpoints(); !slices.Equal(old, endpoints) {
+		var added, removed []string
+		for _, ep := range endpoints {
+			if !slices.Contains(old, ep) {
+				added = append(added, ep)
+			}
+		}
+		for _, ep := range old {
+			if !slices.Contains(endpoints, ep) {
+				removed = append(removed, ep)
+			}
+		}
+		logf(LogInfo, "Endpoints of %s changed, added %v, removed %v", w.discovery.Name, added, removed)
+		w.balancer.SetEndpoints(endpoints)
+	}
+	return ttl, nil
+}
+
+// resolve returns the sorted endpoints of the records, and their lowest TTL.
+func (w *DNSWatcher) resolve(ctx context.Context) ([]string, time.Duration, error) {
+	var endpoints []string
+	if !w.discovery.SRV {
+		addrs, ttl, err := w.resolver.LookupHost(ctx, w.discovery.Name)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, addr := range addrs {
+			endpoints = append(endpoints, net.JoinHostPort(addr, strconv.Itoa(w.discovery.Port)))
+		}
+		return nonNil(endpoints), ttl, nil
+	}
+
+	srvs, ttl, err := w.resolver.LookupSRV(ctx, w.discovery.Name)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Only the targets of the lowest priority are used, round robin
+	// whatever their weight.
+	var priority uint16
+	for i, srv := range srvs {
+		if i == 0 || srv.Priority < priority {
+			priority = srv.Priority
+		}
+	}
+	for _, srv := range srvs {
+		if srv.Priority != priority {
+			continue
+		}
+		addrs, targetTTL, err := w.resolver.LookupHost(ctx, srv.Target)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = min(ttl, targetTTL)
+		for _, addr := range addrs {
+			endpoints = append(endpoints, net.JoinHostPort(addr, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	return nonNil(uniqueSorted(endpoints)), ttl, nil
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,465 @@
+package rep
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsStub is an in-process DNS server answering from records the test
+// changes, over UDP and TCP on the same port.
+type dnsStub struct {
+	addr    string
+	udp     net.PacketConn
+	tcp     net.Listener
+	queries atomic.Int32
+
+	mu      sync.Mutex
+	records map[string][]dnsmessage.Resource
+	rcode   dnsmessage.RCode
+	// truncate answers UDP queries truncated, for the client to retry over
+	// TCP.
+	truncate bool
+}
+
+func newDNSStub(t *testing.T) *dnsStub {
+	t.Helper()
+	s := &dnsStub{records: map[string][]dnsmessage.Resource{}}
+	// Listeners whose port is taken for UDP are kept open until one isn't,
+	// not to get the same port again.
+	var taken []net.Listener
+	defer func() {
+		for _, ln := range taken {
+			ln.Close()
+		}
+	}()
+	for s.udp == nil {
+		tcp, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		udp, err := net.ListenPacket("udp", tcp.Addr().String())
+		if err != nil {
+			if len(taken) == 10 {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			taken = append(taken, tcp)
+			continue
+		}
+		s.udp, s.tcp, s.addr = udp, tcp, tcp.Addr().String()
+	}
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *dnsStub) resolver() *DNSResolver {
+	return &DNSResolver{Server: s.addr, Timeout: time.Second}
+}
+
+// set replaces the records of name.
+func (s *dnsStub) set(name string, records ...dnsmessage.Resource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range records {
+		records[i].Header.Name = dnsmessage.MustNewName(name)
+		records[i].Header.Class = dnsmessage.ClassINET
+	}
+	s.records[name] = records
+}
+
+func aRecord(ip string, ttl uint32) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: ttl}, Body: &dnsmessage.AResource{A: a}}
+}
+
+func aaaaRecord(ip string, ttl uint32) dnsmessage.Resource {
+	var a [16]byte
+	copy(a[:], net.ParseIP(ip))
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeAAAA, TTL: ttl}, Body: &dnsmessage.AAAAResource{AAAA: a}}
+}
+
+func srvRecord(target string, port, priority uint16, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeSRV, TTL: ttl},
+		Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port, Priority: priority},
+	}
+}
+
+func (s *dnsStub) answer(req []byte, udp bool) []byte {
+	s.queries.Add(1)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(req); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	msg.Response = true
+	s.mu.Lock()
+	msg.RCode = s.rcode
+	records, ok := s.records[q.Name.String()]
+	if !ok && msg.RCode == dnsmessage.RCodeSuccess {
+		msg.RCode = dnsmessage.RCodeNameError
+	}
+	switch {
+	case udp && s.truncate:
+		msg.Truncated = true
+	case msg.RCode == dnsmessage.RCodeSuccess:
+		for _, rr := range records {
+			if rr.Header.Type == q.Type {
+				msg.Answers = append(msg.Answers, rr)
+			}
+		}
+	}
+	s.mu.Unlock()
+	if len(msg.Answers) == 0 && msg.RCode != dnsmessage.RCodeServerFailure {
+		msg.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.example.com."),
+				MBox:   dnsmessage.MustNewName("admin.example.com."),
+				MinTTL: 30,
+			},
+		}}
+	}
+	b, _ := msg.Pack()
+	return b
+}
+
+func (s *dnsStub) serveUDP() {
+	b := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(b[:n], true); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *dnsStub) serveTCP() {
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			var n [2]byte
+			if _, err := io.ReadFull(c, n[:]); err != nil {
+				return
+			}
+			req := make([]byte, binary.BigEndian.Uint16(n[:]))
+			if _, err := io.ReadFull(c, req); err != nil {
+				return
+			}
+			resp := s.answer(req, false)
+			c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+		}()
+	}
+}
+
+func TestDNSResolver(t *testing.T) {
+	stub := newDNSStub(t)
+	stub.set("app.example.com.", aRecord("10.0.0.2", 30), aRecord("10.0.0.1", 10), aaaaRecord("fd00::1", 20))
+	stub.set("_http._tcp.app.example.com.", srvRecord("a.example.com.", 8080, 0, 15), srvRecord("b.example.com.", 8081, 1, 5))
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		truncate bool
+		rcode    dnsmessage.RCode
+		lookup   string
+		want     []string
+		wantTTL  time.Duration
+		wantErr  string
+	}{{
+		name:    "a and aaaa",
+		lookup:  "app.example.com",
+		want:    []string{"10.0.0.1", "10.0.0.2", "fd00::1"},
+		wantTTL: 10 * time.Second,
+	}, {
+		name:     "truncated over tcp",
+		truncate: true,
+		lookup:   "app.example.com.",
+		want:     []string{"10.0.0.1", "10.0.0.2", "fd00::1"},
+		wantTTL:  10 * time.Second,
+	}, {
+		name:    "nxdomain",
+		lookup:  "gone.example.com",
+		want:    nil,
+		wantTTL: 30 * time.Second,
+	}, {
+		name:    "server failure",
+		rcode:   dnsmessage.RCodeServerFailure,
+		lookup:  "app.example.com",
+		wantErr: "failed to resolve TypeA app.example.com.: RCodeServerFailure",
+	}, {
+		name:    "srv",
+		lookup:  "srv",
+		want:    []string{"a.example.com.:8080/0", "b.example.com.:8081/1"},
+		wantTTL: 5 * time.Second,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub.mu.Lock()
+			stub.truncate, stub.rcode = test.truncate, test.rcode
+			stub.mu.Unlock()
+
+			var got []string
+			var ttl time.Duration
+			var err error
+			if test.lookup == "srv" {
+				var srvs []*net.SRV
+				srvs, ttl, err = stub.resolver().LookupSRV(ctx, "_http._tcp.app.example.com")
+				for _, srv := range srvs {
+					got = append(got, srv.Target+":"+strconv.Itoa(int(srv.Port))+"/"+strconv.Itoa(int(srv.Priority)))
+				}
+			} else {
+				got, ttl, err = stub.resolver().LookupHost(ctx, test.lookup)
+			}
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("lookup error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookup = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) || ttl != test.wantTTL {
+				t.Errorf("lookup = %v, %s, want %v, %s", got, ttl, test.want, test.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDNSDiscoveryRefresh(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		ttl      time.Duration
+		want     time.Duration
+	}{
+		{name: "ttl", ttl: 30 * time.Second, want: 30 * time.Second},
+		{name: "zero ttl", ttl: 0, want: time.Second},
+		{name: "long ttl", ttl: 24 * time.Hour, want: 5 * time.Minute},
+		{name: "min", min: 10 * time.Second, ttl: time.Second, want: 10 * time.Second},
+		{name: "max", max: 10 * time.Second, ttl: time.Minute, want: 10 * time.Second},
+		{name: "max below default min", max: 100 * time.Millisecond, ttl: 0, want: 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := DNSDiscovery{MinRefresh: Duration{Duration: test.min}, MaxRefresh: Duration{Duration: test.max}}
+			if got := d.refresh(test.ttl); got != test.want {
+				t.Errorf("refresh(%s) = %s, want %s", test.ttl, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDNSWatcher(t *testing.T) {
+	stub := newDNSStub(t)
+	stub.set("app.example.com.", aRecord("10.0.0.1", 0), aRecord("10.0.0.2", 0))
+
+	w := NewDNSWatcher(stub.resolver(), DNSDiscovery{
+		Name:       "app.example.com",
+		Port:       8080,
+		MinRefresh: Duration{Duration: 10 * time.Millisecond},
+	})
+	// Every transport of the upstreams sharing the watcher drains.
+	var mu sync.Mutex
+	var removed [2][]string
+	onRemoved := func(i int) func([]string) {
+		return func(eps []string) {
+			mu.Lock()
+			defer mu.Unlock()
+			removed[i] = append(removed[i], eps...)
+		}
+	}
+	w.Balancer().OnRemoved(onRemoved(0), onRemoved(1))
+	if err := w.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	defer w.Stop()
+	if got, want := w.Balancer().Endpoints(), []string{"10.0.0.1:8080", "10.0.0.2:8080"}; !slices.Equal(got, want) {
+		t.Fatalf("Endpoints() = %v, want %v", got, want)
+	}
+	waitForEndpoints := func(what string, want ...string) {
+		t.Helper()
+		waitFor(t, what, func() bool { return slices.Equal(w.Balancer().Endpoints(), want) })
+	}
+
+	stub.set("app.example.com.", aRecord("10.0.0.2", 0), aRecord("10.0.0.3", 0))
+	waitForEndpoints("the changed records", "10.0.0.2:8080", "10.0.0.3:8080")
+	mu.Lock()
+	for i := range removed {
+		if want := []string{"10.0.0.1:8080"}; !slices.Equal(removed[i], want) {
+			t.Errorf("removed[%d] = %v, want %v", i, removed[i], want)
+		}
+	}
+	mu.Unlock()
+
+	// Failures keep the endpoints.
+	stub.mu.Lock()
+	stub.rcode = dnsmessage.RCodeServerFailure
+	stub.mu.Unlock()
+	queries := stub.queries.Load()
+	waitFor(t, "queries failing", func() bool { return stub.queries.Load() > queries+2 })
+	waitForEndpoints("the endpoints resolved last", "10.0.0.2:8080", "10.0.0.3:8080")
+	stub.mu.Lock()
+	stub.rcode = dnsmessage.RCodeSuccess
+	stub.mu.Unlock()
+
+	// A removed name has no endpoints.
+	stub.mu.Lock()
+	delete(stub.records, "app.example.com.")
+	stub.mu.Unlock()
+	waitForEndpoints("no endpoints")
+
+	// Records are cached for their TTL.
+	stub.set("app.example.com.", aRecord("10.0.0.4", 3600))
+	w2 := NewDNSWatcher(stub.resolver(), DNSDiscovery{Name: "app.example.com", Port: 80, MinRefresh: Duration{Duration: 10 * time.Millisecond}})
+	if err := w2.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	defer w2.Stop()
+	queries = stub.queries.Load()
+	time.Sleep(100 * time.Millisecond)
+	if got := stub.queries.Load(); got != queries {
+		t.Errorf("%d queries before the TTL expired", got-queries)
+	}
+}
+
+func TestDNSWatcherSRV(t *testing.T) {
+	stub := newDNSStub(t)
+	stub.set("_http._tcp.app.example.com.",
+		srvRecord("a.example.com.", 8080, 0, 60),
+		srvRecord("b.example.com.", 8081, 0, 60),
+		srvRecord("backup.example.com.", 9090, 1, 60))
+	stub.set("a.example.com.", aRecord("10.0.0.1", 60))
+	stub.set("b.example.com.", aRecord("10.0.0.2", 60), aaaaRecord("fd00::2", 60))
+	stub.set("backup.example.com.", aRecord("10.0.1.1", 60))
+
+	w := NewDNSWatcher(stub.resolver(), DNSDiscovery{Name: "_http._tcp.app.example.com", SRV: true})
+	if err := w.Start(); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	defer w.Stop()
+	if got, want := w.Balancer().Endpoints(), []string{"10.0.0.1:8080", "10.0.0.2:8081", "[fd00::2]:8081"}; !slices.Equal(got, want) {
+		t.Errorf("Endpoints() = %v, want %v", got, want)
+	}
+
+	stub.mu.Lock()
+	stub.rcode = dnsmessage.RCodeRefused
+	stub.mu.Unlock()
+	w2 := NewDNSWatcher(stub.resolver(), DNSDiscovery{Name: "_http._tcp.app.example.com", SRV: true})
+	if err := w2.Start(); err == nil || !strings.Contains(err.Error(), "RCodeRefused") {
+		t.Errorf("Start() = %v, want a refused error", err)
+	}
+}
+
+// TestDNSWatcherDrain checks the connections to a removed address are
+// closed, once idle, without failing the requests in flight.
+func TestDNSWatcherDrain(t *testing.T) {
+	release := make(chan struct{})
+	var closed sync.Map
+	backend := func() *httptest.Server {
+		s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-release
+			}
+			io.WriteString(w, "ok")
+		}))
+		s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				closed.Store(c.LocalAddr().String(), true)
+			}
+		}
+		s.Start()
+		t.Cleanup(s.Close)
+		return s
+	}
+	// Both listen on 127.0.0.1, the endpoints differ by port.
+	removedBackend, keptBackend := backend(), backend()
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	// Before the backends close, which waits for the requests.
+	t.Cleanup(unblock)
+	_, removedPort, _ := net.SplitHostPort(removedBackend.Listener.Addr().String())
+	_, keptPort, _ := net.SplitHostPort(keptBackend.Listener.Addr().String())
+
+	transport := NewProtocolTransport(UpstreamHTTP1)
+	transport.TrackEndpoints()
+	balancer := NewEndpointBalancer([]string{"127.0.0.1:" + removedPort, "127.0.0.1:" + keptPort})
+	balancer.OnRemoved(transport.DrainEndpoints)
+	target, _ := url.Parse("http://app.example.com")
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	proxy.Director = balancer.Director(proxy.Director)
+	h := balancer.Handler(proxy)
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return strconv.Itoa(rec.Code) + " " + rec.Body.String()
+	}
+
+	// A request in flight to the first endpoint, then an idle connection to
+	// each.
+	slow := make(chan string)
+	go func() { slow <- get("/slow") }()
+	waitFor(t, "the slow request", func() bool { return transport.conns.count("127.0.0.1:"+removedPort) == 1 })
+	for i := 0; i < 2; i++ {
+		if got := get("/"); got != "200 ok" {
+			t.Fatalf("get() = %q", got)
+		}
+	}
+	if n := transport.conns.count("127.0.0.1:" + removedPort); n != 2 {
+		t.Fatalf("%d connections to the removed endpoint, want 2", n)
+	}
+	removedAddr := removedBackend.Listener.Addr().String()
+
+	balancer.SetEndpoints([]string{"127.0.0.1:" + keptPort})
+	waitFor(t, "the idle connection closed", func() bool { return transport.conns.count("127.0.0.1:"+removedPort) == 1 })
+	if _, ok := closed.Load(keptBackend.Listener.Addr().String()); ok {
+		t.Error("the connection to the kept endpoint was closed")
+	}
+
+	unblock()
+	if got := <-slow; got != "200 ok" {
+		t.Errorf("the request in flight got %q", got)
+	}
+	waitFor(t, "the drained connection closed", func() bool { return transport.conns.count("127.0.0.1:"+removedPort) == 0 })
+	waitFor(t, "the backend to see the connections closed", func() bool {
+		_, ok := closed.Load(removedAddr)
+		return ok
+	})
+	if got := get("/"); got != "200 ok" {
+		t.Errorf("get() = %q after the drain", got)
+	}
+	if n := transport.conns.count("127.0.0.1:" + keptPort); n != 1 {
+		t.Errorf("%d connections to the kept endpoint, want 1", n)
+	}
+}
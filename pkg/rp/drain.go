@@ -0,0 +1,148 @@
+package rep
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Drainer tracks in-flight requests so a server can shut down without
+// cutting them, in the order Knative's queue-proxy drains:
+//
+//  1. readiness fails, so load balancers stop sending new requests,
+//  2. for a drain delay requests are still served, HTTP/1 ones with
+//     Connection: close so clients stop reusing connections,
+//  3. listeners close, HTTP/2 clients get a GOAWAY and idle connections are
+//     closed,
+//  4. requests still in flight, including full-duplex streams and upgraded
+//     connections, finish up to a deadline, after which everything is closed.
+type Drainer struct {
+	mu       sync.Mutex
+	inFlight int
+	draining bool
+	// idle is closed once draining and no request is in flight.
+	idle chan struct{}
+}
+
+// NewDrainer returns a Drainer that isn't draining.
+func NewDrainer() *Drainer {
+	return &Drainer{idle: make(chan struct{})}
+}
+
+// Draining reports whether a drain started.
+func (d *Drainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// InFlight returns the number of requests being served.
+func (d *Drainer) InFlight() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.inFlight
+}
+
+// Handler counts the requests served by h.
+func (d *Drainer) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		d.inFlight++
+		draining := d.draining
+		d.mu.Unlock()
+		defer d.done()
+
+		if draining && r.ProtoMajor == 1 {
+			w.Header().Set("Connection", "close")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (d *Drainer) done() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inFlight--
+	if d.draining && d.inFlight == 0 {
+		d.closeIdle()
+	}
+}
+
+func (d *Drainer) closeIdle() {
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
+
+// ReadinessHandler answers 200 until a drain starts and 503 after.
+func (d *Drainer) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.Draining() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// HandlerWithReadiness serves the readiness endpoint on readinessPath and
+// counts the requests to every other path, served by h.
+func (d *Drainer) HandlerWithReadiness(readinessPath string, h http.Handler) http.Handler {
+	readiness, counted := d.ReadinessHandler(), d.Handler(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readinessPath != "" && r.URL.Path == readinessPath {
+			readiness.ServeHTTP(w, r)
+			return
+		}
+		counted.ServeHTTP(w, r)
+	})
+}
+
+// StartDraining fails readiness and marks new HTTP/1 responses with
+// Connection: close.
+func (d *Drainer) StartDraining() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = true
+	if d.inFlight == 0 {
+		d.closeIdle()
+	}
+}
+
+// Drain starts draining, keeps serving for delay, then shuts the servers
+// down and waits for in-flight requests until ctx is done. On expiry the
+// servers are closed and the context error returned.
+func (d *Drainer) Drain(ctx context.Context, delay time.Duration, servers ...*http.Server) error {
+	d.StartDraining()
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv := srv
+		go func() { errs <- srv.Shutdown(ctx) }()
+	}
+	var err error
+	for range servers {
+		err = errors.Join(err, <-errs)
+	}
+	// Shutdown doesn't wait for hijacked connections, which serve h2c and
+	// upgraded requests.
+	select {
+	case <-d.idle:
+	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
+		for _, srv := range servers {
+			srv.Close()
+		}
+		return ctx.Err()
+	}
+	return err
+}
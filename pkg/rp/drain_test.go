@@ -0,0 +1,198 @@
+package rep
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newDrainServer serves h behind a Drainer on a NewServer listener, with the
+// readiness endpoint on /ready.
+func newDrainServer(t *testing.T, h http.Handler) (*Drainer, *Server, string) {
+	t.Helper()
+	d := NewDrainer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv, err := NewServer(ln.Addr().String(), d.HandlerWithReadiness("/ready", h), nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return d, srv, "http://" + ln.Addr().String()
+}
+
+func h2cClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func TestDrainerReadinessFailsFirst(t *testing.T) {
+	d, srv, url := newDrainServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	resp, err := http.Get(url + "/ready")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("readiness before draining = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	drained := make(chan error)
+	go func() { drained <- d.Drain(context.Background(), 300*time.Millisecond, srv.Server) }()
+	waitFor(t, "draining", d.Draining)
+
+	resp, err = http.Get(url + "/ready")
+	if err != nil {
+		t.Fatalf("Failed to probe readiness: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("readiness while draining = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	// Requests are still served during the delay, closing their connection.
+	resp, err = http.Get(url + "/")
+	if err != nil {
+		t.Fatalf("Request during the drain delay failed: %v", err)
+	}
+	resp.Body.Close()
+	if !resp.Close {
+		t.Error("response during the drain delay doesn't close the connection")
+	}
+
+	if err := <-drained; err != nil {
+		t.Errorf("Drain() = %v", err)
+	}
+	if _, err := http.Get(url + "/"); err == nil {
+		t.Error("request after the drain succeeded")
+	}
+}
+
+func TestDrainerWaitsForInFlightRequests(t *testing.T) {
+	// Echoes the body back as it arrives, full duplex, taking longer than the
+	// drain delay so requests are in flight when the server shuts down.
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		rc.EnableFullDuplex()
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				rc.Flush()
+				time.Sleep(20 * time.Millisecond)
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+	d, srv, url := newDrainServer(t, h)
+
+	// Clients behave like a load balancer: they stop sending new requests
+	// once readiness fails, requests already sent must complete.
+	var ready atomic.Bool
+	ready.Store(true)
+	stopProbing := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stopProbing:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			resp, err := http.Get(url + "/ready")
+			if err != nil || resp.StatusCode != http.StatusOK {
+				ready.Store(false)
+				return
+			}
+			resp.Body.Close()
+		}
+	}()
+	defer close(stopProbing)
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	var wg sync.WaitGroup
+	var served atomic.Int64
+	errs := make(chan error, 100)
+	for i := 0; i < 8; i++ {
+		client := http.DefaultClient
+		if i%2 == 1 {
+			client = h2cClient()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ready.Load() {
+				resp, err := client.Post(url+"/", "application/octet-stream", bytes.NewReader(body))
+				if err != nil {
+					errs <- err
+					return
+				}
+				got, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(got, body) {
+					errs <- errors.New("truncated response")
+					return
+				}
+				served.Add(1)
+			}
+		}()
+	}
+
+	waitFor(t, "requests to flow", func() bool { return served.Load() >= 8 })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := d.Drain(ctx, 200*time.Millisecond, srv.Server); err != nil {
+		t.Errorf("Drain() = %v", err)
+	}
+	if n := d.InFlight(); n != 0 {
+		t.Errorf("%d requests in flight after the drain", n)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Client saw an error during the drain: %v", err)
+	}
+}
+
+func TestDrainerDeadline(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	d, srv, url := newDrainServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		<-stuck
+	}))
+
+	resp, err := h2cClient().Get(url + "/")
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := d.Drain(ctx, 0, srv.Server); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Drain() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,218 @@
+package rep
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// endpointConns tracks the connections of a transport by endpoint, and the
+// requests using each of them, so the connections to removed endpoints can
+// be drained: closed once idle, without failing the requests in flight.
+type endpointConns struct {
+	mu    sync.Mutex
+	conns map[string]map[*endpointConn]struct{}
+	dials uint64
+	rate  dialRate
+	// retries counts the requests resent on another connection, h2Errors
+	// the HTTP/2 errors by type.
+	retries  uint64
+	h2Errors map[string]uint64
+}
+
+// endpointConn is a connection to an endpoint, with the requests using it,
+// more than one for HTTP/2.
+type endpointConn struct {
+	net.Conn
+	owner *endpointConns
+	addr  string
+
+	// Guarded by owner.mu.
+	inUse    int
+	draining bool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newEndpointConns() *endpointConns {
+	return &endpointConns{conns: map[string]map[*endpointConn]struct{}{}}
+}
+
+// dial wraps dial to track the connections it returns.
+func (ec *endpointConns) dial(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := &endpointConn{Conn: c, owner: ec, addr: addr}
+		ec.mu.Lock()
+		defer ec.mu.Unlock()
+		ec.dials++
+		ec.rate.add(time.Now())
+		if ec.conns[addr] == nil {
+			ec.conns[addr] = map[*endpointConn]struct{}{}
+		}
+		ec.conns[addr][conn] = struct{}{}
+		return conn, nil
+	}
+}
+
+// roundTrip sends r through rt, counting the connection it gets as in use
+// until the response body is closed.
+func (ec *endpointConns) roundTrip(rt http.RoundTripper, r *http.Request) (*http.Response, error) {
+	var mu sync.Mutex
+	var got *endpointConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c, ok := info.Conn.(*endpointConn)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// A request retried on another connection no longer uses the
+			// first one.
+			if got != nil {
+				ec.release(got)
+				ec.retried()
+			}
+			got = c
+			ec.acquire(c)
+		},
+	}
+	resp, err := rt.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	mu.Lock()
+	c := got
+	mu.Unlock()
+	switch {
+	case c == nil:
+	case err != nil:
+		ec.release(c)
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		// The connection is the upgraded stream's until closed.
+	default:
+		resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() { ec.release(c) }}
+	}
+	return resp, err
+}
+
+func (ec *endpointConns) acquire(c *endpointConn) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	c.inUse++
+}
+
+func (ec *endpointConns) release(c *endpointConn) {
+	ec.mu.Lock()
+	c.inUse--
+	closing := c.inUse == 0 && c.draining
+	ec.mu.Unlock()
+	if closing {
+		c.Close()
+	}
+}
+
+func (ec *endpointConns) retried() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	ec.retries++
+}
+
+// countError is the http2.Transport.CountError of the transports.
+func (ec *endpointConns) countError(errType string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.h2Errors == nil {
+		ec.h2Errors = map[string]uint64{}
+	}
+	ec.h2Errors[errType]++
+}
+
+// drain closes the idle connections to addrs, and the others once their
+// requests are done.
+func (ec *endpointConns) drain(addrs []string) {
+	var idle []*endpointConn
+	ec.mu.Lock()
+	for _, addr := range addrs {
+		for c := range ec.conns[addr] {
+			c.draining = true
+			if c.inUse == 0 {
+				idle = append(idle, c)
+			}
+		}
+	}
+	ec.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+}
+
+// stats returns the connections of every endpoint.
+func (ec *endpointConns) stats(now time.Time) PoolStats {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	s := PoolStats{Dials: ec.dials, DialsPerSecond: ec.rate.perSecond(now), Retries: ec.retries}
+	if len(ec.h2Errors) > 0 {
+		s.HTTP2Errors = make(map[string]uint64, len(ec.h2Errors))
+		for typ, n := range ec.h2Errors {
+			s.HTTP2Errors[typ] = n
+		}
+	}
+	for _, conns := range ec.conns {
+		for c := range conns {
+			s.Open++
+			s.Requests += c.inUse
+			if c.inUse > 0 {
+				s.InUse++
+			} else {
+				s.Idle++
+			}
+		}
+	}
+	return s
+}
+
+// count returns the number of open connections to addr.
+func (ec *endpointConns) count(addr string) int {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return len(ec.conns[addr])
+}
+
+func (c *endpointConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.owner.mu.Lock()
+		delete(c.owner.conns[c.addr], c)
+		if len(c.owner.conns[c.addr]) == 0 {
+			delete(c.owner.conns, c.addr)
+		}
+		c.owner.mu.Unlock()
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// CloseWrite half-closes the underlying connection if it supports it.
+func (c *endpointConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// releaseBody releases the connection of a response once its body is
+// closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
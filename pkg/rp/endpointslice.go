@@ -0,0 +1,192 @@
+package rep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// KubernetesDiscovery names the Service whose endpoints an upstream sends
+// requests to.
+type KubernetesDiscovery struct {
+	Service string `json:"service"`
+	// Namespace of the Service, "default" when empty.
+	Namespace string `json:"namespace,omitempty"`
+	// Port is the name of the Service port. The first port of every
+	// EndpointSlice is used when empty, e.g. for single port Services.
+	Port string `json:"port,omitempty"`
+}
+
+// Validate checks that a Service is named.
+func (d *KubernetesDiscovery) Validate() error {
+	if d.Service == "" {
+		return errors.New("kubernetes discovery without a service")
+	}
+	return nil
+}
+
+func (d KubernetesDiscovery) namespace() string {
+	if d.Namespace == "" {
+		return metav1.NamespaceDefault
+	}
+	return d.Namespace
+}
+
+// EndpointSliceWatcher keeps the endpoints of a balancer in sync with the
+// EndpointSlices of a Service, as pods come and go. Like the activator, it
+// only sends requests to ready endpoints, unless none is, in which case the
+// terminating endpoints still serving get them rather than failing every
+// request.
+type EndpointSliceWatcher struct {
+	balancer  *EndpointBalancer
+	discovery KubernetesDiscovery
+	factory   informers.SharedInformerFactory
+	lister    discoverylisters.EndpointSliceLister
+	synced    cache.InformerSynced
+	selector  labels.Selector
+
+	// mu serializes updates.
+	mu       sync.Mutex
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewEndpointSliceWatcher returns a watcher of the EndpointSlices of the
+// Service of d. It does nothing until started.
+func NewEndpointSliceWatcher(client kubernetes.Interface, d KubernetesDiscovery) *EndpointSliceWatcher {
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: d.Service})
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(d.namespace()),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = selector.String()
+		}))
+	informer := factory.Discovery().V1().EndpointSlices()
+	w := &EndpointSliceWatcher{
+		balancer:  NewEndpointBalancer(nil),
+		discovery: d,
+		factory:   factory,
+		lister:    informer.Lister(),
+		synced:    informer.Informer().HasSynced,
+		selector:  selector,
+		stop:      make(chan struct{}),
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(any) { w.update() },
+		UpdateFunc: func(any, any) { w.update() },
+		DeleteFunc: func(any) { w.update() },
+	})
+	return w
+}
+
+// Balancer returns the balancer over the endpoints of the Service.
+func (w *EndpointSliceWatcher) Balancer() *EndpointBalancer {
+	return w.balancer
+}
+
+// Start watches the EndpointSlices until Stop is called, waiting up to
+// timeout for the first list of endpoints.
+func (w *EndpointSliceWatcher) Start(timeout time.Duration) error {
+	w.factory.Start(w.stop)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), w.synced) {
+		return fmt.Errorf("timed out listing the EndpointSlices of %s/%s", w.discovery.namespace(), w.discovery.Service)
+	}
+	w.update()
+	return nil
+}
+
+// Stop stops watching the EndpointSlices.
+func (w *EndpointSliceWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		w.factory.Shutdown()
+	})
+}
+
+func (w *EndpointSliceWatcher) update() {
+	list, err := w.lister.EndpointSlices(w.discovery.namespace()).List(w.selector)
+	if err != nil {
+		logf(LogError, "Failed to list EndpointSlices of %s/%s: %v", w.discovery.namespace(), w.discovery.Service, err)
+		return
+	}
+	endpoints := sliceEndpoints(list, w.discovery.Port)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if old := w.balancer.Endpoints(); !slices.Equal(old, endpoints) {
+		logf(LogDebug, "Endpoints of %s/%s changed from %v to %v", w.discovery.namespace(), w.discovery.Service, old, endpoints)
+		w.balancer.SetEndpoints(endpoints)
+	}
+}
+
+// sliceEndpoints returns the sorted host:port of the ready endpoints of
+// list, or of the serving terminating ones if none is ready.
+func sliceEndpoints(list []*discoveryv1.EndpointSlice, portName string) []string {
+	var ready, terminating []string
+	for _, slice := range list {
+		port, ok := slicePort(slice, portName)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			c := ep.Conditions
+			// Unknown readiness means ready, unknown serving means the same
+			// as ready.
+			isReady := c.Ready == nil || *c.Ready
+			isServing := (c.Serving == nil && isReady) || (c.Serving != nil && *c.Serving)
+			isTerminating := c.Terminating != nil && *c.Terminating
+			for _, addr := range ep.Addresses {
+				hostPort := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+				switch {
+				case isReady && !isTerminating:
+					ready = append(ready, hostPort)
+				case isServing && isTerminating:
+					terminating = append(terminating, hostPort)
+				}
+			}
+		}
+	}
+	endpoints := ready
+	if len(endpoints) == 0 {
+		endpoints = terminating
+	}
+	// An endpoint moving between slices may briefly be in both.
+	endpoints = uniqueSorted(endpoints)
+	if endpoints == nil {
+		endpoints = []string{}
+	}
+	return endpoints
+}
+
+func slicePort(slice *discoveryv1.EndpointSlice, name string) (int32, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if name == "" || (p.Name != nil && *p.Name == name) {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
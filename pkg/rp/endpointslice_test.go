@@ -0,0 +1,197 @@
+package rep
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func ptrTo[T any](v T) *T {
+	return &v
+}
+
+func endpointSlice(name, service string, port int32, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "serving",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []discoveryv1.EndpointPort{{Name: ptrTo("http"), Port: ptrTo(port)}},
+	}
+}
+
+func endpoint(ip string, ready, serving, terminating bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses: []string{ip},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       ptrTo(ready),
+			Serving:     ptrTo(serving),
+			Terminating: ptrTo(terminating),
+		},
+	}
+}
+
+func TestSliceEndpoints(t *testing.T) {
+	multiPort := endpointSlice("multi", "app", 8080, endpoint("10.0.0.1", true, true, false))
+	multiPort.Ports = append(multiPort.Ports, discoveryv1.EndpointPort{Name: ptrTo("metrics"), Port: ptrTo(int32(9090))})
+
+	tests := []struct {
+		name   string
+		slices []*discoveryv1.EndpointSlice
+		port   string
+		want   []string
+	}{{
+		name: "ready only",
+		slices: []*discoveryv1.EndpointSlice{endpointSlice("a", "app", 80,
+			endpoint("10.0.0.2", true, true, false),
+			endpoint("10.0.0.1", true, true, false),
+			endpoint("10.0.0.3", false, false, false),
+			endpoint("10.0.0.4", false, true, true),
+		)},
+		want: []string{"10.0.0.1:80", "10.0.0.2:80"},
+	}, {
+		name: "terminating when none is ready",
+		slices: []*discoveryv1.EndpointSlice{endpointSlice("a", "app", 80,
+			endpoint("10.0.0.3", false, false, false),
+			endpoint("10.0.0.4", false, true, true),
+			endpoint("10.0.0.5", false, false, true),
+		)},
+		want: []string{"10.0.0.4:80"},
+	}, {
+		name:   "unknown conditions",
+		slices: []*discoveryv1.EndpointSlice{endpointSlice("a", "app", 80, discoveryv1.Endpoint{Addresses: []string{"10.0.0.1"}})},
+		want:   []string{"10.0.0.1:80"},
+	}, {
+		name: "across slices",
+		slices: []*discoveryv1.EndpointSlice{
+			endpointSlice("a", "app", 80, endpoint("10.0.0.1", true, true, false)),
+			endpointSlice("b", "app", 80, endpoint("10.0.0.2", true, true, false), endpoint("10.0.0.1", true, true, false)),
+		},
+		want: []string{"10.0.0.1:80", "10.0.0.2:80"},
+	}, {
+		name:   "named port",
+		slices: []*discoveryv1.EndpointSlice{multiPort},
+		port:   "metrics",
+		want:   []string{"10.0.0.1:9090"},
+	}, {
+		name:   "missing port",
+		slices: []*discoveryv1.EndpointSlice{multiPort},
+		port:   "grpc",
+		want:   []string{},
+	}, {
+		name: "none",
+		want: []string{},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := sliceEndpoints(test.slices, test.port); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("sliceEndpoints() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEndpointSliceWatcher(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(
+		endpointSlice("app-1", "app", 8080, endpoint("10.0.0.1", true, true, false)),
+		endpointSlice("other-1", "other", 8080, endpoint("10.0.1.1", true, true, false)),
+	)
+	sliceClient := client.DiscoveryV1().EndpointSlices("serving")
+
+	w := NewEndpointSliceWatcher(client, KubernetesDiscovery{Service: "app", Namespace: "serving", Port: "http"})
+	if err := w.Start(5 * time.Second); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	defer w.Stop()
+	waitForEndpoints := func(what string, want ...string) {
+		t.Helper()
+		waitFor(t, what, func() bool { return slices.Equal(w.Balancer().Endpoints(), want) })
+	}
+	waitForEndpoints("the initial endpoints", "10.0.0.1:8080")
+
+	// A pod scaled up is only used once ready.
+	second := endpointSlice("app-2", "app", 8080, endpoint("10.0.0.2", false, false, false))
+	if _, err := sliceClient.Create(ctx, second, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create slice: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	waitForEndpoints("the pod not ready to be left out", "10.0.0.1:8080")
+	second.Endpoints[0] = endpoint("10.0.0.2", true, true, false)
+	if _, err := sliceClient.Update(ctx, second, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update slice: %v", err)
+	}
+	waitForEndpoints("the ready pod", "10.0.0.1:8080", "10.0.0.2:8080")
+
+	// A terminating pod stops getting requests.
+	if err := sliceClient.Delete(ctx, "app-1", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete slice: %v", err)
+	}
+	second.Endpoints[0] = endpoint("10.0.0.2", false, true, true)
+	if _, err := sliceClient.Update(ctx, second, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update slice: %v", err)
+	}
+	// Unless no other is ready.
+	waitForEndpoints("the terminating pod as a last resort", "10.0.0.2:8080")
+
+	if err := sliceClient.Delete(ctx, "app-2", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Failed to delete slice: %v", err)
+	}
+	waitForEndpoints("no endpoints")
+}
+
+// TestEndpointSliceWatcherProxy sends requests to the pods of a Service.
+func TestEndpointSliceWatcherProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pod")
+	}))
+	defer backend.Close()
+	host, portStr, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	client := fake.NewSimpleClientset()
+	w := NewEndpointSliceWatcher(client, KubernetesDiscovery{Service: "app", Namespace: "serving"})
+	if err := w.Start(5 * time.Second); err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	defer w.Stop()
+
+	target, _ := url.Parse("http://app.serving.svc")
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Director = w.Balancer().Director(proxy.Director)
+	h := w.Balancer().Handler(proxy)
+	get := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return strconv.Itoa(rec.Code) + " " + rec.Body.String()
+	}
+
+	if got := get(); got != "503 no healthy upstream\n" {
+		t.Errorf("without pods got %q, want a 503", got)
+	}
+	slice := endpointSlice("app-1", "app", int32(port), endpoint(host, true, true, false))
+	if _, err := client.DiscoveryV1().EndpointSlices("serving").Create(context.Background(), slice, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create slice: %v", err)
+	}
+	waitFor(t, "the pod", func() bool { return slices.Equal(w.Balancer().Endpoints(), []string{backend.Listener.Addr().String()}) })
+	if got := get(); got != "200 pod" {
+		t.Errorf("got %q, want 200 pod", got)
+	}
+}
@@ -0,0 +1,194 @@
+package rep
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultImmediateContentTypes are streamed to the client write by write.
+var DefaultImmediateContentTypes = []string{"text/event-stream", "application/grpc"}
+
+// FlushPolicy controls how responses are flushed to the client.
+type FlushPolicy struct {
+	// Interval flushes responses not matching ImmediateContentTypes at most
+	// this long after a write. Zero leaves buffering to net/http and a
+	// negative value flushes after every write.
+	Interval time.Duration
+	// ImmediateContentTypes are flushed after every write. A type also
+	// matches its "+suffix" variants, e.g. application/grpc matches
+	// application/grpc+proto.
+	ImmediateContentTypes []string
+}
+
+// DefaultFlushPolicy streams Server-Sent Events and gRPC immediately and
+// buffers everything else.
+func DefaultFlushPolicy() FlushPolicy {
+	return FlushPolicy{ImmediateContentTypes: DefaultImmediateContentTypes}
+}
+
+// FlushConfig overrides the flush policy of an upstream or a route. Unset
+// fields keep the less specific policy, the -flush-interval flag of the
+// proxy first, then the upstream's.
+type FlushConfig struct {
+	// Interval, see FlushPolicy.Interval.
+	Interval *Duration `json:"interval,omitempty"`
+	// ImmediateContentTypes replace the immediate content types when set.
+	ImmediateContentTypes []string `json:"immediateContentTypes,omitempty"`
+}
+
+// Validate checks the immediate content types are bare media types.
+func (c *FlushConfig) Validate() error {
+	for _, ct := range c.ImmediateContentTypes {
+		mt, params, err := mime.ParseMediaType(ct)
+		if err != nil || len(params) > 0 || mt != ct {
+			return fmt.Errorf("invalid immediate content type %q", ct)
+		}
+	}
+	return nil
+}
+
+// With returns p overridden by the fields set in c, if any.
+func (p FlushPolicy) With(c *FlushConfig) FlushPolicy {
+	if c == nil {
+		return p
+	}
+	if c.Interval != nil {
+		p.Interval = c.Interval.Duration
+	}
+	if c.ImmediateContentTypes != nil {
+		p.ImmediateContentTypes = c.ImmediateContentTypes
+	}
+	return p
+}
+
+type flushConfigKey struct{}
+
+// WithFlushConfig attaches a route level flush config to the request context.
+func WithFlushConfig(ctx context.Context, c FlushConfig) context.Context {
+	return context.WithValue(ctx, flushConfigKey{}, c)
+}
+
+// Handler applies the policy to the responses of h, overridden by the route
+// config of the request, see WithFlushConfig.
+func (p FlushPolicy) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := p
+		if c, ok := r.Context().Value(flushConfigKey{}).(FlushConfig); ok {
+			policy = p.With(&c)
+		}
+		fw := &flushWriter{ResponseWriter: w, policy: policy}
+		defer fw.stop()
+		h.ServeHTTP(fw, r)
+	})
+}
+
+func (p FlushPolicy) immediate(contentType string) bool {
+	if p.Interval < 0 {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, ct := range p.ImmediateContentTypes {
+		if mt == ct || strings.HasPrefix(mt, ct+"+") {
+			return true
+		}
+	}
+	return false
+}
+
+// flushWriter flushes writes according to the policy picked once the
+// response content type is known.
+type flushWriter struct {
+	http.ResponseWriter
+	policy FlushPolicy
+
+	mu          sync.Mutex
+	decided     bool
+	immediate   bool
+	timer       *time.Timer
+	flushQueued bool
+	stopped     bool
+}
+
+func (fw *flushWriter) decide() {
+	if fw.decided {
+		return
+	}
+	fw.decided = true
+	fw.immediate = fw.policy.immediate(fw.Header().Get("Content-Type"))
+}
+
+func (fw *flushWriter) WriteHeader(code int) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.decide()
+	fw.ResponseWriter.WriteHeader(code)
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.decide()
+	n, err := fw.ResponseWriter.Write(p)
+	if err != nil {
+		return n, err
+	}
+	switch {
+	case fw.immediate:
+		fw.flushLocked()
+	case fw.policy.Interval > 0 && !fw.flushQueued:
+		fw.flushQueued = true
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.policy.Interval, fw.delayedFlush)
+		} else {
+			fw.timer.Reset(fw.policy.Interval)
+		}
+	}
+	return n, nil
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if !fw.flushQueued || fw.stopped {
+		return
+	}
+	fw.flushLocked()
+}
+
+func (fw *flushWriter) flushLocked() {
+	fw.flushQueued = false
+	http.NewResponseController(fw.ResponseWriter).Flush()
+}
+
+// Flush implements http.Flusher.
+func (fw *flushWriter) Flush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.decide()
+	fw.flushLocked()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// enable full duplex or hijack the connection.
+func (fw *flushWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
+
+// stop prevents flushes once the handler returned, the writer is no longer
+// valid then.
+func (fw *flushWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.stopped = true
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
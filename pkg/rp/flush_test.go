@@ -0,0 +1,194 @@
+package rep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"knative.dev/serving/pkg/http/handler"
+)
+
+// newFlushChain fronts upstream with the proxy, the flush policy and the
+// knative timeout handler.
+func newFlushChain(t *testing.T, upstream *httptest.Server, policy FlushPolicy) *httptest.Server {
+	t.Helper()
+	proxy := NewHeaderPruningReverseProxy(upstream.Listener.Addr().String(), "", []string{}, false)
+	composedHandler := handler.NewTimeoutHandler(policy.Handler(proxy), "request timeout", func(r *http.Request) (time.Duration, time.Duration, time.Duration) {
+		return time.Minute, time.Minute, time.Minute
+	})
+	return httptest.NewServer(composedHandler)
+}
+
+func TestSSEThroughTimeoutHandler(t *testing.T) {
+	const count = 5
+	// The upstream writes an event only once the client received the
+	// previous one, so buffered events stall the stream instead of racing
+	// a deadline.
+	received := make(chan struct{}, count)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < count; i++ {
+			fmt.Fprintf(w, "id: %d\nevent: tick\ndata: %d\n\n", i, i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-received:
+			case <-time.After(10 * time.Second):
+				t.Errorf("event %d didn't reach the client before the next write", i)
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+	proxyServer := newFlushChain(t, upstream, DefaultFlushPolicy())
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL)
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	events := 0
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if got, want := strings.TrimPrefix(line, "data: "), strconv.Itoa(events); got != want {
+			t.Errorf("event data = %s, want %s", got, want)
+		}
+		events++
+		received <- struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("Failed to read events: %v", err)
+	}
+	if events != count {
+		t.Errorf("got %d events, want %d", events, count)
+	}
+}
+
+func TestFlushPolicy(t *testing.T) {
+	const pause = 300 * time.Millisecond
+	// The upstream announces the full length, so net/http would buffer the
+	// first chunk until the second one completes the response.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("ct"))
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		time.Sleep(pause)
+		io.WriteString(w, "later")
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name      string
+		policy    FlushPolicy
+		ct        string
+		streaming bool
+	}{{
+		name:   "buffered by default",
+		policy: DefaultFlushPolicy(),
+		ct:     "application/octet-stream",
+	}, {
+		name:      "immediate content type",
+		policy:    DefaultFlushPolicy(),
+		ct:        "application/grpc+proto",
+		streaming: true,
+	}, {
+		name:      "interval",
+		policy:    FlushPolicy{Interval: 10 * time.Millisecond},
+		ct:        "application/octet-stream",
+		streaming: true,
+	}, {
+		name:      "always immediate",
+		policy:    FlushPolicy{Interval: -1},
+		ct:        "application/octet-stream",
+		streaming: true,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyServer := newFlushChain(t, upstream, tc.policy)
+			defer proxyServer.Close()
+
+			start := time.Now()
+			resp, err := http.Get(proxyServer.URL + "?ct=" + url.QueryEscape(tc.ct))
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(resp.Body, buf); err != nil {
+				t.Fatalf("Failed to read first chunk: %v", err)
+			}
+			if streamed := time.Since(start) < pause; streamed != tc.streaming {
+				t.Errorf("first chunk arrived after %v, want streaming = %v", time.Since(start), tc.streaming)
+			}
+		})
+	}
+}
+
+func TestRouteFlushPolicy(t *testing.T) {
+	const pause = 300 * time.Millisecond
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		time.Sleep(pause)
+		io.WriteString(w, "later")
+	}))
+	defer upstream.Close()
+
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+- name: echo
+  url: http://echo
+routes:
+- match: {pathPrefix: /stream}
+  upstream: echo
+  flush: {interval: -1ns}
+- upstream: echo
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig() = %v", err)
+	}
+	proxy := NewHeaderPruningReverseProxy(upstream.Listener.Addr().String(), "", []string{}, false)
+	router, err := NewRouter(cfg.Routes, map[string]http.Handler{"echo": DefaultFlushPolicy().Handler(proxy)})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	proxyServer := httptest.NewServer(router)
+	defer proxyServer.Close()
+
+	for path, streaming := range map[string]bool{"/stream": true, "/buffered": false} {
+		t.Run(path, func(t *testing.T) {
+			start := time.Now()
+			resp, err := http.Get(proxyServer.URL + path)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(resp.Body, buf); err != nil {
+				t.Fatalf("Failed to read first chunk: %v", err)
+			}
+			if streamed := time.Since(start) < pause; streamed != streaming {
+				t.Errorf("first chunk arrived after %v, want streaming = %v", time.Since(start), streaming)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package rep
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+)
+
+// RequestIDHeader carries the request ID. Incoming values are kept, requests
+// without one get a random ID, see NewRequestIDHandler.
+const RequestIDHeader = "X-Request-Id"
+
+// Template variables available in header values, written as ${name}.
+const (
+	HeaderVarClientIP     = "client_ip"
+	HeaderVarRequestID    = "request_id"
+	HeaderVarUpstreamHost = "upstream_host"
+)
+
+var headerVarPattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// HeaderOps edits a set of headers. They are applied in field order: remove,
+// rename, set and add.
+type HeaderOps struct {
+	// Remove deletes the listed headers.
+	Remove []string `json:"remove,omitempty"`
+	// Rename moves the values of each key to the header named by its value,
+	// replacing what the destination held. Renames apply at once, so a
+	// destination can't be renamed again nor be the destination of another.
+	Rename map[string]string `json:"rename,omitempty"`
+	// Set replaces the header with the templated value.
+	Set map[string]string `json:"set,omitempty"`
+	// Add appends the templated value to the header.
+	Add map[string]string `json:"add,omitempty"`
+}
+
+// Validate rejects unknown template variables and renames whose outcome
+// would depend on the order they're applied in.
+func (o *HeaderOps) Validate() error {
+	sources, destinations := map[string]bool{}, map[string]string{}
+	for from, to := range o.Rename {
+		from, to = http.CanonicalHeaderKey(from), http.CanonicalHeaderKey(to)
+		if sources[from] {
+			return fmt.Errorf("header %s renamed twice", from)
+		}
+		sources[from] = true
+		if other, ok := destinations[to]; ok {
+			return fmt.Errorf("headers %s and %s both renamed to %s", other, from, to)
+		}
+		destinations[to] = from
+	}
+	for to, from := range destinations {
+		if sources[to] {
+			return fmt.Errorf("header %s renamed to %s, which is renamed too", from, to)
+		}
+	}
+	for _, values := range []map[string]string{o.Set, o.Add} {
+		for name, v := range values {
+			for _, m := range headerVarPattern.FindAllStringSubmatch(v, -1) {
+				switch m[1] {
+				case HeaderVarClientIP, HeaderVarRequestID, HeaderVarUpstreamHost:
+				default:
+					return fmt.Errorf("header %s: unknown variable %q", name, m[1])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (o *HeaderOps) apply(h http.Header, vars map[string]string) {
+	for _, name := range o.Remove {
+		h.Del(name)
+	}
+	for from, to := range o.Rename {
+		if values, ok := h[http.CanonicalHeaderKey(from)]; ok {
+			h.Del(from)
+			h[http.CanonicalHeaderKey(to)] = values
+		}
+	}
+	expand := func(v string) string {
+		return headerVarPattern.ReplaceAllStringFunc(v, func(s string) string {
+			return vars[s[2:len(s)-1]]
+		})
+	}
+	for name, v := range o.Set {
+		h.Set(name, expand(v))
+	}
+	for name, v := range o.Add {
+		h.Add(name, expand(v))
+	}
+}
+
+// HeaderRule edits the headers of requests matching Match and of their
+// responses. Rules match the request once the router rewrote it, before it's
+// proxied, and responses are matched by their request.
+type HeaderRule struct {
+	Match    RequestMatch `json:"match,omitempty"`
+	Request  HeaderOps    `json:"request,omitempty"`
+	Response HeaderOps    `json:"response,omitempty"`
+}
+
+// HeaderRules are applied in order; unlike timeout rules every matching rule
+// applies.
+type HeaderRules []HeaderRule
+
+// Validate checks every rule.
+func (rs HeaderRules) Validate() error {
+	for i := range rs {
+		if err := rs[i].Match.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if err := rs[i].Request.Validate(); err != nil {
+			return fmt.Errorf("rule %d request: %w", i, err)
+		}
+		if err := rs[i].Response.Validate(); err != nil {
+			return fmt.Errorf("rule %d response: %w", i, err)
+		}
+	}
+	return nil
+}
+
+type headerRulesKey struct{}
+
+// headerRulesState remembers the rules matched by a request and the template
+// variables so its response is edited consistently.
+type headerRulesState struct {
+	matched []*HeaderRule
+	vars    map[string]string
+}
+
+// Apply installs the rules on proxy, wrapping its Director and
+// ModifyResponse. proxy must use a Director, not Rewrite. Apply them after
+// the Director picking the endpoint, e.g. EndpointBalancer.Director, so that
+// ${upstream_host} is the endpoint the request goes to.
+func (rs HeaderRules) Apply(proxy *httputil.ReverseProxy) {
+	if len(rs) == 0 {
+		return
+	}
+	director, modifyResponse := proxy.Director, proxy.ModifyResponse
+	proxy.Director = func(req *http.Request) {
+		// Match before the director gets a chance to alter the request.
+		state := &headerRulesState{}
+		for i := range rs {
+			if rs[i].Match.Matches(req) {
+				state.matched = append(state.matched, &rs[i])
+			}
+		}
+		director(req)
+		if len(state.matched) == 0 {
+			return
+		}
+
+		state.vars = map[string]string{
+			HeaderVarClientIP:     clientIP(req),
+			HeaderVarRequestID:    requestID(req),
+			HeaderVarUpstreamHost: req.URL.Host,
+		}
+		for _, rule := range state.matched {
+			rule.Request.apply(req.Header, state.vars)
+		}
+		*req = *req.WithContext(context.WithValue(req.Context(), headerRulesKey{}, state))
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if state, ok := resp.Request.Context().Value(headerRulesKey{}).(*headerRulesState); ok {
+			for _, rule := range state.matched {
+				rule.Response.apply(resp.Header, state.vars)
+			}
+		}
+		if modifyResponse != nil {
+			return modifyResponse(resp)
+		}
+		return nil
+	}
+}
+
+func clientIP(req *http.Request) string {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+// NewRequestIDHandler gives every request served by h an ID: its incoming
+// X-Request-Id, or else a random one h sees in the header, so that the
+// upstream, ${request_id} and the access log, annotated with request_id,
+// all agree.
+func NewRequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+			r = r.WithContext(r.Context())
+			r.Header = r.Header.Clone()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		AnnotateAccessLog(r.Context(), "request_id", id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the ID of the outgoing request req, setting a random one
+// when it has none, i.e. it wasn't served through NewRequestIDHandler.
+func requestID(req *http.Request) string {
+	id := req.Header.Get(RequestIDHeader)
+	if id == "" {
+		id = newRequestID()
+		req.Header.Set(RequestIDHeader, id)
+	}
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,260 @@
+package rep
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+headers:
+- request:
+    set:
+      X-Client-Ip: ${client_ip}
+      X-Upstream: ${upstream_host}
+      X-Request-Id: ${request_id}
+    remove: [X-Internal]
+  response:
+    set:
+      X-Request-Id: ${request_id}
+- match:
+    pathPrefix: /api
+    methods: [POST]
+  request:
+    rename:
+      X-Old: X-New
+    add:
+      X-Api: "true"
+  response:
+    remove: [Server]
+    add:
+      X-Served-By: proxy-${upstream_host}
+- match:
+    headers:
+      X-Debug: ""
+  response:
+    set:
+      X-Debug-Client: ${client_ip}
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	// The upstream answers with the headers it received.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "upstream")
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	defer upstream.Close()
+	upstreamHost := upstream.Listener.Addr().String()
+
+	proxy := NewHeaderPruningReverseProxy(upstreamHost, "", []string{}, false)
+	cfg.Headers.Apply(proxy)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		header      http.Header
+		wantReq     map[string]string
+		wantResp    map[string]string
+		wantReqMiss []string
+	}{{
+		name:   "every request",
+		method: http.MethodGet,
+		path:   "/api",
+		header: http.Header{"X-Internal": {"secret"}, "X-Old": {"v"}, "X-Request-Id": {"abc"}},
+		wantReq: map[string]string{
+			"X-Client-Ip":  "127.0.0.1",
+			"X-Upstream":   upstreamHost,
+			"X-Request-Id": "abc",
+			"X-Old":        "v",
+		},
+		wantResp:    map[string]string{"X-Request-Id": "abc", "Server": "upstream"},
+		wantReqMiss: []string{"X-Internal", "X-Api", "X-New"},
+	}, {
+		name:        "path and method",
+		method:      http.MethodPost,
+		path:        "/api/items",
+		header:      http.Header{"X-Old": {"v"}},
+		wantReq:     map[string]string{"X-New": "v", "X-Api": "true"},
+		wantResp:    map[string]string{"X-Served-By": "proxy-" + upstreamHost, "Server": ""},
+		wantReqMiss: []string{"X-Old"},
+	}, {
+		name:     "header presence",
+		method:   http.MethodGet,
+		path:     "/",
+		header:   http.Header{"X-Debug": {"1"}},
+		wantResp: map[string]string{"X-Debug-Client": "127.0.0.1", "X-Served-By": ""},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, proxyServer.URL+tc.path, nil)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+			var got http.Header
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatalf("Failed to decode upstream headers: %v", err)
+			}
+
+			for k, v := range tc.wantReq {
+				if got.Get(k) != v {
+					t.Errorf("upstream header %s = %q, want %q", k, got.Get(k), v)
+				}
+			}
+			for _, k := range tc.wantReqMiss {
+				if _, ok := got[k]; ok {
+					t.Errorf("upstream header %s = %q, want it removed", k, got.Get(k))
+				}
+			}
+			for k, v := range tc.wantResp {
+				if resp.Header.Get(k) != v {
+					t.Errorf("response header %s = %q, want %q", k, resp.Header.Get(k), v)
+				}
+			}
+			if id := got.Get("X-Request-Id"); id == "" || resp.Header.Get("X-Request-Id") != id {
+				t.Errorf("request ID %q not echoed in response, got %q", id, resp.Header.Get("X-Request-Id"))
+			}
+		})
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+headers:
+- response:
+    set:
+      X-Request-Id: ${request_id}
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Request-Id", r.Header.Get(RequestIDHeader))
+	}))
+	defer upstream.Close()
+
+	proxy := NewHeaderPruningReverseProxy(upstream.Listener.Addr().String(), "", []string{}, false)
+	cfg.Headers.Apply(proxy)
+	logs := &syncBuffer{}
+	proxyServer := httptest.NewServer(NewAccessLogHandler(NewRequestIDHandler(proxy), log.New(logs, "", 0)))
+	defer proxyServer.Close()
+
+	for _, incoming := range []string{"", "abc"} {
+		t.Run("incoming="+incoming, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+			if incoming != "" {
+				req.Header.Set(RequestIDHeader, incoming)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			resp.Body.Close()
+
+			id := resp.Header.Get("X-Upstream-Request-Id")
+			switch {
+			case id == "":
+				t.Fatal("upstream got no request ID")
+			case incoming != "" && id != incoming:
+				t.Errorf("upstream request ID = %q, want the incoming %q", id, incoming)
+			}
+			if got := resp.Header.Get(RequestIDHeader); got != id {
+				t.Errorf("${request_id} = %q, want the upstream's %q", got, id)
+			}
+			waitFor(t, "request_id="+id+" in the access log", func() bool {
+				return strings.Contains(logs.String(), "request_id="+id)
+			})
+		})
+	}
+}
+
+func TestHeaderRulesRejectUnknownVariable(t *testing.T) {
+	if _, err := ParseConfig([]byte("headers: [{request: {set: {X-A: '${nope}'}}}]")); err == nil {
+		t.Error("ParseConfig succeeded with an unknown template variable")
+	}
+}
+
+func TestHeaderRulesRejectAmbiguousRenames(t *testing.T) {
+	for _, rename := range []string{
+		"{X-A: X-B, X-B: X-C}",
+		"{X-A: X-A}",
+		"{X-A: X-C, X-B: x-c}",
+		"{X-A: X-B, x-a: X-C}",
+	} {
+		if _, err := ParseConfig([]byte("headers: [{request: {rename: " + rename + "}}]")); err == nil {
+			t.Errorf("ParseConfig succeeded with renames %s", rename)
+		}
+	}
+	if _, err := ParseConfig([]byte("headers: [{request: {rename: {X-A: X-B, X-C: X-D}}}]")); err != nil {
+		t.Errorf("ParseConfig() = %v with independent renames", err)
+	}
+}
+
+func TestHeaderRulesUpstreamHostIsEndpoint(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+headers:
+- request:
+    set:
+      X-Upstream: ${upstream_host}
+  response:
+    set:
+      X-Served-By: ${upstream_host}
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	// Every endpoint answers with the X-Upstream it received and its address.
+	var endpoints []string
+	for i := 0; i < 2; i++ {
+		var addr string
+		endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Endpoint", addr)
+			w.Header().Set("X-Got-Upstream", r.Header.Get("X-Upstream"))
+		}))
+		defer endpoint.Close()
+		addr = endpoint.Listener.Addr().String()
+		endpoints = append(endpoints, addr)
+	}
+
+	// The upstream URL names neither endpoint, like a Service.
+	proxy := NewHeaderPruningReverseProxy("echo.default.svc", "", []string{}, false)
+	proxy.Director = NewEndpointBalancer(endpoints).Director(proxy.Director)
+	cfg.Headers.Apply(proxy)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	served := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get(proxyServer.URL)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+		endpoint := resp.Header.Get("X-Endpoint")
+		served[endpoint] = true
+		if got := resp.Header.Get("X-Got-Upstream"); got != endpoint {
+			t.Errorf("request ${upstream_host} = %q, want endpoint %q", got, endpoint)
+		}
+		if got := resp.Header.Get("X-Served-By"); got != endpoint {
+			t.Errorf("response ${upstream_host} = %q, want endpoint %q", got, endpoint)
+		}
+	}
+	if len(served) != len(endpoints) {
+		t.Errorf("requests reached %v, want every endpoint of %v", served, endpoints)
+	}
+}
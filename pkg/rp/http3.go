@@ -0,0 +1,46 @@
+package rep
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP3Server serves the proxy handler over QUIC. It is meant to run next to
+// a TCP Server on the same port number, which advertises it through Alt-Svc.
+type HTTP3Server struct {
+	*http3.Server
+}
+
+// NewHTTP3Server returns an HTTP/3 server for handler. tlsConf is required
+// by QUIC; "h3" is added to its ALPN protocols when serving.
+func NewHTTP3Server(addr string, handler http.Handler, tlsConf *tls.Config) *HTTP3Server {
+	return &HTTP3Server{Server: &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConf,
+	}}
+}
+
+// ListenAndServe listens on the UDP address s.Addr and serves HTTP/3.
+func (s *HTTP3Server) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// AltSvcHandler advertises the HTTP/3 server on every response of h, so
+// clients that support it can switch over to QUIC.
+func (s *HTTP3Server) AltSvcHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			// Only fails before the QUIC listener is up, nothing to advertise then.
+			_ = s.SetQuicHeaders(w.Header())
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,108 @@
+package rep
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/skonto/test-reverse-proxy/pkg/load"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestProxyHTTP3(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Upstream-Proto", req.Proto)
+			w.Write(body)
+		},
+	), &http2.Server{}))
+	defer upstream.Close()
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "proxy", nil, false)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	tlsConf := NewServerTLSConfig(reloader)
+
+	for _, proto := range []UpstreamProtocol{UpstreamHTTP1, UpstreamH2C} {
+		t.Run(string(proto), func(t *testing.T) {
+			proxy := NewHeaderPruningReverseProxy(upstream.Listener.Addr().String(), "", []string{}, false)
+			proxy.Transport = NewProtocolTransport(proto)
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			udp, err := net.ListenPacket("udp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to listen on UDP: %v", err)
+			}
+			h3 := NewHTTP3Server(ln.Addr().String(), proxy, tlsConf)
+			go h3.Serve(udp)
+			defer h3.Close()
+			srv, err := NewServer(ln.Addr().String(), h3.AltSvcHandler(proxy), tlsConf)
+			if err != nil {
+				t.Fatalf("Failed to create server: %v", err)
+			}
+			go srv.Serve(ln)
+			defer srv.Close()
+			url := "https://" + ln.Addr().String()
+
+			clientTLS := &tls.Config{RootCAs: ca.pool()}
+			h2, err := load.NewTransport(load.H2, clientTLS, false)
+			if err != nil {
+				t.Fatalf("Failed to create h2 transport: %v", err)
+			}
+			resp, err := (&http.Client{Transport: h2}).Get(url)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			resp.Body.Close()
+			if altSvc := resp.Header.Get("Alt-Svc"); !strings.Contains(altSvc, `h3=":`) {
+				t.Errorf("Alt-Svc = %q, want an h3 advertisement", altSvc)
+			}
+
+			h3t, err := load.NewTransport(load.H3, clientTLS, false)
+			if err != nil {
+				t.Fatalf("Failed to create h3 transport: %v", err)
+			}
+			defer h3t.(io.Closer).Close()
+			c := &http.Client{Transport: h3t}
+			resp, err = c.Get(url)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			resp.Body.Close()
+			if resp.ProtoMajor != 3 {
+				t.Errorf("client protocol = %s, want HTTP/3", resp.Proto)
+			}
+			want := map[UpstreamProtocol]string{UpstreamHTTP1: "HTTP/1.1", UpstreamH2C: "HTTP/2.0"}[proto]
+			if got := resp.Header.Get("X-Upstream-Proto"); got != want {
+				t.Errorf("upstream protocol = %s, want %s", got, want)
+			}
+
+			res := load.Run(context.Background(), c, load.Config{
+				URL:         url,
+				Parallelism: 8,
+				Requests:    20,
+				Body:        make([]byte, bodySize),
+			})
+			if res.Errors > 0 {
+				t.Errorf("HTTP/3 load run failed:\n%s", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package rep
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// tlsRecordTypeHandshake is the first byte of every TLS ClientHello.
+const tlsRecordTypeHandshake = 0x16
+
+// DefaultSniffTimeout bounds how long a new connection may take to send its
+// first byte before it is dropped.
+const DefaultSniffTimeout = 10 * time.Second
+
+// ProtocolListener accepts plaintext and TLS connections on the same socket.
+// Connections whose first byte starts a TLS handshake are wrapped with
+// tls.Server, so net/http negotiates h2 or http/1.1 through ALPN; everything
+// else is handed over as is and served as HTTP/1.1 or h2c.
+type ProtocolListener struct {
+	net.Listener
+
+	tlsConf      *tls.Config
+	sniffTimeout time.Duration
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewProtocolListener starts sniffing connections accepted from ln. TLS
+// connections are rejected when tlsConf is nil.
+func NewProtocolListener(ln net.Listener, tlsConf *tls.Config) *ProtocolListener {
+	pl := &ProtocolListener{
+		Listener:     ln,
+		tlsConf:      tlsConf,
+		sniffTimeout: DefaultSniffTimeout,
+		conns:        make(chan net.Conn),
+		errs:         make(chan error, 1),
+		done:         make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (pl *ProtocolListener) acceptLoop() {
+	for {
+		c, err := pl.Listener.Accept()
+		if err != nil {
+			var errNet net.Error
+			if errors.As(err, &errNet) && errNet.Timeout() {
+				continue
+			}
+			select {
+			case pl.errs <- err:
+			case <-pl.done:
+			}
+			return
+		}
+		// Sniff off the accept loop so a slow client can't stall others.
+		go pl.sniff(c)
+	}
+}
+
+func (pl *ProtocolListener) sniff(c net.Conn) {
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(pl.sniffTimeout))
+	first, err := br.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	var conn net.Conn = &bufferedConn{Conn: c, r: br}
+	if first[0] == tlsRecordTypeHandshake {
+		if pl.tlsConf == nil {
+			logf(LogInfo, "Rejecting TLS connection from %s: no TLS config", c.RemoteAddr())
+			c.Close()
+			return
+		}
+		conn = tls.Server(conn, pl.tlsConf)
+	}
+
+	select {
+	case pl.conns <- conn:
+	case <-pl.done:
+		c.Close()
+	}
+}
+
+// Accept returns the next sniffed connection.
+func (pl *ProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-pl.conns:
+		return c, nil
+	case err := <-pl.errs:
+		return nil, err
+	case <-pl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and closes the underlying listener.
+func (pl *ProtocolListener) Close() error {
+	pl.closeOnce.Do(func() { close(pl.done) })
+	return pl.Listener.Close()
+}
+
+// bufferedConn reads through bytes already buffered from the connection,
+// e.g. while sniffing it or parsing an HTTP exchange.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection if it supports it.
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection does not support half-close")
+}
+
+// Server is an http.Server serving every supported protocol on one port.
+type Server struct {
+	*http.Server
+
+	// tlsConf is kept apart from Server.TLSConfig, which
+	// http2.ConfigureServer populates even for plaintext servers.
+	tlsConf *tls.Config
+}
+
+// NewServer returns a server that speaks HTTP/1.1, h2c (prior knowledge and
+// Upgrade) and, when tlsConf is set, TLS with ALPN for h2 and http/1.1 on a
+// single listener. Serve it with ListenAndServe, which sniffs the protocol
+// of each connection.
+func NewServer(addr string, handler http.Handler, tlsConf *tls.Config) (*Server, error) {
+	h2s := &http2.Server{}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h2c.NewHandler(handler, h2s),
+		ReadHeaderTimeout: time.Minute,
+		TLSConfig:         tlsConf,
+	}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, err
+	}
+	return &Server{Server: srv, tlsConf: tlsConf}, nil
+}
+
+// Serve accepts connections on ln, detecting the protocol of each of them.
+func (s *Server) Serve(ln net.Listener) error {
+	return s.Server.Serve(NewProtocolListener(ln, s.tlsConf))
+}
+
+// ListenAndServe listens on s.Addr and calls Serve.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// UpstreamProtocol selects the protocol spoken to the upstream.
+type UpstreamProtocol string
+
+const (
+	// UpstreamAuto mirrors the incoming request: HTTP/2 and HTTP/3 requests
+	// go upstream over h2c, anything else over HTTP/1.1.
+	UpstreamAuto UpstreamProtocol = "auto"
+	// UpstreamHTTP1 always uses HTTP/1.1 towards plaintext upstreams.
+	UpstreamHTTP1 UpstreamProtocol = "http1"
+	// UpstreamH2C always uses HTTP/2 with prior knowledge towards plaintext upstreams.
+	UpstreamH2C UpstreamProtocol = "h2c"
+)
+
+type upstreamProtocolKey struct{}
+
+// WithUpstreamProtocol returns a context overriding the upstream protocol
+// for requests carrying it, e.g. as set by a route.
+func WithUpstreamProtocol(ctx context.Context, p UpstreamProtocol) context.Context {
+	return context.WithValue(ctx, upstreamProtocolKey{}, p)
+}
+
+// ProtocolTransport picks http.Transport or http2.Transport per request.
+// https upstreams always go through HTTP1, where ALPN decides between h2 and
+// http/1.1.
+type ProtocolTransport struct {
+	HTTP1   http.RoundTripper
+	H2C     http.RoundTripper
+	Default UpstreamProtocol
+
+	conns *endpointConns
+	// h2 is the HTTP/2 transport of HTTP1 for https upstreams, once SetPool
+	// configured it.
+	h2 *http2.Transport
+}
+
+// NewProtocolTransport returns a ProtocolTransport using proto unless a
+// request context says otherwise.
+func NewProtocolTransport(proto UpstreamProtocol) *ProtocolTransport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = DialWithBackOff
+	return &ProtocolTransport{
+		HTTP1:   transport,
+		H2C:     newH2CTransport(false),
+		Default: proto,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *ProtocolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt := t.HTTP1
+	// ALPN may negotiate h2 with https upstreams.
+	h2 := r.URL.Scheme == "https"
+	if !h2 && t.protocolFor(r) == UpstreamH2C {
+		rt, h2 = t.H2C, true
+	}
+	// HTTP/2 requests the upstream didn't process, e.g. past the last stream
+	// of its GOAWAY, are resent on another connection, with their body.
+	// HTTP/1 transports never resend requests with a body.
+	if h2 {
+		var finish func()
+		r, finish = withReplayBody(r, maxReplayBody)
+		defer finish()
+	}
+	if t.conns != nil {
+		return t.conns.roundTrip(rt, r)
+	}
+	return rt.RoundTrip(r)
+}
+
+// SetConnectTimeout bounds the time connecting to the upstream takes, over
+// both transports.
+func (t *ProtocolTransport) SetConnectTimeout(timeout time.Duration) {
+	if t1, ok := t.HTTP1.(*http.Transport); ok {
+		if t1.DialContext != nil {
+			t1.DialContext = WithConnectTimeout(t1.DialContext, timeout)
+		}
+		if t1.DialTLSContext != nil {
+			t1.DialTLSContext = WithConnectTimeout(t1.DialTLSContext, timeout)
+		}
+	}
+	if t2, ok := t.H2C.(*http2.Transport); ok && t2.DialTLSContext != nil {
+		dial := t2.DialTLSContext
+		t2.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return WithConnectTimeout(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(ctx, network, addr, cfg)
+			}, timeout)(ctx, network, addr)
+		}
+	}
+}
+
+// TrackEndpoints tracks the plaintext connections of both transports by
+// endpoint, for DrainEndpoints and PoolStats, and counts retries and HTTP/2
+// errors. It's called once, after the dialers are set and SetPool.
+// TLS connections aren't tracked, the transport needs them unwrapped to
+// negotiate HTTP/2.
+func (t *ProtocolTransport) TrackEndpoints() {
+	t.conns = newEndpointConns()
+	if t1, ok := t.HTTP1.(*http.Transport); ok && t1.DialContext != nil {
+		t1.DialContext = t.conns.dial(t1.DialContext)
+	}
+	if t.h2 != nil {
+		t.h2.CountError = t.conns.countError
+	}
+	if t2, ok := t.H2C.(*http2.Transport); ok && t2.DialTLSContext != nil {
+		t2.CountError = t.conns.countError
+		dial := t2.DialTLSContext
+		t2.DialTLSContext = func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return t.conns.dial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(ctx, network, addr, cfg)
+			})(ctx, network, addr)
+		}
+	}
+}
+
+// DrainEndpoints closes the connections to endpoints no longer used, e.g.
+// removed by discovery, as soon as their requests are done. Without
+// TrackEndpoints, it closes the idle connections of every endpoint instead.
+func (t *ProtocolTransport) DrainEndpoints(removed []string) {
+	if t.conns == nil {
+		t.CloseIdleConnections()
+		return
+	}
+	t.conns.drain(removed)
+	// Idle TLS connections, which aren't tracked.
+	if t1, ok := t.HTTP1.(*http.Transport); ok && t1.DialTLSContext != nil {
+		t1.CloseIdleConnections()
+	}
+}
+
+// CloseIdleConnections closes the idle connections of both transports.
+func (t *ProtocolTransport) CloseIdleConnections() {
+	type closeIdler interface{ CloseIdleConnections() }
+	for _, rt := range []http.RoundTripper{t.HTTP1, t.H2C} {
+		if c, ok := rt.(closeIdler); ok {
+			c.CloseIdleConnections()
+		}
+	}
+	// http2.Transport only closes the idle connections of its own pool.
+	if t2, ok := t.H2C.(*http2.Transport); ok {
+		if p, ok := t2.ConnPool.(*h2cConnPool); ok {
+			p.closeIdle()
+		}
+	}
+}
+
+func (t *ProtocolTransport) protocolFor(r *http.Request) UpstreamProtocol {
+	proto := t.Default
+	if p, ok := r.Context().Value(upstreamProtocolKey{}).(UpstreamProtocol); ok && p != "" {
+		proto = p
+	}
+	if proto == UpstreamAuto || proto == "" {
+		if r.ProtoMajor >= 2 {
+			return UpstreamH2C
+		}
+		return UpstreamHTTP1
+	}
+	return proto
+}
+
+// ParseUpstreamProtocol validates a protocol name from flags or config.
+func ParseUpstreamProtocol(s string) (UpstreamProtocol, error) {
+	switch p := UpstreamProtocol(s); p {
+	case "", UpstreamAuto:
+		return UpstreamAuto, nil
+	case UpstreamHTTP1, UpstreamH2C:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown upstream protocol %q", s)
+}
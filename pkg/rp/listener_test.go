@@ -0,0 +1,213 @@
+package rep
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestProtocolDetectionOnSingleListener(t *testing.T) {
+	// The upstream speaks both HTTP/1.1 and h2c and reports what it saw.
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Upstream-Proto", req.Proto)
+			w.Write(body)
+		},
+	), &http2.Server{}))
+	defer upstream.Close()
+
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "proxy", nil, false)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+
+	proxy := NewHeaderPruningReverseProxy(upstream.Listener.Addr().String(), "", []string{}, false)
+	proxy.Transport = NewProtocolTransport(UpstreamAuto)
+	forceHTTP1 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Force-HTTP1") != "" {
+			r = r.WithContext(WithUpstreamProtocol(r.Context(), UpstreamHTTP1))
+		}
+		proxy.ServeHTTP(w, r)
+	})
+
+	srv, err := NewServer("127.0.0.1:0", forceHTTP1, NewServerTLSConfig(reloader))
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	addr := ln.Addr().String()
+
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	tlsClient := func(proto string) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.pool(), NextProtos: []string{proto}},
+			ForceAttemptHTTP2: proto == ProtoH2,
+		}}
+	}
+
+	tests := []struct {
+		name          string
+		client        *http.Client
+		url           string
+		header        string
+		wantProto     string
+		wantUpstreamP string
+	}{{
+		name:          "http1",
+		client:        &http.Client{},
+		url:           "http://" + addr,
+		wantProto:     "HTTP/1.1",
+		wantUpstreamP: "HTTP/1.1",
+	}, {
+		name:          "h2c prior knowledge",
+		client:        h2cClient,
+		url:           "http://" + addr,
+		wantProto:     "HTTP/2.0",
+		wantUpstreamP: "HTTP/2.0",
+	}, {
+		name:          "tls h2",
+		client:        tlsClient(ProtoH2),
+		url:           "https://" + addr,
+		wantProto:     "HTTP/2.0",
+		wantUpstreamP: "HTTP/2.0",
+	}, {
+		name:          "tls http1",
+		client:        tlsClient(ProtoHTTP1),
+		url:           "https://" + addr,
+		wantProto:     "HTTP/1.1",
+		wantUpstreamP: "HTTP/1.1",
+	}, {
+		name:          "h2c forced to http1 upstream",
+		client:        h2cClient,
+		url:           "http://" + addr,
+		header:        "X-Force-HTTP1",
+		wantProto:     "HTTP/2.0",
+		wantUpstreamP: "HTTP/1.1",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body := strings.Repeat("a", bodySize)
+			req, err := http.NewRequest(http.MethodPost, tc.url, strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			if tc.header != "" {
+				req.Header.Set(tc.header, "true")
+			}
+			resp, err := tc.client.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Failed to read body: %v", err)
+			}
+			if string(got) != body {
+				t.Errorf("unexpected body length: %d", len(got))
+			}
+			if resp.Proto != tc.wantProto {
+				t.Errorf("client protocol = %s, want %s", resp.Proto, tc.wantProto)
+			}
+			if p := resp.Header.Get("X-Upstream-Proto"); p != tc.wantUpstreamP {
+				t.Errorf("upstream protocol = %s, want %s", p, tc.wantUpstreamP)
+			}
+		})
+	}
+
+	t.Run("h2c upgrade", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET / HTTP/1.1\r\n"+
+			"Host: "+addr+"\r\n"+
+			"Connection: Upgrade, HTTP2-Settings\r\n"+
+			"Upgrade: h2c\r\n"+
+			"HTTP2-Settings: AAMAAABkAARAAAAAAAIAAAAA\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read upgrade response: %v", err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+	})
+}
+
+func TestProtocolListenerRejectsTLSWithoutConfig(t *testing.T) {
+	srv, err := NewServer("127.0.0.1:0", http.NotFoundHandler(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Fatal("TLS handshake succeeded without a TLS config")
+	}
+}
+
+func TestProtocolTransportConnectTimeout(t *testing.T) {
+	for _, proto := range []UpstreamProtocol{UpstreamHTTP1, UpstreamH2C} {
+		t.Run(string(proto), func(t *testing.T) {
+			transport := NewProtocolTransport(proto)
+			// An upstream that never accepts the connection.
+			hang := func(ctx context.Context, _, _ string) (net.Conn, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			transport.HTTP1.(*http.Transport).DialContext = hang
+			transport.H2C.(*http2.Transport).DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return hang(ctx, network, addr)
+			}
+			transport.SetConnectTimeout(50 * time.Millisecond)
+
+			req, _ := http.NewRequest(http.MethodGet, "http://upstream.example", nil)
+			start := time.Now()
+			_, err := transport.RoundTrip(req)
+			if !errors.Is(err, ErrTimeoutDialing) {
+				t.Errorf("RoundTrip() = %v, want %v", err, ErrTimeoutDialing)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("RoundTrip() took %s, want about 50ms", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package rep
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel filters the messages logged by the proxy. The access log isn't
+// affected.
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogDebug || l > LogError {
+		return fmt.Sprintf("LogLevel(%d)", l)
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses debug, info or error.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(LogInfo))
+}
+
+// SetLogLevel changes the level of messages logged, at runtime.
+func SetLogLevel(l LogLevel) {
+	logLevel.Store(int32(l))
+}
+
+// CurrentLogLevel returns the level set by SetLogLevel, LogInfo by default.
+func CurrentLogLevel() LogLevel {
+	return LogLevel(logLevel.Load())
+}
+
+// logf logs with the standard logger if l is enabled.
+func logf(l LogLevel, format string, args ...any) {
+	if l >= CurrentLogLevel() {
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,113 @@
+package rep
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RequestMatch selects requests by host, path, method and headers. Empty
+// fields match everything.
+type RequestMatch struct {
+	// Hosts matches any of the listed hosts, ignoring the port. A leading
+	// "*." matches any subdomain and "*" any host.
+	Hosts []string `json:"hosts,omitempty"`
+	// Path matches the request path exactly.
+	Path string `json:"path,omitempty"`
+	// PathPrefix matches paths starting with it.
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// PathRegex matches paths fully matching the RE2 expression.
+	PathRegex string `json:"pathRegex,omitempty"`
+	// Methods matches any of the listed methods.
+	Methods []string `json:"methods,omitempty"`
+	// Headers requires every listed header to have the given value. An
+	// empty value only requires the header to be present.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	pathRegex *regexp.Regexp
+}
+
+// Validate compiles PathRegex. Matches compiles it on every call otherwise.
+func (m *RequestMatch) Validate() error {
+	if m.PathRegex == "" {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + m.PathRegex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid pathRegex: %w", err)
+	}
+	m.pathRegex = re
+	return nil
+}
+
+// Matches reports whether r satisfies every condition of m.
+func (m *RequestMatch) Matches(r *http.Request) bool {
+	if len(m.Hosts) > 0 && !matchesHost(m.Hosts, r.Host) {
+		return false
+	}
+	if m.Path != "" && r.URL.Path != m.Path {
+		return false
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, m.PathPrefix) {
+		return false
+	}
+	if m.PathRegex != "" {
+		re := m.pathRegex
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile("^(?:" + m.PathRegex + ")$"); err != nil {
+				return false
+			}
+		}
+		if !re.MatchString(r.URL.Path) {
+			return false
+		}
+	}
+	if len(m.Methods) > 0 {
+		found := false
+		for _, method := range m.Methods {
+			if strings.EqualFold(method, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, value := range m.Headers {
+		got, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "" && !containsValue(got, value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesHost(patterns []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		switch {
+		case p == "*" || p == host:
+			return true
+		case strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]) && len(host) > len(p)-1:
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package rep
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MetricsSource writes its metrics in the Prometheus text format.
+type MetricsSource interface {
+	WriteMetrics(w io.Writer)
+}
+
+// Metrics collects MetricsSources and serves them on /metrics.
+type Metrics struct {
+	mu      sync.Mutex
+	sources []MetricsSource
+}
+
+// Register adds s to the metrics served.
+func (m *Metrics) Register(s MetricsSource) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sources = append(m.sources, s)
+}
+
+// ServeHTTP writes the metrics of every source.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	sources := append([]MetricsSource(nil), m.sources...)
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, s := range sources {
+		s.WriteMetrics(w)
+	}
+}
+
+// writeMetric writes one sample, with labels sorted by name.
+func writeMetric(w io.Writer, name string, labels map[string]string, value any) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	if len(pairs) == 0 {
+		fmt.Fprintf(w, "%s %v\n", name, value)
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+}
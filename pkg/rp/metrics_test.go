@@ -0,0 +1,47 @@
+package rep
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsNoDuplicateSeries(t *testing.T) {
+	// The sources echo-rp registers, for the same upstream.
+	cfg := &Config{}
+	reloader, err := NewConfigReloaderFromConfig(cfg, func(*Config) (http.Handler, error) {
+		return http.NotFoundHandler(), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create reloader: %v", err)
+	}
+	breakers := &BreakerSet{}
+	breakers.Set(map[string]*Breaker{"echo": breakers.Get("echo", ConcurrencyLimit{MaxInFlight: 1})})
+	pools := &PoolSet{}
+	transport := NewProtocolTransport(UpstreamHTTP1)
+	transport.TrackEndpoints()
+	pools.Set(map[string]*ProtocolTransport{"echo": transport})
+	metrics := &Metrics{}
+	metrics.Register(breakers)
+	metrics.Register(pools)
+	metrics.Register(reloader)
+	metrics.Register(&ConnTracker{})
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	seen := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		series := line[:strings.LastIndexByte(line, ' ')]
+		if seen[series] {
+			t.Errorf("series %s written twice", series)
+		}
+		seen[series] = true
+	}
+	if len(seen) == 0 {
+		t.Error("no metrics written")
+	}
+}
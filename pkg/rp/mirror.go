@@ -0,0 +1,220 @@
+package rep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMirrorTimeout bounds shadow requests without a timeout.
+	DefaultMirrorTimeout = 30 * time.Second
+	// DefaultMirrorBuffer is how far, in bytes, a shadow request may fall
+	// behind the primary reading the body before it's abandoned.
+	DefaultMirrorBuffer = 1 << 20
+)
+
+var errMirrorAbandoned = errors.New("mirror fell behind the primary request")
+
+// MirrorPolicy sends a copy of a share of a route's requests to a shadow
+// upstream. Responses from the shadow are discarded and the shadow never
+// slows down the primary request: a shadow that can't keep up with the body
+// is abandoned. As in Envoy, the shadow sees the host with "-shadow"
+// appended.
+type MirrorPolicy struct {
+	Upstream string `json:"upstream"`
+	// Percent of the requests mirrored, 100 when unset. 0 turns mirroring
+	// off.
+	Percent *float64 `json:"percent,omitempty"`
+	// Timeout of a shadow request, DefaultMirrorTimeout when zero.
+	Timeout Duration `json:"timeout,omitempty"`
+	// Buffer is the backlog in bytes the shadow may have reading the body,
+	// DefaultMirrorBuffer when zero.
+	Buffer int `json:"buffer,omitempty"`
+}
+
+// Validate checks the percentage and the shadow upstream.
+func (m *MirrorPolicy) Validate(upstreams map[string]bool) error {
+	if !upstreams[m.Upstream] {
+		return fmt.Errorf("unknown mirror upstream %s", m.Upstream)
+	}
+	if m.Percent != nil && (*m.Percent < 0 || *m.Percent > 100) {
+		return fmt.Errorf("mirror percent must be within [0, 100], got %g", *m.Percent)
+	}
+	if m.Timeout.Duration < 0 || m.Buffer < 0 {
+		return errors.New("mirror timeout and buffer must not be negative")
+	}
+	return nil
+}
+
+// Mirror starts the shadow copy of r on shadow, if r is sampled, and returns
+// the request to serve as primary. done must be called once the primary
+// request has been served.
+func (m *MirrorPolicy) Mirror(r *http.Request, shadow http.Handler) (primary *http.Request, done func()) {
+	percent := 100.0
+	if m.Percent != nil {
+		percent = *m.Percent
+	}
+	if IsUpgradeRequest(r) || rand.Float64()*100 >= percent {
+		return r, func() {}
+	}
+	AnnotateAccessLog(r.Context(), "mirror", m.Upstream)
+
+	timeout := m.Timeout.Duration
+	if timeout == 0 {
+		timeout = DefaultMirrorTimeout
+	}
+	// The shadow outlives the primary request and must not annotate its
+	// access log line.
+	ctx := context.WithValue(context.WithoutCancel(r.Context()), accessLogKey{}, nil)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	shadowReq := r.Clone(ctx)
+	shadowReq.Host = shadowHost(r.Host)
+
+	var tee *teeBody
+	if r.Body != nil && r.Body != http.NoBody {
+		max := m.Buffer
+		if max == 0 {
+			max = DefaultMirrorBuffer
+		}
+		tee = newTeeBody(r.Body, max)
+		primary = r.Clone(r.Context())
+		primary.Body = tee
+		shadowReq.Body = tee.shadow()
+	} else {
+		primary = r
+	}
+
+	go func() {
+		defer cancel()
+		defer func() {
+			// A shadow failing must never take the proxy down.
+			if p := recover(); p != nil && p != http.ErrAbortHandler {
+				logf(LogError, "mirror to %s panicked: %v", m.Upstream, p)
+			}
+		}()
+		shadow.ServeHTTP(&discardResponseWriter{header: http.Header{}}, shadowReq)
+		if tee != nil {
+			tee.closeShadow()
+		}
+	}()
+	return primary, func() {
+		if tee != nil {
+			tee.finish()
+		}
+	}
+}
+
+// teeBody copies what the primary request reads from its body to the shadow
+// request through a bounded buffer. Writes never block; when the buffer is
+// full the shadow is abandoned.
+type teeBody struct {
+	io.ReadCloser
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	max    int
+	err    error // returned to the shadow once buf is drained
+	closed bool  // the shadow stopped reading
+}
+
+// shadowHost suffixes the host of a shadow request with -shadow, before the
+// port like Envoy does, e.g. example.com-shadow:8080.
+func shadowHost(host string) string {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(h+"-shadow", port)
+	}
+	return host + "-shadow"
+}
+
+func newTeeBody(body io.ReadCloser, max int) *teeBody {
+	t := &teeBody{ReadCloser: body, max: max}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// Read implements io.Reader for the primary request.
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil && !t.closed {
+		switch {
+		case len(t.buf)+n > t.max:
+			t.buf, t.err = nil, errMirrorAbandoned
+		default:
+			t.buf = append(t.buf, p[:n]...)
+			if err != nil {
+				t.err = err
+			}
+		}
+		t.cond.Broadcast()
+	}
+	return n, err
+}
+
+// finish ends the shadow body once the primary request is served. A body the
+// primary didn't read to the end can't be mirrored faithfully.
+func (t *teeBody) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = io.ErrUnexpectedEOF
+		t.cond.Broadcast()
+	}
+}
+
+func (t *teeBody) closeShadow() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed, t.buf = true, nil
+	t.cond.Broadcast()
+}
+
+func (t *teeBody) shadow() io.ReadCloser {
+	return &shadowBody{t}
+}
+
+type shadowBody struct {
+	t *teeBody
+}
+
+func (s *shadowBody) Read(p []byte) (int, error) {
+	t := s.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.buf) == 0 && t.err == nil && !t.closed {
+		t.cond.Wait()
+	}
+	if len(t.buf) > 0 {
+		n := copy(p, t.buf)
+		t.buf = t.buf[n:]
+		return n, nil
+	}
+	if t.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return 0, t.err
+}
+
+func (s *shadowBody) Close() error {
+	s.t.closeShadow()
+	return nil
+}
+
+// discardResponseWriter drops the shadow response.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardResponseWriter) WriteHeader(int)             {}
+func (d *discardResponseWriter) Flush()                      {}
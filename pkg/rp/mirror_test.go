@@ -0,0 +1,286 @@
+package rep
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type shadowRequest struct {
+	host string
+	body []byte
+	err  error
+}
+
+// newMirrorRouter routes every request to primary and mirrors it to shadow
+// through real proxies.
+func newMirrorRouter(t *testing.T, primary, shadow *httptest.Server, mirror MirrorPolicy) http.Handler {
+	t.Helper()
+	upstreams := map[string]http.Handler{}
+	for name, s := range map[string]*httptest.Server{"primary": primary, "shadow": shadow} {
+		target, _ := url.Parse(s.URL)
+		upstreams[name] = httputil.NewSingleHostReverseProxy(target)
+	}
+	mirror.Upstream = "shadow"
+	router, err := NewRouter([]Route{{Upstream: "primary", Mirror: &mirror}}, upstreams)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).EnableFullDuplex()
+		router.ServeHTTP(w, r)
+	})
+}
+
+func newShadowServer(got chan<- shadowRequest, before func()) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if before != nil {
+			before()
+		}
+		b, err := io.ReadAll(r.Body)
+		got <- shadowRequest{host: r.Host, body: b, err: err}
+		io.WriteString(w, "shadow response")
+	}))
+}
+
+func TestMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer primary.Close()
+	got := make(chan shadowRequest, 1)
+	shadow := newShadowServer(got, nil)
+	defer shadow.Close()
+	proxy := httptest.NewServer(newMirrorRouter(t, primary, shadow, MirrorPolicy{}))
+	defer proxy.Close()
+
+	body := strings.Repeat("mirrored body ", 10000)
+	resp, err := http.Post(proxy.URL, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != body {
+		t.Errorf("primary response has %d bytes, want %d", len(b), len(body))
+	}
+
+	select {
+	case s := <-got:
+		if s.err != nil || string(s.body) != body {
+			t.Errorf("shadow got %d bytes (err %v), want %d", len(s.body), s.err, len(body))
+		}
+		host, port, _ := net.SplitHostPort(strings.TrimPrefix(proxy.URL, "http://"))
+		if want := host + "-shadow:" + port; s.host != want {
+			t.Errorf("shadow host = %q, want %q", s.host, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow request not received")
+	}
+}
+
+func TestShadowHost(t *testing.T) {
+	for host, want := range map[string]string{
+		"example.com":      "example.com-shadow",
+		"example.com:8080": "example.com-shadow:8080",
+		"10.0.0.1:80":      "10.0.0.1-shadow:80",
+	} {
+		if got := shadowHost(host); got != want {
+			t.Errorf("shadowHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestMirrorSlowShadowDoesNotDelayPrimary(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		io.WriteString(w, strings.Repeat("x", int(n%10)))
+	}))
+	defer primary.Close()
+	release := make(chan struct{})
+	got := make(chan shadowRequest, 1)
+	shadow := newShadowServer(got, func() { <-release })
+	defer shadow.Close()
+	proxy := httptest.NewServer(newMirrorRouter(t, primary, shadow, MirrorPolicy{Buffer: 1024}))
+	defer proxy.Close()
+
+	body := bytes.Repeat([]byte("x"), 16<<20)
+	start := time.Now()
+	resp, err := http.Post(proxy.URL, "text/plain", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("primary took %v with a stuck shadow", d)
+	}
+
+	close(release)
+	select {
+	case s := <-got:
+		if s.err == nil && len(s.body) == len(body) {
+			t.Error("shadow that fell behind received the full body")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow request not received")
+	}
+}
+
+func TestMirrorFullDuplex(t *testing.T) {
+	// The primary echoes the body as it arrives, so the client only sends the
+	// next chunk once the previous one came back.
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		rc.EnableFullDuplex()
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				rc.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer primary.Close()
+	got := make(chan shadowRequest, 1)
+	shadow := newShadowServer(got, nil)
+	defer shadow.Close()
+	proxy := httptest.NewServer(newMirrorRouter(t, primary, shadow, MirrorPolicy{}))
+	defer proxy.Close()
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL, pr)
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Failed to execute request: %v", err)
+			pr.Close()
+			close(respCh)
+			return
+		}
+		respCh <- resp
+	}()
+
+	var sent bytes.Buffer
+	pw.Write([]byte("chunk-0\n"))
+	sent.WriteString("chunk-0\n")
+	resp, ok := <-respCh
+	if !ok {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, 64)
+	for i := 1; i <= 20; i++ {
+		if _, err := io.ReadFull(resp.Body, buf[:8]); err != nil {
+			t.Fatalf("Failed to read echoed chunk %d: %v", i-1, err)
+		}
+		chunk := []byte(fmt.Sprintf("chunk-%c\n", 'a'+i))
+		pw.Write(chunk)
+		sent.Write(chunk)
+	}
+	pw.Close()
+	rest, _ := io.ReadAll(resp.Body)
+	if len(rest) != 8 {
+		t.Errorf("got %d trailing bytes, want 8", len(rest))
+	}
+
+	select {
+	case s := <-got:
+		if s.err != nil || !bytes.Equal(s.body, sent.Bytes()) {
+			t.Errorf("shadow got %q (err %v), want %q", s.body, s.err, sent.Bytes())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow request not received")
+	}
+}
+
+func TestMirrorPercent(t *testing.T) {
+	var primary, shadow atomic.Int64
+	upstreams := map[string]http.Handler{
+		"primary": http.HandlerFunc(func(http.ResponseWriter, *http.Request) { primary.Add(1) }),
+		"shadow":  http.HandlerFunc(func(http.ResponseWriter, *http.Request) { shadow.Add(1) }),
+	}
+	router, err := NewRouter([]Route{{Upstream: "primary", Mirror: &MirrorPolicy{Upstream: "shadow", Percent: ptrTo(10.0)}}}, upstreams)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	const n = 5000
+	for i := 0; i < n; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	// Shadows run asynchronously, wait for them to settle.
+	for last := int64(-1); last != shadow.Load(); time.Sleep(50 * time.Millisecond) {
+		last = shadow.Load()
+	}
+	counts := map[string]int{"mirrored": int(shadow.Load()), "skipped": n - int(shadow.Load())}
+	split := TrafficSplit{Targets: []TrafficTarget{{Upstream: "mirrored", Weight: 10}, {Upstream: "skipped", Weight: 90}}}
+	if x := chiSquare(split, counts, n); x > chiSquareCritical {
+		t.Errorf("mirrored %d of %d requests at 10%%, chi-square = %.2f", shadow.Load(), n, x)
+	}
+	if primary.Load() != n {
+		t.Errorf("primary served %d requests, want %d", primary.Load(), n)
+	}
+}
+
+func TestMirrorDisabled(t *testing.T) {
+	var shadow atomic.Int64
+	upstreams := map[string]http.Handler{
+		"primary": http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		"shadow":  http.HandlerFunc(func(http.ResponseWriter, *http.Request) { shadow.Add(1) }),
+	}
+	router, err := NewRouter([]Route{{Upstream: "primary", Mirror: &MirrorPolicy{Upstream: "shadow", Percent: ptrTo(0.0)}}}, upstreams)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := shadow.Load(); n != 0 {
+		t.Errorf("mirrored %d requests at 0%%, want none", n)
+	}
+}
+
+func TestMirrorPolicyValidate(t *testing.T) {
+	upstreams := map[string]bool{"shadow": true}
+	tests := []struct {
+		name    string
+		percent *float64
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "zero", percent: ptrTo(0.0)},
+		{name: "hundred", percent: ptrTo(100.0)},
+		{name: "negative", percent: ptrTo(-1.0), wantErr: true},
+		{name: "over hundred", percent: ptrTo(100.5), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &MirrorPolicy{Upstream: "shadow", Percent: test.percent}
+			if err := m.Validate(upstreams); (err != nil) != test.wantErr {
+				t.Errorf("Validate() = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package rep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// ConnectionPool tunes the connections kept to the endpoints of an upstream.
+// Zero values keep the defaults of Go's transports.
+type ConnectionPool struct {
+	// MaxIdleConnsPerHost is the number of idle HTTP/1 connections kept per
+	// endpoint, 2 when zero.
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
+	// MaxConnsPerHost limits the HTTP/1 connections per endpoint, dialing,
+	// in use and idle. Requests wait for one beyond. Unlimited when zero.
+	MaxConnsPerHost int `json:"maxConnsPerHost,omitempty"`
+	// IdleTimeout closes connections idle for longer, 90s when zero.
+	IdleTimeout Duration `json:"idleTimeout,omitempty"`
+	// MaxConcurrentStreams caps the requests sent at once on an h2c
+	// connection, below the limit of the upstream. More connections are
+	// opened beyond it. The upstream's limit when zero.
+	MaxConcurrentStreams int `json:"maxConcurrentStreams,omitempty"`
+	// ReadIdleTimeout pings HTTP/2 connections nothing was read on for that
+	// long, 30s when zero, closing them when the ping isn't answered within
+	// PingTimeout, 15s when zero.
+	ReadIdleTimeout Duration `json:"readIdleTimeout,omitempty"`
+	PingTimeout     Duration `json:"pingTimeout,omitempty"`
+}
+
+// Validate checks that no value is negative.
+func (p *ConnectionPool) Validate() error {
+	if p.MaxIdleConnsPerHost < 0 || p.MaxConnsPerHost < 0 || p.MaxConcurrentStreams < 0 {
+		return errors.New("pool: limits must not be negative")
+	}
+	if p.IdleTimeout.Duration < 0 || p.ReadIdleTimeout.Duration < 0 || p.PingTimeout.Duration < 0 {
+		return errors.New("pool: timeouts must not be negative")
+	}
+	return nil
+}
+
+// SetPool applies p to both transports. It's called once, before any
+// request.
+func (t *ProtocolTransport) SetPool(p ConnectionPool) error {
+	if t1, ok := t.HTTP1.(*http.Transport); ok {
+		if p.MaxIdleConnsPerHost > 0 {
+			t1.MaxIdleConnsPerHost = p.MaxIdleConnsPerHost
+		}
+		t1.MaxConnsPerHost = p.MaxConnsPerHost
+		if p.IdleTimeout.Duration > 0 {
+			t1.IdleConnTimeout = p.IdleTimeout.Duration
+		}
+		// HTTP/2 negotiated over TLS, whose idle timeout is the one of t1.
+		if t1.DialTLSContext != nil {
+			t2, err := http2.ConfigureTransports(t1)
+			if err != nil {
+				return fmt.Errorf("failed to configure HTTP/2: %w", err)
+			}
+			t2.ReadIdleTimeout = DefaultReadIdleTimeout
+			t2.PingTimeout = DefaultPingTimeout
+			setPings(t2, p)
+			t.h2 = t2
+		}
+	}
+	if t2, ok := t.H2C.(*http2.Transport); ok {
+		t2.IdleConnTimeout = p.IdleTimeout.Duration
+		setPings(t2, p)
+		if p.MaxConcurrentStreams > 0 {
+			t2.ConnPool = &h2cConnPool{
+				t:          t2,
+				maxStreams: p.MaxConcurrentStreams,
+				conns:      map[string][]*http2.ClientConn{},
+				dialing:    map[string][]*h2cDial{},
+			}
+		}
+	}
+	return nil
+}
+
+// setPings overrides the health checks of t2 set in p.
+func setPings(t2 *http2.Transport, p ConnectionPool) {
+	if p.ReadIdleTimeout.Duration > 0 {
+		t2.ReadIdleTimeout = p.ReadIdleTimeout.Duration
+	}
+	if p.PingTimeout.Duration > 0 {
+		t2.PingTimeout = p.PingTimeout.Duration
+	}
+}
+
+// h2cConnPool is the http2.ClientConnPool of an h2c transport sending at
+// most maxStreams requests at once on each connection.
+type h2cConnPool struct {
+	t          *http2.Transport
+	maxStreams int
+
+	mu      sync.Mutex
+	conns   map[string][]*http2.ClientConn
+	dialing map[string][]*h2cDial
+}
+
+// h2cDial is a connection being dialed, the requests waiting for it share
+// it.
+type h2cDial struct {
+	waiters int
+	done    chan struct{}
+	err     error
+}
+
+// GetClientConn returns a connection to addr with a stream reserved for req,
+// dialing one if every connection has maxStreams requests.
+func (p *h2cConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	for {
+		p.mu.Lock()
+		if cc := p.reserve(addr); cc != nil {
+			p.mu.Unlock()
+			return cc, nil
+		}
+		var wait *h2cDial
+		for _, d := range p.dialing[addr] {
+			if d.waiters < p.maxStreams {
+				wait = d
+				break
+			}
+		}
+		if wait == nil {
+			d := &h2cDial{waiters: 1, done: make(chan struct{})}
+			p.dialing[addr] = append(p.dialing[addr], d)
+			p.mu.Unlock()
+			return p.dial(req, addr, d)
+		}
+		wait.waiters++
+		p.mu.Unlock()
+
+		select {
+		case <-wait.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		// A dial canceled with the request that started it is retried.
+		if wait.err != nil && !errors.Is(wait.err, context.Canceled) && !errors.Is(wait.err, context.DeadlineExceeded) {
+			return nil, wait.err
+		}
+	}
+}
+
+// reserve reserves a stream on a connection to addr with less than
+// maxStreams requests. Called with mu held.
+func (p *h2cConnPool) reserve(addr string) *http2.ClientConn {
+	for _, cc := range p.conns[addr] {
+		s := cc.State()
+		if s.Closed || s.Closing || s.StreamsActive+s.StreamsReserved+s.StreamsPending >= p.maxStreams {
+			continue
+		}
+		if cc.ReserveNewRequest() {
+			return cc
+		}
+	}
+	return nil
+}
+
+func (p *h2cConnPool) dial(req *http.Request, addr string, d *h2cDial) (*http2.ClientConn, error) {
+	var cc *http2.ClientConn
+	c, err := p.t.DialTLSContext(req.Context(), "tcp", addr, nil)
+	if err == nil {
+		if cc, err = p.t.NewClientConn(c); err != nil {
+			c.Close()
+		}
+	}
+	// The dialing request gets the first stream.
+	if err == nil && !cc.ReserveNewRequest() {
+		cc.Close()
+		err = fmt.Errorf("new connection to %s can't take requests", addr)
+	}
+
+	p.mu.Lock()
+	for i, pending := range p.dialing[addr] {
+		if pending == d {
+			p.dialing[addr] = append(p.dialing[addr][:i:i], p.dialing[addr][i+1:]...)
+			break
+		}
+	}
+	if len(p.dialing[addr]) == 0 {
+		delete(p.dialing, addr)
+	}
+	if err == nil {
+		p.conns[addr] = append(p.conns[addr], cc)
+	}
+	d.err = err
+	close(d.done)
+	p.mu.Unlock()
+	return cc, err
+}
+
+// MarkDead forgets cc, e.g. closed or sent a GOAWAY.
+func (p *h2cConnPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.conns {
+		for i, c := range conns {
+			if c == cc {
+				p.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+				if len(p.conns[addr]) == 0 {
+					delete(p.conns, addr)
+				}
+				return
+			}
+		}
+	}
+}
+
+// closeIdle closes the connections without requests.
+func (p *h2cConnPool) closeIdle() {
+	var idle []*http2.ClientConn
+	p.mu.Lock()
+	for _, conns := range p.conns {
+		for _, cc := range conns {
+			if s := cc.State(); s.StreamsActive+s.StreamsReserved+s.StreamsPending == 0 {
+				idle = append(idle, cc)
+			}
+		}
+	}
+	p.mu.Unlock()
+	for _, cc := range idle {
+		cc.Close()
+	}
+}
+
+// PoolStats is a snapshot of the connections of a transport.
+type PoolStats struct {
+	Open  int `json:"open"`
+	InUse int `json:"inUse"`
+	Idle  int `json:"idle"`
+	// Requests in flight, more than connections in use with HTTP/2.
+	Requests int    `json:"requests"`
+	Dials    uint64 `json:"dials"`
+	// DialsPerSecond is the rate of new connections over the last 10s.
+	DialsPerSecond float64 `json:"dialsPerSecond"`
+	// Retries counts the requests resent on another connection, e.g. not
+	// processed by an upstream closing the first one with a GOAWAY.
+	Retries uint64 `json:"retries"`
+	// HTTP2Errors counts the HTTP/2 connection errors by type, e.g.
+	// conn_close_lost_ping for connections closed by a health check, or
+	// recv_goaway_PROTOCOL_ERROR.
+	HTTP2Errors map[string]uint64 `json:"http2Errors,omitempty"`
+}
+
+// PoolStats returns the stats of the connections tracked since
+// TrackEndpoints.
+func (t *ProtocolTransport) PoolStats() PoolStats {
+	if t.conns == nil {
+		return PoolStats{}
+	}
+	return t.conns.stats(time.Now())
+}
+
+// PoolSet holds the transport of each upstream, replaced on config reloads,
+// to report their connection pools. Upstreams with the same URL host share
+// a transport, and stats.
+type PoolSet struct {
+	mu         sync.Mutex
+	transports map[string]*ProtocolTransport
+}
+
+// Set replaces the transports, by upstream name.
+func (s *PoolSet) Set(transports map[string]*ProtocolTransport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transports = transports
+}
+
+// Stats returns the stats of the pool of every upstream.
+func (s *PoolSet) Stats() map[string]PoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make(map[string]PoolStats, len(s.transports))
+	for name, t := range s.transports {
+		stats[name] = t.PoolStats()
+	}
+	return stats
+}
+
+// WriteMetrics implements MetricsSource.
+func (s *PoolSet) WriteMetrics(w io.Writer) {
+	stats := s.Stats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		st := stats[name]
+		writeMetric(w, "rp_upstream_connections", map[string]string{"upstream": name, "state": "in_use"}, st.InUse)
+		writeMetric(w, "rp_upstream_connections", map[string]string{"upstream": name, "state": "idle"}, st.Idle)
+		writeMetric(w, "rp_upstream_connections_open", map[string]string{"upstream": name}, st.Open)
+		writeMetric(w, "rp_upstream_pool_active_requests", map[string]string{"upstream": name}, st.Requests)
+		writeMetric(w, "rp_upstream_dials_total", map[string]string{"upstream": name}, st.Dials)
+		writeMetric(w, "rp_upstream_retries_total", map[string]string{"upstream": name}, st.Retries)
+		types := make([]string, 0, len(st.HTTP2Errors))
+		for typ := range st.HTTP2Errors {
+			types = append(types, typ)
+		}
+		sort.Strings(types)
+		for _, typ := range types {
+			writeMetric(w, "rp_upstream_http2_errors_total", map[string]string{"upstream": name, "type": typ}, st.HTTP2Errors[typ])
+		}
+	}
+}
+
+// dialRate counts dials in one second buckets.
+type dialRate struct {
+	seconds [10]int64
+	counts  [10]uint64
+}
+
+func (r *dialRate) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % int64(len(r.seconds))
+	if r.seconds[i] != sec {
+		r.seconds[i], r.counts[i] = sec, 0
+	}
+	r.counts[i]++
+}
+
+func (r *dialRate) perSecond(now time.Time) float64 {
+	sec := now.Unix()
+	var n uint64
+	for i, s := range r.seconds {
+		if s > sec-int64(len(r.seconds)) && s <= sec {
+			n += r.counts[i]
+		}
+	}
+	return float64(n) / float64(len(r.seconds))
+}
@@ -0,0 +1,328 @@
+package rep
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// blockingUpstream answers /slow once release is closed.
+func blockingUpstream(t *testing.T, release chan struct{}) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		io.WriteString(w, r.Proto)
+	}), &http2.Server{}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestTransportPoolStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		proto UpstreamProtocol
+		pool  ConnectionPool
+		slow  int
+		// Requests over MaxConnsPerHost wait for a connection.
+		wantRequests int
+		wantOpen     int
+	}{{
+		name:         "http1",
+		proto:        UpstreamHTTP1,
+		slow:         3,
+		wantRequests: 3,
+		wantOpen:     3,
+	}, {
+		name:         "http1 max conns per host",
+		proto:        UpstreamHTTP1,
+		pool:         ConnectionPool{MaxConnsPerHost: 2},
+		slow:         3,
+		wantRequests: 2,
+		wantOpen:     2,
+	}, {
+		name:         "h2c",
+		proto:        UpstreamH2C,
+		slow:         4,
+		wantRequests: 4,
+		wantOpen:     1,
+	}, {
+		name:         "h2c max concurrent streams",
+		proto:        UpstreamH2C,
+		pool:         ConnectionPool{MaxConcurrentStreams: 2},
+		slow:         4,
+		wantRequests: 4,
+		wantOpen:     2,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			upstream := blockingUpstream(t, release)
+			transport := NewProtocolTransport(test.proto)
+			if err := transport.SetPool(test.pool); err != nil {
+				t.Fatalf("SetPool() = %v", err)
+			}
+			transport.TrackEndpoints()
+			defer transport.CloseIdleConnections()
+			client := &http.Client{Transport: transport}
+
+			var wg sync.WaitGroup
+			for i := 0; i < test.slow; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := client.Get(upstream.URL + "/slow")
+					if err != nil {
+						t.Errorf("Get() = %v", err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}()
+			}
+			waitFor(t, "the requests in flight", func() bool { return transport.PoolStats().Requests == test.wantRequests })
+			s := transport.PoolStats()
+			if s.Open != test.wantOpen || s.InUse != test.wantOpen || s.Idle != 0 || s.Dials != uint64(test.wantOpen) {
+				t.Errorf("PoolStats() = %+v, want %d open, in use and dialed", s, test.wantOpen)
+			}
+			if s.DialsPerSecond <= 0 {
+				t.Errorf("DialsPerSecond = %v, want a rate", s.DialsPerSecond)
+			}
+
+			close(release)
+			wg.Wait()
+			waitFor(t, "the connections to be idle", func() bool {
+				s := transport.PoolStats()
+				return s.Open > 0 && s.InUse == 0 && s.Idle == s.Open && s.Requests == 0
+			})
+			transport.CloseIdleConnections()
+			waitFor(t, "the idle connections closed", func() bool { return transport.PoolStats().Open == 0 })
+		})
+	}
+}
+
+func TestDialRate(t *testing.T) {
+	var r dialRate
+	start := time.Unix(1000, 0)
+	for i := 0; i < 20; i++ {
+		r.add(start.Add(time.Duration(i) * 500 * time.Millisecond))
+	}
+	// 20 dials over 10s.
+	if got := r.perSecond(start.Add(9 * time.Second)); got != 2 {
+		t.Errorf("perSecond() = %v, want 2", got)
+	}
+	if got := r.perSecond(start.Add(14 * time.Second)); got != 1 {
+		t.Errorf("perSecond() 5s later = %v, want 1", got)
+	}
+	if got := r.perSecond(start.Add(time.Minute)); got != 0 {
+		t.Errorf("perSecond() a minute later = %v, want 0", got)
+	}
+}
+
+// goAwayUpstream answers the first request of its first connection with a
+// GOAWAY processing no stream, once the request body was sent. Its other
+// connections echo the body.
+func goAwayUpstream(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})
+	go func() {
+		for first := true; ; first = false {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if !first {
+				go (&http2.Server{}).ServeConn(c, &http2.ServeConnOpts{Handler: echo})
+				continue
+			}
+			go func() {
+				defer c.Close()
+				if _, err := io.ReadFull(c, make([]byte, len(http2.ClientPreface))); err != nil {
+					return
+				}
+				fr := http2.NewFramer(c, c)
+				fr.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 20})
+				fr.WriteWindowUpdate(0, 1<<20)
+				for {
+					f, err := fr.ReadFrame()
+					if err != nil {
+						return
+					}
+					if f.Header().Flags.Has(http2.FlagDataEndStream) && f.Header().Type == http2.FrameData ||
+						f.Header().Flags.Has(http2.FlagHeadersEndStream) && f.Header().Type == http2.FrameHeaders {
+						break
+					}
+				}
+				fr.WriteGoAway(0, http2.ErrCodeNo, nil)
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTransportGoAwayRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{{
+		name: "no body",
+	}, {
+		name: "body",
+		body: "hello",
+	}, {
+		name:    "body over the replay limit",
+		body:    strings.Repeat("a", maxReplayBody+1),
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := goAwayUpstream(t)
+			transport := NewProtocolTransport(UpstreamH2C)
+			if err := transport.SetPool(ConnectionPool{}); err != nil {
+				t.Fatalf("SetPool() = %v", err)
+			}
+			transport.TrackEndpoints()
+			defer transport.CloseIdleConnections()
+
+			// Without GetBody, like the requests of a ReverseProxy.
+			var body io.Reader
+			if test.body != "" {
+				body = io.NopCloser(strings.NewReader(test.body))
+			}
+			r, _ := http.NewRequest(http.MethodPost, "http://"+addr, body)
+			resp, err := transport.RoundTrip(r)
+			if test.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("RoundTrip() = nil error, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RoundTrip() = %v", err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(got) != test.body {
+				t.Errorf("body = %q, want %q", got, test.body)
+			}
+			if s := transport.PoolStats(); s.Dials != 2 || s.Retries != 1 {
+				t.Errorf("PoolStats() = %+v, want 2 dials and 1 retry", s)
+			}
+		})
+	}
+}
+
+// getBodyRecorder records whether requests can be resent with GetBody.
+type getBodyRecorder struct {
+	replayable []bool
+}
+
+func (g *getBodyRecorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	g.replayable = append(g.replayable, r.GetBody != nil)
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+}
+
+func TestTransportReplaysHTTP2Only(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		proto  UpstreamProtocol
+		replay bool
+	}{
+		{"http1", "http://upstream", UpstreamHTTP1, false},
+		{"h2c", "http://upstream", UpstreamH2C, true},
+		{"https", "https://upstream", UpstreamHTTP1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := &getBodyRecorder{}
+			transport := &ProtocolTransport{HTTP1: rec, H2C: rec, Default: test.proto}
+			// Without GetBody, like the requests of a ReverseProxy.
+			r, _ := http.NewRequest(http.MethodPost, test.url, io.NopCloser(strings.NewReader("hello")))
+			resp, err := transport.RoundTrip(r)
+			if err != nil {
+				t.Fatalf("RoundTrip() = %v", err)
+			}
+			resp.Body.Close()
+			if want := []bool{test.replay}; !slices.Equal(rec.replayable, want) {
+				t.Errorf("replayable = %v, want %v", rec.replayable, want)
+			}
+		})
+	}
+}
+
+func TestSetPoolPings(t *testing.T) {
+	tests := []struct {
+		name        string
+		pool        ConnectionPool
+		https       bool
+		wantIdle    time.Duration
+		wantTimeout time.Duration
+	}{{
+		name:        "h2c defaults",
+		wantIdle:    DefaultReadIdleTimeout,
+		wantTimeout: DefaultPingTimeout,
+	}, {
+		name:        "h2c",
+		pool:        ConnectionPool{ReadIdleTimeout: Duration{time.Second}, PingTimeout: Duration{2 * time.Second}},
+		wantIdle:    time.Second,
+		wantTimeout: 2 * time.Second,
+	}, {
+		name:        "h2c read idle timeout only",
+		pool:        ConnectionPool{ReadIdleTimeout: Duration{time.Second}},
+		wantIdle:    time.Second,
+		wantTimeout: DefaultPingTimeout,
+	}, {
+		name:        "https defaults",
+		https:       true,
+		wantIdle:    DefaultReadIdleTimeout,
+		wantTimeout: DefaultPingTimeout,
+	}, {
+		name:        "https",
+		pool:        ConnectionPool{ReadIdleTimeout: Duration{time.Second}, PingTimeout: Duration{2 * time.Second}},
+		https:       true,
+		wantIdle:    time.Second,
+		wantTimeout: 2 * time.Second,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := NewProtocolTransport(UpstreamH2C)
+			if test.https {
+				transport.HTTP1 = NewHTTPSTransport(nil)
+			}
+			if err := transport.SetPool(test.pool); err != nil {
+				t.Fatalf("SetPool() = %v", err)
+			}
+			t2 := transport.H2C.(*http2.Transport)
+			if test.https {
+				t2 = transport.h2
+			}
+			if t2.ReadIdleTimeout != test.wantIdle || t2.PingTimeout != test.wantTimeout {
+				t.Errorf("ReadIdleTimeout, PingTimeout = %v, %v, want %v, %v", t2.ReadIdleTimeout, t2.PingTimeout, test.wantIdle, test.wantTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package rep
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Knative probe headers, as in knative.dev/networking/pkg/http/header.
+const (
+	// ProbeHeaderName marks probes from Knative components. They are
+	// answered by the proxy and never forwarded.
+	ProbeHeaderName = "K-Network-Probe"
+	// ProbeHeaderValue is sent by the ingress prober, which expects
+	// HashHeaderName echoed back.
+	ProbeHeaderValue = "probe"
+	// QueueProbeValue is sent by the activator to check readiness, like
+	// queue-proxy answers it.
+	QueueProbeValue = "queue"
+	// HashHeaderName carries the hash of the ingress configuration probed.
+	HashHeaderName = "K-Network-Hash"
+	// KubeletProbeHeaderName marks kubelet probes rewritten by Knative.
+	KubeletProbeHeaderName = "K-Kubelet-Probe"
+
+	kubeProbeUserAgentPrefix = "kube-probe/"
+)
+
+// DefaultProbeTimeout bounds the upstream dials of a readiness probe.
+const DefaultProbeTimeout = time.Second
+
+var probeBackoff = wait.Backoff{
+	Duration: 50 * time.Millisecond,
+	Factor:   1.4,
+	Jitter:   0.1,
+	Steps:    3,
+}
+
+// Prober answers liveness and readiness probes in front of the proxy.
+// Readiness fails while draining or when an upstream can't be dialed.
+type Prober struct {
+	Drainer *Drainer
+	// Upstreams maps names to the host:port dialed by readiness probes.
+	// Change it with SetUpstreams once serving.
+	Upstreams map[string]string
+	// ReadinessPath and LivenessPath serve the probes. Requests with Knative
+	// probe headers are answered on any path. Disabled when empty.
+	ReadinessPath string
+	LivenessPath  string
+	// Timeout bounds the dials of a probe, DefaultProbeTimeout when zero.
+	Timeout time.Duration
+	// Dial is replaced in tests, NewBackoffDialer when nil.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	mu sync.RWMutex
+}
+
+// SetUpstreams replaces the upstreams checked, e.g. on a config reload.
+func (p *Prober) SetUpstreams(upstreams map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Upstreams = upstreams
+}
+
+func (p *Prober) upstreams() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.Upstreams
+}
+
+// ProbeStatus is the body of readiness responses.
+type ProbeStatus struct {
+	Ready    bool `json:"ready"`
+	Draining bool `json:"draining"`
+	// Upstreams maps every upstream to "ok" or the dial error.
+	Upstreams map[string]string `json:"upstreams,omitempty"`
+}
+
+// IsKubeletProbe reports whether r comes from the kubelet.
+func IsKubeletProbe(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("User-Agent"), kubeProbeUserAgentPrefix) ||
+		r.Header.Get(KubeletProbeHeaderName) != ""
+}
+
+// Check dials every upstream and reports whether the proxy is ready.
+func (p *Prober) Check(ctx context.Context) ProbeStatus {
+	status := ProbeStatus{Draining: p.Drainer != nil && p.Drainer.Draining()}
+	if status.Draining {
+		return status
+	}
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = DefaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dial := p.Dial
+	if dial == nil {
+		dial = NewBackoffDialer(probeBackoff)
+	}
+
+	upstreams := p.upstreams()
+	status.Ready = true
+	status.Upstreams = make(map[string]string, len(upstreams))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, addr := range upstreams {
+		name, addr := name, addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "ok"
+			c, err := dial(ctx, "tcp", addr)
+			if err != nil {
+				result = err.Error()
+			} else {
+				c.Close()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			status.Upstreams[name] = result
+			if err != nil {
+				status.Ready = false
+			}
+		}()
+	}
+	wg.Wait()
+	return status
+}
+
+// Handler answers probes and passes other requests to h, counted by the
+// Drainer if there is one.
+func (p *Prober) Handler(h http.Handler) http.Handler {
+	if p.Drainer != nil {
+		h = p.Drainer.Handler(h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch probe := r.Header.Get(ProbeHeaderName); {
+		case probe == ProbeHeaderValue:
+			// The ingress prober only checks the proxy got the config.
+			if hash := r.Header.Get(HashHeaderName); hash != "" {
+				w.Header().Set(HashHeaderName, hash)
+			}
+			if p.Drainer != nil && p.Drainer.Draining() {
+				http.Error(w, "draining", http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case probe != "", p.ReadinessPath != "" && r.URL.Path == p.ReadinessPath:
+			p.serveReadiness(w, r)
+		case p.LivenessPath != "" && r.URL.Path == p.LivenessPath:
+			w.WriteHeader(http.StatusOK)
+		case IsKubeletProbe(r) && r.URL.Path == "/":
+			// Kubelet HTTP probes without a path, as rewritten by Knative.
+			p.serveReadiness(w, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (p *Prober) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	status := p.Check(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if probe := r.Header.Get(ProbeHeaderName); probe != "" {
+		w.Header().Set(ProbeHeaderName, probe)
+	}
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// UpstreamAddrs returns the host:port of every upstream, for Prober.
+// Upstreams with listed or discovered endpoints are left out, their health
+// is up to what lists them.
+func UpstreamAddrs(upstreams []UpstreamConfig) map[string]string {
+	addrs := make(map[string]string, len(upstreams))
+	for _, u := range upstreams {
+		if !u.Discovered() {
+			addrs[u.Name] = hostPort(u.URL)
+		}
+	}
+	return addrs
+}
+
+// hostPort returns the host:port dialed for rawURL, with the default port
+// of its scheme if needed.
+func hostPort(rawURL string) string {
+	scheme, rest, _ := strings.Cut(rawURL, "://")
+	host, _, _ := strings.Cut(rest, "/")
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
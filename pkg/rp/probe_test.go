@@ -0,0 +1,172 @@
+package rep
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProberHandler(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	// A port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	down := ln.Addr().String()
+	ln.Close()
+
+	var proxied int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied++
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		name      string
+		upstreams map[string]string
+		draining  bool
+		path      string
+		header    http.Header
+		want      int
+		wantHash  string
+		proxied   bool
+	}{{
+		name:      "readiness",
+		upstreams: map[string]string{"up": up.Listener.Addr().String()},
+		path:      "/ready",
+		want:      http.StatusOK,
+	}, {
+		name:      "readiness with an unreachable upstream",
+		upstreams: map[string]string{"up": up.Listener.Addr().String(), "down": down},
+		path:      "/ready",
+		want:      http.StatusServiceUnavailable,
+	}, {
+		name:     "readiness while draining",
+		draining: true,
+		path:     "/ready",
+		want:     http.StatusServiceUnavailable,
+	}, {
+		name:     "liveness while draining",
+		draining: true,
+		path:     "/healthz",
+		want:     http.StatusOK,
+	}, {
+		name:      "liveness with an unreachable upstream",
+		upstreams: map[string]string{"down": down},
+		path:      "/healthz",
+		want:      http.StatusOK,
+	}, {
+		name:     "ingress probe",
+		path:     "/any",
+		header:   http.Header{ProbeHeaderName: {ProbeHeaderValue}, HashHeaderName: {"abc"}},
+		want:     http.StatusOK,
+		wantHash: "abc",
+	}, {
+		name:     "ingress probe while draining",
+		draining: true,
+		path:     "/",
+		header:   http.Header{ProbeHeaderName: {ProbeHeaderValue}},
+		want:     http.StatusServiceUnavailable,
+	}, {
+		name:      "queue probe",
+		upstreams: map[string]string{"down": down},
+		path:      "/",
+		header:    http.Header{ProbeHeaderName: {QueueProbeValue}},
+		want:      http.StatusServiceUnavailable,
+	}, {
+		name:   "kubelet probe",
+		path:   "/",
+		header: http.Header{"User-Agent": {"kube-probe/1.28"}},
+		want:   http.StatusOK,
+	}, {
+		name:     "kubelet probe header while draining",
+		draining: true,
+		path:     "/",
+		header:   http.Header{KubeletProbeHeaderName: {"queue"}},
+		want:     http.StatusServiceUnavailable,
+	}, {
+		name:    "kubelet probe elsewhere is proxied",
+		path:    "/app/health",
+		header:  http.Header{"User-Agent": {"kube-probe/1.28"}},
+		want:    http.StatusTeapot,
+		proxied: true,
+	}, {
+		name:    "request",
+		path:    "/",
+		want:    http.StatusTeapot,
+		proxied: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxied = 0
+			p := &Prober{
+				Drainer:       NewDrainer(),
+				Upstreams:     test.upstreams,
+				ReadinessPath: "/ready",
+				LivenessPath:  "/healthz",
+			}
+			if test.draining {
+				p.Drainer.StartDraining()
+			}
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			p.Handler(next).ServeHTTP(rec, req)
+
+			if rec.Code != test.want {
+				t.Errorf("status = %d, want %d, body: %s", rec.Code, test.want, rec.Body)
+			}
+			if got := rec.Header().Get(HashHeaderName); got != test.wantHash {
+				t.Errorf("%s = %q, want %q", HashHeaderName, got, test.wantHash)
+			}
+			if got := proxied == 1; got != test.proxied {
+				t.Errorf("proxied = %v, want %v", got, test.proxied)
+			}
+		})
+	}
+}
+
+func TestProberReportsUpstreams(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	p := &Prober{Upstreams: map[string]string{"echo": up.Listener.Addr().String()}}
+
+	if s := p.Check(context.Background()); !s.Ready || s.Upstreams["echo"] != "ok" {
+		t.Errorf("Check() with the upstream up = %+v", s)
+	}
+	up.Close()
+
+	rec := httptest.NewRecorder()
+	p.serveReadiness(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readiness with the upstream down = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	var s ProbeStatus
+	if err := json.NewDecoder(rec.Body).Decode(&s); err != nil {
+		t.Fatalf("Failed to decode the probe status: %v", err)
+	}
+	if s.Ready || s.Upstreams["echo"] == "ok" {
+		t.Errorf("status with the upstream down = %+v", s)
+	}
+}
+
+func TestHostPort(t *testing.T) {
+	for url, want := range map[string]string{
+		"http://echo.default.svc":        "echo.default.svc:80",
+		"https://echo.default.svc/path":  "echo.default.svc:443",
+		"h2c://127.0.0.1:8080":           "127.0.0.1:8080",
+		"http://[::1]/":                  "[::1]:80",
+		"http://echo.default.svc:8080/x": "echo.default.svc:8080",
+	} {
+		if got := hostPort(url); got != want {
+			t.Errorf("hostPort(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package rep
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"os"
+)
+
+func NewHeaderPruningReverseProxy(target, hostOverride string, headersToRemove []string, useHTTPS bool) *httputil.ReverseProxy {
+	UserAgentKey := "User-Agent"
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			if useHTTPS {
+				req.URL.Scheme = "https"
+			} else {
+				req.URL.Scheme = "http"
+			}
+			req.URL.Host = target
+
+			if hostOverride != "" {
+				req.Host = hostOverride
+				req.Header.Add("K-Passthrough-Lb", "true")
+			}
+
+			// Copied from httputil.NewSingleHostReverseProxy.
+			if _, ok := req.Header[UserAgentKey]; !ok {
+				// explicitly disable User-Agent so it's not set to default value
+				req.Header.Set(UserAgentKey, "")
+			}
+
+			for _, h := range headersToRemove {
+				req.Header.Del(h)
+			}
+		},
+	}
+}
+
+func ErrorHandler() func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+
+		ss := readSockStat()
+		logf(LogError, "error reverse proxying request; sockstat: %q, %v - %v", ss, err, req)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func readSockStat() string {
+	b, err := os.ReadFile("/proc/net/sockstat")
+	if err != nil {
+		logf(LogError, "Unable to read sockstat: %v", err)
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,321 @@
+package rep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate limit keys. A rule keyed by RateLimitKeyRule has a single bucket
+// shared by every request matching the rule, whatever route it then takes:
+// the limits apply before routing.
+const (
+	RateLimitKeyClientIP     = "client_ip"
+	RateLimitKeyRule         = "rule"
+	RateLimitKeyHeaderPrefix = "header:"
+)
+
+// RateLimitRule limits the requests matching Match, with one token bucket
+// per distinct key.
+type RateLimitRule struct {
+	// Name identifies the rule in the access log.
+	Name  string       `json:"name,omitempty"`
+	Match RequestMatch `json:"match,omitempty"`
+	// Key is client_ip, rule or header:<name>. Requests without the header
+	// aren't limited by a header keyed rule.
+	Key string `json:"key"`
+	// RequestsPerSecond refills the bucket.
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	// Burst is the bucket size, RequestsPerSecond rounded up when zero.
+	Burst int `json:"burst,omitempty"`
+}
+
+// Validate checks the key and the limits of the rule.
+func (r *RateLimitRule) Validate() error {
+	switch {
+	case r.Key == RateLimitKeyClientIP, r.Key == RateLimitKeyRule:
+	case strings.HasPrefix(r.Key, RateLimitKeyHeaderPrefix) && len(r.Key) > len(RateLimitKeyHeaderPrefix):
+	case r.Key == "route":
+		return errors.New(`unknown rate limit key "route", use "rule": limits apply before routing, to the requests the rule matches`)
+	default:
+		return fmt.Errorf("unknown rate limit key %q", r.Key)
+	}
+	if r.RequestsPerSecond <= 0 {
+		return fmt.Errorf("requestsPerSecond must be positive, got %g", r.RequestsPerSecond)
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("burst must not be negative, got %d", r.Burst)
+	}
+	return r.Match.Validate()
+}
+
+func (r *RateLimitRule) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return int(math.Ceil(r.RequestsPerSecond))
+}
+
+// RateLimitConfig lists the rate limits of the proxy. Every matching rule
+// must allow a request for it to proceed.
+type RateLimitConfig struct {
+	Rules []RateLimitRule `json:"rules,omitempty"`
+	// Service is the URL of a remote rate limit service, see
+	// NewRateLimitServiceHandler. Limits are enforced locally when empty.
+	Service string `json:"service,omitempty"`
+	// FailOpen lets requests through when the service can't be reached.
+	FailOpen bool `json:"failOpen,omitempty"`
+}
+
+// Validate checks every rule.
+func (c *RateLimitConfig) Validate() error {
+	for i := range c.Rules {
+		if err := c.Rules[i].Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// RateLimitRequest asks for one token of the bucket Key, created with the
+// given rate and burst if needed. A request sends one per matching rule.
+type RateLimitRequest struct {
+	Key   string  `json:"key"`
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// RateLimitResult is the answer to the RateLimitRequests of a request.
+type RateLimitResult struct {
+	Allowed bool `json:"allowed"`
+	// Denied is the index of the first RateLimitRequest without a token, for
+	// denied requests.
+	Denied int `json:"denied,omitempty"`
+	// RetryAfter is when every bucket will have a token, for denied
+	// requests.
+	RetryAfter Duration `json:"retryAfter,omitempty"`
+}
+
+// RateLimiter holds the token buckets, locally or in a remote service.
+type RateLimiter interface {
+	// Allow takes a token of every bucket of reqs if they all have one, and
+	// none otherwise.
+	Allow(ctx context.Context, reqs []RateLimitRequest) (RateLimitResult, error)
+}
+
+// TokenBucketLimiter is an in-process RateLimiter.
+type TokenBucketLimiter struct {
+	// now is replaced in tests.
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// NewTokenBucketLimiter returns an empty TokenBucketLimiter.
+func NewTokenBucketLimiter() *TokenBucketLimiter {
+	return &TokenBucketLimiter{now: time.Now, buckets: map[string]*tokenBucket{}}
+}
+
+// Allow implements RateLimiter.
+func (l *TokenBucketLimiter) Allow(_ context.Context, reqs []RateLimitRequest) (RateLimitResult, error) {
+	for _, req := range reqs {
+		if req.Rate <= 0 || req.Burst <= 0 {
+			return RateLimitResult{}, fmt.Errorf("invalid rate limit %g/s burst %d", req.Rate, req.Burst)
+		}
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	// Tokens are only taken once every bucket is known to have one.
+	taken := make(map[*tokenBucket]float64, len(reqs))
+	res := RateLimitResult{Allowed: true}
+	for i, req := range reqs {
+		b, ok := l.buckets[req.Key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(req.Burst), last: now}
+			l.buckets[req.Key] = b
+		}
+		b.rate, b.burst = req.Rate, req.Burst
+		b.tokens = math.Min(float64(req.Burst), b.tokens+now.Sub(b.last).Seconds()*req.Rate)
+		b.last = now
+		if left := b.tokens - taken[b]; left >= 1 {
+			taken[b]++
+		} else {
+			if res.Allowed {
+				res = RateLimitResult{Denied: i}
+			}
+			wait := time.Duration((1 - left) / req.Rate * float64(time.Second))
+			if wait > res.RetryAfter.Duration {
+				res.RetryAfter = Duration{wait}
+			}
+		}
+	}
+	if res.Allowed {
+		for b, n := range taken {
+			b.tokens -= n
+		}
+	}
+	return res, nil
+}
+
+// sweep drops, once a minute, buckets that have been idle long enough to
+// be full again. They are recreated full when needed.
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(b.burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// RemoteRateLimiter asks a rate limit service over HTTP.
+type RemoteRateLimiter struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewRemoteRateLimiter returns a RateLimiter for the service at url.
+func NewRemoteRateLimiter(url string) *RemoteRateLimiter {
+	return &RemoteRateLimiter{URL: url, Client: &http.Client{Timeout: time.Second}}
+}
+
+// Allow implements RateLimiter.
+func (l *RemoteRateLimiter) Allow(ctx context.Context, reqs []RateLimitRequest) (RateLimitResult, error) {
+	b, err := json.Marshal(reqs)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, l.URL, bytes.NewReader(b))
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := l.Client.Do(httpReq)
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("rate limit service: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return RateLimitResult{}, fmt.Errorf("rate limit service: unexpected status %d", resp.StatusCode)
+	}
+	var res RateLimitResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return RateLimitResult{}, fmt.Errorf("rate limit service: %w", err)
+	}
+	return res, nil
+}
+
+// NewRateLimitServiceHandler serves limiter to RemoteRateLimiter clients,
+// which post a JSON array of RateLimitRequests. It stands in for a real rate
+// limit service in tests and local setups.
+func NewRateLimitServiceHandler(limiter RateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []RateLimitRequest
+		if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := limiter.Allow(r.Context(), reqs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+}
+
+// NewRateLimitHandler rejects requests over the limits of cfg with a 429
+// and Retry-After before they reach h.
+func NewRateLimitHandler(h http.Handler, cfg RateLimitConfig, limiter RateLimiter) http.Handler {
+	if len(cfg.Rules) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []RateLimitRequest
+		var names []string
+		for i := range cfg.Rules {
+			rule := &cfg.Rules[i]
+			if !rule.Match.Matches(r) {
+				continue
+			}
+			key, ok := rule.key(r)
+			if !ok {
+				continue
+			}
+			// Indexes are prefixed so they can't collide with rule names.
+			name := rule.Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i)
+			}
+			reqs = append(reqs, RateLimitRequest{
+				Key:   name + "/" + key,
+				Rate:  rule.RequestsPerSecond,
+				Burst: rule.burst(),
+			})
+			names = append(names, name)
+		}
+		if len(reqs) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		res, err := limiter.Allow(r.Context(), reqs)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			logf(LogError, "Rate limit check failed: %v", err)
+			if !cfg.FailOpen {
+				http.Error(w, "rate limit check failed", http.StatusInternalServerError)
+				return
+			}
+		} else if !res.Allowed {
+			if res.Denied >= 0 && res.Denied < len(names) {
+				AnnotateAccessLog(r.Context(), "ratelimit", names[res.Denied])
+			}
+			secs := int(math.Ceil(res.RetryAfter.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (r *RateLimitRule) key(req *http.Request) (string, bool) {
+	switch {
+	case r.Key == RateLimitKeyClientIP:
+		return clientIP(req), true
+	case r.Key == RateLimitKeyRule:
+		return "", true
+	default:
+		v := req.Header.Get(strings.TrimPrefix(r.Key, RateLimitKeyHeaderPrefix))
+		return v, v != ""
+	}
+}
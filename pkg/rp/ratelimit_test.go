@@ -0,0 +1,236 @@
+package rep
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewTokenBucketLimiter()
+	l.now = func() time.Time { return now }
+	req := RateLimitRequest{Key: "k", Rate: 2, Burst: 3}
+
+	steps := []struct {
+		advance   time.Duration
+		want      bool
+		wantRetry time.Duration
+	}{
+		{want: true},
+		{want: true},
+		{want: true},
+		{want: false, wantRetry: 500 * time.Millisecond},
+		{advance: 250 * time.Millisecond, want: false, wantRetry: 250 * time.Millisecond},
+		{advance: 250 * time.Millisecond, want: true},
+		{want: false, wantRetry: 500 * time.Millisecond},
+		// The bucket never holds more than burst.
+		{advance: time.Hour, want: true},
+		{want: true},
+		{want: true},
+		{want: false, wantRetry: 500 * time.Millisecond},
+	}
+	for i, s := range steps {
+		now = now.Add(s.advance)
+		res, err := l.Allow(context.Background(), []RateLimitRequest{req})
+		if err != nil {
+			t.Fatalf("step %d: Allow() = %v", i, err)
+		}
+		if res.Allowed != s.want || res.RetryAfter.Duration != s.wantRetry {
+			t.Errorf("step %d: Allow() = %+v, want allowed %v retry after %v", i, res, s.want, s.wantRetry)
+		}
+	}
+
+	// Other keys have their own bucket.
+	if res, _ := l.Allow(context.Background(), []RateLimitRequest{{Key: "other", Rate: 2, Burst: 1}}); !res.Allowed {
+		t.Error("a fresh key was limited")
+	}
+	// Idle, full buckets are dropped.
+	now = now.Add(time.Hour)
+	l.Allow(context.Background(), []RateLimitRequest{{Key: "new", Rate: 1, Burst: 1}})
+	if n := len(l.buckets); n != 1 {
+		t.Errorf("%d buckets left after the sweep, want 1", n)
+	}
+}
+
+func TestTokenBucketLimiterAllOrNothing(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewTokenBucketLimiter()
+	l.now = func() time.Time { return now }
+	wide := RateLimitRequest{Key: "wide", Rate: 1, Burst: 2}
+	narrow := RateLimitRequest{Key: "narrow", Rate: 1, Burst: 1}
+
+	steps := []struct {
+		reqs       []RateLimitRequest
+		want       bool
+		wantDenied int
+		wantRetry  time.Duration
+	}{
+		{reqs: []RateLimitRequest{wide, narrow}, want: true},
+		// Denied by narrow, without spending the last token of wide.
+		{reqs: []RateLimitRequest{wide, narrow}, wantDenied: 1, wantRetry: time.Second},
+		{reqs: []RateLimitRequest{wide}, want: true},
+		{reqs: []RateLimitRequest{wide, narrow}, wantRetry: time.Second},
+		// The same bucket twice needs two tokens.
+		{reqs: []RateLimitRequest{{Key: "twice", Rate: 1, Burst: 1}, {Key: "twice", Rate: 1, Burst: 1}}, wantDenied: 1, wantRetry: time.Second},
+	}
+	for i, s := range steps {
+		res, err := l.Allow(context.Background(), s.reqs)
+		if err != nil {
+			t.Fatalf("step %d: Allow() = %v", i, err)
+		}
+		if res.Allowed != s.want || (!s.want && res.Denied != s.wantDenied) || res.RetryAfter.Duration != s.wantRetry {
+			t.Errorf("step %d: Allow() = %+v, want allowed %v denied %d retry after %v", i, res, s.want, s.wantDenied, s.wantRetry)
+		}
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+rateLimits:
+  rules:
+  - name: per-ip
+    match:
+      pathPrefix: /ip
+    key: client_ip
+    requestsPerSecond: 0.01
+    burst: 2
+  - name: per-key
+    match:
+      pathPrefix: /key
+    key: header:X-Api-Key
+    requestsPerSecond: 0.01
+    burst: 1
+  - name: route
+    match:
+      pathPrefix: /route
+    key: rule
+    requestsPerSecond: 0.01
+    burst: 3
+  - name: both
+    match:
+      pathPrefix: /both
+    key: rule
+    requestsPerSecond: 0.01
+    burst: 2
+  - name: "5"
+    match:
+      pathPrefix: /both/narrow
+    key: rule
+    requestsPerSecond: 0.01
+    burst: 1
+  - match:
+      pathPrefix: /both/other
+    key: rule
+    requestsPerSecond: 0.01
+    burst: 1
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+
+	for name, newLimiter := range map[string]func(t *testing.T) RateLimiter{
+		"local": func(*testing.T) RateLimiter { return NewTokenBucketLimiter() },
+		"remote": func(t *testing.T) RateLimiter {
+			stand := httptest.NewServer(NewRateLimitServiceHandler(NewTokenBucketLimiter()))
+			t.Cleanup(stand.Close)
+			return NewRemoteRateLimiter(stand.URL)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := NewRateLimitHandler(ok, cfg.RateLimits, newLimiter(t))
+			send := func(path, remote, apiKey string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				r.RemoteAddr = remote + ":1234"
+				if apiKey != "" {
+					r.Header.Set("X-Api-Key", apiKey)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				return w
+			}
+
+			steps := []struct {
+				path, remote, key string
+				want              int
+			}{
+				{"/ip", "10.0.0.1", "", http.StatusOK},
+				{"/ip", "10.0.0.1", "", http.StatusOK},
+				{"/ip", "10.0.0.1", "", http.StatusTooManyRequests},
+				{"/ip", "10.0.0.2", "", http.StatusOK},
+				{"/key", "10.0.0.1", "a", http.StatusOK},
+				{"/key", "10.0.0.2", "a", http.StatusTooManyRequests},
+				{"/key", "10.0.0.1", "b", http.StatusOK},
+				{"/key", "10.0.0.1", "", http.StatusOK},
+				{"/key", "10.0.0.1", "", http.StatusOK},
+				{"/route/a", "10.0.0.1", "", http.StatusOK},
+				{"/route/b", "10.0.0.2", "", http.StatusOK},
+				{"/route/c", "10.0.0.3", "", http.StatusOK},
+				{"/route/d", "10.0.0.4", "", http.StatusTooManyRequests},
+				// Denied by the narrow rule, keeping the token of "both".
+				{"/both/narrow", "10.0.0.1", "", http.StatusOK},
+				{"/both/narrow", "10.0.0.1", "", http.StatusTooManyRequests},
+				// The unnamed rule 5 has a bucket of its own, not the one of
+				// the rule named "5".
+				{"/both/other", "10.0.0.1", "", http.StatusOK},
+				{"/both", "10.0.0.1", "", http.StatusTooManyRequests},
+				{"/other", "10.0.0.1", "", http.StatusOK},
+			}
+			for i, s := range steps {
+				w := send(s.path, s.remote, s.key)
+				if w.Code != s.want {
+					t.Fatalf("step %d %+v: status = %d, want %d", i, s, w.Code, s.want)
+				}
+				if s.want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "100" {
+					t.Errorf("step %d: Retry-After = %q, want %q", i, w.Header().Get("Retry-After"), "100")
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitHandlerServiceDown(t *testing.T) {
+	stand := httptest.NewServer(http.NotFoundHandler())
+	url := stand.URL
+	stand.Close()
+
+	rules := []RateLimitRule{{Key: RateLimitKeyRule, RequestsPerSecond: 1}}
+	for _, failOpen := range []bool{true, false} {
+		h := NewRateLimitHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+			RateLimitConfig{Rules: rules, FailOpen: failOpen}, NewRemoteRateLimiter(url))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		want := http.StatusInternalServerError
+		if failOpen {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("failOpen %v: status = %d, want %d", failOpen, w.Code, want)
+		}
+	}
+}
+
+func TestRateLimitRuleValidate(t *testing.T) {
+	tests := []struct {
+		key     string
+		wantErr bool
+	}{
+		{key: RateLimitKeyClientIP},
+		{key: RateLimitKeyRule},
+		{key: "header:X-Api-Key"},
+		{key: "header:", wantErr: true},
+		// The limits apply before routing, a rule has no route.
+		{key: "route", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			r := &RateLimitRule{Key: test.key, RequestsPerSecond: 1}
+			if err := r.Validate(); (err != nil) != test.wantErr {
+				t.Errorf("Validate() = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
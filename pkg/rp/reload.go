@@ -0,0 +1,164 @@
+package rep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ConfigBuilder builds the handler serving a validated config. An error
+// rejects the config.
+type ConfigBuilder func(cfg *Config) (http.Handler, error)
+
+// ConfigReloader serves requests with the handler built from a config file
+// and swaps it atomically when the file changes, or another config is
+// applied, without dropping connections. A request is served by the config
+// it started with, so in-flight requests complete on the old one.
+type ConfigReloader struct {
+	path  string
+	build ConfigBuilder
+
+	// mu serializes reloads.
+	mu      sync.Mutex
+	mod     time.Time
+	current atomic.Pointer[configSnapshot]
+
+	reloads, failures atomic.Uint64
+}
+
+type configSnapshot struct {
+	cfg     *Config
+	handler http.Handler
+	loaded  time.Time
+}
+
+// NewConfigReloader loads the config at path and builds its handler.
+func NewConfigReloader(path string, build ConfigBuilder) (*ConfigReloader, error) {
+	r := &ConfigReloader{path: path, build: build}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewConfigReloaderFromConfig builds cfg, for configs that aren't read from
+// a file but applied, like the ones received over xDS.
+func NewConfigReloaderFromConfig(cfg *Config, build ConfigBuilder) (*ConfigReloader, error) {
+	r := &ConfigReloader{build: build}
+	if err := r.Apply(cfg); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads, validates and builds the config, then swaps it in. On error
+// the previous config keeps serving.
+func (r *ConfigReloader) Reload() error {
+	return r.update(r.reload)
+}
+
+// Apply validates and builds cfg, then swaps it in. On error the previous
+// config keeps serving.
+func (r *ConfigReloader) Apply(cfg *Config) error {
+	return r.update(func() error {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+		return r.swap(cfg)
+	})
+}
+
+func (r *ConfigReloader) update(f func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := f()
+	if err != nil {
+		r.failures.Add(1)
+		return err
+	}
+	r.reloads.Add(1)
+	return nil
+}
+
+func (r *ConfigReloader) reload() error {
+	if r.path == "" {
+		return errors.New("no config file to reload")
+	}
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	// The modification time is kept even if the config is rejected, so it's
+	// only retried once the file changes again.
+	r.mod = fi.ModTime()
+	cfg, err := LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	return r.swap(cfg)
+}
+
+func (r *ConfigReloader) swap(cfg *Config) error {
+	h, err := r.build(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	r.current.Store(&configSnapshot{cfg: cfg, handler: h, loaded: time.Now()})
+	return nil
+}
+
+// Watch polls the config file every interval and reloads it when its
+// modification time changes. It returns when ctx is done.
+func (r *ConfigReloader) Watch(ctx context.Context, interval time.Duration) {
+	if r.path == "" {
+		return
+	}
+	wait.UntilWithContext(ctx, func(context.Context) {
+		fi, err := os.Stat(r.path)
+		if err != nil {
+			logf(LogError, "Unable to stat config file: %v", err)
+			return
+		}
+		r.mu.Lock()
+		changed := !fi.ModTime().Equal(r.mod)
+		r.mu.Unlock()
+		if !changed {
+			return
+		}
+		r.ReloadAndLog()
+	}, interval)
+}
+
+// ReloadAndLog reloads the config, e.g. on SIGHUP, and logs the outcome.
+func (r *ConfigReloader) ReloadAndLog() {
+	if err := r.Reload(); err != nil {
+		logf(LogError, "Keeping previous config, reload failed: %v", err)
+		return
+	}
+	logf(LogInfo, "Reloaded config %s", r.path)
+}
+
+// Config returns the config in use.
+func (r *ConfigReloader) Config() *Config {
+	return r.current.Load().cfg
+}
+
+// ServeHTTP serves r with the current config.
+func (r *ConfigReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.current.Load().handler.ServeHTTP(w, req)
+}
+
+// WriteMetrics implements MetricsSource.
+func (r *ConfigReloader) WriteMetrics(w io.Writer) {
+	writeMetric(w, "rp_config_reloads_total", map[string]string{"result": "success"}, r.reloads.Load())
+	writeMetric(w, "rp_config_reloads_total", map[string]string{"result": "failure"}, r.failures.Load())
+	writeMetric(w, "rp_config_last_reload_timestamp_seconds", nil, r.current.Load().loaded.Unix())
+}
@@ -0,0 +1,172 @@
+package rep
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	reloadConfigV1 = `
+headers:
+- response:
+    set:
+      X-Config: v1
+`
+	reloadConfigV2 = `
+headers:
+- response:
+    set:
+      X-Config: v2
+`
+)
+
+// writeConfig writes a config and moves its modification time forward, so
+// changes are seen even within the file system's time resolution.
+func writeConfig(t *testing.T, path, config string) {
+	t.Helper()
+	var mod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		mod = fi.ModTime()
+	}
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	if !mod.IsZero() {
+		mod = mod.Add(time.Second)
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatalf("Failed to touch config: %v", err)
+		}
+	}
+}
+
+// versionBuilder serves the X-Config response header of the config, after
+// waiting on release for requests to /block.
+func versionBuilder(release <-chan struct{}) ConfigBuilder {
+	return func(cfg *Config) (http.Handler, error) {
+		version := cfg.Headers[0].Response.Set["X-Config"]
+		if version == "broken" {
+			return nil, errors.New("broken config")
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			http.NewResponseController(w).Flush()
+			if r.URL.Path == "/block" {
+				<-release
+			}
+			io.WriteString(w, version)
+		}), nil
+	}
+}
+
+func TestConfigReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, reloadConfigV1)
+	r, err := NewConfigReloader(path, versionBuilder(nil))
+	if err != nil {
+		t.Fatalf("NewConfigReloader() = %v", err)
+	}
+	version := func() string {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Body.String()
+	}
+
+	for _, test := range []struct {
+		name    string
+		config  string
+		wantErr string
+		want    string
+	}{{
+		name:   "valid",
+		config: reloadConfigV2,
+		want:   "v2",
+	}, {
+		name:    "unparsable",
+		config:  "headers: [",
+		wantErr: "failed to parse config",
+		want:    "v2",
+	}, {
+		name:    "invalid",
+		config:  "timeouts:\n  default:\n    request: -1s\n",
+		wantErr: "invalid config",
+		want:    "v2",
+	}, {
+		name:    "rejected by the builder",
+		config:  strings.Replace(reloadConfigV1, "v1", "broken", 1),
+		wantErr: "broken config",
+		want:    "v2",
+	}, {
+		name:   "valid again",
+		config: reloadConfigV1,
+		want:   "v1",
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			writeConfig(t, path, test.config)
+			err := r.Reload()
+			if test.wantErr == "" && err != nil || test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("Reload() = %v, want error %q", err, test.wantErr)
+			}
+			if got := version(); got != test.want {
+				t.Errorf("served by %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	var metrics bytes.Buffer
+	r.WriteMetrics(&metrics)
+	for _, want := range []string{`rp_config_reloads_total{result="success"} 3`, `rp_config_reloads_total{result="failure"} 3`} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("metrics %q don't contain %q", metrics.String(), want)
+		}
+	}
+}
+
+func TestConfigReloaderInFlight(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, reloadConfigV1)
+	release := make(chan struct{})
+	r, err := NewConfigReloader(path, versionBuilder(release))
+	if err != nil {
+		t.Fatalf("NewConfigReloader() = %v", err)
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// The request started on v1 completes on it after the swap.
+	resp, err := http.Get(srv.URL + "/block")
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+	writeConfig(t, path, reloadConfigV2)
+	waitFor(t, "the config to reload", func() bool {
+		return r.Config().Headers[0].Response.Set["X-Config"] == "v2"
+	})
+
+	resp2, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatalf("Failed to execute request: %v", err)
+	}
+	defer resp2.Body.Close()
+	if got, _ := io.ReadAll(resp2.Body); string(got) != "v2" {
+		t.Errorf("new request served by %s, want v2", got)
+	}
+
+	close(release)
+	if got, _ := io.ReadAll(resp.Body); string(got) != "v1" {
+		t.Errorf("in-flight request served by %s, want v1", got)
+	}
+}
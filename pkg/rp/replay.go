@@ -0,0 +1,159 @@
+package rep
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// maxReplayBody is the most of a request body kept to resend the request on
+// another connection.
+const maxReplayBody = 64 << 10
+
+// withReplayBody returns r with a GetBody replaying its body, as long as at
+// most max bytes of it were read, so the transports resend requests the
+// upstream didn't process, e.g. past the last stream of a GOAWAY or refused,
+// with their body. finish is called once r was sent: the body of r is then
+// closed with the last replay.
+func withReplayBody(r *http.Request, max int) (_ *http.Request, finish func()) {
+	if r.Body == nil || r.Body == http.NoBody || r.GetBody != nil {
+		return r, func() {}
+	}
+	b := &replayBody{src: r.Body, max: max}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Body, _ = b.replay()
+	r2.GetBody = b.replay
+	return r2, b.finish
+}
+
+// replayBody keeps what was read of src, for replayReaders to read it again
+// before the rest of src.
+type replayBody struct {
+	src io.ReadCloser
+	max int
+	// readMu serializes the reads of src, without holding mu.
+	readMu sync.Mutex
+
+	mu         sync.Mutex
+	buf        []byte
+	read       int
+	overflowed bool
+	srcErr     error
+	last       *replayReader
+	done       bool
+	closed     bool
+}
+
+func (b *replayBody) replay() (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.overflowed {
+		return nil, b.tooLarge()
+	}
+	b.last = &replayReader{b: b}
+	return b.last, nil
+}
+
+func (b *replayBody) tooLarge() error {
+	return fmt.Errorf("request body of more than %d bytes can't be resent", b.max)
+}
+
+// finish closes src if the last replay was closed, otherwise the last replay
+// closes it.
+func (b *replayBody) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = true
+	if b.last.closed.Load() {
+		b.closeSrc()
+	}
+}
+
+// closeSrc closes src once. Called with mu held.
+func (b *replayBody) closeSrc() {
+	if !b.closed {
+		b.closed = true
+		b.src.Close()
+	}
+}
+
+// readAt reads from off, what was kept then src. The replay of a body that
+// overflowed fails unless it's caught up with src.
+func (b *replayBody) readAt(p []byte, off int) (int, error) {
+	if n, ok := b.buffered(p, off); ok {
+		return n, nil
+	}
+	b.readMu.Lock()
+	defer b.readMu.Unlock()
+	// Another replay may have read src meanwhile.
+	if n, ok := b.buffered(p, off); ok {
+		return n, nil
+	}
+	b.mu.Lock()
+	err := b.srcErr
+	if off != b.read {
+		err = b.tooLarge()
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := b.src.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += n
+	if !b.overflowed {
+		if len(b.buf)+n > b.max {
+			b.overflowed, b.buf = true, nil
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+		}
+	}
+	if err != nil {
+		b.srcErr = err
+	}
+	return n, err
+}
+
+func (b *replayBody) buffered(p []byte, off int) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.overflowed || off >= len(b.buf) {
+		return 0, false
+	}
+	return copy(p, b.buf[off:]), true
+}
+
+// replayReader reads a replayBody from the start. Closing it doesn't close
+// src, needed by the next replay, until the request was sent.
+type replayReader struct {
+	b      *replayBody
+	off    int
+	closed atomic.Bool
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if r.closed.Load() {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	n, err := r.b.readAt(p, r.off)
+	r.off += n
+	return n, err
+}
+
+func (r *replayReader) Close() error {
+	if r.closed.Swap(true) {
+		return nil
+	}
+	b := r.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done && b.last == r {
+		b.closeSrc()
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package rep
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// closeCounter counts the Close calls of a body.
+type closeCounter struct {
+	io.Reader
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestReplayBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		max  int
+		// read is what the first attempt reads before the request is
+		// resent.
+		read    int
+		want    string
+		wantErr bool
+	}{{
+		name: "unread",
+		body: "hello",
+		max:  16,
+		want: "hello",
+	}, {
+		name: "partly read",
+		body: "hello",
+		max:  16,
+		read: 3,
+		want: "hello",
+	}, {
+		name: "read",
+		body: "hello",
+		max:  16,
+		read: 5,
+		want: "hello",
+	}, {
+		name:    "read over max",
+		body:    strings.Repeat("a", 32),
+		max:     16,
+		read:    20,
+		wantErr: true,
+	}, {
+		name: "larger than max, unread",
+		body: strings.Repeat("a", 32),
+		max:  16,
+		want: strings.Repeat("a", 32),
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := &closeCounter{Reader: strings.NewReader(test.body)}
+			r, _ := http.NewRequest(http.MethodPost, "http://example.com", src)
+			r, finish := withReplayBody(r, test.max)
+			if r.GetBody == nil {
+				t.Fatal("GetBody = nil")
+			}
+			if _, err := io.ReadFull(r.Body, make([]byte, test.read)); err != nil {
+				t.Fatalf("Read() = %v", err)
+			}
+			r.Body.Close()
+			if src.closed != 0 {
+				t.Error("The body was closed before the request was sent")
+			}
+
+			body, err := r.GetBody()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("GetBody() = nil error, want an error")
+				}
+				finish()
+			} else {
+				if err != nil {
+					t.Fatalf("GetBody() = %v", err)
+				}
+				got, err := io.ReadAll(body)
+				if err != nil {
+					t.Fatalf("ReadAll() = %v", err)
+				}
+				if string(got) != test.want {
+					t.Errorf("replay = %q, want %q", got, test.want)
+				}
+				finish()
+				if src.closed != 0 {
+					t.Error("The body was closed before its replay")
+				}
+				body.Close()
+			}
+			if src.closed != 1 {
+				t.Errorf("The body was closed %d times, want once", src.closed)
+			}
+		})
+	}
+}
+
+func TestReplayBodyNone(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if got, _ := withReplayBody(r, maxReplayBody); got != r {
+		t.Error("withReplayBody() replaced a request without body")
+	}
+	r, _ = http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("hello"))
+	if got, _ := withReplayBody(r, maxReplayBody); got != r {
+		t.Error("withReplayBody() replaced a request with GetBody")
+	}
+}
@@ -2,18 +2,19 @@ package rep
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
-	"net/http/httptest"
 	"net/http/httputil"
-	"net/url"
-	"sync"
 	"testing"
 	"time"
 
+	"github.com/skonto/test-reverse-proxy/repro"
+	"golang.org/x/net/http2"
 	"knative.dev/serving/pkg/http/handler"
 )
 
@@ -23,267 +24,68 @@ const (
 	disableKeepAlives = false
 )
 
-func TestProxyEchoOK(t *testing.T) {
-	// The server responding with the sent body.
-	echoServer := httptest.NewServer(http.HandlerFunc(
-		func(w http.ResponseWriter, req *http.Request) {
-			body, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("error reading body: %v", err)
-				http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusInternalServerError)
-				return
-			}
-			if _, err := w.Write(body); err != nil {
-				log.Printf("error writing body: %v", err)
-			}
-		},
-	))
-	defer echoServer.Close()
+var (
+	echoRequests = flag.Int("echo-requests", 0, "Requests sent by each worker of every TestProxyEchoMatrix cell, 10 by default.")
+	echoRepro    = flag.Int("echo-repro", 0, "Requests sent by each worker of the golang/go#40747 cell of TestProxyEchoMatrix, which only runs when set, e.g. to 1000 like the original echo tests.")
+)
 
-	// The server proxying requests to the echo server.
-	echoURL, err := url.Parse(echoServer.URL)
+// TestProxyEchoMatrix runs repro's echo matrix through the proxy's header
+// pruning proxy, server and upstream transports, and Knative's own timeout
+// handler. -short skips the 1 MiB bodies, -echo-requests sets the load of
+// every cell and -echo-repro runs the golang/go#40747 cell.
+func TestProxyEchoMatrix(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "proxy", nil, false)
+	reloader, err := NewCertReloader(certFile, keyFile)
 	if err != nil {
-		t.Fatalf("Failed to parse echo URL: %v", err)
-	}
-	proxy := httputil.NewSingleHostReverseProxy(echoURL)
-
-	//proxy.FlushInterval = -1 // flush immediately
-	proxyWithMiddleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rc := http.NewResponseController(w)
-		_ = rc.EnableFullDuplex()
-		proxy.ServeHTTP(w, r)
-	})
-
-	proxyServer := httptest.NewServer(proxyWithMiddleware)
-
-	defer proxyServer.Close()
-
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.DisableKeepAlives = disableKeepAlives
-	c := &http.Client{
-		Transport: transport,
-	}
-
-	body := make([]byte, bodySize)
-	for i := 0; i < cap(body); i++ {
-		body[i] = 42
+		t.Fatalf("Failed to load certificate: %v", err)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(parallelism)
-	for i := 0; i < parallelism; i++ {
-		go func(i int) {
-			defer wg.Done()
-
-			for i := 0; i < 10; i++ {
-				if err := send(c, proxyServer.URL, body, ""); err != nil {
-					t.Errorf("error during request: %v", err)
-				}
-			}
-		}(i)
-	}
-
-	wg.Wait()
-}
-
-func TestProxyEchoOKWithChainHandler(t *testing.T) {
-	// The server responding with the sent body.
-	echoServer := httptest.NewServer(http.HandlerFunc(
-		func(w http.ResponseWriter, req *http.Request) {
-			body, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("error reading body: %v", err)
-				http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			if _, err := w.Write(body); err != nil {
-				log.Printf("error writing body: %v", err)
-			}
+	repro.Run(t, repro.Matrix{
+		Requests: *echoRequests,
+		Repro:    *echoRepro,
+		Short:    testing.Short(),
+		NewProxy: func(upstream string) *httputil.ReverseProxy {
+			return NewHeaderPruningReverseProxy(upstream, "", []string{}, false)
 		},
-	))
-	defer echoServer.Close()
-
-	// The server proxying requests to the echo server.
-	echoURL, err := url.Parse(echoServer.URL)
-	if err != nil {
-		t.Fatalf("Failed to parse echo URL: %v", err)
-	}
-	// proxy := httputil.NewSingleHostReverseProxy(echoURL)
-	proxy := NewHeaderPruningReverseProxy(echoURL.Host, "", []string{}, false)
-	proxy.FlushInterval = 0
-	proxyWithMiddleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		proxy.ServeHTTP(w, r)
-	})
-
-	composedHandler := handler.NewTimeoutHandler(proxyWithMiddleware, "request timeout", func(r *http.Request) (time.Duration, time.Duration, time.Duration) {
-		return time.Minute, time.Minute, time.Minute
-	})
-
-	composedHandler2 := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rc := http.NewResponseController(w)
-		err = rc.EnableFullDuplex()
-		if err != nil {
-			fmt.Printf("ERROR2:%v\n", err)
-		}
-		composedHandler.ServeHTTP(w, r)
-	})
-
-	proxyServer := httptest.NewServer(composedHandler2)
-
-	defer proxyServer.Close()
-
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.DisableKeepAlives = disableKeepAlives
-	c := &http.Client{
-		Transport: transport,
-	}
-
-	body := make([]byte, bodySize)
-	for i := 0; i < cap(body); i++ {
-		body[i] = 42
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(parallelism)
-	for i := 0; i < parallelism; i++ {
-		go func(i int) {
-			defer wg.Done()
-
-			for i := 0; i < 1000; i++ {
-				if err := send(c, proxyServer.URL, body, ""); err != nil {
-					t.Errorf("error during request: %v", err)
-				}
-			}
-		}(i)
-	}
-
-	wg.Wait()
-}
-
-func TestProxyEchoFailWithChainHandler(t *testing.T) {
-	// The server responding with the sent body.
-	echoServer := httptest.NewServer(http.HandlerFunc(
-		func(w http.ResponseWriter, req *http.Request) {
-			body, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("error reading body: %v", err)
-				http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusInternalServerError)
-				return
-			}
-
-			if _, err := w.Write(body); err != nil {
-				log.Printf("error writing body: %v", err)
-			}
+		Timeout: func(h http.Handler) http.Handler {
+			return handler.NewTimeoutHandler(h, "request timeout", func(r *http.Request) (time.Duration, time.Duration, time.Duration) {
+				return time.Minute, time.Minute, time.Minute
+			})
 		},
-	))
-	defer echoServer.Close()
-
-	// The server proxying requests to the echo server.
-	echoURL, err := url.Parse(echoServer.URL)
-	if err != nil {
-		t.Fatalf("Failed to parse echo URL: %v", err)
-	}
-	// proxy := httputil.NewSingleHostReverseProxy(echoURL)
-	proxy := NewHeaderPruningReverseProxy(echoURL.Host, "", []string{}, false)
-	proxy.FlushInterval = 0
-	proxyWithMiddleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		proxy.ServeHTTP(w, r)
-	})
-
-	composedHandler := handler.NewTimeoutHandler(proxyWithMiddleware, "request timeout", func(r *http.Request) (time.Duration, time.Duration, time.Duration) {
-		return time.Minute, time.Minute, time.Minute
-	})
-
-	proxyServer := httptest.NewServer(composedHandler)
-
-	defer proxyServer.Close()
-
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.DisableKeepAlives = disableKeepAlives
-	c := &http.Client{
-		Transport: transport,
-	}
-
-	body := make([]byte, bodySize)
-	for i := 0; i < cap(body); i++ {
-		body[i] = 42
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(parallelism)
-	for i := 0; i < parallelism; i++ {
-		go func(i int) {
-			defer wg.Done()
-
-			for i := 0; i < 1000; i++ {
-				if err := send(c, proxyServer.URL, body, ""); err != nil {
-					t.Errorf("error during request: %v", err)
-				}
-			}
-		}(i)
-	}
-
-	wg.Wait()
-}
-
-func TestProxyEchoFail(t *testing.T) {
-	// The server responding with the sent body.
-	echoServer := httptest.NewServer(http.HandlerFunc(
-		func(w http.ResponseWriter, req *http.Request) {
-			body, err := ioutil.ReadAll(req.Body)
+		Serve: func(client string, h http.Handler) (string, http.RoundTripper, func(), error) {
+			srv, err := NewServer("127.0.0.1:0", h, NewServerTLSConfig(reloader))
 			if err != nil {
-				log.Printf("error reading body: %v", err)
-				http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusInternalServerError)
-				return
+				return "", nil, nil, err
 			}
-
-			if _, err := w.Write(body); err != nil {
-				log.Printf("error writing body: %v", err)
+			ln, err := net.Listen("tcp", srv.Addr)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			go srv.Serve(ln)
+			stop := func() { srv.Close() }
+
+			switch client {
+			case "h1":
+				return "http://" + ln.Addr().String(), &http.Transport{}, stop, nil
+			case "h2c":
+				return "http://" + ln.Addr().String(), &http2.Transport{
+					AllowHTTP: true,
+					DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, network, addr)
+					},
+				}, stop, nil
+			default:
+				return "https://" + ln.Addr().String(), &http.Transport{
+					TLSClientConfig:   &tls.Config{RootCAs: ca.pool(), NextProtos: []string{ProtoH2}},
+					ForceAttemptHTTP2: true,
+				}, stop, nil
 			}
 		},
-	))
-	defer echoServer.Close()
-
-	// The server proxying requests to the echo server.
-	echoURL, err := url.Parse(echoServer.URL)
-	if err != nil {
-		t.Fatalf("Failed to parse echo URL: %v", err)
-	}
-	proxy := httputil.NewSingleHostReverseProxy(echoURL)
-
-	//proxy.FlushInterval = -1 // flush immediately
-
-	proxyServer := httptest.NewServer(proxy)
-
-	defer proxyServer.Close()
-
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.DisableKeepAlives = disableKeepAlives
-	c := &http.Client{
-		Transport: transport,
-	}
-
-	body := make([]byte, bodySize)
-	for i := 0; i < cap(body); i++ {
-		body[i] = 42
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(parallelism)
-	for i := 0; i < parallelism; i++ {
-		go func(i int) {
-			defer wg.Done()
-
-			for i := 0; i < 1000; i++ {
-				if err := send(c, proxyServer.URL, body, ""); err != nil {
-					t.Errorf("error during request: %v", err)
-				}
-			}
-		}(i)
-	}
-
-	wg.Wait()
+		Transport: func(proto string) http.RoundTripper {
+			return NewProtocolTransport(UpstreamProtocol(proto))
+		},
+	})
 }
 
 func send(client *http.Client, url string, body []byte, rHost string) error {
@@ -306,7 +108,7 @@ func send(client *http.Client, url string, body []byte, rHost string) error {
 
 	bd := io.Reader(resp.Body)
 
-	rec, err := ioutil.ReadAll(bd)
+	rec, err := io.ReadAll(bd)
 
 	if err != nil {
 		return fmt.Errorf("failed to read body: %w", err)
@@ -326,32 +128,3 @@ func send(client *http.Client, url string, body []byte, rHost string) error {
 
 	return nil
 }
-
-func NewHeaderPruningReverseProxy(target, hostOverride string, headersToRemove []string, useHTTPS bool) *httputil.ReverseProxy {
-	UserAgentKey := "User-Agent"
-	return &httputil.ReverseProxy{
-		Director: func(req *http.Request) {
-			if useHTTPS {
-				req.URL.Scheme = "https"
-			} else {
-				req.URL.Scheme = "http"
-			}
-			req.URL.Host = target
-
-			if hostOverride != "" {
-				req.Host = hostOverride
-				req.Header.Add("K-Passthrough-Lb", "true")
-			}
-
-			// Copied from httputil.NewSingleHostReverseProxy.
-			if _, ok := req.Header[UserAgentKey]; !ok {
-				// explicitly disable User-Agent so it's not set to default value
-				req.Header.Set(UserAgentKey, "")
-			}
-
-			for _, h := range headersToRemove {
-				req.Header.Del(h)
-			}
-		},
-	}
-}
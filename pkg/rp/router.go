@@ -0,0 +1,305 @@
+package rep
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// UpstreamConfig names an upstream routes forward to.
+type UpstreamConfig struct {
+	Name string `json:"name"`
+	// URL of the upstream, http or https.
+	URL string `json:"url"`
+	// Endpoints, as host:port, receive the requests round robin instead of
+	// the host of URL when set. An empty list, e.g. of an xDS cluster without
+	// healthy endpoints, fails requests with a 503.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Kubernetes discovers the endpoints from the EndpointSlices of a
+	// Service instead.
+	Kubernetes *KubernetesDiscovery `json:"kubernetes,omitempty"`
+	// DNS resolves the endpoints from DNS records instead, periodically.
+	DNS *DNSDiscovery `json:"dns,omitempty"`
+	// Protocol towards a plaintext upstream, see ParseUpstreamProtocol.
+	Protocol string `json:"protocol,omitempty"`
+	// Concurrency limits the requests in flight to the upstream.
+	Concurrency ConcurrencyLimit `json:"concurrency,omitempty"`
+	// ConnectTimeout bounds connecting to the upstream, retries included.
+	// Unbounded when zero.
+	ConnectTimeout Duration `json:"connectTimeout,omitempty"`
+	// Pool tunes the connections kept to the upstream.
+	Pool ConnectionPool `json:"pool,omitempty"`
+	// Flush overrides the flush policy of the proxy for the upstream.
+	Flush *FlushConfig `json:"flush,omitempty"`
+	// TLS overrides the upstream TLS options of the proxy, for https.
+	TLS *UpstreamTLS `json:"tls,omitempty"`
+}
+
+// Validate checks the URL and protocol of u.
+func (u *UpstreamConfig) Validate() error {
+	if u.Name == "" {
+		return errors.New("upstream without a name")
+	}
+	target, err := url.Parse(u.URL)
+	if err != nil {
+		return fmt.Errorf("upstream %s: %w", u.Name, err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return fmt.Errorf("upstream %s: scheme must be http or https, got %q", u.Name, target.Scheme)
+	}
+	if _, err := ParseUpstreamProtocol(u.Protocol); err != nil {
+		return fmt.Errorf("upstream %s: %w", u.Name, err)
+	}
+	for _, ep := range u.Endpoints {
+		if _, _, err := net.SplitHostPort(ep); err != nil {
+			return fmt.Errorf("upstream %s: invalid endpoint: %w", u.Name, err)
+		}
+	}
+	if u.Kubernetes != nil {
+		if u.Endpoints != nil {
+			return fmt.Errorf("upstream %s: endpoints and kubernetes are exclusive", u.Name)
+		}
+		if err := u.Kubernetes.Validate(); err != nil {
+			return fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+	}
+	if u.DNS != nil {
+		if u.Endpoints != nil || u.Kubernetes != nil {
+			return fmt.Errorf("upstream %s: dns is exclusive with endpoints and kubernetes", u.Name)
+		}
+		if err := u.DNS.Validate(); err != nil {
+			return fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+	}
+	if err := u.Concurrency.Validate(); err != nil {
+		return fmt.Errorf("upstream %s: %w", u.Name, err)
+	}
+	if u.ConnectTimeout.Duration < 0 {
+		return fmt.Errorf("upstream %s: connectTimeout must not be negative, got %s", u.Name, u.ConnectTimeout.Duration)
+	}
+	if err := u.Pool.Validate(); err != nil {
+		return fmt.Errorf("upstream %s: %w", u.Name, err)
+	}
+	if u.Flush != nil {
+		if err := u.Flush.Validate(); err != nil {
+			return fmt.Errorf("upstream %s: flush: %w", u.Name, err)
+		}
+	}
+	if u.TLS != nil {
+		if target.Scheme != "https" {
+			return fmt.Errorf("upstream %s: tls requires an https url", u.Name)
+		}
+		if err := u.TLS.Validate(); err != nil {
+			return fmt.Errorf("upstream %s: tls: %w", u.Name, err)
+		}
+	}
+	return nil
+}
+
+// Discovered reports whether the endpoints of u are listed or discovered
+// rather than the host of its URL.
+func (u *UpstreamConfig) Discovered() bool {
+	return u.Endpoints != nil || u.Kubernetes != nil || u.DNS != nil
+}
+
+// PathRewrite changes the path of a routed request before it's proxied.
+type PathRewrite struct {
+	// Prefix replaces the part of the path matched by the route's PathPrefix.
+	Prefix string `json:"prefix,omitempty"`
+	// Regex and Substitution rewrite the path with regexp.ReplaceAllString,
+	// so Substitution may refer to groups as $1.
+	Regex        string `json:"regex,omitempty"`
+	Substitution string `json:"substitution,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Route forwards requests matching Match to Upstream or across Split.
+type Route struct {
+	// Name identifies the route in the access log.
+	Name    string       `json:"name,omitempty"`
+	Match   RequestMatch `json:"match,omitempty"`
+	Rewrite *PathRewrite `json:"rewrite,omitempty"`
+	// Upstream receives the requests of the route, unless Split is set.
+	Upstream string        `json:"upstream,omitempty"`
+	Split    *TrafficSplit `json:"split,omitempty"`
+	// Mirror copies requests of the route to a shadow upstream.
+	Mirror *MirrorPolicy `json:"mirror,omitempty"`
+	// Timeouts overrides the default timeout policy for the route.
+	Timeouts *TimeoutPolicy `json:"timeouts,omitempty"`
+	// Flush overrides the flush policy of the upstream for the route.
+	Flush *FlushConfig `json:"flush,omitempty"`
+}
+
+// Validate checks the matcher, rewrite, timeouts and flush config of the
+// route.
+func (r *Route) Validate() error {
+	if (r.Upstream == "") == (r.Split == nil) {
+		return errors.New("exactly one of upstream and split must be set")
+	}
+	if err := r.Match.Validate(); err != nil {
+		return err
+	}
+	if r.Timeouts != nil {
+		if err := r.Timeouts.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Flush != nil {
+		if err := r.Flush.Validate(); err != nil {
+			return fmt.Errorf("flush: %w", err)
+		}
+	}
+	if rw := r.Rewrite; rw != nil {
+		if rw.Prefix != "" && r.Match.PathPrefix == "" {
+			return errors.New("prefix rewrite requires a pathPrefix match")
+		}
+		if rw.Prefix != "" && rw.Regex != "" {
+			return errors.New("rewrite sets both prefix and regex")
+		}
+		if rw.Regex != "" {
+			re, err := regexp.Compile(rw.Regex)
+			if err != nil {
+				return fmt.Errorf("invalid rewrite regex: %w", err)
+			}
+			rw.regex = re
+		}
+	}
+	return nil
+}
+
+// ValidateRoutes checks every route and that it refers to one of upstreams.
+func ValidateRoutes(routes []Route, upstreams []UpstreamConfig) error {
+	names := make(map[string]bool, len(upstreams))
+	for i := range upstreams {
+		if err := upstreams[i].Validate(); err != nil {
+			return err
+		}
+		if names[upstreams[i].Name] {
+			return fmt.Errorf("duplicate upstream %s", upstreams[i].Name)
+		}
+		names[upstreams[i].Name] = true
+	}
+	for i := range routes {
+		if err := routes[i].Validate(); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		if split := routes[i].Split; split != nil {
+			if err := split.Validate(names); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		} else if !names[routes[i].Upstream] {
+			return fmt.Errorf("route %d: unknown upstream %s", i, routes[i].Upstream)
+		}
+		if mirror := routes[i].Mirror; mirror != nil {
+			if err := mirror.Validate(names); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Router sends every request to the upstream of the first matching route.
+// Requests matching no route get a 404.
+type Router struct {
+	routes    []Route
+	upstreams map[string]http.Handler
+}
+
+// NewRouter returns a Router over validated routes, with upstreams holding
+// the handler of every upstream they refer to.
+func NewRouter(routes []Route, upstreams map[string]http.Handler) (*Router, error) {
+	for i := range routes {
+		for _, name := range routes[i].upstreams() {
+			if _, ok := upstreams[name]; !ok {
+				return nil, fmt.Errorf("route %d: no handler for upstream %s", i, name)
+			}
+		}
+	}
+	return &Router{routes: routes, upstreams: upstreams}, nil
+}
+
+// Route returns the first route matching r, or nil.
+func (rt *Router) Route(r *http.Request) *Route {
+	for i := range rt.routes {
+		if rt.routes[i].Match.Matches(r) {
+			return &rt.routes[i]
+		}
+	}
+	return nil
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := rt.Route(r)
+	if route == nil {
+		AnnotateAccessLog(r.Context(), "route", "none")
+		http.NotFound(w, r)
+		return
+	}
+	if route.Name != "" {
+		AnnotateAccessLog(r.Context(), "route", route.Name)
+	}
+
+	ctx := r.Context()
+	if route.Timeouts != nil {
+		ctx = WithTimeoutPolicy(ctx, *route.Timeouts)
+	}
+	if route.Flush != nil {
+		ctx = WithFlushConfig(ctx, *route.Flush)
+	}
+	r = r.WithContext(ctx)
+	if route.Rewrite != nil {
+		u := *r.URL
+		u.Path = route.rewrite(u.Path)
+		u.RawPath = ""
+		r.URL = &u
+	}
+	if route.Mirror != nil {
+		var done func()
+		r, done = route.Mirror.Mirror(r, rt.upstreams[route.Mirror.Upstream])
+		defer done()
+	}
+	upstream := route.Upstream
+	if route.Split != nil {
+		upstream = route.Split.Pick(w, r)
+		AnnotateAccessLog(r.Context(), "upstream", upstream)
+	}
+	logf(LogDebug, "Routing %s %s to %s by route %q", r.Method, r.URL.Path, upstream, route.Name)
+	rt.upstreams[upstream].ServeHTTP(w, r)
+}
+
+// upstreams lists the upstreams the route forwards to.
+func (r *Route) upstreams() []string {
+	var names []string
+	if r.Split == nil {
+		names = append(names, r.Upstream)
+	} else {
+		for _, t := range r.Split.Targets {
+			names = append(names, t.Upstream)
+		}
+	}
+	if r.Mirror != nil {
+		names = append(names, r.Mirror.Upstream)
+	}
+	return names
+}
+
+func (r *Route) rewrite(path string) string {
+	rw := r.Rewrite
+	switch {
+	case rw.Prefix != "":
+		return rw.Prefix + strings.TrimPrefix(path, r.Match.PathPrefix)
+	case rw.Regex != "":
+		re := rw.regex
+		if re == nil {
+			re = regexp.MustCompile(rw.Regex)
+		}
+		return re.ReplaceAllString(path, rw.Substitution)
+	}
+	return path
+}
@@ -0,0 +1,260 @@
+package rep
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skonto/test-reverse-proxy/pkg/echo"
+	"github.com/skonto/test-reverse-proxy/pkg/grpc/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestRouter(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+- name: api
+  url: http://api.internal
+- name: web
+  url: http://web.internal
+- name: admin
+  url: http://admin.internal
+routes:
+- name: admin
+  match:
+    hosts: [admin.example.com]
+  upstream: admin
+- name: api-v1
+  match:
+    hosts: ["*.example.com"]
+    pathPrefix: /api/v1/
+  rewrite:
+    prefix: /
+  upstream: api
+- name: users
+  match:
+    pathRegex: /users/[0-9]+
+    methods: [GET]
+  rewrite:
+    regex: ^/users/([0-9]+)$
+    substitution: /profiles/$1
+  upstream: api
+- name: canary
+  match:
+    path: /
+    headers:
+      X-Canary: "true"
+  upstream: api
+- name: default
+  match:
+    pathPrefix: /
+  upstream: web
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	upstreams := map[string]http.Handler{}
+	for _, u := range cfg.Upstreams {
+		name := u.Name
+		upstreams[name] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		})
+	}
+	router, err := NewRouter(cfg.Routes, upstreams)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		path   string
+		header http.Header
+		want   string
+	}{{
+		name: "exact host",
+		host: "admin.example.com:8080",
+		path: "/api/v1/x",
+		want: "admin /api/v1/x",
+	}, {
+		name: "wildcard host with prefix rewrite",
+		host: "shop.example.com",
+		path: "/api/v1/items",
+		want: "api /items",
+	}, {
+		name: "wildcard does not match the apex",
+		host: "example.com",
+		path: "/api/v1/items",
+		want: "web /api/v1/items",
+	}, {
+		name: "regex with rewrite",
+		host: "example.org",
+		path: "/users/42",
+		want: "api /profiles/42",
+	}, {
+		name:   "regex respects methods",
+		method: http.MethodDelete,
+		host:   "example.org",
+		path:   "/users/42",
+		want:   "web /users/42",
+	}, {
+		name: "regex is anchored",
+		host: "example.org",
+		path: "/users/42/posts",
+		want: "web /users/42/posts",
+	}, {
+		name:   "header",
+		host:   "example.org",
+		path:   "/",
+		header: http.Header{"X-Canary": {"true"}},
+		want:   "api /",
+	}, {
+		name: "fallback",
+		host: "example.org",
+		path: "/",
+		want: "web /",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "http://"+tc.host+tc.path, nil)
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if got := w.Body.String(); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router, err := NewRouter([]Route{{Match: RequestMatch{Hosts: []string{"a.example.com"}}, Upstream: "a"}},
+		map[string]http.Handler{"a": http.NotFoundHandler()})
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://b.example.com/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestParseConfigRejectsInvalidRoutes(t *testing.T) {
+	for _, in := range []string{
+		"routes: [{upstream: missing}]",
+		"upstreams: [{name: a, url: 'ftp://x'}]",
+		"upstreams: [{name: a, url: 'http://x'}, {name: a, url: 'http://y'}]",
+		"upstreams: [{name: a, url: 'http://x', protocol: h3}]",
+		"upstreams: [{name: a, url: 'http://x'}]\nroutes: [{upstream: a, match: {pathRegex: '('}}]",
+		"upstreams: [{name: a, url: 'http://x'}]\nroutes: [{upstream: a, rewrite: {prefix: /}}]",
+		"upstreams: [{name: a, url: 'http://x', flush: {immediateContentTypes: ['text/*;q=1']}}]",
+		"upstreams: [{name: a, url: 'http://x'}]\nroutes: [{upstream: a, flush: {immediateContentTypes: ['']}}]",
+	} {
+		if _, err := ParseConfig([]byte(in)); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded", in)
+		}
+	}
+}
+
+func TestRouterFrontsEchoAndGrpc(t *testing.T) {
+	echoServer := httptest.NewServer(echo.Handler())
+	defer echoServer.Close()
+
+	grpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	pb.RegisterGreetingServiceServer(grpcServer, &gServer{})
+	go grpcServer.Serve(grpcLn)
+	defer grpcServer.Stop()
+
+	cfg, err := ParseConfig([]byte(`
+upstreams:
+- name: echo
+  url: ` + echoServer.URL + `
+  protocol: http1
+- name: grpc
+  url: http://` + grpcLn.Addr().String() + `
+  protocol: h2c
+routes:
+- match:
+    headers:
+      Content-Type: application/grpc
+  upstream: grpc
+- match:
+    pathPrefix: /echo/
+  rewrite:
+    prefix: /
+  upstream: echo
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	upstreams := map[string]http.Handler{}
+	for _, u := range cfg.Upstreams {
+		target, _ := url.Parse(u.URL)
+		proto, _ := ParseUpstreamProtocol(u.Protocol)
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.Transport = NewProtocolTransport(proto)
+		upstreams[u.Name] = DefaultFlushPolicy().Handler(proxy)
+	}
+	router, err := NewRouter(cfg.Routes, upstreams)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server, err := NewServer(ln.Addr().String(), router, nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Serve(ln)
+	defer server.Close()
+
+	resp, err := http.Post("http://"+ln.Addr().String()+"/echo/", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Failed to execute echo request: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("echo body = %q, want %q", body, "hello")
+	}
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := pb.NewGreetingServiceClient(conn).Greeting(ctx, &pb.GreetingServiceRequest{Name: "router"})
+	if err != nil {
+		t.Fatalf("Greeting failed: %v", err)
+	}
+	if reply.Message != "Hello, router" {
+		t.Errorf("reply = %q, want %q", reply.Message, "Hello, router")
+	}
+}
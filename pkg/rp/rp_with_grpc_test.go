@@ -2,7 +2,6 @@ package rep
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"golang.org/x/net/http2"
@@ -12,12 +11,16 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/skonto/test-reverse-proxy/pkg/grpc/pb"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 type gServer struct {
@@ -81,87 +84,270 @@ func TestReverseProxyWithGrpc(t *testing.T) {
 
 }
 
-func ErrorHandler() func(http.ResponseWriter, *http.Request, error) {
-	return func(w http.ResponseWriter, req *http.Request, err error) {
+// holdServer greets after delay, holding the calls for "hold" until they're
+// canceled.
+type holdServer struct {
+	pb.GreetingServiceServer
+	delay  time.Duration
+	served atomic.Int64
+	held   chan struct{}
+}
 
-		ss := readSockStat()
-		log.Printf("error reverse proxying request; sockstat: %q, %v - %v", ss, err, req)
-		http.Error(w, err.Error(), http.StatusBadGateway)
+func (s *holdServer) Greeting(ctx context.Context, req *pb.GreetingServiceRequest) (*pb.GreetingServiceReply, error) {
+	if req.Name == "hold" {
+		s.held <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
 	}
+	time.Sleep(s.delay)
+	s.served.Add(1)
+	return &pb.GreetingServiceReply{Message: "Hello, " + req.Name}, nil
+}
+
+// connQueue hands the connections accepted on an address to the listeners
+// of the gRPC servers taking them, so a server can replace another without
+// the address refusing connections meanwhile.
+type connQueue struct {
+	addr  net.Addr
+	conns chan net.Conn
 }
 
-func readSockStat() string {
-	b, err := os.ReadFile("/proc/net/sockstat")
+func newConnQueue(t *testing.T) *connQueue {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		log.Printf("Unable to read sockstat: %v", err)
-		return ""
+		t.Fatalf("Failed to listen: %v", err)
 	}
-	return string(b)
+	t.Cleanup(func() { ln.Close() })
+	q := &connQueue{addr: ln.Addr(), conns: make(chan net.Conn)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			q.conns <- c
+		}
+	}()
+	return q
+}
+
+func (q *connQueue) listener() net.Listener {
+	return &queueListener{q: q, done: make(chan struct{})}
+}
+
+type queueListener struct {
+	q    *connQueue
+	once sync.Once
+	done chan struct{}
 }
 
-func newH2CTransport(disableCompression bool) http.RoundTripper {
-	return &http2.Transport{
-		AllowHTTP:          true,
-		DisableCompression: disableCompression,
-		DialTLS: func(netw, addr string, _ *tls.Config) (net.Conn, error) {
-			return DialWithBackOff(context.Background(),
-				netw, addr)
-		},
+func (l *queueListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	default:
 	}
+	select {
+	case c := <-l.q.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *queueListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
 }
 
-var backOffTemplate = wait.Backoff{
-	Duration: 50 * time.Millisecond,
-	Factor:   1.4,
-	Jitter:   0.1, // At most 10% jitter.
-	Steps:    15,
+func (l *queueListener) Addr() net.Addr { return l.q.addr }
+
+// freezeListener accepts connections that freeze() makes stop writing
+// without closing, like a hung or unreachable upstream.
+type freezeListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []*freezeConn
 }
 
-const sleep = 30 * time.Millisecond
+func (l *freezeListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	fc := &freezeConn{Conn: c, frozen: make(chan struct{}), closed: make(chan struct{})}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns = append(l.conns, fc)
+	return fc, nil
+}
+
+// freeze freezes the connections accepted so far.
+func (l *freezeListener) freeze() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.freezeOnce.Do(func() { close(c.frozen) })
+	}
+}
 
-var ErrTimeoutDialing = errors.New("timed out dialing")
-var DialWithBackOff = NewBackoffDialer(backOffTemplate)
+type freezeConn struct {
+	net.Conn
+	freezeOnce, closeOnce sync.Once
+	frozen, closed        chan struct{}
+}
 
-// NewBackoffDialer returns a dialer that executes `net.Dialer.DialContext()` with
-// exponentially increasing dial timeouts. In addition it sleeps with random jitter
-// between tries.
-func NewBackoffDialer(backoffConfig wait.Backoff) func(context.Context, string, string) (net.Conn, error) {
-	return func(ctx context.Context, network, address string) (net.Conn, error) {
-		return dialBackOffHelper(ctx, network, address, backoffConfig, nil)
+func (c *freezeConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.frozen:
+		<-c.closed
+		return 0, net.ErrClosed
+	default:
+		return c.Conn.Write(b)
 	}
 }
 
-func dialBackOffHelper(ctx context.Context, network, address string, bo wait.Backoff, tlsConf *tls.Config) (net.Conn, error) {
-	dialer := &net.Dialer{
-		Timeout:   bo.Duration, // Initial duration.
-		KeepAlive: 5 * time.Second,
-		DualStack: true,
+func (c *freezeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// newGrpcProxy proxies to the h2c upstream at addr, returning the transport
+// and a client of the proxy.
+func newGrpcProxy(t *testing.T, addr string, pool ConnectionPool) (*ProtocolTransport, pb.GreetingServiceClient) {
+	t.Helper()
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: addr})
+	transport := NewProtocolTransport(UpstreamH2C)
+	if err := transport.SetPool(pool); err != nil {
+		t.Fatalf("SetPool() = %v", err)
 	}
-	start := time.Now()
-	for {
-		var (
-			c   net.Conn
-			err error
-		)
-		if tlsConf == nil {
-			c, err = dialer.DialContext(ctx, network, address)
-		} else {
-			c, err = tls.DialWithDialer(dialer, network, address, tlsConf)
-		}
-		if err != nil {
-			var errNet net.Error
-			if errors.As(err, &errNet) && errNet.Timeout() {
-				if bo.Steps < 1 {
-					break
+	transport.TrackEndpoints()
+	t.Cleanup(transport.CloseIdleConnections)
+	proxy.Transport = transport
+	proxy.ErrorHandler = ErrorHandler()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server, err := NewServer(ln.Addr().String(), DefaultFlushPolicy().Handler(proxy), nil)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create the proxy client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return transport, pb.NewGreetingServiceClient(conn)
+}
+
+// TestGrpcBackendGracefulStop replaces the backend while calls are sent:
+// the calls in flight on the stopped one complete, the calls after its
+// GOAWAY go to a new connection to the other one, none fails.
+func TestGrpcBackendGracefulStop(t *testing.T) {
+	q := newConnQueue(t)
+	first := &holdServer{delay: 5 * time.Millisecond}
+	s1 := grpc.NewServer()
+	pb.RegisterGreetingServiceServer(s1, first)
+	go s1.Serve(q.listener())
+	t.Cleanup(s1.Stop)
+	transport, client := newGrpcProxy(t, q.addr.String(), ConnectionPool{})
+
+	stop := make(chan struct{})
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err := client.Greeting(ctx, &pb.GreetingServiceRequest{Name: "load"})
+				cancel()
+				if err != nil && failed.Add(1) == 1 {
+					t.Errorf("Greeting() = %v", err)
 				}
-				dialer.Timeout = bo.Step()
-				time.Sleep(wait.Jitter(sleep, 1.0)) // Sleep with jitter.
-				continue
 			}
-			return nil, err
+		}()
+	}
+	defer wg.Wait()
+	defer close(stop)
+
+	waitFor(t, "calls served by the first backend", func() bool { return first.served.Load() >= 50 })
+	second := &holdServer{}
+	s2 := grpc.NewServer()
+	pb.RegisterGreetingServiceServer(s2, second)
+	go s2.Serve(q.listener())
+	// After the calls stopped.
+	t.Cleanup(s2.Stop)
+	s1.GracefulStop()
+	waitFor(t, "calls served by the second backend", func() bool { return second.served.Load() >= 50 })
+
+	if s := transport.PoolStats(); s.Dials != 2 {
+		t.Errorf("PoolStats() = %+v, want 2 dials", s)
+	}
+}
+
+// TestGrpcBackendFrozen stops the backend answering mid-call: the health
+// check closes its connection, failing the call instead of hanging, and the
+// next calls go to a new connection.
+func TestGrpcBackendFrozen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	fl := &freezeListener{Listener: ln}
+	backend := &holdServer{held: make(chan struct{}, 1)}
+	s := grpc.NewServer()
+	pb.RegisterGreetingServiceServer(s, backend)
+	go s.Serve(fl)
+	defer s.Stop()
+	transport, client := newGrpcProxy(t, ln.Addr().String(), ConnectionPool{
+		ReadIdleTimeout: Duration{100 * time.Millisecond},
+		PingTimeout:     Duration{100 * time.Millisecond},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := client.Greeting(ctx, &pb.GreetingServiceRequest{Name: "before"}); err != nil {
+		t.Fatalf("Greeting() = %v", err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Greeting(ctx, &pb.GreetingServiceRequest{Name: "hold"})
+		errs <- err
+	}()
+	<-backend.held
+	fl.freeze()
+
+	start := time.Now()
+	select {
+	case err := <-errs:
+		if code := status.Code(err); code != codes.Unavailable {
+			t.Errorf("Greeting() = %v, want %v", err, codes.Unavailable)
 		}
-		return c, nil
+	case <-time.After(10 * time.Second):
+		t.Fatal("The call to the frozen backend hangs")
+	}
+	t.Logf("The call failed after %v", time.Since(start))
+	if got := transport.PoolStats().HTTP2Errors["conn_close_lost_ping"]; got != 1 {
+		t.Errorf("lost pings = %d, want 1", got)
+	}
+
+	if _, err := client.Greeting(ctx, &pb.GreetingServiceRequest{Name: "after"}); err != nil {
+		t.Fatalf("Greeting() after the freeze = %v", err)
+	}
+	if s := transport.PoolStats(); s.Dials != 2 {
+		t.Errorf("PoolStats() = %+v, want 2 dials", s)
 	}
-	elapsed := time.Since(start)
-	return nil, fmt.Errorf("%w %s after %.2fs", ErrTimeoutDialing, address, elapsed.Seconds())
 }
@@ -0,0 +1,128 @@
+package rep
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	mrand "math/rand"
+	"net/http"
+)
+
+// DefaultTagHeader forces a split to a tagged target, like Knative's tag
+// header routing.
+const DefaultTagHeader = "Knative-Serving-Tag"
+
+// TrafficTarget is one upstream of a split.
+type TrafficTarget struct {
+	Upstream string `json:"upstream"`
+	// Weight is relative to the other targets. Zero weight targets are only
+	// reached through their tag.
+	Weight int `json:"weight"`
+	// Tag selects the target through the tag header.
+	Tag string `json:"tag,omitempty"`
+}
+
+// TrafficSplit spreads the requests of a route over upstreams by weight.
+// Without a sticky key every request is assigned at random; with one, its
+// hash decides so a client keeps hitting the same target while the weights
+// don't change.
+type TrafficSplit struct {
+	Targets []TrafficTarget `json:"targets"`
+	// StickyHeader names a request header, e.g. a user ID, whose value is
+	// the sticky key.
+	StickyHeader string `json:"stickyHeader,omitempty"`
+	// StickyCookie names a cookie holding the sticky key. Clients without it
+	// get one with a random key.
+	StickyCookie string `json:"stickyCookie,omitempty"`
+	// TagHeader names the header forcing a target by tag, DefaultTagHeader
+	// when empty. Untagged targets can't be forced.
+	TagHeader string `json:"tagHeader,omitempty"`
+}
+
+// Validate checks the targets refer to upstreams and carry some weight.
+func (s *TrafficSplit) Validate(upstreams map[string]bool) error {
+	if len(s.Targets) == 0 {
+		return errors.New("split without targets")
+	}
+	total := 0
+	tags := map[string]bool{}
+	for _, t := range s.Targets {
+		if !upstreams[t.Upstream] {
+			return fmt.Errorf("unknown upstream %s", t.Upstream)
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("upstream %s: weight must not be negative", t.Upstream)
+		}
+		if t.Tag != "" {
+			if tags[t.Tag] {
+				return fmt.Errorf("duplicate tag %s", t.Tag)
+			}
+			tags[t.Tag] = true
+		}
+		total += t.Weight
+	}
+	if total == 0 {
+		return errors.New("split weights add up to zero")
+	}
+	if s.StickyHeader != "" && s.StickyCookie != "" {
+		return errors.New("split sets both stickyHeader and stickyCookie")
+	}
+	return nil
+}
+
+// Pick returns the upstream serving r. It may set the sticky cookie on w.
+func (s *TrafficSplit) Pick(w http.ResponseWriter, r *http.Request) string {
+	tagHeader := s.TagHeader
+	if tagHeader == "" {
+		tagHeader = DefaultTagHeader
+	}
+	if tag := r.Header.Get(tagHeader); tag != "" {
+		for _, t := range s.Targets {
+			if t.Tag == tag {
+				return t.Upstream
+			}
+		}
+	}
+
+	total := 0
+	for _, t := range s.Targets {
+		total += t.Weight
+	}
+	var n int
+	switch key := s.stickyKey(w, r); {
+	case key != "":
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(total))
+	default:
+		n = mrand.Intn(total)
+	}
+	for _, t := range s.Targets {
+		if n < t.Weight {
+			return t.Upstream
+		}
+		n -= t.Weight
+	}
+	return s.Targets[len(s.Targets)-1].Upstream
+}
+
+func (s *TrafficSplit) stickyKey(w http.ResponseWriter, r *http.Request) string {
+	switch {
+	case s.StickyHeader != "":
+		return r.Header.Get(s.StickyHeader)
+	case s.StickyCookie != "":
+		if c, err := r.Cookie(s.StickyCookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return ""
+		}
+		key := hex.EncodeToString(b)
+		http.SetCookie(w, &http.Cookie{Name: s.StickyCookie, Value: key, Path: "/", HttpOnly: true})
+		return key
+	}
+	return ""
+}
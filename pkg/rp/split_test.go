@@ -0,0 +1,156 @@
+package rep
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var canarySplit = TrafficSplit{
+	Targets: []TrafficTarget{
+		{Upstream: "stable", Weight: 90},
+		{Upstream: "canary", Weight: 10, Tag: "next"},
+		{Upstream: "preview", Weight: 0, Tag: "preview"},
+	},
+}
+
+// chiSquare returns the chi-square statistic of counts against the split
+// weights.
+func chiSquare(s TrafficSplit, counts map[string]int, n int) float64 {
+	total := 0
+	for _, t := range s.Targets {
+		total += t.Weight
+	}
+	var x float64
+	for _, t := range s.Targets {
+		if t.Weight == 0 {
+			continue
+		}
+		want := float64(n) * float64(t.Weight) / float64(total)
+		d := float64(counts[t.Upstream]) - want
+		x += d * d / want
+	}
+	return x
+}
+
+// With one degree of freedom, chi-square exceeds 10.83 with probability 0.001.
+const chiSquareCritical = 10.83
+
+func TestTrafficSplitDistribution(t *testing.T) {
+	tests := []struct {
+		name  string
+		split TrafficSplit
+		key   func(i int, r *http.Request)
+	}{{
+		name:  "random",
+		split: canarySplit,
+		key:   func(int, *http.Request) {},
+	}, {
+		name: "sticky header",
+		split: func() TrafficSplit {
+			s := canarySplit
+			s.StickyHeader = "X-User"
+			return s
+		}(),
+		key: func(i int, r *http.Request) { r.Header.Set("X-User", fmt.Sprintf("user-%d", i)) },
+	}}
+
+	const n = 20000
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			counts := map[string]int{}
+			for i := 0; i < n; i++ {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				tc.key(i, r)
+				counts[tc.split.Pick(httptest.NewRecorder(), r)]++
+			}
+			if counts["preview"] != 0 {
+				t.Errorf("zero weight target got %d requests", counts["preview"])
+			}
+			if x := chiSquare(tc.split, counts, n); x > chiSquareCritical {
+				t.Errorf("distribution %v does not follow the weights, chi-square = %.2f", counts, x)
+			}
+		})
+	}
+}
+
+func TestTrafficSplitSticky(t *testing.T) {
+	split := canarySplit
+	split.StickyHeader = "X-User"
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", user)
+		first := split.Pick(httptest.NewRecorder(), r)
+		for j := 0; j < 10; j++ {
+			if got := split.Pick(httptest.NewRecorder(), r); got != first {
+				t.Fatalf("%s moved from %s to %s", user, first, got)
+			}
+		}
+	}
+
+	split = canarySplit
+	split.StickyCookie = "split"
+	w := httptest.NewRecorder()
+	first := split.Pick(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "split" {
+		t.Fatalf("cookies = %v, want the sticky cookie", cookies)
+	}
+	for j := 0; j < 10; j++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		if got := split.Pick(w, r); got != first {
+			t.Fatalf("cookie %s moved from %s to %s", cookies[0].Value, first, got)
+		}
+		if c := w.Result().Cookies(); len(c) != 0 {
+			t.Errorf("cookie reissued: %v", c)
+		}
+	}
+}
+
+func TestTrafficSplitTagOverride(t *testing.T) {
+	for tag, want := range map[string]string{
+		"next":    "canary",
+		"preview": "preview",
+	} {
+		for i := 0; i < 20; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(DefaultTagHeader, tag)
+			if got := canarySplit.Pick(httptest.NewRecorder(), r); got != want {
+				t.Fatalf("tag %s routed to %s, want %s", tag, got, want)
+			}
+		}
+	}
+
+	// Upstream names aren't tags: untagged targets can't be forced.
+	split := &TrafficSplit{Targets: []TrafficTarget{
+		{Upstream: "stable", Weight: 1},
+		{Upstream: "internal", Weight: 0},
+	}}
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(DefaultTagHeader, "internal")
+		if got := split.Pick(httptest.NewRecorder(), r); got != "stable" {
+			t.Fatalf("upstream name internal routed to %s, want stable", got)
+		}
+	}
+}
+
+func TestParseConfigRejectsInvalidSplits(t *testing.T) {
+	upstreams := "upstreams: [{name: a, url: 'http://a'}, {name: b, url: 'http://b'}]\n"
+	for _, in := range []string{
+		"routes: [{upstream: a, split: {targets: [{upstream: b, weight: 1}]}}]",
+		"routes: [{split: {targets: [{upstream: c, weight: 1}]}}]",
+		"routes: [{split: {targets: [{upstream: a, weight: 0}]}}]",
+		"routes: [{split: {targets: [{upstream: a, weight: -1}, {upstream: b, weight: 2}]}}]",
+		"routes: [{split: {targets: [{upstream: a, weight: 1, tag: x}, {upstream: b, weight: 1, tag: x}]}}]",
+		"routes: [{split: {stickyHeader: h, stickyCookie: c, targets: [{upstream: a, weight: 1}]}}]",
+	} {
+		if _, err := ParseConfig([]byte(upstreams + in)); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package rep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"knative.dev/serving/pkg/http/handler"
+)
+
+const (
+	// DefaultRequestTimeout applies when no policy sets a request timeout,
+	// like the default Knative revision timeout.
+	DefaultRequestTimeout = 5 * time.Minute
+	// DefaultTimeoutOverrideHeader is the usual header of per-request timeout
+	// overrides, see TimeoutConfig.OverrideHeader.
+	DefaultTimeoutOverrideHeader = "X-Request-Timeout"
+	// TimeoutMessage is the body of the 504 sent when a timeout fires.
+	TimeoutMessage = "request timeout"
+)
+
+// Timeout reasons reported in the access log.
+const (
+	TimeoutReasonRequest           = "request"
+	TimeoutReasonResponseStart     = "response_start"
+	TimeoutReasonIdle              = "idle"
+	TimeoutReasonMaxStreamDuration = "max_stream_duration"
+)
+
+// TimeoutPolicy bounds the lifetime of a request. Zero fields are unset and
+// fall back to the next less specific policy.
+type TimeoutPolicy struct {
+	// Request is the time the upstream has to start responding. As in
+	// Knative, it no longer applies once the response started.
+	Request Duration `json:"request,omitempty"`
+	// ResponseStart is the time until the first response byte.
+	ResponseStart Duration `json:"responseStart,omitempty"`
+	// Idle is the longest pause between two response writes.
+	Idle Duration `json:"idle,omitempty"`
+	// MaxStreamDuration cuts the request, streaming or not, after it.
+	MaxStreamDuration Duration `json:"maxStreamDuration,omitempty"`
+}
+
+// merge overrides p with the fields set in o.
+func (p TimeoutPolicy) merge(o TimeoutPolicy) TimeoutPolicy {
+	if o.Request.Duration != 0 {
+		p.Request = o.Request
+	}
+	if o.ResponseStart.Duration != 0 {
+		p.ResponseStart = o.ResponseStart
+	}
+	if o.Idle.Duration != 0 {
+		p.Idle = o.Idle
+	}
+	if o.MaxStreamDuration.Duration != 0 {
+		p.MaxStreamDuration = o.MaxStreamDuration
+	}
+	return p
+}
+
+// Validate rejects negative timeouts.
+func (p TimeoutPolicy) Validate() error {
+	for name, d := range map[string]Duration{
+		"request":           p.Request,
+		"responseStart":     p.ResponseStart,
+		"idle":              p.Idle,
+		"maxStreamDuration": p.MaxStreamDuration,
+	} {
+		if d.Duration < 0 {
+			return fmt.Errorf("%s timeout must not be negative, got %s", name, d)
+		}
+	}
+	return nil
+}
+
+// TimeoutRule applies its policy to requests matching Match.
+type TimeoutRule struct {
+	Match RequestMatch `json:"match"`
+	TimeoutPolicy
+}
+
+// TimeoutConfig resolves the timeout policy of every request. From least to
+// most specific: Default, the route policy (see WithTimeoutPolicy), the first
+// matching rule and the override header.
+type TimeoutConfig struct {
+	Default TimeoutPolicy `json:"default,omitempty"`
+	Rules   []TimeoutRule `json:"rules,omitempty"`
+	// OverrideHeader names the request header clients override the request
+	// timeout with, e.g. DefaultTimeoutOverrideHeader. Disabled when empty.
+	// Values are Go durations ("2.5s") or seconds ("30"). The header is
+	// removed before the request is proxied.
+	OverrideHeader string `json:"overrideHeader,omitempty"`
+	// MaxOverride caps overrides from the header. When zero, it is the
+	// request timeout the policies resolve to: clients can only shorten it.
+	MaxOverride Duration `json:"maxOverride,omitempty"`
+}
+
+// Validate checks every policy of the config.
+func (c *TimeoutConfig) Validate() error {
+	if err := c.Default.Validate(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for i := range c.Rules {
+		if err := c.Rules[i].Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if err := c.Rules[i].Match.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	if c.MaxOverride.Duration < 0 {
+		return errors.New("maxOverride must not be negative")
+	}
+	return nil
+}
+
+type timeoutPolicyKey struct{}
+
+// WithTimeoutPolicy attaches a route level policy to the request context.
+func WithTimeoutPolicy(ctx context.Context, p TimeoutPolicy) context.Context {
+	return context.WithValue(ctx, timeoutPolicyKey{}, p)
+}
+
+// Resolve returns the policy applying to r.
+func (c *TimeoutConfig) Resolve(r *http.Request) TimeoutPolicy {
+	p := TimeoutPolicy{Request: Duration{DefaultRequestTimeout}}.merge(c.Default)
+	if rp, ok := r.Context().Value(timeoutPolicyKey{}).(TimeoutPolicy); ok {
+		p = p.merge(rp)
+	}
+	for i := range c.Rules {
+		if c.Rules[i].Match.Matches(r) {
+			p = p.merge(c.Rules[i].TimeoutPolicy)
+			break
+		}
+	}
+
+	if c.OverrideHeader == "" {
+		return p
+	}
+	if v := r.Header.Get(c.OverrideHeader); v != "" {
+		d, err := parseTimeoutOverride(v)
+		if err != nil {
+			AnnotateAccessLog(r.Context(), "timeout_override", "invalid")
+			return p
+		}
+		limit := c.MaxOverride.Duration
+		if limit == 0 {
+			limit = p.Request.Duration
+		}
+		if d > limit {
+			d = limit
+		}
+		p.Request = Duration{d}
+	}
+	return p
+}
+
+func parseTimeoutOverride(v string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		v = fmt.Sprintf("%gs", secs)
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive, got %s", d)
+	}
+	return d, nil
+}
+
+type timeoutStateKey struct{}
+
+// timeoutState is shared between the handler and the knative timeout func.
+type timeoutState struct {
+	policy TimeoutPolicy
+
+	mu    sync.Mutex
+	inner *responseRecorder
+}
+
+// NewTimeoutPolicyHandler runs h under the knative timeout handler with the
+// timeouts cfg resolves for each request. Timeouts that fire are reported
+// as `timeout=<reason>` in the access log.
+func NewTimeoutPolicyHandler(h http.Handler, cfg TimeoutConfig) http.Handler {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := r.Context().Value(timeoutStateKey{}).(*timeoutState)
+		rec := &responseRecorder{ResponseWriter: w}
+		state.mu.Lock()
+		state.inner = rec
+		state.mu.Unlock()
+		h.ServeHTTP(rec, r)
+	})
+	timeoutHandler := handler.NewTimeoutHandler(inner, TimeoutMessage, func(r *http.Request) (time.Duration, time.Duration, time.Duration) {
+		p := r.Context().Value(timeoutStateKey{}).(*timeoutState).policy
+		return p.Request.Duration, p.ResponseStart.Duration, p.Idle.Duration
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &timeoutState{policy: cfg.Resolve(r)}
+		if cfg.OverrideHeader != "" {
+			r.Header.Del(cfg.OverrideHeader)
+		}
+		ctx := context.WithValue(r.Context(), timeoutStateKey{}, state)
+		if d := state.policy.MaxStreamDuration.Duration; d > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
+		}
+
+		outer := &responseRecorder{ResponseWriter: w}
+		// Deferred since ReverseProxy aborts the handler with a panic when a
+		// streamed response is cut short.
+		defer func() {
+			if reason := state.fired(ctx, outer); reason != "" {
+				AnnotateAccessLog(r.Context(), "timeout", reason)
+			}
+		}()
+		timeoutHandler.ServeHTTP(outer, r.WithContext(ctx))
+	})
+}
+
+// fired works out which timeout, if any, ended the request. The knative
+// handler writes its 504 straight to outer, bypassing the inner recorder.
+func (s *timeoutState) fired(ctx context.Context, outer *responseRecorder) string {
+	outer.mu.Lock()
+	outerStatus, late := outer.status, outer.lateHeaders
+	outer.mu.Unlock()
+	innerStatus := 0
+	s.mu.Lock()
+	if s.inner != nil {
+		innerStatus, _ = s.inner.result()
+	}
+	s.mu.Unlock()
+
+	switch {
+	case outerStatus == http.StatusGatewayTimeout && innerStatus != http.StatusGatewayTimeout:
+		// Nothing was written yet, the shortest of the three fired.
+		reason, shortest := "", time.Duration(0)
+		for _, c := range []struct {
+			reason string
+			d      time.Duration
+		}{
+			{TimeoutReasonRequest, s.policy.Request.Duration},
+			{TimeoutReasonResponseStart, s.policy.ResponseStart.Duration},
+			{TimeoutReasonIdle, s.policy.Idle.Duration},
+		} {
+			if c.d > 0 && (shortest == 0 || c.d < shortest) {
+				reason, shortest = c.reason, c.d
+			}
+		}
+		return reason
+	case containsStatus(late, http.StatusGatewayTimeout):
+		return TimeoutReasonIdle
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return TimeoutReasonMaxStreamDuration
+	}
+	return ""
+}
+
+func containsStatus(codes []int, want int) bool {
+	for _, c := range codes {
+		if c == want {
+			return true
+		}
+	}
+	return false
+}
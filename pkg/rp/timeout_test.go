@@ -0,0 +1,305 @@
+package rep
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimeoutConfigResolve(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+timeouts:
+  default:
+    request: 30s
+    idle: 10s
+  rules:
+  - match:
+      pathPrefix: /slow
+    request: 2m
+  - match:
+      headers:
+        X-Tenant: batch
+    maxStreamDuration: 1h
+  overrideHeader: X-Request-Timeout
+  maxOverride: 1m
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		route  *TimeoutPolicy
+		want   TimeoutPolicy
+	}{{
+		name: "default",
+		path: "/",
+		want: TimeoutPolicy{Request: Duration{30 * time.Second}, Idle: Duration{10 * time.Second}},
+	}, {
+		name: "path rule",
+		path: "/slow/op",
+		want: TimeoutPolicy{Request: Duration{2 * time.Minute}, Idle: Duration{10 * time.Second}},
+	}, {
+		name:   "header rule",
+		path:   "/",
+		header: http.Header{"X-Tenant": {"batch"}},
+		want: TimeoutPolicy{
+			Request:           Duration{30 * time.Second},
+			Idle:              Duration{10 * time.Second},
+			MaxStreamDuration: Duration{time.Hour},
+		},
+	}, {
+		name:  "route policy",
+		path:  "/",
+		route: &TimeoutPolicy{ResponseStart: Duration{time.Second}},
+		want: TimeoutPolicy{
+			Request:       Duration{30 * time.Second},
+			ResponseStart: Duration{time.Second},
+			Idle:          Duration{10 * time.Second},
+		},
+	}, {
+		name:   "override in seconds",
+		path:   "/slow",
+		header: http.Header{"X-Request-Timeout": {"1.5"}},
+		want:   TimeoutPolicy{Request: Duration{1500 * time.Millisecond}, Idle: Duration{10 * time.Second}},
+	}, {
+		name:   "override capped",
+		path:   "/",
+		header: http.Header{"X-Request-Timeout": {"1h"}},
+		want:   TimeoutPolicy{Request: Duration{time.Minute}, Idle: Duration{10 * time.Second}},
+	}, {
+		name:   "invalid override ignored",
+		path:   "/",
+		header: http.Header{"X-Request-Timeout": {"-3s"}},
+		want:   TimeoutPolicy{Request: Duration{30 * time.Second}, Idle: Duration{10 * time.Second}},
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for k, v := range tc.header {
+				r.Header[k] = v
+			}
+			if tc.route != nil {
+				r = r.WithContext(WithTimeoutPolicy(r.Context(), *tc.route))
+			}
+			if got := cfg.Timeouts.Resolve(r); got != tc.want {
+				t.Errorf("Resolve() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTimeoutOverrideDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    TimeoutConfig
+		header string
+		want   time.Duration
+	}{{
+		name:   "disabled",
+		cfg:    TimeoutConfig{Default: TimeoutPolicy{Request: Duration{30 * time.Second}}},
+		header: "1s",
+		want:   30 * time.Second,
+	}, {
+		name:   "shortened",
+		cfg:    TimeoutConfig{Default: TimeoutPolicy{Request: Duration{30 * time.Second}}, OverrideHeader: DefaultTimeoutOverrideHeader},
+		header: "1s",
+		want:   time.Second,
+	}, {
+		name:   "capped by the request timeout",
+		cfg:    TimeoutConfig{Default: TimeoutPolicy{Request: Duration{30 * time.Second}}, OverrideHeader: DefaultTimeoutOverrideHeader},
+		header: "1h",
+		want:   30 * time.Second,
+	}, {
+		name:   "capped by the default request timeout",
+		cfg:    TimeoutConfig{OverrideHeader: DefaultTimeoutOverrideHeader},
+		header: "1h",
+		want:   DefaultRequestTimeout,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set(DefaultTimeoutOverrideHeader, tc.header)
+			if got := tc.cfg.Resolve(r).Request.Duration; got != tc.want {
+				t.Errorf("Resolve().Request = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigRejectsInvalidTimeouts(t *testing.T) {
+	for _, in := range []string{
+		"timeouts: {default: {request: -1s}}",
+		"timeouts: {maxOverride: -1s}",
+		"timeouts: {default: {request: 10}}",
+		"timeouts: {default: {requst: 1s}}",
+	} {
+		if _, err := ParseConfig([]byte(in)); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded", in)
+		}
+	}
+}
+
+// syncBuffer collects log output written from server goroutines.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestTimeoutPolicyHandler(t *testing.T) {
+	// The upstream waits for ?delay before responding, then streams ?chunks
+	// writes ?gap apart.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		delay, _ := time.ParseDuration(q.Get("delay"))
+		gap, _ := time.ParseDuration(q.Get("gap"))
+		chunks := len(q.Get("chunks"))
+		if r.Header.Get(DefaultTimeoutOverrideHeader) != "" {
+			http.Error(w, "timeout override proxied", http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < chunks; i++ {
+			io.WriteString(w, "data: x\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(gap):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := TimeoutConfig{
+		Default:        TimeoutPolicy{Request: Duration{time.Minute}},
+		OverrideHeader: DefaultTimeoutOverrideHeader,
+		Rules: []TimeoutRule{{
+			Match:         RequestMatch{PathPrefix: "/start"},
+			TimeoutPolicy: TimeoutPolicy{ResponseStart: Duration{100 * time.Millisecond}},
+		}, {
+			Match:         RequestMatch{PathPrefix: "/idle"},
+			TimeoutPolicy: TimeoutPolicy{Idle: Duration{100 * time.Millisecond}},
+		}, {
+			Match:         RequestMatch{PathPrefix: "/stream"},
+			TimeoutPolicy: TimeoutPolicy{MaxStreamDuration: Duration{200 * time.Millisecond}},
+		}},
+	}
+	proxy := NewHeaderPruningReverseProxy(upstream.Listener.Addr().String(), "", []string{}, false)
+	logs := &syncBuffer{}
+	proxyServer := httptest.NewServer(NewAccessLogHandler(NewTimeoutPolicyHandler(proxy, cfg), log.New(logs, "", 0)))
+	defer proxyServer.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		header     string
+		wantStatus int
+		wantReason string
+	}{{
+		name:       "no timeout",
+		path:       "/ok?chunks=xx&gap=10ms",
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "response start",
+		path:       "/start?delay=1s&chunks=x",
+		wantStatus: http.StatusGatewayTimeout,
+		wantReason: TimeoutReasonResponseStart,
+	}, {
+		name:       "request timeout override",
+		path:       "/override?delay=1s&chunks=x",
+		header:     "0.1",
+		wantStatus: http.StatusGatewayTimeout,
+		wantReason: TimeoutReasonRequest,
+	}, {
+		name:       "request timeout override stripped",
+		path:       "/stripped?chunks=x",
+		header:     "30",
+		wantStatus: http.StatusOK,
+	}, {
+		name:       "idle",
+		path:       "/idle?chunks=xx&gap=1s",
+		wantStatus: http.StatusOK,
+		wantReason: TimeoutReasonIdle,
+	}, {
+		name:       "max stream duration",
+		path:       "/stream?chunks=xxxxxxxxxxxxxxxxxxxxxxxxxxxxxx&gap=20ms",
+		wantStatus: http.StatusOK,
+		wantReason: TimeoutReasonMaxStreamDuration,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, proxyServer.URL+tc.path, nil)
+			if tc.header != "" {
+				req.Header.Set(DefaultTimeoutOverrideHeader, tc.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+
+			path := strings.SplitN(tc.path, "?", 2)[0]
+			var line string
+			for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+				if line = findLogLine(logs.String(), "path="+path+" "); line != "" {
+					break
+				}
+			}
+			if line == "" {
+				t.Fatalf("no access log line for %s in:\n%s", path, logs)
+			}
+			hasReason := strings.Contains(line, "timeout=")
+			if tc.wantReason == "" && hasReason {
+				t.Errorf("unexpected timeout in access log: %s", line)
+			}
+			if tc.wantReason != "" && !strings.Contains(line, "timeout="+tc.wantReason) {
+				t.Errorf("access log %q does not report timeout=%s", line, tc.wantReason)
+			}
+		})
+	}
+}
+
+// findLogLine returns the last access log line containing needle.
+func findLogLine(logs, needle string) string {
+	lines := strings.Split(logs, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.HasPrefix(lines[i], "access ") && strings.Contains(lines[i], needle) {
+			return lines[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,239 @@
+package rep
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ALPN protocol identifiers offered by the proxy listener and upstream transports.
+const (
+	ProtoH2    = "h2"
+	ProtoHTTP1 = "http/1.1"
+)
+
+// CertReloader serves a certificate/key pair loaded from disk and reloads it
+// whenever either file changes, so certificates can be rotated without
+// restarting the proxy.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertReloader loads the given certificate/key pair and returns a reloader for it.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate/key pair from disk. On error the previously
+// loaded certificate is kept.
+func (r *CertReloader) Reload() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair %s/%s: %w", r.certFile, r.keyFile, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	return nil
+}
+
+// Watch polls the certificate files every interval and reloads them when their
+// modification time changes. It returns when ctx is done.
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	wait.UntilWithContext(ctx, func(context.Context) {
+		certMod, keyMod, err := r.modTimes()
+		if err != nil {
+			logf(LogError, "Unable to stat certificate files: %v", err)
+			return
+		}
+		r.mu.RLock()
+		changed := !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)
+		r.mu.RUnlock()
+		if !changed {
+			return
+		}
+		if err := r.Reload(); err != nil {
+			logf(LogError, "Keeping previous certificate, reload failed: %v", err)
+			return
+		}
+		logf(LogInfo, "Reloaded certificate %s", r.certFile)
+	}, interval)
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *CertReloader) modTimes() (time.Time, time.Time, error) {
+	ci, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	ki, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return ci.ModTime(), ki.ModTime(), nil
+}
+
+// NewServerTLSConfig returns the TLS config for the proxy listener. Certificates
+// are served from the reloader and ALPN negotiates h2 before http/1.1.
+func NewServerTLSConfig(r *CertReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		NextProtos:     []string{ProtoH2, ProtoHTTP1},
+	}
+}
+
+// UpstreamTLSOptions configures TLS origination towards the upstream.
+type UpstreamTLSOptions struct {
+	// CAFile is a PEM bundle used to verify the upstream. System roots are
+	// used when empty.
+	CAFile string
+	// ServerName overrides the SNI and the name verified against the
+	// upstream certificate. Defaults to the dialed host.
+	ServerName string
+	// CertFile and KeyFile are an optional client certificate presented to
+	// the upstream. They are reloaded like the listener certificate.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables upstream certificate verification.
+	InsecureSkipVerify bool
+}
+
+// NewUpstreamTLSConfig builds the client TLS config described by opts. The
+// returned reloader is nil unless a client certificate was configured.
+func NewUpstreamTLSConfig(opts UpstreamTLSOptions) (*tls.Config, *CertReloader, error) {
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		NextProtos:         []string{ProtoH2, ProtoHTTP1},
+	}
+
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in CA bundle %s", opts.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, nil, errors.New("client certificate and key must be set together")
+	}
+	var reloader *CertReloader
+	if opts.CertFile != "" {
+		var err error
+		if reloader, err = NewCertReloader(opts.CertFile, opts.KeyFile); err != nil {
+			return nil, nil, err
+		}
+		conf.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return conf, reloader, nil
+}
+
+// UpstreamTLS overrides the upstream TLS options of the proxy for one https
+// upstream.
+type UpstreamTLS struct {
+	// ServerName is the SNI sent to the upstream and the name verified
+	// against its certificate.
+	ServerName string `json:"serverName,omitempty"`
+	// CAFile is a PEM bundle verifying the upstream, and CA the bundle
+	// itself.
+	CAFile string `json:"caFile,omitempty"`
+	CA     string `json:"ca,omitempty"`
+}
+
+// Validate checks the CA is set at most once and holds certificates.
+func (t *UpstreamTLS) Validate() error {
+	if t.CAFile != "" && t.CA != "" {
+		return errors.New("caFile and ca are exclusive")
+	}
+	if t.CA != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(t.CA)) {
+		return errors.New("no certificates found in ca")
+	}
+	return nil
+}
+
+// Config returns base overridden by t.
+func (t *UpstreamTLS) Config(base *tls.Config) (*tls.Config, error) {
+	conf := base.Clone()
+	if t.ServerName != "" {
+		conf.ServerName = t.ServerName
+	}
+	pem := []byte(t.CA)
+	if t.CAFile != "" {
+		var err error
+		if pem, err = os.ReadFile(t.CAFile); err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+	}
+	if len(pem) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA bundle")
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+// NewTLSBackoffDialer is like NewBackoffDialer but performs a TLS handshake
+// using tlsConf on the established connection.
+func NewTLSBackoffDialer(backoffConfig wait.Backoff, tlsConf *tls.Config) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialBackOffHelper(ctx, network, address, backoffConfig, tlsConf)
+	}
+}
+
+// NewHTTPSTransport returns a transport originating TLS to the upstream with
+// tlsConf, speaking h2 or http/1.1 depending on what ALPN negotiates.
+func NewHTTPSTransport(tlsConf *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConf
+	transport.DialTLSContext = NewTLSBackoffDialer(backOffTemplate, tlsConf)
+	transport.ForceAttemptHTTP2 = true
+	return transport
+}
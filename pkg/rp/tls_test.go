@@ -0,0 +1,301 @@
+package rep
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates signed by a throwaway CA generated at runtime.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	dir    string
+	caFile string
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir(), serial: 1}
+	ca.caFile = filepath.Join(ca.dir, "ca.pem")
+	writePEM(t, ca.caFile, "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a leaf certificate and key for the given names and returns the file paths.
+func (ca *testCA) issue(t *testing.T, name string, dnsNames []string, client bool) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	ca.serial++
+	usage := x509.ExtKeyUsageServerAuth
+	if client {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certFile := filepath.Join(ca.dir, name+".pem")
+	keyFile := filepath.Join(ca.dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestProxyTLSTerminationAndOrigination(t *testing.T) {
+	ca := newTestCA(t)
+
+	// The upstream only accepts clients presenting a certificate from the CA
+	// and serves a certificate valid for upstream.test, not for its IP.
+	upCert, upKey := ca.issue(t, "upstream", []string{"upstream.test"}, false)
+	upPair, err := tls.LoadX509KeyPair(upCert, upKey)
+	if err != nil {
+		t.Fatalf("Failed to load upstream key pair: %v", err)
+	}
+	echoServer := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if len(req.TLS.PeerCertificates) == 0 {
+				http.Error(w, "no client certificate", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("X-Upstream-Proto", req.Proto)
+			w.Header().Set("X-Client-CN", req.TLS.PeerCertificates[0].Subject.CommonName)
+			io.Copy(w, req.Body)
+		},
+	))
+	echoServer.EnableHTTP2 = true
+	echoServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{upPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	}
+	echoServer.StartTLS()
+	defer echoServer.Close()
+
+	clientCert, clientKey := ca.issue(t, "proxy-client", nil, true)
+	upstreamTLS, _, err := NewUpstreamTLSConfig(UpstreamTLSOptions{
+		CAFile:     ca.caFile,
+		ServerName: "upstream.test",
+		CertFile:   clientCert,
+		KeyFile:    clientKey,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build upstream TLS config: %v", err)
+	}
+	proxy := NewHeaderPruningReverseProxy(echoServer.Listener.Addr().String(), "", []string{}, true)
+	proxy.Transport = NewHTTPSTransport(upstreamTLS)
+
+	proxyCert, proxyKey := ca.issue(t, "proxy", []string{"proxy.test"}, false)
+	reloader, err := NewCertReloader(proxyCert, proxyKey)
+	if err != nil {
+		t.Fatalf("Failed to load proxy certificate: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	proxyServer := &http.Server{Handler: proxy, TLSConfig: NewServerTLSConfig(reloader)}
+	go proxyServer.ServeTLS(ln, "", "")
+	defer proxyServer.Close()
+	proxyURL := "https://" + ln.Addr().String()
+
+	for _, proto := range []string{ProtoH2, ProtoHTTP1} {
+		t.Run(proto, func(t *testing.T) {
+			transport := &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: ca.pool(), NextProtos: []string{proto}},
+				ForceAttemptHTTP2: proto == ProtoH2,
+			}
+			defer transport.CloseIdleConnections()
+			c := &http.Client{Transport: transport}
+
+			body := make([]byte, bodySize)
+			if err := send(c, proxyURL, body, ""); err != nil {
+				t.Fatalf("error during request: %v", err)
+			}
+
+			resp, err := c.Get(proxyURL)
+			if err != nil {
+				t.Fatalf("Failed to execute request: %v", err)
+			}
+			resp.Body.Close()
+			if got := resp.TLS.NegotiatedProtocol; got != proto {
+				t.Errorf("NegotiatedProtocol = %q, want %q", got, proto)
+			}
+			if got := resp.Header.Get("X-Upstream-Proto"); got != "HTTP/2.0" {
+				t.Errorf("upstream protocol = %q, want HTTP/2.0", got)
+			}
+			if got := resp.Header.Get("X-Client-CN"); got != "proxy-client" {
+				t.Errorf("upstream saw client certificate %q, want proxy-client", got)
+			}
+		})
+	}
+
+	// Rotate the listener certificate and check new handshakes pick it up.
+	rotatedCert, rotatedKey := ca.issue(t, "proxy-rotated", []string{"proxy.test"}, false)
+	for src, dst := range map[string]string{rotatedCert: proxyCert, rotatedKey: proxyKey} {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", src, err)
+		}
+		if err := os.WriteFile(dst, b, 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", dst, err)
+		}
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Failed to reload certificate: %v", err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: ca.pool(), ServerName: "proxy.test"})
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != "proxy-rotated" {
+		t.Errorf("proxy served certificate %q after reload, want proxy-rotated", got)
+	}
+}
+
+func TestCertReloaderKeepsCertificateOnError(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "proxy", nil, false)
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	before, _ := reloader.GetCertificate(nil)
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("Failed to corrupt certificate: %v", err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("Reload() succeeded with a corrupt certificate")
+	}
+	if after, _ := reloader.GetCertificate(nil); after != before {
+		t.Error("previous certificate was replaced after a failed reload")
+	}
+}
+
+func TestUpstreamTLSOverride(t *testing.T) {
+	ca := newTestCA(t)
+	upCert, upKey := ca.issue(t, "upstream", []string{"upstream.test"}, false)
+	upPair, err := tls.LoadX509KeyPair(upCert, upKey)
+	if err != nil {
+		t.Fatalf("Failed to load upstream key pair: %v", err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{upPair}}
+	upstream.StartTLS()
+	defer upstream.Close()
+	caPEM, err := os.ReadFile(ca.caFile)
+	if err != nil {
+		t.Fatalf("Failed to read CA: %v", err)
+	}
+
+	// The flags set neither the CA nor the SNI.
+	base, _, err := NewUpstreamTLSConfig(UpstreamTLSOptions{})
+	if err != nil {
+		t.Fatalf("Failed to build upstream TLS config: %v", err)
+	}
+	tests := []struct {
+		name     string
+		override UpstreamTLS
+		wantErr  bool
+	}{
+		{name: "flags", wantErr: true},
+		{name: "ca file", override: UpstreamTLS{ServerName: "upstream.test", CAFile: ca.caFile}},
+		{name: "inline ca", override: UpstreamTLS{ServerName: "upstream.test", CA: string(caPEM)}},
+		{name: "wrong server name", override: UpstreamTLS{ServerName: "other.test", CA: string(caPEM)}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.override.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			conf, err := test.override.Config(base)
+			if err != nil {
+				t.Fatalf("Config() = %v", err)
+			}
+			transport := NewHTTPSTransport(conf)
+			defer transport.CloseIdleConnections()
+			resp, err := (&http.Client{Transport: transport}).Get(upstream.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("Get() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+	if base.ServerName != "" || base.RootCAs != nil {
+		t.Error("Config() modified the base config")
+	}
+
+	for _, invalid := range []UpstreamTLS{{CAFile: ca.caFile, CA: string(caPEM)}, {CA: "not a certificate"}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate() succeeded for %+v", invalid)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package rep
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Defaults of the HTTP/2 health checks of upstream connections: a
+// connection that was silent for DefaultReadIdleTimeout is pinged, and closed,
+// failing its requests, when the ping isn't answered within DefaultPingTimeout.
+const (
+	DefaultReadIdleTimeout = 30 * time.Second
+	DefaultPingTimeout     = 15 * time.Second
+)
+
+func newH2CTransport(disableCompression bool) http.RoundTripper {
+	return &http2.Transport{
+		AllowHTTP:          true,
+		DisableCompression: disableCompression,
+		ReadIdleTimeout:    DefaultReadIdleTimeout,
+		PingTimeout:        DefaultPingTimeout,
+		DialTLSContext: func(ctx context.Context, netw, addr string, _ *tls.Config) (net.Conn, error) {
+			return DialWithBackOff(ctx, netw, addr)
+		},
+	}
+}
+
+var backOffTemplate = wait.Backoff{
+	Duration: 50 * time.Millisecond,
+	Factor:   1.4,
+	Jitter:   0.1, // At most 10% jitter.
+	Steps:    15,
+}
+
+const sleep = 30 * time.Millisecond
+
+var ErrTimeoutDialing = errors.New("timed out dialing")
+var DialWithBackOff = NewBackoffDialer(backOffTemplate)
+
+// NewBackoffDialer returns a dialer that executes `net.Dialer.DialContext()` with
+// exponentially increasing dial timeouts. In addition it sleeps with random jitter
+// between tries.
+func NewBackoffDialer(backoffConfig wait.Backoff) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialBackOffHelper(ctx, network, address, backoffConfig, nil)
+	}
+}
+
+func dialBackOffHelper(ctx context.Context, network, address string, bo wait.Backoff, tlsConf *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   bo.Duration, // Initial duration.
+		KeepAlive: 5 * time.Second,
+		DualStack: true,
+	}
+	start := time.Now()
+	for {
+		var (
+			c   net.Conn
+			err error
+		)
+		if tlsConf == nil {
+			c, err = dialer.DialContext(ctx, network, address)
+		} else {
+			c, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConf}).DialContext(ctx, network, address)
+		}
+		if err != nil {
+			var errNet net.Error
+			if errors.As(err, &errNet) && errNet.Timeout() && ctx.Err() == nil {
+				if bo.Steps < 1 {
+					break
+				}
+				dialer.Timeout = bo.Step()
+				time.Sleep(wait.Jitter(sleep, 1.0)) // Sleep with jitter.
+				continue
+			}
+			return nil, err
+		}
+		return c, nil
+	}
+	elapsed := time.Since(start)
+	return nil, fmt.Errorf("%w %s after %.2fs", ErrTimeoutDialing, address, elapsed.Seconds())
+}
+
+// WithConnectTimeout bounds the time dial spends connecting, retries
+// included, like the connect_timeout of an Envoy cluster.
+func WithConnectTimeout(dial func(context.Context, string, string) (net.Conn, error), timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		c, err := dial(ctx, network, address)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w %s after %s", ErrTimeoutDialing, address, timeout)
+		}
+		return c, err
+	}
+}
@@ -0,0 +1,249 @@
+package rep
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// UpgradeTunnel proxies `Connection: Upgrade` requests, e.g. WebSocket,
+// through its own tunnel and everything else through Proxy.
+//
+// httputil.ReverseProxy tears an upgraded connection down as soon as either
+// side stops sending. The tunnel instead propagates a half-close to the other
+// side and keeps the opposite direction flowing until it finishes too, and
+// closes connections that stay idle in both directions for IdleTimeout.
+type UpgradeTunnel struct {
+	// Proxy handles regular requests; its Director rewrites upgrade requests.
+	Proxy *httputil.ReverseProxy
+	// Dial connects to the upstream. DialWithBackOff is used when nil.
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// TLSConfig is used for https upstreams.
+	TLSConfig *tls.Config
+	// IdleTimeout closes tunnels without traffic in either direction. Zero disables it.
+	IdleTimeout time.Duration
+}
+
+// NewUpgradeTunnel returns an UpgradeTunnel in front of proxy.
+func NewUpgradeTunnel(proxy *httputil.ReverseProxy, idleTimeout time.Duration) *UpgradeTunnel {
+	return &UpgradeTunnel{Proxy: proxy, IdleTimeout: idleTimeout}
+}
+
+// IsUpgradeRequest reports whether r asks to switch protocols.
+func IsUpgradeRequest(r *http.Request) bool {
+	return r.ProtoMajor == 1 && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade") && r.Header.Get("Upgrade") != ""
+}
+
+func (t *UpgradeTunnel) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsUpgradeRequest(r) {
+		t.Proxy.ServeHTTP(w, r)
+		return
+	}
+
+	outreq := r.Clone(r.Context())
+	t.Proxy.Director(outreq)
+	outreq.RequestURI = ""
+	outreq.Close = false
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := outreq.Header["X-Forwarded-For"]; len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		outreq.Header.Set("X-Forwarded-For", ip)
+	}
+
+	backConn, err := t.dial(outreq)
+	if err != nil {
+		t.error(w, r, err)
+		return
+	}
+	if err := outreq.Write(backConn); err != nil {
+		backConn.Close()
+		t.error(w, r, err)
+		return
+	}
+	backBuf := bufio.NewReader(backConn)
+	res, err := http.ReadResponse(backBuf, outreq)
+	if err != nil {
+		backConn.Close()
+		t.error(w, r, err)
+		return
+	}
+
+	if t.Proxy.ModifyResponse != nil {
+		if err := t.Proxy.ModifyResponse(res); err != nil {
+			backConn.Close()
+			t.error(w, r, err)
+			return
+		}
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// The upstream refused the upgrade, relay its answer without the
+		// headers of its connection.
+		defer backConn.Close()
+		defer res.Body.Close()
+		removeHopHeaders(res.Header)
+		for k, vv := range res.Header {
+			w.Header()[k] = vv
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		backConn.Close()
+		t.error(w, r, fmt.Errorf("can't switch protocols using non-Hijacker ResponseWriter: %w", err))
+		return
+	}
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", res.Status)
+	res.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		backConn.Close()
+		return
+	}
+
+	t.tunnel(&bufferedConn{Conn: conn, r: brw.Reader}, &bufferedConn{Conn: backConn, r: backBuf})
+}
+
+// hopHeaders are the headers of a single connection, which
+// httputil.ReverseProxy doesn't forward either.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers of h and the ones its
+// Connection header lists.
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func (t *UpgradeTunnel) dial(outreq *http.Request) (net.Conn, error) {
+	addr := outreq.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if outreq.URL.Scheme == "https" {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+	dial := t.Dial
+	if dial == nil {
+		dial = DialWithBackOff
+	}
+	conn, err := dial(outreq.Context(), "tcp", addr)
+	if err != nil || outreq.URL.Scheme != "https" {
+		return conn, err
+	}
+	conf := &tls.Config{}
+	if t.TLSConfig != nil {
+		conf = t.TLSConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		conf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	// Upgrades are an HTTP/1.1 mechanism.
+	conf.NextProtos = []string{ProtoHTTP1}
+	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.HandshakeContext(outreq.Context()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (t *UpgradeTunnel) error(w http.ResponseWriter, r *http.Request, err error) {
+	if t.Proxy.ErrorHandler != nil {
+		t.Proxy.ErrorHandler(w, r, err)
+		return
+	}
+	logf(LogError, "error tunneling upgrade request: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// tunnel copies data both ways until both directions are done.
+func (t *UpgradeTunnel) tunnel(client, backend *bufferedConn) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			client.Close()
+			backend.Close()
+		})
+	}
+	defer closeBoth()
+
+	var idle *time.Timer
+	if t.IdleTimeout > 0 {
+		idle = time.AfterFunc(t.IdleTimeout, closeBoth)
+		defer idle.Stop()
+	}
+	activity := func() {
+		if idle != nil {
+			idle.Reset(t.IdleTimeout)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	halfClose := func(dst, src *bufferedConn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, &activityReader{r: src, activity: activity})
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			// Abort the whole tunnel on errors, only a clean EOF is a half-close.
+			closeBoth()
+			return
+		}
+		if err := dst.CloseWrite(); err != nil {
+			closeBoth()
+		}
+	}
+	go halfClose(backend, client)
+	go halfClose(client, backend)
+	wg.Wait()
+}
+
+// activityReader reports every successful read.
+type activityReader struct {
+	r        io.Reader
+	activity func()
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.activity()
+	}
+	return n, err
+}
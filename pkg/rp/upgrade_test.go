@@ -0,0 +1,210 @@
+package rep
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"knative.dev/serving/pkg/http/handler"
+)
+
+// newTunnelChain fronts upstream with the tunnel and the knative timeout
+// handler, like the timeout chain of the echo matrix in rev_test.go.
+func newTunnelChain(t *testing.T, upstream *httptest.Server, idleTimeout time.Duration) *httptest.Server {
+	t.Helper()
+	proxy := NewHeaderPruningReverseProxy(upstream.Listener.Addr().String(), "", []string{}, false)
+	tunnel := NewUpgradeTunnel(proxy, idleTimeout)
+	composedHandler := handler.NewTimeoutHandler(tunnel, "request timeout", func(r *http.Request) (time.Duration, time.Duration, time.Duration) {
+		return time.Minute, time.Minute, time.Minute
+	})
+	return httptest.NewServer(composedHandler)
+}
+
+func TestWebSocketThroughProxy(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+	defer upstream.Close()
+
+	idleTimeout := 300 * time.Millisecond
+	proxyServer := newTunnelChain(t, upstream, idleTimeout)
+	defer proxyServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(proxyServer.URL, "http")
+
+	t.Run("echo", func(t *testing.T) {
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer c.Close()
+		for i := 0; i < 10; i++ {
+			want := strings.Repeat("x", i*1024)
+			if err := c.WriteMessage(websocket.TextMessage, []byte(want)); err != nil {
+				t.Fatalf("Failed to write message: %v", err)
+			}
+			_, got, err := c.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read message: %v", err)
+			}
+			if string(got) != want {
+				t.Fatalf("unexpected message length: %d", len(got))
+			}
+		}
+	})
+
+	t.Run("ping keeps the tunnel alive", func(t *testing.T) {
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer c.Close()
+		pongs := make(chan struct{}, 100)
+		c.SetPongHandler(func(string) error {
+			pongs <- struct{}{}
+			return nil
+		})
+		readErr := make(chan error, 1)
+		go func() {
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					readErr <- err
+					return
+				}
+			}
+		}()
+
+		deadline := time.Now().Add(3 * idleTimeout)
+		for time.Now().Before(deadline) {
+			if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("Failed to ping: %v", err)
+			}
+			select {
+			case <-pongs:
+			case err := <-readErr:
+				t.Fatalf("Tunnel closed while pinging: %v", err)
+			case <-time.After(time.Second):
+				t.Fatal("Timed out waiting for pong")
+			}
+			time.Sleep(idleTimeout / 4)
+		}
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		c, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(10 * idleTimeout))
+		start := time.Now()
+		_, _, err = c.ReadMessage()
+		if err == nil {
+			t.Fatal("ReadMessage() succeeded on an idle tunnel")
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatalf("Tunnel was not closed after %v: %v", time.Since(start), err)
+		}
+	})
+}
+
+func TestUpgradeHalfClosePropagation(t *testing.T) {
+	// The upstream echoes until the client half-closes, then sends a trailer
+	// message and closes.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "1")
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.Header().Set("Upgrade", "echo")
+			w.Header().Set("X-End-To-End", "1")
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+		io.WriteString(conn, "bye")
+	}))
+	defer upstream.Close()
+
+	proxyServer := newTunnelChain(t, upstream, time.Minute)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: echo\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	io.WriteString(conn, "hello")
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("Failed to half-close: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("Failed to read after half-close: %v", err)
+	}
+	if string(got) != "hellobye" {
+		t.Errorf("got %q after half-close, want %q", got, "hellobye")
+	}
+
+	t.Run("refused upgrade", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, proxyServer.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "other")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUpgradeRequired {
+			t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUpgradeRequired)
+		}
+		// The headers of the upstream connection aren't relayed.
+		for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Upgrade"} {
+			if v := resp.Header.Get(name); v != "" {
+				t.Errorf("%s = %q, want it removed", name, v)
+			}
+		}
+		if v := resp.Header.Get("X-End-To-End"); v != "1" {
+			t.Errorf("X-End-To-End = %q, want 1", v)
+		}
+	})
+}
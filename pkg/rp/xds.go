@@ -0,0 +1,604 @@
+package rep
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	httpv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Type URLs of the xDS resources translated to a Config.
+const (
+	ListenerType = "type.googleapis.com/envoy.config.listener.v3.Listener"
+	RouteType    = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+	ClusterType  = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	EndpointType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+)
+
+const (
+	hcmFilterName             = "envoy.filters.network.http_connection_manager"
+	hcmTypeURL                = "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager"
+	httpProtocolOptionsName   = "envoy.extensions.upstreams.http.v3.HttpProtocolOptions"
+	tlsTransportSocketName    = "envoy.transport_sockets.tls"
+	upstreamTLSContextTypeURL = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext"
+	methodPseudoHeader        = ":method"
+	// xdsRouteTimeout is Envoy's timeout of routes that don't set one.
+	xdsRouteTimeout = 15 * time.Second
+)
+
+var invalidHostChars = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// envoyRegexGroup matches the \1 group references of Envoy substitutions.
+var envoyRegexGroup = regexp.MustCompile(`\\([0-9])`)
+
+// XDSResources is the state of the world of the xDS resources of a proxy,
+// by name. Listeners are served in name order, each through the routes of
+// its HTTP connection manager.
+type XDSResources struct {
+	Listeners map[string]*listenerv3.Listener
+	Routes    map[string]*routev3.RouteConfiguration
+	Clusters  map[string]*clusterv3.Cluster
+	Endpoints map[string]*endpointv3.ClusterLoadAssignment
+}
+
+// NewXDSResources returns the resources of msgs, which must be Listeners,
+// RouteConfigurations, Clusters or ClusterLoadAssignments.
+func NewXDSResources(msgs ...proto.Message) (*XDSResources, error) {
+	res := &XDSResources{}
+	for _, m := range msgs {
+		if err := res.add(m); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (res *XDSResources) add(m proto.Message) error {
+	switch m := m.(type) {
+	case *listenerv3.Listener:
+		setResource(&res.Listeners, m.GetName(), m)
+	case *routev3.RouteConfiguration:
+		setResource(&res.Routes, m.GetName(), m)
+	case *clusterv3.Cluster:
+		setResource(&res.Clusters, m.GetName(), m)
+	case *endpointv3.ClusterLoadAssignment:
+		setResource(&res.Endpoints, m.GetClusterName(), m)
+	default:
+		return fmt.Errorf("unsupported xDS resource %T", m)
+	}
+	return nil
+}
+
+func setResource[M proto.Message](m *map[string]M, name string, r M) {
+	if *m == nil {
+		*m = make(map[string]M)
+	}
+	(*m)[name] = r
+}
+
+// xdsTypeURL returns the type URL of an xDS resource.
+func xdsTypeURL(m proto.Message) string {
+	return "type.googleapis.com/" + string(m.ProtoReflect().Descriptor().FullName())
+}
+
+// xdsResourceName returns the name of an xDS resource.
+func xdsResourceName(m proto.Message) string {
+	if cla, ok := m.(*endpointv3.ClusterLoadAssignment); ok {
+		return cla.GetClusterName()
+	}
+	if named, ok := m.(interface{ GetName() string }); ok {
+		return named.GetName()
+	}
+	return ""
+}
+
+// routeConfigNames returns the RDS route configurations the listeners use.
+func (res *XDSResources) routeConfigNames() []string {
+	var names []string
+	for _, l := range res.Listeners {
+		hcms, _ := listenerHCMs(l)
+		for _, hcm := range hcms {
+			if name := hcm.GetRds().GetRouteConfigName(); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return uniqueSorted(names)
+}
+
+// endpointNames returns the EDS load assignments the clusters use.
+func (res *XDSResources) endpointNames() []string {
+	var names []string
+	for _, c := range res.Clusters {
+		if c.GetType() == clusterv3.Cluster_EDS {
+			names = append(names, edsServiceName(c))
+		}
+	}
+	return uniqueSorted(names)
+}
+
+// complete reports whether every route configuration and load assignment
+// referred to was received.
+func (res *XDSResources) complete() bool {
+	for _, name := range res.routeConfigNames() {
+		if res.Routes[name] == nil {
+			return false
+		}
+	}
+	for _, name := range res.endpointNames() {
+		if res.Endpoints[name] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Translate returns the upstreams and routes of the resources. Clusters
+// become upstreams and the virtual hosts of every listener become routes.
+// Fields the proxy doesn't implement are rejected as the resources are
+// decoded; the values it can't honor are errors here rather than being
+// ignored.
+func (res *XDSResources) Translate() ([]UpstreamConfig, []Route, error) {
+	upstreams := make([]UpstreamConfig, 0, len(res.Clusters))
+	for _, name := range sortedNames(res.Clusters) {
+		u, err := res.translateCluster(res.Clusters[name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("cluster %s: %w", name, err)
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	var routes []Route
+	for _, name := range sortedNames(res.Listeners) {
+		hcms, err := listenerHCMs(res.Listeners[name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("listener %s: %w", name, err)
+		}
+		for _, hcm := range hcms {
+			rc := hcm.GetRouteConfig()
+			if rds := hcm.GetRds(); rds != nil {
+				if rc = res.Routes[rds.GetRouteConfigName()]; rc == nil {
+					return nil, nil, fmt.Errorf("listener %s: missing route configuration %s", name, rds.GetRouteConfigName())
+				}
+			}
+			rs, err := translateRouteConfig(rc)
+			if err != nil {
+				return nil, nil, fmt.Errorf("listener %s: %w", name, err)
+			}
+			routes = append(routes, rs...)
+		}
+	}
+	return upstreams, routes, nil
+}
+
+// listenerHCMs returns the HTTP connection managers of the listener's
+// filter chains.
+func listenerHCMs(l *listenerv3.Listener) ([]*hcmv3.HttpConnectionManager, error) {
+	var hcms []*hcmv3.HttpConnectionManager
+	for _, fc := range l.GetFilterChains() {
+		for _, f := range fc.GetFilters() {
+			tc := f.GetTypedConfig()
+			if f.GetName() != hcmFilterName && tc.GetTypeUrl() != hcmTypeURL {
+				continue
+			}
+			hcm := &hcmv3.HttpConnectionManager{}
+			if err := tc.UnmarshalTo(hcm); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", hcmFilterName, err)
+			}
+			hcms = append(hcms, hcm)
+		}
+	}
+	return hcms, nil
+}
+
+func edsServiceName(c *clusterv3.Cluster) string {
+	if name := c.GetEdsClusterConfig().GetServiceName(); name != "" {
+		return name
+	}
+	return c.GetName()
+}
+
+func (res *XDSResources) translateCluster(c *clusterv3.Cluster) (UpstreamConfig, error) {
+	// Requests go to the endpoints, the host of the URL only names the
+	// cluster.
+	host := invalidHostChars.ReplaceAllString(c.GetName(), "-")
+	u := UpstreamConfig{Name: c.GetName(), URL: "http://" + host}
+	if ts := c.GetTransportSocket(); ts != nil {
+		if ts.GetName() != tlsTransportSocketName && ts.GetTypedConfig().GetTypeUrl() != upstreamTLSContextTypeURL {
+			return u, fmt.Errorf("unsupported transport socket %s", ts.GetName())
+		}
+		u.URL = "https://" + host
+		tlsConf, err := clusterTLS(ts)
+		if err != nil {
+			return u, err
+		}
+		u.TLS = tlsConf
+	}
+
+	hpo, err := clusterHTTPOptions(c)
+	if err != nil {
+		return u, err
+	}
+	if u.Protocol, err = clusterProtocol(c, hpo); err != nil {
+		return u, err
+	}
+	u.Concurrency = clusterConcurrency(c)
+	u.ConnectTimeout = xdsDuration(c.GetConnectTimeout())
+	u.Pool = clusterPool(c, hpo)
+
+	var cla *endpointv3.ClusterLoadAssignment
+	switch c.GetType() {
+	case clusterv3.Cluster_STATIC, clusterv3.Cluster_STRICT_DNS, clusterv3.Cluster_LOGICAL_DNS:
+		cla = c.GetLoadAssignment()
+	case clusterv3.Cluster_EDS:
+		cla = res.Endpoints[edsServiceName(c)]
+	default:
+		return u, fmt.Errorf("unsupported discovery type %s", c.GetType())
+	}
+	u.Endpoints, err = healthyEndpoints(cla)
+	return u, err
+}
+
+// clusterTLS translates the SNI and trusted CA of the UpstreamTlsContext of
+// ts, nil without either, and rejects the rest of the context rather than
+// ignoring it.
+func clusterTLS(ts *corev3.TransportSocket) (*UpstreamTLS, error) {
+	if ts.GetTypedConfig() == nil {
+		return nil, nil
+	}
+	tc := &tlsv3.UpstreamTlsContext{}
+	if err := ts.GetTypedConfig().UnmarshalTo(tc); err != nil {
+		return nil, fmt.Errorf("invalid transport socket %s: %w", ts.GetName(), err)
+	}
+	var unsupported []string
+	unsupportedFields(tc.ProtoReflect(), "transport_socket", &unsupported)
+	if len(unsupported) > 0 {
+		return nil, fmt.Errorf("unsupported upstream TLS options %s", strings.Join(unsupported, ", "))
+	}
+	t := UpstreamTLS{ServerName: tc.GetSni()}
+	ca := tc.GetCommonTlsContext().GetValidationContext().GetTrustedCa()
+	switch {
+	case ca.GetFilename() != "":
+		t.CAFile = ca.GetFilename()
+	case ca.GetInlineBytes() != nil:
+		t.CA = string(ca.GetInlineBytes())
+	default:
+		t.CA = ca.GetInlineString()
+	}
+	if t == (UpstreamTLS{}) {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+// clusterHTTPOptions returns the HttpProtocolOptions extension of c, nil
+// without one.
+func clusterHTTPOptions(c *clusterv3.Cluster) (*httpv3.HttpProtocolOptions, error) {
+	opts, ok := c.GetTypedExtensionProtocolOptions()[httpProtocolOptionsName]
+	if !ok {
+		return nil, nil
+	}
+	hpo := &httpv3.HttpProtocolOptions{}
+	if err := opts.UnmarshalTo(hpo); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", httpProtocolOptionsName, err)
+	}
+	return hpo, nil
+}
+
+func clusterProtocol(c *clusterv3.Cluster, hpo *httpv3.HttpProtocolOptions) (string, error) {
+	if c.GetHttp2ProtocolOptions() != nil {
+		return string(UpstreamH2C), nil
+	}
+	switch {
+	case hpo.GetUseDownstreamProtocolConfig() != nil:
+		return string(UpstreamAuto), nil
+	case hpo.GetExplicitHttpConfig().GetHttp2ProtocolOptions() != nil:
+		return string(UpstreamH2C), nil
+	case hpo.GetExplicitHttpConfig().GetHttp3ProtocolOptions() != nil, hpo.GetAutoConfig() != nil:
+		return "", fmt.Errorf("unsupported upstream protocol options")
+	}
+	return string(UpstreamHTTP1), nil
+}
+
+// clusterPool maps the idle timeout and HTTP/2 options of c to its
+// connection pool. Keepalive pings are sent once the interval passes without
+// reads, rather than every interval.
+func clusterPool(c *clusterv3.Cluster, hpo *httpv3.HttpProtocolOptions) ConnectionPool {
+	h2 := c.GetHttp2ProtocolOptions()
+	if h2 == nil {
+		h2 = hpo.GetExplicitHttpConfig().GetHttp2ProtocolOptions()
+	}
+	if h2 == nil {
+		h2 = hpo.GetUseDownstreamProtocolConfig().GetHttp2ProtocolOptions()
+	}
+	p := ConnectionPool{
+		IdleTimeout:     xdsDuration(hpo.GetCommonHttpProtocolOptions().GetIdleTimeout()),
+		ReadIdleTimeout: xdsDuration(h2.GetConnectionKeepalive().GetInterval()),
+		PingTimeout:     xdsDuration(h2.GetConnectionKeepalive().GetTimeout()),
+	}
+	if v := h2.GetMaxConcurrentStreams(); v != nil {
+		p.MaxConcurrentStreams = int(v.GetValue())
+	}
+	return p
+}
+
+// clusterConcurrency maps the default priority circuit breakers to limits,
+// max_requests to requests in flight and max_pending_requests to the queue.
+func clusterConcurrency(c *clusterv3.Cluster) ConcurrencyLimit {
+	var limit ConcurrencyLimit
+	for _, t := range c.GetCircuitBreakers().GetThresholds() {
+		if t.GetPriority() != corev3.RoutingPriority_DEFAULT {
+			continue
+		}
+		if v := t.GetMaxRequests(); v != nil {
+			limit.MaxInFlight = int(v.GetValue())
+		}
+		if v := t.GetMaxPendingRequests(); v != nil {
+			limit.QueueDepth = int(v.GetValue())
+		}
+	}
+	return limit
+}
+
+// healthyEndpoints returns the endpoints not known to be unhealthy, as
+// Envoy routes to hosts whose health is unknown.
+func healthyEndpoints(cla *endpointv3.ClusterLoadAssignment) ([]string, error) {
+	endpoints := []string{}
+	for _, locality := range cla.GetEndpoints() {
+		for _, lb := range locality.GetLbEndpoints() {
+			switch lb.GetHealthStatus() {
+			case corev3.HealthStatus_UNHEALTHY, corev3.HealthStatus_DRAINING, corev3.HealthStatus_TIMEOUT:
+				continue
+			}
+			sa := lb.GetEndpoint().GetAddress().GetSocketAddress()
+			if sa == nil {
+				return nil, fmt.Errorf("unsupported endpoint address %v", lb.GetEndpoint().GetAddress())
+			}
+			endpoints = append(endpoints, net.JoinHostPort(sa.GetAddress(), strconv.Itoa(int(sa.GetPortValue()))))
+		}
+	}
+	return endpoints, nil
+}
+
+// translateRouteConfig flattens virtual hosts into routes. The router takes
+// the first match, so routes are ordered like Envoy picks virtual hosts:
+// exact domains first, then suffix wildcards, longest first, then "*".
+func translateRouteConfig(rc *routev3.RouteConfiguration) ([]Route, error) {
+	type domainGroup struct {
+		rank  int
+		key   string
+		hosts []string
+		vh    *routev3.VirtualHost
+	}
+	var groups []domainGroup
+	for _, vh := range rc.GetVirtualHosts() {
+		var exact, suffix []string
+		catchAll := false
+		for _, d := range vh.GetDomains() {
+			switch {
+			case d == "*":
+				catchAll = true
+			case strings.HasPrefix(d, "*"):
+				suffix = append(suffix, "*"+strings.TrimPrefix(d, "*"))
+			case strings.HasSuffix(d, "*"):
+				return nil, fmt.Errorf("virtual host %s: unsupported prefix wildcard domain %s", vh.GetName(), d)
+			default:
+				exact = append(exact, d)
+			}
+		}
+		if len(exact) > 0 {
+			groups = append(groups, domainGroup{rank: 0, hosts: exact, vh: vh})
+		}
+		for _, d := range suffix {
+			groups = append(groups, domainGroup{rank: 1, key: d, hosts: []string{d}, vh: vh})
+		}
+		if catchAll {
+			groups = append(groups, domainGroup{rank: 2, vh: vh})
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].rank != groups[j].rank {
+			return groups[i].rank < groups[j].rank
+		}
+		return len(groups[i].key) > len(groups[j].key)
+	})
+
+	var routes []Route
+	for _, g := range groups {
+		for i, r := range g.vh.GetRoutes() {
+			route, err := translateRoute(r)
+			if err != nil {
+				return nil, fmt.Errorf("virtual host %s route %d: %w", g.vh.GetName(), i, err)
+			}
+			route.Match.Hosts = g.hosts
+			if route.Name == "" {
+				route.Name = g.vh.GetName()
+			}
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+func translateRoute(r *routev3.Route) (Route, error) {
+	route := Route{Name: r.GetName()}
+	m := r.GetMatch()
+	switch ps := m.GetPathSpecifier().(type) {
+	case *routev3.RouteMatch_SafeRegex:
+		route.Match.PathRegex = ps.SafeRegex.GetRegex()
+	case *routev3.RouteMatch_Path:
+		route.Match.Path = ps.Path
+	case *routev3.RouteMatch_Prefix:
+		route.Match.PathPrefix = ps.Prefix
+	default:
+		return route, fmt.Errorf("unsupported path match")
+	}
+	if m.GetCaseSensitive() != nil && !m.GetCaseSensitive().GetValue() {
+		return route, fmt.Errorf("unsupported case insensitive match")
+	}
+	if len(m.GetQueryParameters()) > 0 || m.GetRuntimeFraction() != nil || m.GetGrpc() != nil || m.GetTlsContext() != nil {
+		return route, fmt.Errorf("unsupported match")
+	}
+	for _, h := range m.GetHeaders() {
+		value, err := exactHeaderMatch(h)
+		if err != nil {
+			return route, err
+		}
+		if strings.EqualFold(h.GetName(), methodPseudoHeader) {
+			route.Match.Methods = append(route.Match.Methods, value)
+			continue
+		}
+		if route.Match.Headers == nil {
+			route.Match.Headers = make(map[string]string)
+		}
+		route.Match.Headers[h.GetName()] = value
+	}
+
+	action := r.GetRoute()
+	if action == nil {
+		return route, fmt.Errorf("unsupported action, only route is")
+	}
+	switch {
+	case action.GetCluster() != "":
+		route.Upstream = action.GetCluster()
+	case action.GetWeightedClusters() != nil:
+		route.Split = &TrafficSplit{}
+		for _, c := range action.GetWeightedClusters().GetClusters() {
+			route.Split.Targets = append(route.Split.Targets, TrafficTarget{
+				Upstream: c.GetName(),
+				Weight:   int(c.GetWeight().GetValue()),
+			})
+		}
+	default:
+		return route, fmt.Errorf("unsupported cluster specifier")
+	}
+
+	switch {
+	case action.GetPrefixRewrite() != "":
+		route.Rewrite = &PathRewrite{Prefix: action.GetPrefixRewrite()}
+	case action.GetRegexRewrite() != nil:
+		route.Rewrite = &PathRewrite{
+			Regex:        action.GetRegexRewrite().GetPattern().GetRegex(),
+			Substitution: envoyRegexGroup.ReplaceAllString(action.GetRegexRewrite().GetSubstitution(), "$${$1}"),
+		}
+	}
+
+	var timeouts TimeoutPolicy
+	// The route timeout covers the whole response, streaming or not. Like in
+	// Envoy it defaults to 15s, and zero disables it, leaving the defaults of
+	// -config.
+	timeouts.MaxStreamDuration = Duration{Duration: xdsRouteTimeout}
+	if action.GetTimeout() != nil {
+		timeouts.MaxStreamDuration = xdsDuration(action.GetTimeout())
+	}
+	timeouts.Idle = xdsDuration(action.GetIdleTimeout())
+	if msd := xdsDuration(action.GetMaxStreamDuration().GetMaxStreamDuration()); msd.Duration != 0 &&
+		(timeouts.MaxStreamDuration.Duration == 0 || msd.Duration < timeouts.MaxStreamDuration.Duration) {
+		timeouts.MaxStreamDuration = msd
+	}
+	if timeouts != (TimeoutPolicy{}) {
+		route.Timeouts = &timeouts
+	}
+
+	switch mirrors := action.GetRequestMirrorPolicies(); len(mirrors) {
+	case 0:
+	case 1:
+		percent := fractionPercent(mirrors[0].GetRuntimeFraction().GetDefaultValue())
+		route.Mirror = &MirrorPolicy{Upstream: mirrors[0].GetCluster(), Percent: &percent}
+	default:
+		return route, fmt.Errorf("unsupported multiple mirror policies")
+	}
+	return route, nil
+}
+
+func exactHeaderMatch(h *routev3.HeaderMatcher) (string, error) {
+	if h.GetInvertMatch() {
+		return "", fmt.Errorf("unsupported inverted match of header %s", h.GetName())
+	}
+	switch {
+	case h.GetExactMatch() != "":
+		return h.GetExactMatch(), nil
+	case h.GetStringMatch().GetExact() != "" && !h.GetStringMatch().GetIgnoreCase():
+		return h.GetStringMatch().GetExact(), nil
+	}
+	return "", fmt.Errorf("unsupported match of header %s, only exact is", h.GetName())
+}
+
+// fractionPercent returns f as a percentage, 100 when unset.
+func fractionPercent(f *typev3.FractionalPercent) float64 {
+	if f == nil {
+		return 100
+	}
+	n := float64(f.GetNumerator())
+	switch f.GetDenominator() {
+	case typev3.FractionalPercent_TEN_THOUSAND:
+		return n / 100
+	case typev3.FractionalPercent_MILLION:
+		return n / 10000
+	}
+	return n
+}
+
+func xdsDuration(d *durationpb.Duration) Duration {
+	if d == nil {
+		return Duration{}
+	}
+	return Duration{Duration: d.AsDuration().Round(time.Millisecond)}
+}
+
+func sortedNames[M any](m map[string]M) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func uniqueSorted(s []string) []string {
+	sort.Strings(s)
+	out := s[:0]
+	for i, v := range s {
+		if i == 0 || v != s[i-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// unmarshalXDSResource decodes a resource of an xDS response.
+func unmarshalXDSResource(a *anypb.Any) (proto.Message, error) {
+	var m proto.Message
+	switch a.GetTypeUrl() {
+	case ListenerType:
+		m = &listenerv3.Listener{}
+	case RouteType:
+		m = &routev3.RouteConfiguration{}
+	case ClusterType:
+		m = &clusterv3.Cluster{}
+	case EndpointType:
+		m = &endpointv3.ClusterLoadAssignment{}
+	default:
+		return nil, fmt.Errorf("unsupported resource type %s", a.GetTypeUrl())
+	}
+	if err := a.UnmarshalTo(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,217 @@
+package rep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var xdsBackoff = wait.Backoff{
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    8,
+	Cap:      30 * time.Second,
+}
+
+// XDSClient subscribes to listeners and clusters of an xDS management server
+// over ADS, in state of the world mode, and follows the route
+// configurations and load assignments they refer to. Every complete set of
+// resources is translated and applied; resources that fail are NACKed and
+// the previous ones kept, like Envoy does.
+type XDSClient struct {
+	// Node identifies the proxy to the management server.
+	Node *corev3.Node
+	// Listeners are the names of the listeners subscribed to, all of them
+	// when empty.
+	Listeners []string
+	// Apply receives the upstreams and routes of every complete update. An
+	// error rejects it.
+	Apply func(upstreams []UpstreamConfig, routes []Route) error
+
+	ads discoveryv3.AggregatedDiscoveryServiceClient
+	// res holds the accepted resources, kept across reconnections.
+	res      XDSResources
+	versions map[string]string
+}
+
+// NewXDSClient returns a client using the management server behind cc.
+func NewXDSClient(cc grpc.ClientConnInterface, node *corev3.Node, apply func([]UpstreamConfig, []Route) error) *XDSClient {
+	return &XDSClient{
+		Node:     node,
+		Apply:    apply,
+		ads:      discoveryv3.NewAggregatedDiscoveryServiceClient(cc),
+		versions: make(map[string]string),
+	}
+}
+
+// Run keeps a stream to the management server open, reconnecting with
+// backoff, until ctx is done.
+func (c *XDSClient) Run(ctx context.Context) error {
+	backoff := xdsBackoff
+	for {
+		received, err := c.stream(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if received {
+			backoff = xdsBackoff
+		}
+		delay := backoff.Step()
+		logf(LogError, "xDS stream failed, reconnecting in %s: %v", delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// xdsSubscription is the state of a resource type on a stream.
+type xdsSubscription struct {
+	names []string
+	nonce string
+}
+
+// stream runs one ADS stream, reporting whether anything was received.
+func (c *XDSClient) stream(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.ads.StreamAggregatedResources(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	subs := map[string]*xdsSubscription{
+		ListenerType: {names: c.Listeners},
+		ClusterType:  {},
+		RouteType:    {names: c.res.routeConfigNames()},
+		EndpointType: {names: c.res.endpointNames()},
+	}
+	send := func(typeURL string, nack error) error {
+		req := &discoveryv3.DiscoveryRequest{
+			Node:          c.Node,
+			TypeUrl:       typeURL,
+			VersionInfo:   c.versions[typeURL],
+			ResourceNames: subs[typeURL].names,
+			ResponseNonce: subs[typeURL].nonce,
+		}
+		if nack != nil {
+			req.ErrorDetail = &statuspb.Status{Code: int32(codes.InvalidArgument), Message: nack.Error()}
+		}
+		return stream.Send(req)
+	}
+	for _, typeURL := range []string{ListenerType, ClusterType, RouteType, EndpointType} {
+		// Route configurations and load assignments are only subscribed to
+		// once listeners and clusters refer to them.
+		if (typeURL == RouteType || typeURL == EndpointType) && len(subs[typeURL].names) == 0 {
+			continue
+		}
+		if err := send(typeURL, nil); err != nil {
+			return false, err
+		}
+	}
+
+	received := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		sub, ok := subs[resp.GetTypeUrl()]
+		if !ok {
+			continue
+		}
+		sub.nonce = resp.GetNonce()
+
+		nack := c.update(resp)
+		if nack != nil {
+			logf(LogError, "Rejecting xDS %s version %s: %v", resp.GetTypeUrl(), resp.GetVersionInfo(), nack)
+		} else {
+			c.versions[resp.GetTypeUrl()] = resp.GetVersionInfo()
+		}
+		if err := send(resp.GetTypeUrl(), nack); err != nil {
+			return received, err
+		}
+
+		// Follow the route configurations and load assignments referred to.
+		for typeURL, names := range map[string][]string{RouteType: c.res.routeConfigNames(), EndpointType: c.res.endpointNames()} {
+			if slices.Equal(subs[typeURL].names, names) {
+				continue
+			}
+			subs[typeURL].names = names
+			if err := send(typeURL, nil); err != nil {
+				return received, err
+			}
+		}
+	}
+}
+
+// update decodes the resources of resp, rejecting the fields the proxy
+// doesn't implement like ParseEnvoyBootstrap does, and, once they're
+// complete, applies them. The resources are only kept if that works.
+func (c *XDSClient) update(resp *discoveryv3.DiscoveryResponse) error {
+	next := c.res
+	switch resp.GetTypeUrl() {
+	// Every response carries all the listeners and clusters, while route
+	// configurations and load assignments may come one at a time.
+	case ListenerType:
+		next.Listeners = nil
+	case ClusterType:
+		next.Clusters = nil
+	case RouteType:
+		next.Routes = clone(next.Routes)
+	case EndpointType:
+		next.Endpoints = clone(next.Endpoints)
+	}
+	var unsupported []string
+	for _, a := range resp.GetResources() {
+		if a.GetTypeUrl() != resp.GetTypeUrl() {
+			return fmt.Errorf("resource of type %s in a %s response", a.GetTypeUrl(), resp.GetTypeUrl())
+		}
+		m, err := unmarshalXDSResource(a)
+		if err != nil {
+			return err
+		}
+		unsupportedFields(m.ProtoReflect(), fmt.Sprintf("%s[%s]", m.ProtoReflect().Descriptor().Name(), xdsResourceName(m)), &unsupported)
+		if err := next.add(m); err != nil {
+			return err
+		}
+	}
+	if len(unsupported) > 0 {
+		return &UnsupportedFieldsError{Fields: unsupported}
+	}
+
+	if next.complete() {
+		upstreams, routes, err := next.Translate()
+		if err != nil {
+			return err
+		}
+		if c.Apply == nil {
+			return errors.New("no config to apply the resources to")
+		}
+		if err := c.Apply(upstreams, routes); err != nil {
+			return err
+		}
+	}
+	c.res = next
+	return nil
+}
+
+func clone[M any](m map[string]M) map[string]M {
+	out := make(map[string]M, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
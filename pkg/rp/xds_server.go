@@ -0,0 +1,191 @@
+package rep
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// XDSServer is a minimal ADS management server, in state of the world mode,
+// serving a snapshot of resources to Envoy or XDSClient. It's meant for
+// tests and local setups rather than fleets of proxies.
+type XDSServer struct {
+	discoveryv3.UnimplementedAggregatedDiscoveryServiceServer
+
+	mu        sync.Mutex
+	version   string
+	resources map[string]map[string]*anypb.Any
+	// changed is closed, and replaced, when the snapshot changes.
+	changed chan struct{}
+	nonce   uint64
+	status  map[string]XDSStatus
+}
+
+// XDSStatus is the last answer of a proxy to the resources of a type.
+type XDSStatus struct {
+	// Version is the last version accepted.
+	Version string
+	// Error is why the last response was rejected, if it was.
+	Error string
+}
+
+// NewXDSServer returns a server with an empty snapshot.
+func NewXDSServer() *XDSServer {
+	return &XDSServer{
+		resources: make(map[string]map[string]*anypb.Any),
+		changed:   make(chan struct{}),
+		status:    make(map[string]XDSStatus),
+	}
+}
+
+// Register registers the server as the ADS service of s.
+func (s *XDSServer) Register(gs *grpc.Server) {
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(gs, s)
+}
+
+// SetSnapshot replaces the resources served with msgs, at version, and
+// pushes them to the connected proxies.
+func (s *XDSServer) SetSnapshot(version string, msgs ...proto.Message) error {
+	resources := make(map[string]map[string]*anypb.Any)
+	for _, m := range msgs {
+		a, err := anypb.New(m)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %T: %w", m, err)
+		}
+		typeURL := xdsTypeURL(m)
+		if resources[typeURL] == nil {
+			resources[typeURL] = make(map[string]*anypb.Any)
+		}
+		resources[typeURL][xdsResourceName(m)] = a
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version, s.resources = version, resources
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+// Status returns the last answer of the proxies to the resources of typeURL.
+func (s *XDSServer) Status(typeURL string) XDSStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status[typeURL]
+}
+
+// xdsWatch is what a stream subscribed to for a type.
+type xdsWatch struct {
+	names   []string
+	version string
+	nonce   string
+}
+
+// StreamAggregatedResources implements the ADS service.
+func (s *XDSServer) StreamAggregatedResources(stream discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
+	reqs := make(chan *discoveryv3.DiscoveryRequest)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	watches := make(map[string]*xdsWatch)
+	s.mu.Lock()
+	changed := s.changed
+	s.mu.Unlock()
+	for {
+		select {
+		case req := <-reqs:
+			w := watches[req.GetTypeUrl()]
+			if w == nil {
+				w = &xdsWatch{}
+				watches[req.GetTypeUrl()] = w
+			} else if req.GetResponseNonce() != w.nonce {
+				// An answer to a response superseded since.
+				continue
+			}
+			if req.GetResponseNonce() != "" {
+				s.record(req)
+			}
+			// A rejected version isn't sent again, only the next one.
+			if w.nonce != "" && slices.Equal(w.names, req.GetResourceNames()) {
+				continue
+			}
+			w.names = req.GetResourceNames()
+			if err := s.respond(stream, req.GetTypeUrl(), w); err != nil {
+				return err
+			}
+		case <-changed:
+			s.mu.Lock()
+			version := s.version
+			changed = s.changed
+			s.mu.Unlock()
+			for typeURL, w := range watches {
+				if w.version == version {
+					continue
+				}
+				if err := s.respond(stream, typeURL, w); err != nil {
+					return err
+				}
+			}
+		case err := <-errs:
+			return err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (s *XDSServer) record(req *discoveryv3.DiscoveryRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := XDSStatus{Version: req.GetVersionInfo()}
+	if req.GetErrorDetail() != nil {
+		status.Error = req.GetErrorDetail().GetMessage()
+	}
+	s.status[req.GetTypeUrl()] = status
+}
+
+// respond sends the resources of typeURL watched by w: all of them for
+// listeners and clusters when no names are given, only the ones named
+// otherwise.
+func (s *XDSServer) respond(stream discoveryv3.AggregatedDiscoveryService_StreamAggregatedResourcesServer, typeURL string, w *xdsWatch) error {
+	s.mu.Lock()
+	resources := s.resources[typeURL]
+	wildcard := len(w.names) == 0 && (typeURL == ListenerType || typeURL == ClusterType)
+	resp := &discoveryv3.DiscoveryResponse{TypeUrl: typeURL, VersionInfo: s.version}
+	if wildcard {
+		for _, name := range sortedNames(resources) {
+			resp.Resources = append(resp.Resources, resources[name])
+		}
+	} else {
+		for _, name := range w.names {
+			if a, ok := resources[name]; ok {
+				resp.Resources = append(resp.Resources, a)
+			}
+		}
+	}
+	s.nonce++
+	resp.Nonce = strconv.FormatUint(s.nonce, 10)
+	s.mu.Unlock()
+
+	w.version, w.nonce = resp.GetVersionInfo(), resp.GetNonce()
+	return stream.Send(resp)
+}
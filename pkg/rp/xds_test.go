@@ -0,0 +1,494 @@
+package rep
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func edsCluster(name string) *clusterv3.Cluster {
+	return &clusterv3.Cluster{
+		Name:                 name,
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+		EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
+			EdsConfig: &corev3.ConfigSource{ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}}},
+		},
+	}
+}
+
+func loadAssignment(t *testing.T, cluster string, endpoints ...string) *endpointv3.ClusterLoadAssignment {
+	t.Helper()
+	locality := &endpointv3.LocalityLbEndpoints{}
+	for _, ep := range endpoints {
+		host, port, err := net.SplitHostPort(ep)
+		if err != nil {
+			t.Fatalf("Invalid endpoint %s: %v", ep, err)
+		}
+		p, _ := strconv.Atoi(port)
+		locality.LbEndpoints = append(locality.LbEndpoints, &endpointv3.LbEndpoint{
+			HostIdentifier: &endpointv3.LbEndpoint_Endpoint{Endpoint: &endpointv3.Endpoint{
+				Address: &corev3.Address{Address: &corev3.Address_SocketAddress{SocketAddress: &corev3.SocketAddress{
+					Address:       host,
+					PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(p)},
+				}}},
+			}},
+		})
+	}
+	return &endpointv3.ClusterLoadAssignment{ClusterName: cluster, Endpoints: []*endpointv3.LocalityLbEndpoints{locality}}
+}
+
+// rdsListener returns a listener whose routes come from the route
+// configuration named routes.
+func rdsListener(t *testing.T, name, routes string) *listenerv3.Listener {
+	t.Helper()
+	hcm, err := anypb.New(&hcmv3.HttpConnectionManager{
+		StatPrefix: name,
+		RouteSpecifier: &hcmv3.HttpConnectionManager_Rds{Rds: &hcmv3.Rds{
+			RouteConfigName: routes,
+			ConfigSource:    &corev3.ConfigSource{ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal HCM: %v", err)
+	}
+	return &listenerv3.Listener{
+		Name: name,
+		FilterChains: []*listenerv3.FilterChain{{
+			Filters: []*listenerv3.Filter{{Name: hcmFilterName, ConfigType: &listenerv3.Filter_TypedConfig{TypedConfig: hcm}}},
+		}},
+	}
+}
+
+// tlsCluster returns a static cluster originating TLS with tc.
+func tlsCluster(t *testing.T, name string, tc *tlsv3.UpstreamTlsContext, endpoints ...string) *clusterv3.Cluster {
+	t.Helper()
+	a, err := anypb.New(tc)
+	if err != nil {
+		t.Fatalf("Failed to marshal TLS context: %v", err)
+	}
+	return &clusterv3.Cluster{
+		Name:                 name,
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_STATIC},
+		LoadAssignment:       loadAssignment(t, name, endpoints...),
+		TransportSocket: &corev3.TransportSocket{
+			Name:       tlsTransportSocketName,
+			ConfigType: &corev3.TransportSocket_TypedConfig{TypedConfig: a},
+		},
+	}
+}
+
+func prefixRoute(prefix, cluster string) *routev3.Route {
+	return &routev3.Route{
+		Match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: prefix}},
+		Action: &routev3.Route_Route{Route: &routev3.RouteAction{
+			ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: cluster},
+		}},
+	}
+}
+
+func TestXDSTranslate(t *testing.T) {
+	staticCluster := &clusterv3.Cluster{
+		Name:                 "static_h2",
+		ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_STATIC},
+		LoadAssignment:       loadAssignment(t, "static_h2", "10.0.0.1:8080"),
+		Http2ProtocolOptions: &corev3.Http2ProtocolOptions{},
+		CircuitBreakers: &clusterv3.CircuitBreakers{Thresholds: []*clusterv3.CircuitBreakers_Thresholds{{
+			MaxRequests:        wrapperspb.UInt32(10),
+			MaxPendingRequests: wrapperspb.UInt32(5),
+		}}},
+	}
+	unhealthy := loadAssignment(t, "api", "10.0.1.1:80", "10.0.1.2:80")
+	unhealthy.Endpoints[0].LbEndpoints[1].HealthStatus = corev3.HealthStatus_UNHEALTHY
+
+	apiRoute := &routev3.Route{
+		Name: "users",
+		Match: &routev3.RouteMatch{
+			PathSpecifier: &routev3.RouteMatch_SafeRegex{SafeRegex: &matcherv3.RegexMatcher{Regex: "/users/[0-9]+"}},
+			Headers: []*routev3.HeaderMatcher{{
+				Name:                 ":method",
+				HeaderMatchSpecifier: &routev3.HeaderMatcher_StringMatch{StringMatch: &matcherv3.StringMatcher{MatchPattern: &matcherv3.StringMatcher_Exact{Exact: "GET"}}},
+			}},
+		},
+		Action: &routev3.Route_Route{Route: &routev3.RouteAction{
+			ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: "api"},
+			RegexRewrite: &matcherv3.RegexMatchAndSubstitute{
+				Pattern:      &matcherv3.RegexMatcher{Regex: "^/users/([0-9]+)$"},
+				Substitution: `/profiles/\1`,
+			},
+			Timeout: durationpb.New(5 * time.Second),
+		}},
+	}
+	splitRoute := &routev3.Route{
+		Match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
+		Action: &routev3.Route_Route{Route: &routev3.RouteAction{
+			ClusterSpecifier: &routev3.RouteAction_WeightedClusters{WeightedClusters: &routev3.WeightedCluster{
+				Clusters: []*routev3.WeightedCluster_ClusterWeight{
+					{Name: "api", Weight: wrapperspb.UInt32(90)},
+					{Name: "static_h2", Weight: wrapperspb.UInt32(10)},
+				},
+			}},
+			PrefixRewrite: "/v2/",
+		}},
+	}
+
+	// A route without a timeout is cut after 15s, like in Envoy, and a zero
+	// timeout disables it.
+	wildcardRoute := prefixRoute("/", "static_h2")
+	wildcardRoute.GetRoute().Timeout = durationpb.New(0)
+	defaultTimeouts := &TimeoutPolicy{MaxStreamDuration: Duration{Duration: 15 * time.Second}}
+
+	tests := []struct {
+		name          string
+		resources     []proto.Message
+		wantUpstreams []UpstreamConfig
+		wantRoutes    []Route
+		wantErr       string
+	}{{
+		name: "clusters and virtual hosts",
+		resources: []proto.Message{
+			rdsListener(t, "http", "local"),
+			&routev3.RouteConfiguration{Name: "local", VirtualHosts: []*routev3.VirtualHost{{
+				Name:    "default",
+				Domains: []string{"*"},
+				Routes:  []*routev3.Route{splitRoute},
+			}, {
+				Name:    "wildcard",
+				Domains: []string{"*.example.com"},
+				Routes:  []*routev3.Route{wildcardRoute},
+			}, {
+				Name:    "api",
+				Domains: []string{"api.example.com"},
+				Routes:  []*routev3.Route{apiRoute},
+			}}},
+			edsCluster("api"),
+			unhealthy,
+			staticCluster,
+		},
+		wantUpstreams: []UpstreamConfig{{
+			Name:      "api",
+			URL:       "http://api",
+			Protocol:  "http1",
+			Endpoints: []string{"10.0.1.1:80"},
+		}, {
+			Name:        "static_h2",
+			URL:         "http://static-h2",
+			Protocol:    "h2c",
+			Endpoints:   []string{"10.0.0.1:8080"},
+			Concurrency: ConcurrencyLimit{MaxInFlight: 10, QueueDepth: 5},
+		}},
+		wantRoutes: []Route{{
+			Name:     "users",
+			Match:    RequestMatch{Hosts: []string{"api.example.com"}, PathRegex: "/users/[0-9]+", Methods: []string{"GET"}},
+			Rewrite:  &PathRewrite{Regex: "^/users/([0-9]+)$", Substitution: "/profiles/${1}"},
+			Upstream: "api",
+			Timeouts: &TimeoutPolicy{MaxStreamDuration: Duration{Duration: 5 * time.Second}},
+		}, {
+			Name:     "wildcard",
+			Match:    RequestMatch{Hosts: []string{"*.example.com"}, PathPrefix: "/"},
+			Upstream: "static_h2",
+		}, {
+			Name:    "default",
+			Match:   RequestMatch{PathPrefix: "/"},
+			Rewrite: &PathRewrite{Prefix: "/v2/"},
+			Split: &TrafficSplit{Targets: []TrafficTarget{
+				{Upstream: "api", Weight: 90},
+				{Upstream: "static_h2", Weight: 10},
+			}},
+			Timeouts: defaultTimeouts,
+		}},
+	}, {
+		name: "tls cluster",
+		resources: []proto.Message{tlsCluster(t, "secure", &tlsv3.UpstreamTlsContext{
+			Sni: "secure.internal",
+			CommonTlsContext: &tlsv3.CommonTlsContext{
+				ValidationContextType: &tlsv3.CommonTlsContext_ValidationContext{ValidationContext: &tlsv3.CertificateValidationContext{
+					TrustedCa: &corev3.DataSource{Specifier: &corev3.DataSource_Filename{Filename: "/etc/ssl/ca.pem"}},
+				}},
+			},
+		}, "10.0.0.3:443")},
+		wantUpstreams: []UpstreamConfig{{
+			Name:      "secure",
+			URL:       "https://secure",
+			Protocol:  "http1",
+			Endpoints: []string{"10.0.0.3:443"},
+			TLS:       &UpstreamTLS{ServerName: "secure.internal", CAFile: "/etc/ssl/ca.pem"},
+		}},
+	}, {
+		name:          "tls cluster with flag defaults",
+		resources:     []proto.Message{tlsCluster(t, "secure", &tlsv3.UpstreamTlsContext{}, "10.0.0.3:443")},
+		wantUpstreams: []UpstreamConfig{{Name: "secure", URL: "https://secure", Protocol: "http1", Endpoints: []string{"10.0.0.3:443"}}},
+	}, {
+		name: "unsupported tls options",
+		resources: []proto.Message{tlsCluster(t, "secure", &tlsv3.UpstreamTlsContext{
+			CommonTlsContext: &tlsv3.CommonTlsContext{TlsCertificates: []*tlsv3.TlsCertificate{{}}},
+		}, "10.0.0.3:443")},
+		wantErr: "unsupported upstream TLS options transport_socket.common_tls_context.tls_certificates",
+	}, {
+		name:          "eds cluster without assignment",
+		resources:     []proto.Message{edsCluster("api")},
+		wantUpstreams: []UpstreamConfig{{Name: "api", URL: "http://api", Protocol: "http1", Endpoints: []string{}}},
+	}, {
+		name: "prefix wildcard domain",
+		resources: []proto.Message{
+			rdsListener(t, "http", "local"),
+			&routev3.RouteConfiguration{Name: "local", VirtualHosts: []*routev3.VirtualHost{{
+				Name:    "default",
+				Domains: []string{"api.*"},
+				Routes:  []*routev3.Route{prefixRoute("/", "api")},
+			}}},
+		},
+		wantErr: "unsupported prefix wildcard domain",
+	}, {
+		name: "missing route configuration",
+		resources: []proto.Message{
+			rdsListener(t, "http", "local"),
+		},
+		wantErr: "missing route configuration local",
+	}, {
+		name: "unsupported discovery type",
+		resources: []proto.Message{&clusterv3.Cluster{
+			Name:                 "orig",
+			ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_ORIGINAL_DST},
+		}},
+		wantErr: "unsupported discovery type ORIGINAL_DST",
+	}, {
+		name: "unsupported header match",
+		resources: []proto.Message{
+			rdsListener(t, "http", "local"),
+			&routev3.RouteConfiguration{Name: "local", VirtualHosts: []*routev3.VirtualHost{{
+				Name:    "default",
+				Domains: []string{"*"},
+				Routes: []*routev3.Route{{
+					Match: &routev3.RouteMatch{
+						PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"},
+						Headers: []*routev3.HeaderMatcher{{
+							Name:                 "X-Canary",
+							HeaderMatchSpecifier: &routev3.HeaderMatcher_PresentMatch{PresentMatch: true},
+						}},
+					},
+					Action: prefixRoute("/", "api").Action,
+				}},
+			}}},
+		},
+		wantErr: "unsupported match of header X-Canary",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := NewXDSResources(test.resources...)
+			if err != nil {
+				t.Fatalf("NewXDSResources() = %v", err)
+			}
+			upstreams, routes, err := res.Translate()
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("Translate() = %v, want error %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Translate() = %v", err)
+			}
+			if !reflect.DeepEqual(upstreams, test.wantUpstreams) {
+				t.Errorf("upstreams = %+v, want %+v", upstreams, test.wantUpstreams)
+			}
+			if !reflect.DeepEqual(routes, test.wantRoutes) {
+				t.Errorf("routes = %+v, want %+v", routes, test.wantRoutes)
+			}
+		})
+	}
+}
+
+// startXDSServer serves a management server on a local port and returns a
+// connection to it.
+func startXDSServer(t *testing.T) (*XDSServer, *grpc.ClientConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := NewXDSServer()
+	gs := grpc.NewServer()
+	server.Register(gs)
+	go gs.Serve(ln)
+	t.Cleanup(gs.Stop)
+
+	cc, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return server, cc
+}
+
+func TestXDSClient(t *testing.T) {
+	server, cc := startXDSServer(t)
+	applied := make(chan []UpstreamConfig, 10)
+	client := NewXDSClient(cc, &corev3.Node{Id: "test"}, func(upstreams []UpstreamConfig, routes []Route) error {
+		applied <- upstreams
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+
+	routes := &routev3.RouteConfiguration{Name: "local", VirtualHosts: []*routev3.VirtualHost{{
+		Name:    "default",
+		Domains: []string{"*"},
+		Routes:  []*routev3.Route{prefixRoute("/", "api")},
+	}}}
+	// Every response of a complete update is applied, so a new version may
+	// be applied a few times as its resource types arrive.
+	waitForEndpoints := func(want ...string) {
+		t.Helper()
+		for {
+			select {
+			case upstreams := <-applied:
+				if reflect.DeepEqual(upstreams[0].Endpoints, want) {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for endpoints %v", want)
+			}
+		}
+	}
+
+	// Only complete updates are applied, once the route configuration and
+	// load assignment the listener and cluster refer to arrived.
+	if err := server.SetSnapshot("1", rdsListener(t, "http", "local"), routes, edsCluster("api"), loadAssignment(t, "api", "10.0.0.1:80")); err != nil {
+		t.Fatalf("SetSnapshot() = %v", err)
+	}
+	select {
+	case upstreams := <-applied:
+		if len(upstreams) != 1 || !reflect.DeepEqual(upstreams[0].Endpoints, []string{"10.0.0.1:80"}) {
+			t.Fatalf("applied %+v, want endpoints [10.0.0.1:80]", upstreams)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the resources to be applied")
+	}
+	waitFor(t, "the endpoints to be ACKed", func() bool { return server.Status(EndpointType).Version == "1" })
+
+	if err := server.SetSnapshot("2", rdsListener(t, "http", "local"), routes, edsCluster("api"), loadAssignment(t, "api", "10.0.0.2:80", "10.0.0.3:80")); err != nil {
+		t.Fatalf("SetSnapshot() = %v", err)
+	}
+	waitForEndpoints("10.0.0.2:80", "10.0.0.3:80")
+
+	// An update that can't be translated is NACKed and the previous version
+	// kept.
+	broken := proto.Clone(routes).(*routev3.RouteConfiguration)
+	broken.VirtualHosts[0].Domains = []string{"api.*"}
+	if err := server.SetSnapshot("3", rdsListener(t, "http", "local"), broken, edsCluster("api"), loadAssignment(t, "api", "10.0.0.2:80", "10.0.0.3:80")); err != nil {
+		t.Fatalf("SetSnapshot() = %v", err)
+	}
+	waitFor(t, "the routes to be NACKed", func() bool { return server.Status(RouteType).Error != "" })
+	if got := server.Status(RouteType); got.Version != "2" || !strings.Contains(got.Error, "unsupported prefix wildcard domain") {
+		t.Errorf("route status = %+v, want version 2 rejected", got)
+	}
+
+	if err := server.SetSnapshot("4", rdsListener(t, "http", "local"), routes, edsCluster("api"), loadAssignment(t, "api", "10.0.0.4:80")); err != nil {
+		t.Fatalf("SetSnapshot() = %v", err)
+	}
+	waitForEndpoints("10.0.0.4:80")
+	waitFor(t, "the routes to be ACKed", func() bool { return server.Status(RouteType) == XDSStatus{Version: "4"} })
+
+	// Fields the proxy doesn't implement are NACKed rather than ignored.
+	retried := proto.Clone(routes).(*routev3.RouteConfiguration)
+	retried.VirtualHosts[0].Routes[0].GetRoute().RetryPolicy = &routev3.RetryPolicy{RetryOn: "5xx"}
+	if err := server.SetSnapshot("5", rdsListener(t, "http", "local"), retried, edsCluster("api"), loadAssignment(t, "api", "10.0.0.4:80")); err != nil {
+		t.Fatalf("SetSnapshot() = %v", err)
+	}
+	waitFor(t, "the routes to be NACKed", func() bool { return server.Status(RouteType).Error != "" })
+	if got := server.Status(RouteType); got.Version != "4" || !strings.Contains(got.Error, "RouteConfiguration[local].virtual_hosts[0].routes[0].route.retry_policy") {
+		t.Errorf("route status = %+v, want version 4 rejected for its retry_policy", got)
+	}
+}
+
+// TestXDSProxy drives a proxy with the management server and moves the
+// traffic between backends with EDS.
+func TestXDSProxy(t *testing.T) {
+	backend := func(name string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.Listener.Addr().String()
+	}
+	blue, green := backend("blue"), backend("green")
+
+	reloader, err := NewConfigReloaderFromConfig(&Config{}, func(cfg *Config) (http.Handler, error) {
+		handlers := make(map[string]http.Handler, len(cfg.Upstreams))
+		for _, u := range cfg.Upstreams {
+			target, _ := url.Parse(u.URL)
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			b := NewEndpointBalancer(u.Endpoints)
+			proxy.Director = b.Director(proxy.Director)
+			handlers[u.Name] = b.Handler(proxy)
+		}
+		return NewRouter(cfg.Routes, handlers)
+	})
+	if err != nil {
+		t.Fatalf("NewConfigReloaderFromConfig() = %v", err)
+	}
+	proxy := httptest.NewServer(reloader)
+	defer proxy.Close()
+
+	server, cc := startXDSServer(t)
+	client := NewXDSClient(cc, &corev3.Node{Id: "test"}, func(upstreams []UpstreamConfig, routes []Route) error {
+		return reloader.Apply(&Config{Upstreams: upstreams, Routes: routes})
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go client.Run(ctx)
+
+	get := func() string {
+		resp, err := http.Get(proxy.URL)
+		if err != nil {
+			t.Fatalf("Failed to execute request: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return strconv.Itoa(resp.StatusCode) + " " + string(b)
+	}
+	snapshot := func(version string, endpoints ...string) {
+		t.Helper()
+		routes := &routev3.RouteConfiguration{Name: "local", VirtualHosts: []*routev3.VirtualHost{{
+			Name:    "default",
+			Domains: []string{"*"},
+			Routes:  []*routev3.Route{prefixRoute("/", "app")},
+		}}}
+		if err := server.SetSnapshot(version, rdsListener(t, "http", "local"), routes, edsCluster("app"), loadAssignment(t, "app", endpoints...)); err != nil {
+			t.Fatalf("SetSnapshot() = %v", err)
+		}
+	}
+
+	snapshot("1", blue)
+	waitFor(t, "traffic on blue", func() bool { return get() == "200 blue" })
+	snapshot("2", green)
+	waitFor(t, "traffic on green", func() bool { return get() == "200 green" })
+	snapshot("3")
+	waitFor(t, "no healthy upstream", func() bool { return strings.HasPrefix(get(), "503 no healthy upstream") })
+}
@@ -0,0 +1,8 @@
+// Package repro is the reproduction suite of golang/go#40747: concurrent
+// requests whose body a reverse proxy echoes back from its upstream, over
+// every client and upstream protocol. It only depends on the standard
+// library and the vendored x/net, with a copy of Knative's timeout handler,
+// so that cmd/regress can build it with the toolchains from before the fix,
+// Go 1.21's EnableFullDuplex, as well as after, whatever the go line of the
+// module. The proxy's own tests run the same Matrix through its handlers.
+package repro
@@ -0,0 +1,18 @@
+package repro
+
+import (
+	"flag"
+	"testing"
+)
+
+var (
+	echoRequests = flag.Int("echo-requests", 0, "Requests sent by each worker of every TestProxyEchoMatrix cell, 10 by default.")
+	echoRepro    = flag.Int("echo-repro", 0, "Requests sent by each worker of the golang/go#40747 cell of TestProxyEchoMatrix, which only runs when set, e.g. to 1000 like the original echo tests.")
+)
+
+// TestProxyEchoMatrix runs the echo matrix with this package's handlers.
+// -short skips the 1 MiB bodies, -echo-requests sets the load of every cell
+// and -echo-repro runs the golang/go#40747 cell.
+func TestProxyEchoMatrix(t *testing.T) {
+	Run(t, Matrix{Requests: *echoRequests, Repro: *echoRepro, Short: testing.Short()})
+}
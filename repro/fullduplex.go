@@ -0,0 +1,15 @@
+//go:build go1.21
+
+package repro
+
+import "net/http"
+
+// fullDuplex lets h read the request body while writing the response, which
+// HTTP/1 servers don't by default.
+func fullDuplex(h http.Handler) (http.Handler, error) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Not supported, and not needed, over HTTP/2.
+		_ = http.NewResponseController(w).EnableFullDuplex()
+		h.ServeHTTP(w, r)
+	}), nil
+}
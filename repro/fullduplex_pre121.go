@@ -0,0 +1,13 @@
+//go:build !go1.21
+
+package repro
+
+import (
+	"errors"
+	"net/http"
+)
+
+// fullDuplex fails before Go 1.21, skipping the cells of the fix.
+func fullDuplex(http.Handler) (http.Handler, error) {
+	return nil, errors.New("EnableFullDuplex needs Go 1.21")
+}
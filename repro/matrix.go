@@ -0,0 +1,441 @@
+package repro
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	bodySize          = 32 * 1024
+	parallelism       = 32
+	requestsPerWorker = 10
+)
+
+// Matrix sends the echo scenario, concurrent requests whose body is echoed
+// back, through every combination of client protocol, proxy mode, upstream
+// protocol, keep-alive and body size. The zero Matrix proxies with this
+// package's handlers between httptest servers; the proxy's own tests plug in
+// theirs.
+//
+// HTTP/1 clients sending bodies to an HTTP/1 upstream through a mode without
+// full duplex are known-bad, golang/go#40747: their failures are reported without
+// failing the matrix, and so are their passes, which only mean the bug
+// didn't show under the load.
+type Matrix struct {
+	// Requests sent by each worker of every cell, 10 by default.
+	Requests int
+	// Short skips the 1 MiB bodies, e.g. with go test -short.
+	Short bool
+	// Repro is the requests sent by each worker of the golang/go#40747 cell,
+	// 1000 for the load of the original echo tests: HTTP/1 with keep-alive
+	// and 32 KiB bodies through Knative's timeout chain without full duplex.
+	// The cell only runs when Repro is set and, unlike the known-bad cells of
+	// the matrix, fails when the bug reproduces.
+	Repro int
+	// NewProxy returns the header pruning proxy to the upstream host of the
+	// timeout chains and header pruning modes.
+	NewProxy func(upstream string) *httputil.ReverseProxy
+	// Timeout wraps the proxy of the timeout chains, with Knative's timeout
+	// handler by default.
+	Timeout func(http.Handler) http.Handler
+	// Serve starts serving h to the client protocol, h1, h2c or h2, and
+	// returns its URL, the client's transport and a func stopping it.
+	Serve func(client string, h http.Handler) (string, http.RoundTripper, func(), error)
+	// Transport returns the transport to the upstream protocol, http1 or h2c.
+	Transport func(proto string) http.RoundTripper
+}
+
+// proxyMode is a handler proxying the echo scenario to an upstream.
+type proxyMode struct {
+	name       string
+	fullDuplex bool
+	handler    func(m *Matrix, upstream string, transport http.RoundTripper) (http.Handler, error)
+}
+
+// proxyModes are the handlers of the matrix.
+var proxyModes = []proxyMode{{
+	name: "reverse-proxy",
+	handler: func(_ *Matrix, upstream string, transport http.RoundTripper) (http.Handler, error) {
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: upstream})
+		proxy.Transport = transport
+		return proxy, nil
+	},
+}, {
+	name:       "full-duplex",
+	fullDuplex: true,
+	handler: func(_ *Matrix, upstream string, transport http.RoundTripper) (http.Handler, error) {
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: upstream})
+		proxy.Transport = transport
+		return fullDuplex(proxy)
+	},
+}, {
+	// The chain of Knative's queue-proxy.
+	name:       "timeout-chain",
+	fullDuplex: true,
+	handler: func(m *Matrix, upstream string, transport http.RoundTripper) (http.Handler, error) {
+		return fullDuplex(m.timeoutChain(upstream, transport))
+	},
+}, {
+	// The chain before queue-proxy enabled full duplex, knative/serving#12387.
+	name: "timeout-chain-no-full-duplex",
+	handler: func(m *Matrix, upstream string, transport http.RoundTripper) (http.Handler, error) {
+		return m.timeoutChain(upstream, transport), nil
+	},
+}, {
+	name: "header-pruning",
+	handler: func(m *Matrix, upstream string, transport http.RoundTripper) (http.Handler, error) {
+		proxy := m.NewProxy(upstream)
+		proxy.Transport = transport
+		return proxy, nil
+	},
+}}
+
+// timeoutChain proxies through the timeout handler, like queue-proxy.
+func (m *Matrix) timeoutChain(upstream string, transport http.RoundTripper) http.Handler {
+	proxy := m.NewProxy(upstream)
+	proxy.FlushInterval = 0
+	proxy.Transport = transport
+	return m.Timeout(proxy)
+}
+
+// headerPruningProxy is the part of the proxy's header pruning reverse proxy
+// the echo scenario goes through.
+func headerPruningProxy(upstream string) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = upstream
+			if _, ok := req.Header["User-Agent"]; !ok {
+				req.Header.Set("User-Agent", "")
+			}
+		},
+	}
+}
+
+// queueProxyTimeout is the timeout handler of the timeout chains.
+func queueProxyTimeout(h http.Handler) http.Handler {
+	return NewTimeoutHandler(h, "request timeout", func(r *http.Request) (time.Duration, time.Duration, time.Duration) {
+		return time.Minute, time.Minute, time.Minute
+	})
+}
+
+// serve starts an httptest server of h for the client protocol.
+func serve(client string, h http.Handler) (string, http.RoundTripper, func(), error) {
+	switch client {
+	case "h1":
+		srv := httptest.NewServer(h)
+		return srv.URL, &http.Transport{}, srv.Close, nil
+	case "h2c":
+		srv := httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+		return srv.URL, h2cTransport(), srv.Close, nil
+	default:
+		srv := httptest.NewUnstartedServer(h)
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		return srv.URL, srv.Client().Transport.(*http.Transport).Clone(), srv.Close, nil
+	}
+}
+
+func transport(proto string) http.RoundTripper {
+	if proto == "h2c" {
+		return h2cTransport()
+	}
+	return &http.Transport{}
+}
+
+func h2cTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// echoUpstream echoes request bodies over HTTP/1.1 and h2c, reporting the
+// protocol of the request.
+func echoUpstream() *httptest.Server {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Upstream-Proto", req.Proto)
+			w.Write(body)
+		},
+	), &http2.Server{}))
+	return upstream
+}
+
+// closeConns sends every request with Connection: close, on a connection of
+// its own, whatever the protocol.
+type closeConns struct {
+	http.RoundTripper
+}
+
+func (c closeConns) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Close = true
+	return c.RoundTripper.RoundTrip(r)
+}
+
+func closeIdleConnections(rt http.RoundTripper) {
+	if c, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// protocol is a client or upstream protocol and the one its requests are
+// received over.
+type protocol struct {
+	name      string
+	wantProto string
+}
+
+var (
+	clients = []protocol{
+		{"h1", "HTTP/1.1"},
+		{"h2c", "HTTP/2.0"},
+		{"h2", "HTTP/2.0"},
+	}
+	upstreams = []protocol{
+		{"http1", "HTTP/1.1"},
+		{"h2c", "HTTP/2.0"},
+	}
+)
+
+// cell is a combination of the matrix.
+type cell struct {
+	client    protocol
+	mode      proxyMode
+	upstream  protocol
+	keepAlive bool
+	size      int
+}
+
+// knownBad reports whether c fails under load, golang/go#40747: the HTTP/1
+// server of the proxy, without full duplex, closes the body of a request
+// the upstream still reads once it writes the response.
+func (c cell) knownBad() bool {
+	return c.client.name == "h1" && c.upstream.name == "http1" && !c.mode.fullDuplex && c.size > 0
+}
+
+func (c cell) String() string {
+	return fmt.Sprintf("%s/%s/%s/keep-alive=%t/%dB", c.client.name, c.mode.name, c.upstream.name, c.keepAlive, c.size)
+}
+
+// reproCell is the cell of golang/go#40747.
+func reproCell() cell {
+	c := cell{client: clients[0], upstream: upstreams[0], keepAlive: true, size: bodySize}
+	for _, mode := range proxyModes {
+		if mode.name == "timeout-chain-no-full-duplex" {
+			c.mode = mode
+		}
+	}
+	return c
+}
+
+// TB is the part of *testing.T the matrix runs with, T being the type of
+// its subtests, so that it runs without importing testing into the
+// package.
+type TB[T any] interface {
+	Run(name string, f func(t T)) bool
+	Helper()
+	Cleanup(f func())
+	Logf(format string, args ...any)
+	Errorf(format string, args ...any)
+	Skip(args ...any)
+}
+
+// Run runs every cell of m as a subtest of t, then the golang/go#40747 cell
+// when Repro is set, and reports the result of each, with -v when all pass.
+// Toolchains before Go 1.21 skip the full duplex cells.
+func Run[T TB[T]](t T, m Matrix) {
+	t.Helper()
+	if m.Requests == 0 {
+		m.Requests = requestsPerWorker
+	}
+	if m.NewProxy == nil {
+		m.NewProxy = headerPruningProxy
+	}
+	if m.Timeout == nil {
+		m.Timeout = queueProxyTimeout
+	}
+	if m.Serve == nil {
+		m.Serve = serve
+	}
+	if m.Transport == nil {
+		m.Transport = transport
+	}
+	echo := echoUpstream()
+	t.Cleanup(echo.Close)
+	upstream := echo.Listener.Addr().String()
+
+	bodySizes := []int{0, bodySize, 1 << 20}
+	if m.Short {
+		bodySizes = bodySizes[:2]
+	}
+
+	var report strings.Builder
+	tw := tabwriter.NewWriter(&report, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "client\tproxy\tupstream")
+	for _, keepAlive := range []bool{true, false} {
+		for _, size := range bodySizes {
+			fmt.Fprintf(tw, "\tkeep-alive=%t/%dB", keepAlive, size)
+		}
+	}
+	fmt.Fprintln(tw)
+
+	var mismatches []string
+	for _, client := range clients {
+		for _, mode := range proxyModes {
+			for _, up := range upstreams {
+				fmt.Fprintf(tw, "%s\t%s\t%s", client.name, mode.name, up.name)
+				for _, keepAlive := range []bool{true, false} {
+					for _, size := range bodySizes {
+						c := cell{client: client, mode: mode, upstream: up, keepAlive: keepAlive, size: size}
+						result := runCell(t, &m, c.String(), upstream, c, m.Requests, c.knownBad())
+						if result == resultFail || result == resultUnexpectedPass {
+							mismatches = append(mismatches, fmt.Sprintf("%s: %s", c, result))
+						}
+						fmt.Fprintf(tw, "\t%s", result)
+					}
+				}
+				fmt.Fprintln(tw)
+			}
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(&report, "%d cells not as expected\n", len(mismatches))
+	for _, mismatch := range mismatches {
+		fmt.Fprintf(&report, "  %s\n", mismatch)
+	}
+	if m.Repro > 0 {
+		c := reproCell()
+		result := runCell(t, &m, "golang-go-40747/"+c.String(), upstream, c, m.Repro, false)
+		fmt.Fprintf(&report, "golang/go#40747, %s with %d requests per worker: %s\n", c, m.Repro, result)
+	}
+	t.Logf("Echo matrix:\n%s", report.String())
+}
+
+// Results of a cell, the known-bad ones expected to fail.
+const (
+	resultPass           = "pass"
+	resultFail           = "FAIL"
+	resultSkip           = "skip"
+	resultKnownBad       = "fail (known-bad)"
+	resultUnexpectedPass = "PASS (known-bad)"
+	// resultNotRun is the result of the cells -run filters out.
+	resultNotRun = "-"
+)
+
+// runCell runs c as the subtest name, each worker sending requests to the
+// echo upstream, and returns its result. The errors of a known-bad cell are
+// logged rather than failing the subtest.
+func runCell[T TB[T]](t T, m *Matrix, name, upstream string, c cell, requests int, knownBad bool) string {
+	result := resultNotRun
+	passed := t.Run(name, func(t T) {
+		result = resultPass
+		transport := m.Transport(c.upstream.name)
+		defer closeIdleConnections(transport)
+		h, err := c.mode.handler(m, upstream, transport)
+		if err != nil {
+			result = resultSkip
+			t.Skip(err)
+			return
+		}
+		url, rt, stop, err := m.Serve(c.client.name, h)
+		if err != nil {
+			t.Errorf("Failed to serve %s: %v", c.client.name, err)
+			return
+		}
+		defer stop()
+		defer closeIdleConnections(rt)
+		if !c.keepAlive {
+			rt = closeConns{rt}
+		}
+		client := &http.Client{Transport: rt}
+		body := make([]byte, c.size)
+		for i := range body {
+			body[i] = byte(i)
+		}
+
+		var (
+			wg     sync.WaitGroup
+			mu     sync.Mutex
+			failed bool
+		)
+		for w := 0; w < parallelism; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < requests; i++ {
+					if err := sendEcho(client, url, body, c.client.wantProto, c.upstream.wantProto); err != nil {
+						if !knownBad {
+							t.Errorf("error during request: %v", err)
+							return
+						}
+						mu.Lock()
+						failed = true
+						mu.Unlock()
+						t.Logf("known-bad error during request: %v", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		switch {
+		case knownBad && failed:
+			result = resultKnownBad
+		case knownBad:
+			result = resultUnexpectedPass
+		}
+	})
+	if !passed {
+		result = resultFail
+	}
+	return result
+}
+
+// sendEcho sends body to url, checking it's echoed back, over wantProto
+// from the client and wantUpstream to the upstream.
+func sendEcho(c *http.Client, url string, body []byte, wantProto, wantUpstream string) error {
+	resp, err := c.Post(url, "application/octet-stream", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	rec, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	case !bytes.Equal(rec, body):
+		return fmt.Errorf("unexpected body of length %d, want %d", len(rec), len(body))
+	case resp.Proto != wantProto:
+		return fmt.Errorf("client protocol = %s, want %s", resp.Proto, wantProto)
+	case resp.Header.Get("X-Upstream-Proto") != wantUpstream:
+		return fmt.Errorf("upstream protocol = %s, want %s", resp.Header.Get("X-Upstream-Proto"), wantUpstream)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package repro
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// knativeServing is the version of knative.dev/serving timeout.go is copied
+// from.
+const knativeServing = "v0.39.0"
+
+// timeoutChanges turn the vendored timeout handler into timeout.go, in
+// order.
+var timeoutChanges = []struct{ old, new string }{{
+	"package handler\n",
+	`// Copied from knative.dev/serving v0.39.0, commit
+// 2659cc3aed8ecc7b89335c2729dc33667d2dbe51, pkg/http/handler/timeout.go,
+// with time's timers instead of k8s.io/utils/clock and an http.Hijacker
+// check instead of knative.dev/pkg/websocket, so that repro keeps building
+// with the toolchains before the fix. TestTimeoutHandlerCopy checks it
+// against the vendored source.
+
+package repro
+`,
+}, {
+	"\t\"context\"\n", "\t\"context\"\n\t\"fmt\"\n",
+}, {
+	"\n\n\t\"k8s.io/utils/clock\"\n\t\"knative.dev/pkg/websocket\"\n", "\n",
+}, {
+	"\tclock       clock.Clock\n", "",
+}, {
+	"\t\tclock:       clock.RealClock{},\n", "",
+}, {
+	"getTimer(h.clock, ", "getTimer(",
+}, {
+	"clock.Timer", "*time.Timer",
+}, {
+	".C()", ".C",
+}, {
+	"&timeoutWriter{w: w, clock: h.clock}", "&timeoutWriter{w: w}",
+}, {
+	"\tw     http.ResponseWriter\n\tclock clock.PassiveClock\n", "\tw http.ResponseWriter\n",
+}, {
+	"\treturn websocket.HijackIfPossible(tw.w)\n",
+	`	hj, ok := tw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("wrapped writer of type %T can't be hijacked", tw.w)
+	}
+	return hj.Hijack()
+`,
+}, {
+	"tw.clock.Now()", "time.Now()",
+}, {
+	"func getTimer(c clock.Clock, ", "func getTimer(",
+}, {
+	"c.NewTimer(timeout)", "time.NewTimer(timeout)",
+}}
+
+// TestTimeoutHandlerCopy checks timeout.go is still the timeout handler of
+// the vendored knative.dev/serving, with the changes it lists, so that the
+// timeout chains of the matrix run the same handler as the proxy's.
+func TestTimeoutHandlerCopy(t *testing.T) {
+	modules, err := os.ReadFile("../vendor/modules.txt")
+	if err != nil {
+		t.Fatalf("Failed to read the vendored modules: %v", err)
+	}
+	if want := "# knative.dev/serving " + knativeServing + "\n"; !strings.Contains(string(modules), want) {
+		t.Fatalf("knative.dev/serving isn't vendored at %s, copy timeout.go from the new version", knativeServing)
+	}
+	vendored, err := os.ReadFile("../vendor/knative.dev/serving/pkg/http/handler/timeout.go")
+	if err != nil {
+		t.Fatalf("Failed to read the vendored timeout handler: %v", err)
+	}
+	copied, err := os.ReadFile("timeout.go")
+	if err != nil {
+		t.Fatalf("Failed to read timeout.go: %v", err)
+	}
+
+	want := string(vendored)
+	for _, c := range timeoutChanges {
+		if !strings.Contains(want, c.old) {
+			t.Fatalf("Vendored timeout handler doesn't contain %q anymore", c.old)
+		}
+		want = strings.ReplaceAll(want, c.old, c.new)
+	}
+	got := strings.Split(string(copied), "\n")
+	for i, line := range strings.Split(want, "\n") {
+		if i >= len(got) || got[i] != line {
+			t.Fatalf("timeout.go:%d differs from the vendored timeout handler, want %q", i+1, line)
+		}
+	}
+	if n := strings.Count(want, "\n") + 1; len(got) != n {
+		t.Fatalf("timeout.go has %d lines, want %d", len(got), n)
+	}
+}